@@ -0,0 +1,193 @@
+package bpmn
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// Config is the configuration for the process definition API
+type Config struct {
+	ResultsPerPage int `mapstructure:"default-results-per-page"`
+}
+
+// Register the process definition API
+func Register(e *echo.Group, config *Config) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+
+	/*
+	 * get process definitions
+	 *   offset - [int] (default: 0) offset into the index
+	 *   limit  - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit int
+
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		defs, err := GetProcessDefinitions(offset, limit)
+		if err != nil {
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, defs)
+	})
+
+	/*
+	 * deploy a BPMN document, either as the "file" part of a multipart form or
+	 * as the raw XML request body. Redeploying identical XML is a no-op.
+	 *   name - [string] (default: process.bpmn) resource name of a raw upload
+	 */
+	e.POST("", func(c echo.Context) error {
+		name, data, err := resource.ReadUpload(c, "process.bpmn")
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		deployed, created, err := Deploy(name, data)
+		if err != nil {
+			if invalid, isInvalid := err.(*ValidationError); isInvalid {
+				return resource.BadRequest(invalid.Issues)
+			}
+			return resource.BadRequest(err)
+		}
+		if !created {
+			return c.JSON(http.StatusOK, deployed)
+		}
+		return c.JSON(http.StatusCreated, deployed)
+	})
+
+	/*
+	 * validate a BPMN document without deploying it, uploaded the same way as a
+	 * deployment, returning the issues found with its elements
+	 */
+	e.POST("/validate", func(c echo.Context) error {
+		_, data, err := resource.ReadUpload(c, "process.bpmn")
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		issues, err := ValidateDocument(data)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		return c.JSON(http.StatusOK, issues)
+	})
+
+	/*
+	 * get the latest version of a process definition
+	 */
+	e.GET("/key/:key", func(c echo.Context) error {
+		var key string
+
+		if err := resource.Param("key").InPath().String(c, &key); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		def, err := FindLatestProcessDefinition(key)
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, def)
+	})
+
+	/*
+	 * get a process definition by key and version
+	 */
+	e.GET("/key/:key/version/:version", func(c echo.Context) error {
+		var key string
+		var version int
+
+		if err := resource.Param("key").InPath().String(c, &key); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("version").InPath().Int(c, &version); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		def, err := FindProcessDefinitionByKey(key, version)
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, def)
+	})
+
+	/*
+	 * get the semantic differences between two versions of a process definition
+	 *   from - [int] older version
+	 *   to   - [int] (default: latest) newer version
+	 */
+	e.GET("/key/:key/diff", func(c echo.Context) error {
+		var key string
+		var from, to int
+
+		if err := resource.Param("key").InPath().String(c, &key); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("from").Int(c, &from); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("to").Optional("0").Int(c, &to); err != nil {
+			return resource.BadRequest(err)
+		}
+		if to == 0 {
+			latest, err := FindLatestProcessDefinition(key)
+			if err != nil {
+				if err == util.ErrNotFound {
+					return resource.NotFound(err)
+				}
+				return resource.InternalServerError(err)
+			}
+			to = latest.Version
+		}
+
+		diff, err := DiffProcessDefinitions(key, from, to)
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, diff)
+	})
+
+	/*
+	 * download the BPMN XML of a process definition
+	 */
+	e.GET("/:id/xml", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		def, err := FindProcessDefinition(uint(id))
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition,
+			fmt.Sprintf("attachment; filename=%q", def.ResourceName))
+		return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, []byte(def.XML))
+	})
+
+	resource.GetMethod(e, GetProcessDefinition)
+	resource.DeleteMethod(e, DeleteProcessDefinition)
+}
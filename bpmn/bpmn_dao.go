@@ -0,0 +1,253 @@
+package bpmn
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/util"
+)
+
+var (
+	db *gorm.DB
+
+	// parsed processes keyed by process definition id
+	processCache     = make(map[uint]*Process)
+	processCacheLock sync.RWMutex
+
+	// serializes the assignment of definition versions
+	deployLock sync.Mutex
+
+	deployListeners = make([]DeployListener, 0)
+	validators      = make([]Validator, 0)
+)
+
+// Validator returns further issues with a process that is about to be deployed
+type Validator func(process *Process) []*Issue
+
+// DeployListener is called within the deployment transaction for every new
+// version of a process definition
+type DeployListener func(tx *gorm.DB, def *ProcessDefinition, process *Process) error
+
+// TableName for process definitions
+func (ProcessDefinition) TableName() string {
+	return "process_definitions"
+}
+
+// VersionOf returns the version of the process definition, the hash of its
+// XML and whether it is deleted
+func (def *ProcessDefinition) VersionOf() (int, string, bool) {
+	return def.Version, def.Hash, def.DeletedAt != nil
+}
+
+// Init sets the database used to store process definitions
+func Init(database *gorm.DB) {
+	db = database
+}
+
+// OnDeploy adds a listener that is called when a process definition is deployed
+func OnDeploy(listener DeployListener) {
+	deployListeners = append(deployListeners, listener)
+}
+
+// OnValidate adds a validator that is run on every process of a BPMN document
+// before it is deployed
+func OnValidate(validator Validator) {
+	validators = append(validators, validator)
+}
+
+// ValidateDocument parses the BPMN document and returns the issues found with
+// its processes by Validate and by the registered validators
+func ValidateDocument(data []byte) ([]*Issue, error) {
+	definitions, err := ParseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return validateDefinitions(definitions), nil
+}
+
+func validateDefinitions(definitions *Definitions) []*Issue {
+	issues := make([]*Issue, 0)
+	for _, process := range definitions.Processes {
+		issues = append(issues, process.Validate()...)
+		for _, validator := range validators {
+			issues = append(issues, validator(process)...)
+		}
+	}
+	return issues
+}
+
+// Deploy parses and validates the BPMN document and stores a new version of
+// the process definition for each executable process within it. Warnings do
+// not prevent deployment. A process whose latest version was deployed from
+// identical XML is left as is. The definitions are returned along with whether
+// any new version was created.
+func Deploy(resourceName string, data []byte) ([]*ProcessDefinition, bool, error) {
+	definitions, err := ParseBytes(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if issues := validateDefinitions(definitions); HasErrors(issues) {
+		return nil, false, &ValidationError{issues}
+	}
+
+	hash := util.ContentHash(data)
+
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	deployed := make([]*ProcessDefinition, 0)
+	created := false
+	tx := db.Begin()
+	for _, process := range definitions.Processes {
+		if !process.IsExecutable {
+			continue
+		}
+		latest := &ProcessDefinition{}
+		version, err := util.NextVersion(tx, latest, process.ID, hash)
+		if err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		if version == 0 {
+			deployed = append(deployed, latest)
+			continue
+		}
+
+		def := &ProcessDefinition{
+			Key:          process.ID,
+			Version:      version,
+			Name:         process.Name,
+			ResourceName: resourceName,
+			XML:          string(data),
+			Hash:         hash,
+		}
+		if err := tx.Create(def).Error; err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		for _, listener := range deployListeners {
+			if err := listener(tx, def, process); err != nil {
+				tx.Rollback()
+				return nil, false, err
+			}
+		}
+		deployed = append(deployed, def)
+		created = true
+	}
+	if len(deployed) == 0 {
+		tx.Rollback()
+		return nil, false, fmt.Errorf("BPMN document does not contain an executable process")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, false, err
+	}
+	return deployed, created, nil
+}
+
+// FindProcessDefinition returns the process definition with the given id
+func FindProcessDefinition(id uint) (*ProcessDefinition, error) {
+	def := &ProcessDefinition{}
+	if err := db.First(def, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// LoadProcess returns the parsed process of a process definition
+func LoadProcess(def *ProcessDefinition) (*Process, error) {
+	processCacheLock.RLock()
+	process, cached := processCache[def.ID]
+	processCacheLock.RUnlock()
+	if cached {
+		return process, nil
+	}
+
+	definitions, err := ParseBytes([]byte(def.XML))
+	if err != nil {
+		return nil, err
+	}
+	if process = definitions.Process(def.Key); process == nil {
+		return nil, fmt.Errorf("Process %s not found in definition %d", def.Key, def.ID)
+	}
+
+	processCacheLock.Lock()
+	processCache[def.ID] = process
+	processCacheLock.Unlock()
+	return process, nil
+}
+
+// GetProcessDefinitions returns a page of process definitions
+func GetProcessDefinitions(offset int, limit int) ([]*ProcessDefinition, error) {
+	defs := make([]*ProcessDefinition, 0)
+	if err := db.Order("key, version").Offset(offset).Limit(limit).Find(&defs).Error; err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// GetProcessDefinition returns a specific process definition
+func GetProcessDefinition(id int) (util.Entity, error) {
+	return FindProcessDefinition(uint(id))
+}
+
+// FindProcessDefinitionByKey returns the process definition with the given key and version
+func FindProcessDefinitionByKey(key string, version int) (*ProcessDefinition, error) {
+	def := &ProcessDefinition{}
+	if err := db.Where(&ProcessDefinition{Key: key, Version: version}).First(def).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// FindLatestProcessDefinition returns the latest version of the process definition with the given key
+func FindLatestProcessDefinition(key string) (*ProcessDefinition, error) {
+	def := &ProcessDefinition{}
+	if err := db.Where("key = ?", key).Order("version desc").First(def).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// DiffProcessDefinitions returns the differences between two versions of the
+// process definition with the given key
+func DiffProcessDefinitions(key string, from int, to int) (*Diff, error) {
+	processes := make([]*Process, 0, 2)
+	for _, version := range []int{from, to} {
+		def, err := FindProcessDefinitionByKey(key, version)
+		if err != nil {
+			return nil, err
+		}
+		process, err := LoadProcess(def)
+		if err != nil {
+			return nil, err
+		}
+		processes = append(processes, process)
+	}
+	return CompareProcesses(processes[0], processes[1]), nil
+}
+
+// DeleteProcessDefinition deletes the process definition with the specified ID
+func DeleteProcessDefinition(id int) error {
+	def, err := FindProcessDefinition(uint(id))
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(def).Error; err != nil {
+		return err
+	}
+
+	processCacheLock.Lock()
+	delete(processCache, def.ID)
+	processCacheLock.Unlock()
+	return nil
+}
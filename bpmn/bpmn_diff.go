@@ -0,0 +1,301 @@
+package bpmn
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChangeKind tells how an element differs between two versions of a process
+type ChangeKind string
+
+const (
+
+	// Added the element only exists in the newer version
+	Added ChangeKind = "added"
+
+	// Removed the element only exists in the older version
+	Removed ChangeKind = "removed"
+
+	// Modified the element exists in both versions with different properties
+	Modified ChangeKind = "modified"
+)
+
+// Diff the semantic differences between two versions of a BPMN document.
+// Processes and flow nodes are listed as added, removed or modified while
+// sequence flows are listed apart. Changes to the layout of the diagram are
+// not differences.
+type Diff struct {
+	Added    []*Change `json:"added"`
+	Removed  []*Change `json:"removed"`
+	Modified []*Change `json:"modified"`
+	Flows    []*Change `json:"flows"`
+}
+
+// Change an element that differs between the versions along with its
+// properties that differ, which for added and removed elements are all of
+// its properties
+type Change struct {
+	ProcessID   string            `json:"processId"`
+	ElementID   string            `json:"elementId"`
+	ElementType string            `json:"elementType"`
+	Change      ChangeKind        `json:"change"`
+	Properties  []*PropertyChange `json:"properties"`
+}
+
+// PropertyChange the values of a property in the older and the newer
+// version, where a missing property has an empty value
+type PropertyChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Compare returns the differences between two BPMN documents, matching their
+// processes and elements by id
+func Compare(before *Definitions, after *Definitions) *Diff {
+	diff := newDiff()
+	for _, process := range before.Processes {
+		diff.compare(process, after.Process(process.ID))
+	}
+	for _, process := range after.Processes {
+		if before.Process(process.ID) == nil {
+			diff.compare(nil, process)
+		}
+	}
+	return diff
+}
+
+// CompareProcesses returns the differences between two versions of a process
+func CompareProcesses(before *Process, after *Process) *Diff {
+	diff := newDiff()
+	diff.compare(before, after)
+	return diff
+}
+
+func newDiff() *Diff {
+	return &Diff{
+		Added:    make([]*Change, 0),
+		Removed:  make([]*Change, 0),
+		Modified: make([]*Change, 0),
+		Flows:    make([]*Change, 0),
+	}
+}
+
+// element the type and the properties of a process, flow node or sequence
+// flow keyed by element id
+type element struct {
+	kind       string
+	properties map[string]string
+}
+
+// compare adds the differences between two versions of a process, either of
+// which is nil when the process was added or removed
+func (d *Diff) compare(before *Process, after *Process) {
+	id := ""
+	oldProcess, newProcess := make(map[string]*element), make(map[string]*element)
+	oldNodes, newNodes := make(map[string]*element), make(map[string]*element)
+	oldFlows, newFlows := make(map[string]*element), make(map[string]*element)
+	if before != nil {
+		id = before.ID
+		before.elements(oldProcess, oldNodes, oldFlows)
+	}
+	if after != nil {
+		id = after.ID
+		after.elements(newProcess, newNodes, newFlows)
+	}
+
+	for _, change := range compareElements(id, oldProcess, newProcess) {
+		d.add(change)
+	}
+	for _, change := range compareElements(id, oldNodes, newNodes) {
+		d.add(change)
+	}
+	d.Flows = append(d.Flows, compareElements(id, oldFlows, newFlows)...)
+}
+
+func (d *Diff) add(change *Change) {
+	switch change.Change {
+	case Added:
+		d.Added = append(d.Added, change)
+	case Removed:
+		d.Removed = append(d.Removed, change)
+	default:
+		d.Modified = append(d.Modified, change)
+	}
+}
+
+// compareElements returns the changes between the elements of two versions
+// of a process in order of element id
+func compareElements(processID string, before map[string]*element, after map[string]*element) []*Change {
+	ids := make([]string, 0)
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if before[id] == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	changes := make([]*Change, 0)
+	for _, id := range ids {
+		old, current := before[id], after[id]
+		change := &Change{ProcessID: processID, ElementID: id}
+		switch {
+		case old == nil:
+			change.Change, change.ElementType = Added, current.kind
+			change.Properties = compareProperties(nil, current.properties)
+		case current == nil:
+			change.Change, change.ElementType = Removed, old.kind
+			change.Properties = compareProperties(old.properties, nil)
+		default:
+			change.Change, change.ElementType = Modified, current.kind
+			change.Properties = compareProperties(old.properties, current.properties)
+			if old.kind != current.kind {
+				change.Properties = append([]*PropertyChange{{Name: "type", Old: old.kind, New: current.kind}},
+					change.Properties...)
+			}
+			if len(change.Properties) == 0 {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// compareProperties returns the properties whose values differ in order of
+// property name
+func compareProperties(before map[string]string, after map[string]string) []*PropertyChange {
+	names := make([]string, 0)
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, exists := before[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]*PropertyChange, 0)
+	for _, name := range names {
+		if before[name] != after[name] {
+			changes = append(changes, &PropertyChange{Name: name, Old: before[name], New: after[name]})
+		}
+	}
+	return changes
+}
+
+// elements collects the properties of the process, its flow nodes and its
+// sequence flows
+func (p *Process) elements(process map[string]*element, nodes map[string]*element, flows map[string]*element) {
+	process[p.ID] = &element{kind: "process", properties: properties(map[string]string{
+		"name":         p.Name,
+		"isExecutable": strconv.FormatBool(p.IsExecutable),
+	})}
+	for _, node := range p.Nodes {
+		nodes[node.ID] = &element{kind: string(node.Type), properties: node.properties()}
+	}
+	for _, flow := range p.Flows {
+		values := map[string]string{
+			"name":      flow.Name,
+			"sourceRef": flow.Source.ID,
+			"targetRef": flow.Target.ID,
+			"condition": flow.Condition,
+		}
+		if flow.IsDefault() {
+			values["default"] = "true"
+		}
+		flows[flow.ID] = &element{kind: "sequenceFlow", properties: properties(values)}
+	}
+}
+
+// properties of a flow node, made up of its attributes other than its id and
+// of what is defined by its child elements
+func (n *FlowNode) properties() map[string]string {
+	values := make(map[string]string)
+	for name, value := range n.Attributes {
+		if name != "id" {
+			values[name] = value
+		}
+	}
+	if n.Parent != nil {
+		values["parent"] = n.Parent.ID
+	}
+	if n.Handler != nil {
+		values["compensationHandler"] = n.Handler.ID
+	}
+	values["script"] = n.Script
+	for _, m := range n.Inputs {
+		values["input:"+m.Name] = m.Expression
+	}
+	for _, m := range n.Outputs {
+		values["output:"+m.Name] = m.Expression
+	}
+
+	if event := n.Event; event != nil {
+		values["event"] = string(event.Type)
+		values["event.ref"] = event.Ref
+		values["event.name"] = event.Name
+		values["event.code"] = event.Code
+		if event.TimerKind != "" {
+			values["event."+event.TimerKind] = event.Timer
+		}
+	}
+	if loop := n.Loop; loop != nil {
+		values["loop.sequential"] = strconv.FormatBool(loop.Sequential)
+		values["loop.collection"] = loop.Collection
+		values["loop.elementVariable"] = loop.ElementVariable
+		values["loop.cardinality"] = loop.Cardinality
+		values["loop.completionCondition"] = loop.CompletionCondition
+	}
+	if call := n.Call; call != nil {
+		if call.AllIn {
+			values["call.in"] = "all"
+		}
+		if call.AllOut {
+			values["call.out"] = "all"
+		}
+		for _, m := range call.In {
+			values["call.in:"+m.Name] = m.Expression
+		}
+		for _, m := range call.Out {
+			values["call.out:"+m.Name] = m.Expression
+		}
+	}
+	if connector := n.HTTP; connector != nil {
+		values["http.method"] = connector.Method
+		values["http.url"] = connector.URL
+		values["http.body"] = connector.Body
+		if connector.Timeout != 0 {
+			values["http.timeout"] = connector.Timeout.String()
+		}
+		if connector.Retries != 0 {
+			values["http.retries"] = strconv.Itoa(connector.Retries)
+		}
+		if connector.RetryBackoff != 0 {
+			values["http.retryBackoff"] = connector.RetryBackoff.String()
+		}
+		for _, m := range connector.Headers {
+			values["http.header:"+m.Name] = m.Expression
+		}
+		for _, status := range connector.Statuses {
+			values["http.status:"+status.Status] = strings.TrimSpace(fmt.Sprintf("%s %s", status.Outcome, status.ErrorCode))
+		}
+	}
+	return properties(values)
+}
+
+// properties drops the properties without a value
+func properties(values map[string]string) map[string]string {
+	for name, value := range values {
+		if value == "" {
+			delete(values, name)
+		}
+	}
+	return values
+}
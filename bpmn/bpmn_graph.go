@@ -0,0 +1,521 @@
+package bpmn
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ElementType identifies the kind of a BPMN flow node
+type ElementType string
+
+const (
+
+	/* EVENTS */
+
+	// StartEvent starts a process
+	StartEvent ElementType = "startEvent"
+
+	// EndEvent ends a path of execution
+	EndEvent ElementType = "endEvent"
+
+	// IntermediateCatchEvent waits for its event definition to occur
+	IntermediateCatchEvent ElementType = "intermediateCatchEvent"
+
+	// IntermediateThrowEvent raises its event definition
+	IntermediateThrowEvent ElementType = "intermediateThrowEvent"
+
+	// BoundaryEvent is attached to an activity and occurs while it is active
+	BoundaryEvent ElementType = "boundaryEvent"
+
+	/* ACTIVITIES */
+
+	// Task is an abstract task with no behavior
+	Task ElementType = "task"
+
+	// UserTask is performed by a person
+	UserTask ElementType = "userTask"
+
+	// ServiceTask invokes a service
+	ServiceTask ElementType = "serviceTask"
+
+	// ScriptTask runs a script
+	ScriptTask ElementType = "scriptTask"
+
+	// SendTask sends a message
+	SendTask ElementType = "sendTask"
+
+	// ReceiveTask waits for a message
+	ReceiveTask ElementType = "receiveTask"
+
+	// ManualTask is performed without the aid of the engine
+	ManualTask ElementType = "manualTask"
+
+	// BusinessRuleTask evaluates a business rule
+	BusinessRuleTask ElementType = "businessRuleTask"
+
+	// SubProcess is a scope of flow nodes embedded within the process, or an
+	// event subprocess when it is triggered by an event
+	SubProcess ElementType = "subProcess"
+
+	// Transaction is a subprocess whose completed activities are compensated
+	// when it is cancelled by a cancel end event
+	Transaction ElementType = "transaction"
+
+	// CallActivity starts an instance of another process and waits for it
+	CallActivity ElementType = "callActivity"
+
+	/* GATEWAYS */
+
+	// ExclusiveGateway takes exactly one outgoing flow
+	ExclusiveGateway ElementType = "exclusiveGateway"
+
+	// ParallelGateway forks and joins every flow
+	ParallelGateway ElementType = "parallelGateway"
+
+	// InclusiveGateway takes every outgoing flow whose condition holds
+	InclusiveGateway ElementType = "inclusiveGateway"
+)
+
+// EventType identifies the event definition of an event
+type EventType string
+
+const (
+
+	// TimerEvent occurs at a point in time, after a duration or repeatedly
+	TimerEvent EventType = "timer"
+
+	// MessageEvent sends or receives a message addressed to a single receiver
+	MessageEvent EventType = "message"
+
+	// SignalEvent broadcasts or receives a signal addressed to every receiver
+	SignalEvent EventType = "signal"
+
+	// ErrorEvent throws or catches a BPMN error, interrupting the activity
+	ErrorEvent EventType = "error"
+
+	// EscalationEvent throws or catches an escalation without interrupting
+	// the activity that raised it
+	EscalationEvent EventType = "escalation"
+
+	// CompensateEvent undoes the completed activities of a scope, or a single
+	// activity, by running their compensation handlers in reverse order
+	CompensateEvent EventType = "compensate"
+
+	// CancelEvent cancels a transaction once its completed activities have
+	// been compensated
+	CancelEvent EventType = "cancel"
+)
+
+// IsTask returns true when the element type is one of the BPMN task types
+func (t ElementType) IsTask() bool {
+	switch t {
+	case Task, UserTask, ServiceTask, ScriptTask, SendTask, ReceiveTask, ManualTask, BusinessRuleTask:
+		return true
+	}
+	return false
+}
+
+// IsActivity returns true when the element type is a task, a subprocess or
+// a call activity, which are the elements boundary events attach to
+func (t ElementType) IsActivity() bool {
+	return t.IsTask() || t.IsSubProcess() || t == CallActivity
+}
+
+// IsSubProcess returns true when the element type holds flow nodes of its own
+func (t ElementType) IsSubProcess() bool {
+	return t == SubProcess || t == Transaction
+}
+
+// IsGateway returns true when the element type is a gateway
+func (t ElementType) IsGateway() bool {
+	switch t {
+	case ExclusiveGateway, ParallelGateway, InclusiveGateway:
+		return true
+	}
+	return false
+}
+
+// Binding strategies that select the version of the process a call activity
+// starts
+const (
+
+	// BindingLatest calls the latest version
+	BindingLatest = "latest"
+
+	// BindingDeployment calls the version deployed from the same document as
+	// the calling process
+	BindingDeployment = "deployment"
+
+	// BindingVersion calls a fixed version
+	BindingVersion = "version"
+)
+
+// Mappings of the results of the decision evaluated by a business rule task
+// onto its result variable
+const (
+
+	// MapSingleEntry the single output of the single result
+	MapSingleEntry = "singleEntry"
+
+	// MapSingleResult the outputs of the single result keyed by name
+	MapSingleResult = "singleResult"
+
+	// MapCollectEntries a list with the single output of each result
+	MapCollectEntries = "collectEntries"
+
+	// MapResultList a list with the outputs of each result keyed by name
+	MapResultList = "resultList"
+)
+
+// Definitions is the root of a parsed BPMN document
+type Definitions struct {
+	ID              string
+	Name            string
+	TargetNamespace string
+	Processes       []*Process
+}
+
+// Process returns the process with the given id or nil if it does not exist
+func (d *Definitions) Process(id string) *Process {
+	for _, p := range d.Processes {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// Process is a graph of flow nodes connected by sequence flows. Nodes holds
+// the flow nodes of every scope, including those within subprocesses.
+type Process struct {
+	ID           string
+	Name         string
+	IsExecutable bool
+
+	Nodes []*FlowNode
+	Flows []*SequenceFlow
+
+	nodes map[string]*FlowNode
+	flows map[string]*SequenceFlow
+}
+
+// Node returns the flow node with the given id or nil if it does not exist
+func (p *Process) Node(id string) *FlowNode {
+	return p.nodes[id]
+}
+
+// Flow returns the sequence flow with the given id or nil if it does not exist
+func (p *Process) Flow(id string) *SequenceFlow {
+	return p.flows[id]
+}
+
+// Scope returns the flow nodes directly within the subprocess, or at process
+// level when it is nil
+func (p *Process) Scope(subprocess *FlowNode) []*FlowNode {
+	if subprocess != nil {
+		return subprocess.Children
+	}
+	nodes := make([]*FlowNode, 0)
+	for _, n := range p.Nodes {
+		if n.Parent == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// EventSubprocesses returns the event subprocesses directly within the
+// subprocess, or at process level when it is nil
+func (p *Process) EventSubprocesses(subprocess *FlowNode) []*FlowNode {
+	events := make([]*FlowNode, 0)
+	for _, n := range p.Scope(subprocess) {
+		if n.TriggeredByEvent {
+			events = append(events, n)
+		}
+	}
+	return events
+}
+
+// StartEvents returns the start events at process level
+func (p *Process) StartEvents() []*FlowNode {
+	return startEvents(p.Scope(nil))
+}
+
+// NoneStartEvent returns the start event without an event definition, which
+// starts the process when it is started directly, or nil if there is none
+func (p *Process) NoneStartEvent() *FlowNode {
+	for _, n := range p.StartEvents() {
+		if n.Event == nil {
+			return n
+		}
+	}
+	return nil
+}
+
+func startEvents(nodes []*FlowNode) []*FlowNode {
+	events := make([]*FlowNode, 0)
+	for _, n := range nodes {
+		if n.Type == StartEvent {
+			events = append(events, n)
+		}
+	}
+	return events
+}
+
+// FlowNode is an event, activity or gateway within a process
+type FlowNode struct {
+	ID   string
+	Name string
+	Type ElementType
+
+	Incoming []*SequenceFlow
+	Outgoing []*SequenceFlow
+
+	// Default flow taken by gateways and activities when no condition holds
+	Default *SequenceFlow
+
+	// Attributes of the element keyed by local name, including extension attributes
+	Attributes map[string]string
+
+	// variable mappings applied when the activity starts and when it completes
+	Inputs  []*Mapping
+	Outputs []*Mapping
+
+	// Event definition of an event, nil for none events
+	Event *EventDefinition
+
+	// AttachedTo is the activity a boundary event is attached to
+	AttachedTo *FlowNode
+
+	// CancelActivity tells whether a boundary event interrupts its activity or
+	// the start event of an event subprocess the scope it is within. Error
+	// events always interrupt.
+	CancelActivity bool
+
+	// Boundaries are the boundary events attached to an activity
+	Boundaries []*FlowNode
+
+	// Script of a script task
+	Script string
+
+	// Parent is the subprocess the node is within, nil at process level, and
+	// Children are the flow nodes within a subprocess
+	Parent   *FlowNode
+	Children []*FlowNode
+
+	// TriggeredByEvent tells whether a subprocess is an event subprocess,
+	// which starts when the event of its start event occurs within its scope
+	TriggeredByEvent bool
+
+	// Call of a call activity, nil for other elements
+	Call *CallDefinition
+
+	// Loop of a multi-instance activity, nil for other elements
+	Loop *LoopDefinition
+
+	// HTTP request made by a service task with an HTTP connector, nil for
+	// other elements
+	HTTP *HTTPConnector
+
+	// ForCompensation tells whether an activity is a compensation handler,
+	// which only runs when the activity it is associated with is compensated
+	ForCompensation bool
+
+	// Handler is the compensation handler a compensation boundary event is
+	// associated with
+	Handler *FlowNode
+}
+
+// StartEvent returns the start event of a subprocess or nil if it has none
+func (n *FlowNode) StartEvent() *FlowNode {
+	if events := startEvents(n.Children); len(events) > 0 {
+		return events[0]
+	}
+	return nil
+}
+
+// CompensationHandler returns the handler of the compensation boundary event
+// of an activity or nil if it has none
+func (n *FlowNode) CompensationHandler() *FlowNode {
+	for _, boundary := range n.Boundaries {
+		if boundary.Event != nil && boundary.Event.Type == CompensateEvent {
+			return boundary.Handler
+		}
+	}
+	return nil
+}
+
+// LoopDefinition describes the multi-instance loop of an activity, which runs
+// the activity once for every element of a collection or a fixed number of
+// times, either one after the other or all at once
+type LoopDefinition struct {
+	Sequential bool
+
+	// Collection is an expression evaluating to the list of elements, each of
+	// which is held by the ElementVariable local to its instance
+	Collection      string
+	ElementVariable string
+
+	// Cardinality is an expression evaluating to the number of instances,
+	// used when there is no collection
+	Cardinality string
+
+	// CompletionCondition is an expression that ends the loop early when it
+	// holds once an instance has completed
+	CompletionCondition string
+}
+
+// CallDefinition describes the process a call activity starts and the
+// variables passed to it and back
+type CallDefinition struct {
+
+	// Key of the called process definition and the binding that selects its
+	// version, where Version is only used by the version binding
+	Key     string
+	Binding string
+	Version int
+
+	// variables passed in when the called instance starts and out once it
+	// completes, which is either every variable or those that are mapped
+	AllIn  bool
+	AllOut bool
+	In     []*Mapping
+	Out    []*Mapping
+}
+
+// HTTPConnector describes the request a service task makes and how the
+// response is handled. The URL, header values and body are templates with
+// ${...} placeholders that are filled in from the variables visible to the
+// task.
+type HTTPConnector struct {
+	Method  string
+	URL     string
+	Headers []*Mapping
+	Body    string
+
+	// Timeout of a single request, zero for the default
+	Timeout time.Duration
+
+	// Retries is the number of times a failing request is made before an
+	// incident is raised, zero for the default, and RetryBackoff the delay
+	// before the first retry, which doubles with every failure
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Statuses map response status codes to outcomes. Without a matching
+	// mapping 2xx responses complete the task and the others are retried.
+	Statuses []*StatusMapping
+}
+
+// StatusMapping decides the outcome of responses whose status code matches
+// Status, which is either a code such as 404 or a class such as 5xx
+type StatusMapping struct {
+	Status  string
+	Outcome StatusOutcome
+
+	// ErrorCode of the BPMN error thrown by the error outcome
+	ErrorCode string
+}
+
+// StatusOutcome what an HTTP connector does with a response
+type StatusOutcome string
+
+const (
+
+	// OutcomeComplete completes the task
+	OutcomeComplete StatusOutcome = "complete"
+
+	// OutcomeRetry retries the request until no retries are left
+	OutcomeRetry StatusOutcome = "retry"
+
+	// OutcomeIncident raises an incident without retrying
+	OutcomeIncident StatusOutcome = "incident"
+
+	// OutcomeError throws a BPMN error that the process can catch
+	OutcomeError StatusOutcome = "error"
+)
+
+// Matches tells whether the mapping applies to the status code
+func (m *StatusMapping) Matches(status int) bool {
+	code := strconv.Itoa(status)
+	if len(m.Status) != 3 || len(code) != 3 {
+		return false
+	}
+	if strings.HasSuffix(m.Status, "xx") {
+		return m.Status[0] == code[0]
+	}
+	return m.Status == code
+}
+
+// EventDefinition describes what an event waits for or raises
+type EventDefinition struct {
+	Type EventType
+
+	// TimerKind is one of timeDate, timeDuration or timeCycle and Timer is
+	// its definition, which may be an expression
+	TimerKind string
+	Timer     string
+
+	// Ref is the id of the referenced message, signal, error or escalation, or
+	// of the activity a compensate event compensates, and Name is its name,
+	// which is empty when the reference could not be resolved
+	Ref  string
+	Name string
+
+	// Code of a referenced error or escalation. Catch events without a code
+	// catch every error or escalation.
+	Code string
+}
+
+// Mapping assigns the result of an expression to a variable
+type Mapping struct {
+	Name       string
+	Expression string
+}
+
+// Attribute returns the named attribute or the empty string
+func (n *FlowNode) Attribute(name string) string {
+	return n.Attributes[name]
+}
+
+// SequenceFlow connects two flow nodes
+type SequenceFlow struct {
+	ID        string
+	Name      string
+	Source    *FlowNode
+	Target    *FlowNode
+	Condition string
+}
+
+// IsDefault returns true when the flow is the default flow of its source
+func (f *SequenceFlow) IsDefault() bool {
+	return f.Source.Default == f
+}
+
+// CanReach returns true when there is a path of sequence flows from the node
+// to the target that does not pass through the target
+func (n *FlowNode) CanReach(target *FlowNode) bool {
+	visited := map[*FlowNode]bool{n: true}
+	pending := []*FlowNode{n}
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+		for _, flow := range node.Outgoing {
+			if flow.Target == target {
+				return true
+			}
+			if !visited[flow.Target] {
+				visited[flow.Target] = true
+				pending = append(pending, flow.Target)
+			}
+		}
+		for _, boundary := range node.Boundaries {
+			if !visited[boundary] {
+				visited[boundary] = true
+				pending = append(pending, boundary)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package bpmn
+
+import (
+	"fmt"
+)
+
+// lint returns the issues with the structure of the process: a missing start
+// event, flow nodes that can never be reached and gateways that cannot route
+// their tokens
+func (p *Process) lint() []*Issue {
+	response := make([]*Issue, 0)
+
+	if len(p.StartEvents()) == 0 {
+		response = append(response, p.issues(p.ID, SeverityError,
+			fmt.Sprintf("Process %s has no start event", p.ID))...)
+	}
+
+	reachable := p.reachable()
+	for _, node := range p.Nodes {
+		if !reachable[node] && !node.ForCompensation {
+			response = append(response, p.issues(node.ID, SeverityWarning,
+				fmt.Sprintf("%s %s can never be reached", node.Type, node.ID))...)
+		}
+		if node.Type.IsGateway() {
+			response = append(response, p.lintGateway(node)...)
+		}
+	}
+	return response
+}
+
+// lintGateway returns the issues with the sequence flows of a gateway
+func (p *Process) lintGateway(node *FlowNode) []*Issue {
+	switch {
+	case len(node.Outgoing) == 0:
+		return p.issues(node.ID, SeverityError, fmt.Sprintf("Gateway %s has no outgoing sequence flow", node.ID))
+
+	case len(node.Outgoing) == 1 && len(node.Incoming) <= 1:
+		return p.issues(node.ID, SeverityWarning,
+			fmt.Sprintf("Gateway %s has a single outgoing sequence flow so it neither forks nor joins", node.ID))
+
+	case node.Type == ExclusiveGateway && node.Default == nil:
+		for _, flow := range node.Outgoing {
+			if flow.Condition != "" {
+				return nil
+			}
+		}
+		return p.issues(node.ID, SeverityError,
+			fmt.Sprintf("Exclusive gateway %s has neither a default flow nor conditions to choose between its flows", node.ID))
+	}
+	return nil
+}
+
+// reachable returns the flow nodes that a token can reach from the start
+// events and event subprocesses at process level
+func (p *Process) reachable() map[*FlowNode]bool {
+	visited := make(map[*FlowNode]bool)
+	pending := make([]*FlowNode, 0)
+	visit := func(nodes ...*FlowNode) {
+		for _, n := range nodes {
+			if n != nil && !visited[n] {
+				visited[n] = true
+				pending = append(pending, n)
+			}
+		}
+	}
+
+	visit(p.StartEvents()...)
+	visit(p.EventSubprocesses(nil)...)
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+
+		for _, flow := range node.Outgoing {
+			visit(flow.Target)
+		}
+		visit(node.Boundaries...)
+		visit(node.Handler)
+		if len(node.Children) > 0 {
+			visit(startEvents(node.Children)...)
+			visit(p.EventSubprocesses(node)...)
+		}
+	}
+	return visited
+}
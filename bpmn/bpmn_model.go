@@ -0,0 +1,18 @@
+package bpmn
+
+import (
+	"github.com/sterrasi/stepwise/util"
+)
+
+// ProcessDefinition a deployed BPMN process
+type ProcessDefinition struct {
+	util.EntityImpl
+	Key     string `gorm:"type:varchar(255);unique_index:idx_process_definition_version;not null"`
+	Version int    `gorm:"unique_index:idx_process_definition_version;not null"`
+	Name    string `gorm:"type:varchar(255)"`
+
+	// name of the deployed resource, its BPMN XML and the SHA-256 of the XML
+	ResourceName string `gorm:"type:varchar(255)"`
+	XML          string `gorm:"type:text;not null" json:"-"`
+	Hash         string `gorm:"type:varchar(64);index;not null"`
+}
@@ -0,0 +1,515 @@
+package bpmn
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xmlElement is a generic XML element. BPMN documents mix element types freely
+// so they are decoded into a tree first and then interpreted by local name.
+type xmlElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr    `xml:",any,attr"`
+	Content  string        `xml:",chardata"`
+	Children []*xmlElement `xml:",any"`
+}
+
+func (e *xmlElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (e *xmlElement) child(name string) *xmlElement {
+	for _, c := range e.Children {
+		if c.XMLName.Local == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (e *xmlElement) text() string {
+	return strings.TrimSpace(e.Content)
+}
+
+// elements that may appear within a process but are not flow nodes
+var nonFlowElements = map[string]bool{
+	"documentation":        true,
+	"extensionElements":    true,
+	"laneSet":              true,
+	"ioSpecification":      true,
+	"property":             true,
+	"dataObject":           true,
+	"dataObjectReference":  true,
+	"dataStoreReference":   true,
+	"textAnnotation":       true,
+	"dataInputAssociation": true,
+	"group":                true,
+	"category":             true,
+	"incoming":             true,
+	"outgoing":             true,
+
+	"multiInstanceLoopCharacteristics": true,
+	"standardLoopCharacteristics":      true,
+}
+
+// Parse reads a BPMN 2.0 XML document
+func Parse(r io.Reader) (*Definitions, error) {
+	root := &xmlElement{}
+	if err := xml.NewDecoder(r).Decode(root); err != nil {
+		return nil, fmt.Errorf("Malformed BPMN document: %s", err)
+	}
+	if root.XMLName.Local != "definitions" {
+		return nil, fmt.Errorf("Expected a definitions root element but found %s", root.XMLName.Local)
+	}
+
+	definitions := &Definitions{
+		ID:              root.attr("id"),
+		Name:            root.attr("name"),
+		TargetNamespace: root.attr("targetNamespace"),
+		Processes:       make([]*Process, 0),
+	}
+
+	// messages and the like are defined once and referenced by id
+	refs := make(map[string]*xmlElement)
+	for _, c := range root.Children {
+		switch c.XMLName.Local {
+		case "message", "signal", "error", "escalation":
+			refs[c.attr("id")] = c
+		}
+	}
+
+	for _, c := range root.Children {
+		if c.XMLName.Local != "process" {
+			continue
+		}
+		process, err := parseProcess(c, refs)
+		if err != nil {
+			return nil, err
+		}
+		if definitions.Process(process.ID) != nil {
+			return nil, fmt.Errorf("Duplicate process id %s", process.ID)
+		}
+		definitions.Processes = append(definitions.Processes, process)
+	}
+
+	if len(definitions.Processes) == 0 {
+		return nil, fmt.Errorf("BPMN document does not contain a process")
+	}
+	return definitions, nil
+}
+
+// ParseBytes reads a BPMN 2.0 XML document from a byte slice
+func ParseBytes(data []byte) (*Definitions, error) {
+	return Parse(bytes.NewReader(data))
+}
+
+func parseProcess(e *xmlElement, refs map[string]*xmlElement) (*Process, error) {
+	process := &Process{
+		ID:           e.attr("id"),
+		Name:         e.attr("name"),
+		IsExecutable: e.attr("isExecutable") != "false",
+		Nodes:        make([]*FlowNode, 0),
+		Flows:        make([]*SequenceFlow, 0),
+		nodes:        make(map[string]*FlowNode),
+		flows:        make(map[string]*SequenceFlow),
+	}
+	if process.ID == "" {
+		return nil, fmt.Errorf("Process id is required")
+	}
+
+	// nodes first so that flows can be resolved regardless of document order
+	flowElements := make([]*xmlElement, 0)
+	if err := parseScope(process, e, nil, refs, &flowElements); err != nil {
+		return nil, fmt.Errorf("Process %s: %s", process.ID, err)
+	}
+
+	associations := make([]*xmlElement, 0)
+	for _, c := range flowElements {
+		if c.XMLName.Local == "association" {
+			associations = append(associations, c)
+			continue
+		}
+		flow, err := parseSequenceFlow(process, c)
+		if err != nil {
+			return nil, fmt.Errorf("Process %s: %s", process.ID, err)
+		}
+		process.flows[flow.ID] = flow
+		process.Flows = append(process.Flows, flow)
+	}
+
+	// boundary events
+	for _, node := range process.Nodes {
+		if node.Type != BoundaryEvent {
+			continue
+		}
+		ref := node.Attribute("attachedToRef")
+		activity := process.nodes[ref]
+		if activity == nil || !activity.Type.IsActivity() || activity.TriggeredByEvent {
+			return nil, fmt.Errorf("Process %s: boundary event %s is attached to unknown activity %s",
+				process.ID, node.ID, ref)
+		}
+		node.AttachedTo = activity
+		node.CancelActivity = node.Attribute("cancelActivity") != "false" || alwaysInterrupts(node)
+		activity.Boundaries = append(activity.Boundaries, node)
+	}
+
+	// compensation boundary events are associated with their handler, other
+	// associations only annotate the diagram
+	for _, c := range associations {
+		source := process.nodes[c.attr("sourceRef")]
+		target := process.nodes[c.attr("targetRef")]
+		if source == nil || target == nil || source.Type != BoundaryEvent || source.Event == nil ||
+			source.Event.Type != CompensateEvent {
+			continue
+		}
+		source.Handler = target
+	}
+
+	// default flows
+	for _, node := range process.Nodes {
+		ref := node.Attribute("default")
+		if ref == "" {
+			continue
+		}
+		flow := process.flows[ref]
+		if flow == nil || flow.Source != node {
+			return nil, fmt.Errorf("Process %s: default flow %s is not an outgoing flow of %s",
+				process.ID, ref, node.ID)
+		}
+		node.Default = flow
+	}
+	return process, nil
+}
+
+// parseScope parses the flow nodes within the process or a subprocess,
+// collecting their sequence flows and associations to be resolved once every
+// node is known
+func parseScope(process *Process, e *xmlElement, parent *FlowNode, refs map[string]*xmlElement,
+	flowElements *[]*xmlElement) error {
+
+	for _, c := range e.Children {
+		name := c.XMLName.Local
+		if nonFlowElements[name] {
+			continue
+		}
+		if name == "sequenceFlow" || name == "association" {
+			*flowElements = append(*flowElements, c)
+			continue
+		}
+
+		node, err := parseFlowNode(c, refs)
+		if err != nil {
+			return err
+		}
+		if process.nodes[node.ID] != nil {
+			return fmt.Errorf("duplicate element id %s", node.ID)
+		}
+		node.Parent = parent
+		process.nodes[node.ID] = node
+		process.Nodes = append(process.Nodes, node)
+
+		if parent != nil {
+			parent.Children = append(parent.Children, node)
+			if parent.TriggeredByEvent && node.Type == StartEvent {
+				node.CancelActivity = node.Attribute("isInterrupting") != "false" || alwaysInterrupts(node)
+			}
+		}
+		if node.Type.IsSubProcess() {
+			if err := parseScope(process, c, node, refs, flowElements); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// alwaysInterrupts tells whether the event interrupts regardless of its
+// cancelActivity or isInterrupting attribute
+func alwaysInterrupts(node *FlowNode) bool {
+	return node.Event != nil && (node.Event.Type == ErrorEvent || node.Event.Type == CancelEvent)
+}
+
+func parseFlowNode(e *xmlElement, refs map[string]*xmlElement) (*FlowNode, error) {
+	node := &FlowNode{
+		ID:         e.attr("id"),
+		Name:       e.attr("name"),
+		Type:       ElementType(e.XMLName.Local),
+		Incoming:   make([]*SequenceFlow, 0),
+		Outgoing:   make([]*SequenceFlow, 0),
+		Attributes: make(map[string]string),
+		Boundaries: make([]*FlowNode, 0),
+		Children:   make([]*FlowNode, 0),
+	}
+	if node.ID == "" {
+		return nil, fmt.Errorf("%s element without an id", e.XMLName.Local)
+	}
+	for _, a := range e.Attrs {
+		node.Attributes[a.Name.Local] = a.Value
+	}
+
+	for _, c := range e.Children {
+		name := c.XMLName.Local
+		if !strings.HasSuffix(name, "EventDefinition") {
+			continue
+		}
+		if node.Event != nil {
+			return nil, fmt.Errorf("%s has more than one event definition", node.ID)
+		}
+		node.Event = parseEventDefinition(c, refs)
+	}
+
+	if script := e.child("script"); script != nil {
+		node.Script = script.text()
+	}
+	node.TriggeredByEvent = node.Type == SubProcess && node.Attribute("triggeredByEvent") == "true"
+	node.ForCompensation = node.Attribute("isForCompensation") == "true"
+	if loop := e.child("multiInstanceLoopCharacteristics"); loop != nil {
+		node.Loop = parseLoop(loop)
+	}
+	if node.Type == CallActivity {
+		call, err := parseCall(e, node)
+		if err != nil {
+			return nil, err
+		}
+		node.Call = call
+	}
+	if extensions := e.child("extensionElements"); extensions != nil {
+		if c := extensions.child("http"); c != nil {
+			connector, err := parseHTTP(c, node)
+			if err != nil {
+				return nil, err
+			}
+			node.HTTP = connector
+		}
+	}
+
+	// receive and send tasks reference their message directly
+	if ref := node.Attribute("messageRef"); ref != "" && (node.Type == ReceiveTask || node.Type == SendTask) {
+		node.Event = &EventDefinition{Type: MessageEvent, Ref: ref, Name: refName(refs, ref)}
+	}
+
+	node.Inputs = make([]*Mapping, 0)
+	node.Outputs = make([]*Mapping, 0)
+	if extensions := e.child("extensionElements"); extensions != nil {
+		if mappings := extensions.child("inputOutput"); mappings != nil {
+			for _, c := range mappings.Children {
+				mapping := &Mapping{Name: c.attr("name"), Expression: c.text()}
+				if mapping.Name == "" {
+					return nil, fmt.Errorf("%s of %s without a name", c.XMLName.Local, node.ID)
+				}
+				switch c.XMLName.Local {
+				case "inputParameter":
+					node.Inputs = append(node.Inputs, mapping)
+				case "outputParameter":
+					node.Outputs = append(node.Outputs, mapping)
+				}
+			}
+		}
+	}
+	return node, nil
+}
+
+// parseCall reads the called process of a call activity along with the in
+// and out variable mappings of its extension elements, which either pass
+// every variable or map a source variable or expression onto a target
+func parseCall(e *xmlElement, node *FlowNode) (*CallDefinition, error) {
+	call := &CallDefinition{
+		Key:     node.Attribute("calledElement"),
+		Binding: node.Attribute("calledElementBinding"),
+		In:      make([]*Mapping, 0),
+		Out:     make([]*Mapping, 0),
+	}
+	if call.Binding == "" {
+		call.Binding = BindingLatest
+	}
+	if version := node.Attribute("calledElementVersion"); version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("calledElementVersion %q of %s is not a number", version, node.ID)
+		}
+		call.Version = v
+	}
+
+	extensions := e.child("extensionElements")
+	if extensions == nil {
+		return call, nil
+	}
+	for _, c := range extensions.Children {
+		name := c.XMLName.Local
+		if name != "in" && name != "out" {
+			continue
+		}
+		if c.attr("variables") == "all" {
+			if name == "in" {
+				call.AllIn = true
+			} else {
+				call.AllOut = true
+			}
+			continue
+		}
+
+		mapping := &Mapping{Name: c.attr("target"), Expression: c.attr("source")}
+		if source := c.attr("sourceExpression"); source != "" {
+			mapping.Expression = source
+		}
+		if mapping.Name == "" || mapping.Expression == "" {
+			return nil, fmt.Errorf("%s mapping of %s without a source or target", name, node.ID)
+		}
+		if name == "in" {
+			call.In = append(call.In, mapping)
+		} else {
+			call.Out = append(call.Out, mapping)
+		}
+	}
+	return call, nil
+}
+
+// parseHTTP reads the HTTP connector of a service task along with its
+// headers, body and status mappings
+func parseHTTP(e *xmlElement, node *FlowNode) (*HTTPConnector, error) {
+	connector := &HTTPConnector{
+		Method:   strings.ToUpper(e.attr("method")),
+		URL:      e.attr("url"),
+		Headers:  make([]*Mapping, 0),
+		Statuses: make([]*StatusMapping, 0),
+	}
+	if connector.Method == "" {
+		connector.Method = "GET"
+	}
+
+	for _, d := range []struct {
+		name   string
+		target *time.Duration
+	}{{"timeout", &connector.Timeout}, {"retryBackoff", &connector.RetryBackoff}} {
+		if value := e.attr(d.name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s %q of %s is not a duration", d.name, value, node.ID)
+			}
+			*d.target = duration
+		}
+	}
+	if retries := e.attr("retries"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil {
+			return nil, fmt.Errorf("retries %q of %s is not a number", retries, node.ID)
+		}
+		connector.Retries = n
+	}
+
+	for _, c := range e.Children {
+		switch c.XMLName.Local {
+		case "header":
+			if c.attr("name") == "" {
+				return nil, fmt.Errorf("header of %s without a name", node.ID)
+			}
+			connector.Headers = append(connector.Headers, &Mapping{Name: c.attr("name"), Expression: c.text()})
+		case "body":
+			connector.Body = c.text()
+		case "status":
+			status := &StatusMapping{
+				Status:    strings.ToLower(c.attr("code")),
+				Outcome:   StatusOutcome(c.attr("outcome")),
+				ErrorCode: c.attr("errorCode"),
+			}
+			if status.Outcome == "" && status.ErrorCode != "" {
+				status.Outcome = OutcomeError
+			}
+			connector.Statuses = append(connector.Statuses, status)
+		}
+	}
+	return connector, nil
+}
+
+// parseLoop reads multi-instance loop characteristics, which take the
+// collection and element variable as extension attributes
+func parseLoop(e *xmlElement) *LoopDefinition {
+	loop := &LoopDefinition{
+		Sequential:      e.attr("isSequential") == "true",
+		Collection:      e.attr("collection"),
+		ElementVariable: e.attr("elementVariable"),
+	}
+	if c := e.child("loopCardinality"); c != nil {
+		loop.Cardinality = c.text()
+	}
+	if c := e.child("completionCondition"); c != nil {
+		loop.CompletionCondition = c.text()
+	}
+	return loop
+}
+
+func parseEventDefinition(e *xmlElement, refs map[string]*xmlElement) *EventDefinition {
+	event := &EventDefinition{
+		Type: EventType(strings.TrimSuffix(e.XMLName.Local, "EventDefinition")),
+	}
+	for _, a := range e.Attrs {
+		if a.Name.Local == string(event.Type)+"Ref" {
+			event.Ref = a.Value
+			event.Name = refName(refs, a.Value)
+			if ref := refs[a.Value]; ref != nil {
+				event.Code = ref.attr(string(event.Type) + "Code")
+			}
+		}
+	}
+	if event.Type == CompensateEvent {
+		event.Ref = e.attr("activityRef")
+	}
+	for _, kind := range []string{"timeDate", "timeDuration", "timeCycle"} {
+		if c := e.child(kind); c != nil {
+			event.TimerKind = kind
+			event.Timer = c.text()
+		}
+	}
+	return event
+}
+
+// refName returns the name of a referenced root element, or the empty string
+// when the reference cannot be resolved
+func refName(refs map[string]*xmlElement, ref string) string {
+	if e := refs[ref]; e != nil {
+		return e.attr("name")
+	}
+	return ""
+}
+
+func parseSequenceFlow(process *Process, e *xmlElement) (*SequenceFlow, error) {
+	flow := &SequenceFlow{
+		ID:   e.attr("id"),
+		Name: e.attr("name"),
+	}
+	if flow.ID == "" {
+		return nil, fmt.Errorf("sequenceFlow element without an id")
+	}
+	if process.nodes[flow.ID] != nil || process.flows[flow.ID] != nil {
+		return nil, fmt.Errorf("duplicate element id %s", flow.ID)
+	}
+
+	sourceRef, targetRef := e.attr("sourceRef"), e.attr("targetRef")
+	if flow.Source = process.nodes[sourceRef]; flow.Source == nil {
+		return nil, fmt.Errorf("sequence flow %s references unknown source %s", flow.ID, sourceRef)
+	}
+	if flow.Target = process.nodes[targetRef]; flow.Target == nil {
+		return nil, fmt.Errorf("sequence flow %s references unknown target %s", flow.ID, targetRef)
+	}
+	if flow.Source.Parent != flow.Target.Parent {
+		return nil, fmt.Errorf("sequence flow %s crosses the boundary of a subprocess", flow.ID)
+	}
+
+	if condition := e.child("conditionExpression"); condition != nil {
+		flow.Condition = condition.text()
+	}
+
+	flow.Source.Outgoing = append(flow.Source.Outgoing, flow)
+	flow.Target.Incoming = append(flow.Target.Incoming, flow)
+	return flow, nil
+}
@@ -0,0 +1,421 @@
+package bpmn
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sterrasi/stepwise/expr"
+	"github.com/sterrasi/stepwise/timer"
+)
+
+// Severity of an issue found with a process
+type Severity string
+
+const (
+
+	// SeverityError prevents the process from being deployed
+	SeverityError Severity = "error"
+
+	// SeverityWarning points out a likely modeling mistake that does not
+	// prevent the process from being deployed
+	SeverityWarning Severity = "warning"
+)
+
+// Issue a problem found with an element of a process
+type Issue struct {
+	ProcessID string   `json:"processId"`
+	ElementID string   `json:"elementId"`
+	Severity  Severity `json:"severity"`
+	Message   string   `json:"message"`
+}
+
+// ValidationError lists the issues found with a BPMN document, at least one of
+// which prevents it from being deployed
+type ValidationError struct {
+	Issues []*Issue
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0)
+	for _, issue := range e.Issues {
+		if issue.Severity == SeverityError {
+			messages = append(messages, issue.Message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// HasErrors tells whether any of the issues prevents deployment
+func HasErrors(issues []*Issue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// issues makes issues of the given severity for an element of the process
+func (p *Process) issues(elementID string, severity Severity, messages ...string) []*Issue {
+	response := make([]*Issue, 0)
+	for _, message := range messages {
+		response = append(response, &Issue{
+			ProcessID: p.ID,
+			ElementID: elementID,
+			Severity:  severity,
+			Message:   message,
+		})
+	}
+	return response
+}
+
+// Validate returns the issues with the structure of an executable process and
+// with the expressions, scripts, timers, messages, signals, subprocesses, call
+// activities, business rule tasks, HTTP connectors and compensation of its
+// elements
+func (p *Process) Validate() []*Issue {
+	response := make([]*Issue, 0)
+	if p.IsExecutable {
+		response = append(response, p.lint()...)
+	}
+
+	for _, flow := range p.Flows {
+		if flow.Condition == "" {
+			continue
+		}
+		for _, issue := range expr.Validate(flow.Condition) {
+			response = append(response, p.issues(flow.ID, SeverityError,
+				fmt.Sprintf("Condition of sequence flow %s: %s", flow.ID, issue))...)
+		}
+	}
+	for _, node := range p.Nodes {
+		response = append(response, p.issues(node.ID, SeverityError, p.validateNode(node)...)...)
+	}
+	return response
+}
+
+// validateNode returns the issues with the expressions and settings of a
+// flow node, all of which prevent deployment
+func (p *Process) validateNode(node *FlowNode) []string {
+	response := make([]string, 0)
+
+	for _, m := range append(node.Inputs, node.Outputs...) {
+		for _, issue := range expr.Validate(m.Expression) {
+			response = append(response, fmt.Sprintf("Mapping %s of %s: %s", m.Name, node.ID, issue))
+		}
+	}
+	switch node.Type {
+	case ScriptTask:
+		response = append(response, validateScript(node)...)
+	case SubProcess, Transaction:
+		response = append(response, validateSubProcess(node)...)
+	case CallActivity:
+		response = append(response, validateCall(node)...)
+	case BusinessRuleTask:
+		response = append(response, validateBusinessRule(node)...)
+	case StartEvent:
+		if node.Event != nil && (node.Event.Type == ErrorEvent || node.Event.Type == EscalationEvent) &&
+			(node.Parent == nil || !node.Parent.TriggeredByEvent) {
+			response = append(response, fmt.Sprintf("The %s start event %s is only allowed in an event subprocess",
+				node.Event.Type, node.ID))
+		}
+	}
+	if node.Loop != nil {
+		response = append(response, validateLoop(node)...)
+	}
+	if node.HTTP != nil {
+		response = append(response, validateHTTP(node)...)
+	}
+	if node.ForCompensation && (len(node.Incoming) > 0 || len(node.Outgoing) > 0) {
+		response = append(response, fmt.Sprintf("Compensation handler %s cannot have sequence flows", node.ID))
+	}
+	if node.Event != nil && (node.Event.Type == CompensateEvent || node.Event.Type == CancelEvent) {
+		response = append(response, p.validateCompensation(node)...)
+	}
+	if node.Event != nil && node.Event.Type == TimerEvent {
+		response = append(response, validateTimer(node)...)
+	}
+	if node.Event != nil && (node.Event.Type == MessageEvent || node.Event.Type == SignalEvent) &&
+		node.Event.Name == "" {
+		response = append(response, fmt.Sprintf("The %s %q referenced by %s is not defined or has no name",
+			node.Event.Type, node.Event.Ref, node.ID))
+	}
+	return response
+}
+
+// validateTimer checks the timer of an event, where timers given as an
+// expression can only be checked for syntax
+func validateTimer(node *FlowNode) []string {
+	response := make([]string, 0)
+	event := node.Event
+
+	if event.TimerKind == "" {
+		return append(response, fmt.Sprintf("Timer of %s has no timeDate, timeDuration or timeCycle", node.ID))
+	}
+	if unwrapped := expr.Unwrap(event.Timer); unwrapped != event.Timer {
+		for _, issue := range expr.Validate(unwrapped) {
+			response = append(response, fmt.Sprintf("Timer of %s: %s", node.ID, issue))
+		}
+		return response
+	}
+	if _, err := timer.Parse(timer.Kind(event.TimerKind), event.Timer); err != nil {
+		response = append(response, fmt.Sprintf("Timer of %s: %s", node.ID, err))
+	}
+	return response
+}
+
+// validateScript checks that a script task has a script in the expression
+// language, the only script format that is supported
+func validateScript(node *FlowNode) []string {
+	response := make([]string, 0)
+
+	if format := node.Attribute("scriptFormat"); format != "" && format != "expression" {
+		return append(response, fmt.Sprintf("Script format %s of %s is not supported", format, node.ID))
+	}
+	if node.Script == "" {
+		return append(response, fmt.Sprintf("Script task %s has no script", node.ID))
+	}
+	for _, issue := range expr.Validate(node.Script) {
+		response = append(response, fmt.Sprintf("Script of %s: %s", node.ID, issue))
+	}
+	return response
+}
+
+// validateBusinessRule checks the decision a business rule task evaluates and
+// how its results are mapped
+func validateBusinessRule(node *FlowNode) []string {
+	response := make([]string, 0)
+
+	if node.Attribute("decisionRef") == "" {
+		if node.Attribute("resultVariable") != "" || node.Attribute("mapDecisionResult") != "" {
+			response = append(response, fmt.Sprintf("Business rule task %s maps a decision result but has no decisionRef",
+				node.ID))
+		}
+		return response
+	}
+	switch node.Attribute("mapDecisionResult") {
+	case "", MapSingleEntry, MapSingleResult, MapCollectEntries, MapResultList:
+	default:
+		response = append(response, fmt.Sprintf("mapDecisionResult %s of %s is not one of %s, %s, %s or %s",
+			node.Attribute("mapDecisionResult"), node.ID, MapSingleEntry, MapSingleResult, MapCollectEntries, MapResultList))
+	}
+	if version := node.Attribute("decisionRefVersion"); version != "" {
+		if v, err := strconv.Atoi(version); err != nil || v < 1 {
+			response = append(response, fmt.Sprintf("decisionRefVersion %q of %s is not a version", version, node.ID))
+		}
+	}
+	return response
+}
+
+// event types that can start an event subprocess
+var eventSubprocessTriggers = map[EventType]bool{
+	ErrorEvent:      true,
+	EscalationEvent: true,
+	MessageEvent:    true,
+	SignalEvent:     true,
+	TimerEvent:      true,
+}
+
+// validateSubProcess checks that an embedded subprocess starts at a single
+// none start event and that an event subprocess is not connected by sequence
+// flows and starts at a single start event with an event definition
+func validateSubProcess(node *FlowNode) []string {
+	response := make([]string, 0)
+	starts := startEvents(node.Children)
+
+	if !node.TriggeredByEvent {
+		if len(starts) != 1 || starts[0].Event != nil {
+			response = append(response, fmt.Sprintf("Subprocess %s needs a single none start event", node.ID))
+		}
+		return response
+	}
+
+	if len(node.Incoming) > 0 || len(node.Outgoing) > 0 {
+		response = append(response, fmt.Sprintf("Event subprocess %s cannot have sequence flows", node.ID))
+	}
+	if len(starts) != 1 || starts[0].Event == nil || !eventSubprocessTriggers[starts[0].Event.Type] {
+		response = append(response, fmt.Sprintf(
+			"Event subprocess %s needs a single error, escalation, message, signal or timer start event", node.ID))
+	}
+	return response
+}
+
+// validateCall checks the called process, binding and variable mappings of a
+// call activity
+func validateCall(node *FlowNode) []string {
+	response := make([]string, 0)
+	call := node.Call
+
+	if call.Key == "" {
+		response = append(response, fmt.Sprintf("Call activity %s has no calledElement", node.ID))
+	}
+	switch call.Binding {
+	case BindingLatest, BindingDeployment:
+	case BindingVersion:
+		if call.Version < 1 {
+			response = append(response, fmt.Sprintf("Call activity %s is bound to a version but has no calledElementVersion",
+				node.ID))
+		}
+	default:
+		response = append(response, fmt.Sprintf("Binding %s of %s is not one of latest, deployment or version",
+			call.Binding, node.ID))
+	}
+	for _, m := range append(call.In, call.Out...) {
+		for _, issue := range expr.Validate(m.Expression) {
+			response = append(response, fmt.Sprintf("Mapping %s of %s: %s", m.Name, node.ID, issue))
+		}
+	}
+	return response
+}
+
+// validateCompensation checks that a compensation boundary event is associated
+// with a compensation handler, that a compensate throw event references an
+// activity and that cancel events belong to a transaction
+func (p *Process) validateCompensation(node *FlowNode) []string {
+	response := make([]string, 0)
+
+	switch {
+	case node.Event.Type == CompensateEvent && node.Type == BoundaryEvent:
+		if node.Handler == nil || !node.Handler.Type.IsActivity() || !node.Handler.ForCompensation {
+			response = append(response, fmt.Sprintf(
+				"Compensation boundary event %s is not associated with an activity that isForCompensation", node.ID))
+		}
+		if len(node.Outgoing) > 0 {
+			response = append(response, fmt.Sprintf("Compensation boundary event %s cannot have sequence flows", node.ID))
+		}
+
+	case node.Event.Type == CompensateEvent:
+		if node.Type != IntermediateThrowEvent && node.Type != EndEvent {
+			response = append(response, fmt.Sprintf("%s %s cannot have a compensate event definition", node.Type, node.ID))
+		}
+		if ref := node.Event.Ref; ref != "" {
+			if activity := p.Node(ref); activity == nil || !activity.Type.IsActivity() {
+				response = append(response, fmt.Sprintf("Compensate event %s references unknown activity %s", node.ID, ref))
+			}
+		}
+
+	case node.Type == BoundaryEvent:
+		if node.AttachedTo.Type != Transaction {
+			response = append(response, fmt.Sprintf("Cancel boundary event %s is not attached to a transaction", node.ID))
+		}
+
+	case node.Type == EndEvent:
+		if node.Parent == nil || node.Parent.Type != Transaction {
+			response = append(response, fmt.Sprintf("Cancel end event %s is not within a transaction", node.ID))
+		} else if !hasBoundary(node.Parent, CancelEvent) {
+			response = append(response, fmt.Sprintf("Transaction %s has a cancel end event but no cancel boundary event",
+				node.Parent.ID))
+		}
+
+	default:
+		response = append(response, fmt.Sprintf("%s %s cannot have a cancel event definition", node.Type, node.ID))
+	}
+	return response
+}
+
+func hasBoundary(activity *FlowNode, kind EventType) bool {
+	for _, boundary := range activity.Boundaries {
+		if boundary.Event != nil && boundary.Event.Type == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// methods an HTTP connector can use
+var httpMethods = map[string]bool{
+	"GET":    true,
+	"HEAD":   true,
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// validateHTTP checks the request and status mappings of an HTTP connector
+func validateHTTP(node *FlowNode) []string {
+	response := make([]string, 0)
+	connector := node.HTTP
+
+	if node.Type != ServiceTask {
+		return append(response, fmt.Sprintf("%s %s cannot have an HTTP connector", node.Type, node.ID))
+	}
+	if node.Attribute("topic") != "" {
+		response = append(response, fmt.Sprintf("Service task %s has both a topic and an HTTP connector", node.ID))
+	}
+	if !httpMethods[connector.Method] {
+		response = append(response, fmt.Sprintf("HTTP method %s of %s is not supported", connector.Method, node.ID))
+	}
+	if connector.URL == "" {
+		response = append(response, fmt.Sprintf("HTTP connector of %s has no url", node.ID))
+	}
+	if connector.Timeout < 0 || connector.Retries < 0 || connector.RetryBackoff < 0 {
+		response = append(response, fmt.Sprintf("Timeout, retries and retryBackoff of %s cannot be negative", node.ID))
+	}
+
+	templates := []struct{ name, source string }{{"URL", connector.URL}, {"Body", connector.Body}}
+	for _, h := range connector.Headers {
+		templates = append(templates, struct{ name, source string }{"Header " + h.Name, h.Expression})
+	}
+	for _, t := range templates {
+		for _, issue := range expr.ValidateTemplate(t.source) {
+			response = append(response, fmt.Sprintf("%s of %s: %s", t.name, node.ID, issue))
+		}
+	}
+
+	for _, status := range connector.Statuses {
+		if !statusPattern.MatchString(status.Status) {
+			response = append(response, fmt.Sprintf("Status %q of %s is neither a code nor a class such as 5xx",
+				status.Status, node.ID))
+		}
+		switch status.Outcome {
+		case OutcomeComplete, OutcomeRetry, OutcomeIncident:
+		case OutcomeError:
+			if status.ErrorCode == "" {
+				response = append(response, fmt.Sprintf("Status %s of %s throws an error without an errorCode",
+					status.Status, node.ID))
+			}
+		default:
+			response = append(response, fmt.Sprintf("Status %s of %s has an unknown outcome %q",
+				status.Status, node.ID, status.Outcome))
+		}
+	}
+	return response
+}
+
+// status codes such as 404 and classes such as 5xx
+var statusPattern = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+// validateLoop checks the multi-instance loop of an activity
+func validateLoop(node *FlowNode) []string {
+	response := make([]string, 0)
+	loop := node.Loop
+
+	if !node.Type.IsActivity() || node.TriggeredByEvent {
+		return append(response, fmt.Sprintf("%s %s cannot be a multi-instance activity", node.Type, node.ID))
+	}
+	if loop.Collection == "" && loop.Cardinality == "" {
+		response = append(response, fmt.Sprintf("Multi-instance activity %s has neither a collection nor a loopCardinality",
+			node.ID))
+	}
+	if loop.ElementVariable != "" && loop.Collection == "" {
+		response = append(response, fmt.Sprintf("Multi-instance activity %s has an elementVariable but no collection",
+			node.ID))
+	}
+
+	for _, e := range []struct{ name, source string }{
+		{"Collection", loop.Collection},
+		{"Loop cardinality", loop.Cardinality},
+		{"Completion condition", loop.CompletionCondition},
+	} {
+		if e.source == "" {
+			continue
+		}
+		for _, issue := range expr.Validate(e.source) {
+			response = append(response, fmt.Sprintf("%s of %s: %s", e.name, node.ID, issue))
+		}
+	}
+	return response
+}
@@ -43,6 +43,24 @@ var RootCmd = &cobra.Command{
 		viper.SetDefault("server.cert-cache-dir", "/var/www/.cache")
 		viper.SetDefault("server.address", ":443")
 		viper.SetDefault("users.default-results-per-page", "20")
+		viper.SetDefault("process-definitions.default-results-per-page", "20")
+		viper.SetDefault("decisions.default-results-per-page", "20")
+		viper.SetDefault("diagrams.default-results-per-page", "20")
+		viper.SetDefault("diagrams.auto-save-revisions", 20)
+		viper.SetDefault("diagrams.snapshot-operations", 50)
+		viper.SetDefault("process-instances.default-results-per-page", "20")
+		viper.SetDefault("tasks.default-results-per-page", "20")
+		viper.SetDefault("tasks.open-to-all", false)
+		viper.SetDefault("external-tasks.default-results-per-page", "20")
+		viper.SetDefault("incidents.default-results-per-page", "20")
+		viper.SetDefault("history.default-results-per-page", "20")
+		viper.SetDefault("history.level", "activity")
+		viper.SetDefault("external-tasks.max-async-response-timeout", "1m")
+		viper.SetDefault("job-executor.workers", 4)
+		viper.SetDefault("job-executor.batch-size", 10)
+		viper.SetDefault("job-executor.poll-interval", "5s")
+		viper.SetDefault("job-executor.lock-duration", "5m")
+		viper.SetDefault("job-executor.backoff", "10s")
 		viper.SetDefault("logging.level", logging.InfoLogLevel)
 		viper.SetDefault("logging.format", logging.TextLoggingFormat)
 		viper.SetDefault("logging.log-requests", false)
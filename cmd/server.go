@@ -7,6 +7,10 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/acme/autocert"
 
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/diagrams"
+	"github.com/sterrasi/stepwise/dmn"
+	"github.com/sterrasi/stepwise/engine"
 	"github.com/sterrasi/stepwise/logging"
 	"github.com/sterrasi/stepwise/users"
 	"github.com/sterrasi/stepwise/util"
@@ -60,6 +64,31 @@ var serverCmd = &cobra.Command{
 			panic(err.Error())
 		}
 		defer db.Close()
+		bpmn.Init(db)
+		dmn.Init(db)
+		diagrams.Init(db)
+		engine.Init(db)
+
+		// history
+		historyConfig := &engine.HistoryConfig{}
+		if err := viper.UnmarshalKey("history", historyConfig); err != nil {
+			panic(err.Error())
+		}
+		if err := engine.SetHistoryLevel(historyConfig.Level); err != nil {
+			panic(err.Error())
+		}
+
+		// job executor
+		executorConfig := &engine.ExecutorConfig{}
+		if err := viper.UnmarshalKey("job-executor", executorConfig); err != nil {
+			panic(err.Error())
+		}
+		executor, err := engine.NewExecutor(executorConfig)
+		if err != nil {
+			panic(err.Error())
+		}
+		executor.Start()
+		defer executor.Stop()
 
 		// server
 		e := echo.New()
@@ -80,6 +109,64 @@ var serverCmd = &cobra.Command{
 		}
 		users.Register(e.Group("/users"), db, usersConfig)
 
+		// Register Process Definitions API
+		definitionsConfig := &bpmn.Config{}
+		if err := viper.UnmarshalKey("process-definitions", definitionsConfig); err != nil {
+			panic(err.Error())
+		}
+		bpmn.Register(e.Group("/process-definitions"), definitionsConfig)
+
+		// Register Decisions API
+		decisionsConfig := &dmn.Config{}
+		if err := viper.UnmarshalKey("decisions", decisionsConfig); err != nil {
+			panic(err.Error())
+		}
+		dmn.Register(e.Group("/decisions"), decisionsConfig)
+
+		// Register Diagrams API
+		diagramsConfig := &diagrams.Config{}
+		if err := viper.UnmarshalKey("diagrams", diagramsConfig); err != nil {
+			panic(err.Error())
+		}
+		diagrams.Register(e.Group("/diagrams"), diagramsConfig)
+
+		// Register Process Instances API
+		instancesConfig := &engine.Config{}
+		if err := viper.UnmarshalKey("process-instances", instancesConfig); err != nil {
+			panic(err.Error())
+		}
+		engine.Register(e.Group("/process-instances"), instancesConfig)
+
+		// Register Tasks API
+		tasksConfig := &engine.Config{}
+		if err := viper.UnmarshalKey("tasks", tasksConfig); err != nil {
+			panic(err.Error())
+		}
+		engine.RegisterTasks(e.Group("/tasks"), tasksConfig)
+
+		// Register External Tasks API
+		externalTasksConfig := &engine.ExternalTaskConfig{}
+		if err := viper.UnmarshalKey("external-tasks", externalTasksConfig); err != nil {
+			panic(err.Error())
+		}
+		engine.RegisterExternalTasks(e.Group("/external-tasks"), externalTasksConfig)
+
+		// Register Incidents API
+		incidentsConfig := &engine.Config{}
+		if err := viper.UnmarshalKey("incidents", incidentsConfig); err != nil {
+			panic(err.Error())
+		}
+		engine.RegisterIncidents(e.Group("/incidents"), incidentsConfig)
+
+		// Register History API
+		engine.RegisterHistory(e.Group("/history"), historyConfig)
+
+		// Register Messages API
+		engine.RegisterMessages(e.Group("/messages"))
+
+		// Register Signals API
+		engine.RegisterSignals(e.Group("/signals"))
+
 		e.GET("/", hello)
 
 		// Start server
@@ -113,7 +200,12 @@ func initDatabase() (*gorm.DB, error) {
 	}
 
 	if databaseConfig.Migrate {
-		db.AutoMigrate(&users.User{})
+		db.AutoMigrate(&users.User{}, &bpmn.ProcessDefinition{}, &dmn.DecisionDefinition{},
+			&engine.ProcessInstance{}, &engine.Token{}, &engine.Incident{}, &engine.Variable{},
+			&engine.Task{}, &engine.TaskCandidate{}, &engine.Job{}, &engine.EventSubscription{},
+			&engine.Compensation{}, &engine.ExternalTask{}, &engine.HistoricInstance{},
+			&engine.HistoricActivity{}, &engine.HistoricVariable{}, &engine.HistoricTask{},
+			&engine.HistoricIncident{}, &diagrams.Diagram{}, &diagrams.DiagramRevision{})
 	}
 	return db, nil
 }
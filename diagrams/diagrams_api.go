@@ -0,0 +1,496 @@
+package diagrams
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/resource"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// Config is the configuration for the diagram API
+type Config struct {
+	ResultsPerPage     int `mapstructure:"default-results-per-page"`
+	AutoSaveRevisions  int `mapstructure:"auto-save-revisions"`
+	SnapshotOperations int `mapstructure:"snapshot-operations"`
+}
+
+// CreateRequest creates a diagram, from a blank document when there is no XML
+type CreateRequest struct {
+	Name    string `json:"name"`
+	OwnerID uint   `json:"ownerId"`
+	XML     string `json:"xml"`
+}
+
+// Validate the CreateRequest
+func (req *CreateRequest) Validate() []string {
+	response := validateName(req.Name)
+
+	if req.OwnerID == 0 {
+		response = append(response, "Owner ID is required")
+	}
+	return response
+}
+
+// SaveRequest saves the XML of a diagram as a new revision. When the revision
+// the changes were made to is given the save fails if the diagram has been
+// saved since.
+type SaveRequest struct {
+	XML      string `json:"xml"`
+	UserID   uint   `json:"userId"`
+	AutoSave bool   `json:"autoSave"`
+	Comment  string `json:"comment"`
+	Revision int    `json:"revision"`
+}
+
+// Validate the SaveRequest
+func (req *SaveRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.XML == "" {
+		response = append(response, "XML is required")
+	}
+	if req.UserID == 0 {
+		response = append(response, "User ID is required")
+	}
+	if len(req.Comment) > 255 {
+		response = append(response, "Comment must be at most 255 characters")
+	}
+	if req.Revision < 0 {
+		response = append(response, "Revision cannot be negative")
+	}
+	return response
+}
+
+// RenameRequest renames a diagram
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+// Validate the RenameRequest
+func (req *RenameRequest) Validate() []string {
+	return validateName(req.Name)
+}
+
+// DuplicateRequest copies a diagram into a new diagram owned by the user,
+// named after the original unless a name is given
+type DuplicateRequest struct {
+	Name   string `json:"name"`
+	UserID uint   `json:"userId"`
+}
+
+// Validate the DuplicateRequest
+func (req *DuplicateRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if len(req.Name) > 255 {
+		response = append(response, "Name must be at most 255 characters")
+	}
+	if req.UserID == 0 {
+		response = append(response, "User ID is required")
+	}
+	return response
+}
+
+// RestoreRequest restores an earlier revision of a diagram. When the revision
+// the user is looking at is given the restore fails if the diagram has been
+// saved since.
+type RestoreRequest struct {
+	UserID   uint `json:"userId"`
+	Revision int  `json:"revision"`
+}
+
+// Validate the RestoreRequest
+func (req *RestoreRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.UserID == 0 {
+		response = append(response, "User ID is required")
+	}
+	if req.Revision < 0 {
+		response = append(response, "Revision cannot be negative")
+	}
+	return response
+}
+
+func validateName(name string) []string {
+	response := make([]string, 0)
+
+	if name == "" {
+		response = append(response, "Name is required")
+	}
+	if len(name) > 255 {
+		response = append(response, "Name must be at most 255 characters")
+	}
+	return response
+}
+
+// Register the diagram API
+func Register(e *echo.Group, config *Config) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+	autoSaveRevisions = config.AutoSaveRevisions
+	if config.SnapshotOperations > 0 {
+		snapshotOperations = config.SnapshotOperations
+	}
+
+	/*
+	 * get diagrams, the most recently modified first
+	 *   owner  - [int] id of the user owning the diagrams
+	 *   name   - [string] part of the name of the diagrams
+	 *   offset - [int] (default: 0) offset into the index
+	 *   limit  - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit, ownerID int
+		filter := &DiagramFilter{}
+
+		if err := resource.Param("owner").Optional("0").Int(c, &ownerID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("name").Optional("").String(c, &filter.Name); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.OwnerID = uint(ownerID)
+
+		diagrams, err := GetDiagrams(filter, offset, limit)
+		if err != nil {
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, diagrams)
+	})
+
+	/*
+	 * create a diagram
+	 */
+	e.POST("", func(c echo.Context) error {
+		req := &CreateRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		diagram, err := CreateDiagram(req)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusCreated, diagram)
+	})
+
+	/*
+	 * download the BPMN XML of the current revision of a diagram
+	 */
+	e.GET("/:id/xml", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		diagram, err := FindDiagram(uint(id))
+		if err != nil {
+			return failure(err)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition,
+			fmt.Sprintf("attachment; filename=%q", diagram.resourceName()))
+		return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, []byte(diagram.XML))
+	})
+
+	/*
+	 * save the XML of a diagram as a new revision, responding with 201 when a
+	 * revision was created and 200 when the XML was unchanged
+	 */
+	e.POST("/:id/save", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &SaveRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		diagram, created, err := SaveDiagram(uint(id), req)
+		if err != nil {
+			return failure(err)
+		}
+		if !created {
+			return c.JSON(http.StatusOK, diagram)
+		}
+		return c.JSON(http.StatusCreated, diagram)
+	})
+
+	/*
+	 * rename a diagram
+	 */
+	e.POST("/:id/rename", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &RenameRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		diagram, err := RenameDiagram(uint(id), req.Name)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, diagram)
+	})
+
+	/*
+	 * duplicate a diagram
+	 */
+	e.POST("/:id/duplicate", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &DuplicateRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		diagram, err := DuplicateDiagram(uint(id), req)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusCreated, diagram)
+	})
+
+	/*
+	 * deploy the current revision of a diagram, responding with the process
+	 * definitions or with the issues that prevent it from being deployed
+	 */
+	e.POST("/:id/publish", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		deployed, err := PublishDiagram(uint(id))
+		if err != nil {
+			if invalid, isInvalid := err.(*bpmn.ValidationError); isInvalid {
+				return resource.BadRequest(invalid.Issues)
+			}
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.BadRequest(err)
+		}
+		return c.JSON(http.StatusOK, deployed)
+	})
+
+	/*
+	 * get the revisions of a diagram, the latest first
+	 *   offset - [int] (default: 0) offset into the index
+	 *   limit  - [int] (default: 20) number of results to return
+	 */
+	e.GET("/:id/revisions", func(c echo.Context) error {
+		var id, offset, limit int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		revisions, err := GetRevisions(uint(id), offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, revisions)
+	})
+
+	/*
+	 * get a revision of a diagram
+	 */
+	e.GET("/:id/revisions/:number", func(c echo.Context) error {
+		id, number, err := revisionParams(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		revision, err := FindRevision(id, number)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, revision)
+	})
+
+	/*
+	 * download the BPMN XML of a revision of a diagram
+	 */
+	e.GET("/:id/revisions/:number/xml", func(c echo.Context) error {
+		id, number, err := revisionParams(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		diagram, err := FindDiagram(id)
+		if err != nil {
+			return failure(err)
+		}
+		revision, err := FindRevision(id, number)
+		if err != nil {
+			return failure(err)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition,
+			fmt.Sprintf("attachment; filename=%q", diagram.resourceName()))
+		return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, []byte(revision.XML))
+	})
+
+	/*
+	 * restore an earlier revision of a diagram as a new revision, responding
+	 * with 201 when a revision was created and 200 when it is the current one
+	 */
+	e.POST("/:id/revisions/:number/restore", func(c echo.Context) error {
+		id, number, err := revisionParams(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &RestoreRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		diagram, created, err := RestoreRevision(id, number, req)
+		if err != nil {
+			return failure(err)
+		}
+		if !created {
+			return c.JSON(http.StatusOK, diagram)
+		}
+		return c.JSON(http.StatusCreated, diagram)
+	})
+
+	/*
+	 * get the semantic differences between two revisions of a diagram
+	 *   from - [int] older revision
+	 *   to   - [int] (default: current) newer revision
+	 */
+	e.GET("/:id/diff", func(c echo.Context) error {
+		var id, from, to int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("from").Int(c, &from); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("to").Optional("0").Int(c, &to); err != nil {
+			return resource.BadRequest(err)
+		}
+		if to == 0 {
+			diagram, err := FindDiagram(uint(id))
+			if err != nil {
+				return failure(err)
+			}
+			to = diagram.Revision
+		}
+
+		diff, err := DiffRevisions(uint(id), from, to)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, diff)
+	})
+
+	/*
+	 * collaborate on a diagram with other users over a WebSocket, exchanging
+	 * the messages described by Message
+	 *   user - [int] id of the user joining the collaboration
+	 */
+	e.GET("/:id/collaborate", func(c echo.Context) error {
+		var id, userID int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("user").Int(c, &userID); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		diagram, err := FindDiagram(uint(id))
+		if err != nil {
+			return failure(err)
+		}
+		user, err := findUser(db, uint(userID))
+		if err != nil {
+			return failure(err)
+		}
+
+		conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// the upgrader has already responded
+			return nil
+		}
+		collaborate(conn, diagram, user)
+		return nil
+	})
+
+	resource.GetMethod(e, GetDiagram)
+	resource.DeleteMethod(e, DeleteDiagram)
+}
+
+// revisionParams reads the diagram id and revision number from the path
+func revisionParams(c echo.Context) (uint, int, error) {
+	var id, number int
+
+	if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+		return 0, 0, err
+	}
+	if err := resource.Param("number").InPath().Int(c, &number); err != nil {
+		return 0, 0, err
+	}
+	return uint(id), number, nil
+}
+
+// failure maps an error onto its http error
+func failure(err error) error {
+	switch {
+	case err == util.ErrNotFound:
+		return resource.NotFound(err)
+	case util.IsConflictError(err):
+		return resource.Conflict(err)
+	default:
+		if invalid, isInvalid := err.(*ValidationError); isInvalid {
+			return resource.BadRequest(invalid.Issues)
+		}
+		return resource.InternalServerError(err)
+	}
+}
@@ -0,0 +1,555 @@
+package diagrams
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/sterrasi/stepwise/users"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// types of the messages exchanged while collaborating on a diagram
+const (
+
+	// MessageWelcome is sent to a user that joins, holding the XML of the
+	// diagram as of Sequence, the operations since, the participants and the
+	// locks
+	MessageWelcome = "welcome"
+
+	// MessageOperation is a change to the diagram. The server numbers the
+	// operations it receives and broadcasts them in that order, so that every
+	// participant applies them in the same order.
+	MessageOperation = "operation"
+
+	// MessageAck tells the sender of an operation its sequence number
+	MessageAck = "ack"
+
+	// MessagePresence lists the participants whenever a user joins or leaves
+	MessagePresence = "presence"
+
+	// MessageCursor is the position of the cursor of a participant
+	MessageCursor = "cursor"
+
+	// MessageLock asks for soft locks on elements, which tell the other
+	// participants that the user is working on them. Locks are released by
+	// MessageUnlock or when the user leaves.
+	MessageLock   = "lock"
+	MessageUnlock = "unlock"
+
+	// MessageLocked and MessageUnlocked broadcast the locks taken and released
+	MessageLocked   = "locked"
+	MessageUnlocked = "unlocked"
+
+	// MessageLockDenied answers a lock on elements that another participant
+	// already locked
+	MessageLockDenied = "lockDenied"
+
+	// MessageSave saves the XML of the diagram as of Sequence as a revision,
+	// while MessageSnapshot saves it as an auto-saved revision. The XML is
+	// saved on top of the revision of the session unless another Revision is
+	// given.
+	MessageSave     = "save"
+	MessageSnapshot = "snapshot"
+
+	// MessageSaved broadcasts the revision the XML was saved as
+	MessageSaved = "saved"
+
+	// MessageSnapshotRequest asks a participant for a snapshot once enough
+	// operations have been made since the last revision, or when operations
+	// are left unsaved by participants who left
+	MessageSnapshotRequest = "snapshotRequest"
+
+	// MessageConflict broadcasts the Revision the diagram was saved as outside
+	// of the session, after the revision the session is based on, when saving
+	// fails because of it. Participants save on top of that revision once they
+	// have merged it.
+	MessageConflict = "conflict"
+
+	// MessageError reports a message that could not be handled
+	MessageError = "error"
+)
+
+const (
+
+	// time allowed to write a message to a participant
+	writeWait = 10 * time.Second
+
+	// time allowed between pongs from a participant, which are asked for by
+	// pings sent a little more often
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	// largest message accepted from a participant, which bounds the XML saved
+	maxMessageSize = 4 << 20
+)
+
+// Message exchanged with the participants of a collaboration session
+type Message struct {
+	Type   string `json:"type"`
+	UserID uint   `json:"userId,omitempty"`
+
+	// Sequence of an operation, or the last operation reflected by the XML
+	// of a welcome, save, snapshot or saved message
+	Sequence int `json:"sequence,omitempty"`
+
+	// Operation is the change made to the diagram, which is only interpreted
+	// by the editors
+	Operation json.RawMessage `json:"operation,omitempty"`
+
+	ElementIDs []string `json:"elementIds,omitempty"`
+	Cursor     *Cursor  `json:"cursor,omitempty"`
+
+	XML      string `json:"xml,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	Revision int    `json:"revision,omitempty"`
+
+	Operations   []*Message      `json:"operations,omitempty"`
+	Participants []*Participant  `json:"participants,omitempty"`
+	Locks        map[string]uint `json:"locks,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Cursor the position of the pointer of a participant on the canvas and the
+// elements the participant has selected
+type Cursor struct {
+	X         float64  `json:"x"`
+	Y         float64  `json:"y"`
+	Selection []string `json:"selection,omitempty"`
+}
+
+// Participant a user within a collaboration session
+type Participant struct {
+	UserID   uint    `json:"userId"`
+	UserName string  `json:"userName"`
+	Cursor   *Cursor `json:"cursor,omitempty"`
+}
+
+// session the users collaborating on a diagram. Operations are kept from the
+// last revision saved within the session so that users who join can catch up,
+// and a session whose participants left before they were saved is kept until
+// they are.
+type session struct {
+	diagramID uint
+
+	// guards the state of the session, which is not held while saving
+	lock    sync.Mutex
+	clients map[*client]bool
+
+	// XML of the diagram as of the operation with the saved sequence number
+	xml      string
+	saved    int
+	sequence int
+	revision int
+
+	operations []*Message
+	locks      map[string]*client
+
+	// participant asked for a snapshot that has not been saved yet
+	snapshotClient *client
+
+	// revision the diagram was saved as outside of the session, zero unless
+	// the last save conflicted with it
+	conflict int
+
+	// serializes the saves of the session so that each is made on top of
+	// the revision saved before it
+	saveLock sync.Mutex
+}
+
+// client the connection of a participant
+type client struct {
+	session     *session
+	conn        *websocket.Conn
+	participant *Participant
+	send        chan []byte
+}
+
+var (
+	upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+	// collaboration sessions keyed by diagram id, the lock of which is taken
+	// before the lock of a session
+	sessions     = make(map[uint]*session)
+	sessionsLock sync.Mutex
+
+	// number of operations after which a snapshot is asked for
+	snapshotOperations = 50
+)
+
+// collaborate runs the collaboration session of a user on a diagram over the
+// connection until the connection is closed
+func collaborate(conn *websocket.Conn, diagram *Diagram, user *users.User) {
+	c := &client{
+		conn:        conn,
+		participant: &Participant{UserID: user.ID, UserName: user.UserName},
+		send:        make(chan []byte, 256),
+	}
+	go c.writePump()
+
+	join(c, diagram)
+	c.readPump()
+	leave(c)
+}
+
+// join adds the client to the session of the diagram, starting the session
+// when it is the first to join
+func join(c *client, diagram *Diagram) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	s := sessions[diagram.ID]
+	if s == nil {
+		s = &session{
+			diagramID:  diagram.ID,
+			clients:    make(map[*client]bool),
+			xml:        diagram.XML,
+			revision:   diagram.Revision,
+			operations: make([]*Message, 0),
+			locks:      make(map[string]*client),
+		}
+		sessions[diagram.ID] = s
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.session = s
+	s.clients[c] = true
+
+	c.deliver(&Message{
+		Type:         MessageWelcome,
+		UserID:       c.participant.UserID,
+		Sequence:     s.saved,
+		XML:          s.xml,
+		Revision:     s.revision,
+		Operations:   s.operations,
+		Participants: s.participants(),
+		Locks:        s.lockHolders(),
+	})
+	s.broadcast(nil, &Message{Type: MessagePresence, Participants: s.participants()})
+	if s.conflict != 0 {
+		c.deliver(&Message{Type: MessageConflict, Revision: s.conflict})
+	}
+
+	// the first to rejoin saves the operations of those who left
+	if len(s.clients) == 1 {
+		s.requestSnapshot(c)
+	}
+}
+
+// leave removes the client from its session, releasing its locks. A snapshot
+// asked of the client is asked of another participant. The session ends when
+// the client was the last to leave, unless operations are left unsaved.
+func leave(c *client) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	s := c.session
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, c)
+	close(c.send)
+
+	released := s.unlock(c, nil)
+	if len(s.clients) == 0 {
+		s.snapshotClient = nil
+		if len(s.operations) > 0 {
+			logrus.Infof("Collaboration on diagram %d kept with %d operations after revision %d until they are saved",
+				s.diagramID, len(s.operations), s.revision)
+			return
+		}
+		delete(sessions, s.diagramID)
+		return
+	}
+	if len(released) > 0 {
+		s.broadcast(nil, &Message{Type: MessageUnlocked, UserID: c.participant.UserID, ElementIDs: released})
+	}
+	s.broadcast(nil, &Message{Type: MessagePresence, Participants: s.participants()})
+
+	if s.snapshotClient == c {
+		s.snapshotClient = nil
+		s.requestSnapshot(s.firstClient())
+	}
+}
+
+// handle a message received from the client
+func (c *client) handle(msg *Message) {
+	s := c.session
+	if msg.Type == MessageSave || msg.Type == MessageSnapshot {
+		s.save(c, msg)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	userID := c.participant.UserID
+	switch msg.Type {
+	case MessageOperation:
+		if len(msg.Operation) == 0 {
+			c.fail(msg, "Operation is required")
+			return
+		}
+		s.sequence++
+		operation := &Message{Type: MessageOperation, UserID: userID, Sequence: s.sequence,
+			Operation: msg.Operation, ElementIDs: msg.ElementIDs}
+		s.operations = append(s.operations, operation)
+		c.deliver(&Message{Type: MessageAck, Sequence: s.sequence})
+		s.broadcast(c, operation)
+
+		if len(s.operations) >= snapshotOperations {
+			s.requestSnapshot(c)
+		}
+
+	case MessageCursor:
+		c.participant.Cursor = msg.Cursor
+		s.broadcast(c, &Message{Type: MessageCursor, UserID: userID, Cursor: msg.Cursor})
+
+	case MessageLock:
+		denied := make([]string, 0)
+		for _, id := range msg.ElementIDs {
+			if holder := s.locks[id]; holder != nil && holder.participant.UserID != userID {
+				denied = append(denied, id)
+			}
+		}
+		if len(denied) > 0 {
+			c.deliver(&Message{Type: MessageLockDenied, ElementIDs: denied,
+				Error: "Elements are locked by another participant"})
+			return
+		}
+		for _, id := range msg.ElementIDs {
+			s.locks[id] = c
+		}
+		s.broadcast(nil, &Message{Type: MessageLocked, UserID: userID, ElementIDs: msg.ElementIDs})
+
+	case MessageUnlock:
+		if released := s.unlock(c, msg.ElementIDs); len(released) > 0 {
+			s.broadcast(nil, &Message{Type: MessageUnlocked, UserID: userID, ElementIDs: released})
+		}
+
+	default:
+		c.fail(msg, fmt.Sprintf("Unknown message type %q", msg.Type))
+	}
+}
+
+// save stores the XML of a save or snapshot message as a revision and drops
+// the operations it reflects. The lock of the session is not held while the
+// revision is stored so that the participants carry on meanwhile.
+func (s *session) save(c *client, msg *Message) {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	s.lock.Lock()
+	if msg.Sequence < s.saved || msg.Sequence > s.sequence {
+		c.fail(msg, fmt.Sprintf("Sequence %d is not between the last saved operation %d and the last operation %d",
+			msg.Sequence, s.saved, s.sequence))
+		s.lock.Unlock()
+		return
+	}
+	autoSave := msg.Type == MessageSnapshot
+	if autoSave {
+		s.snapshotClient = nil
+	}
+	base := s.revision
+	if msg.Revision != 0 {
+		base = msg.Revision
+	}
+	s.lock.Unlock()
+
+	diagram, _, err := SaveDiagram(s.diagramID, &SaveRequest{
+		XML:      msg.XML,
+		UserID:   c.participant.UserID,
+		AutoSave: autoSave,
+		Comment:  msg.Comment,
+		Revision: base,
+	})
+	if util.IsConflictError(err) {
+		s.conflicted(c, msg, err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		c.fail(msg, err.Error())
+		return
+	}
+
+	s.conflict = 0
+	s.xml = msg.XML
+	s.revision = diagram.Revision
+	for len(s.operations) > 0 && s.operations[0].Sequence <= msg.Sequence {
+		s.operations = s.operations[1:]
+	}
+	s.saved = msg.Sequence
+	s.broadcast(nil, &Message{Type: MessageSaved, UserID: c.participant.UserID, Sequence: msg.Sequence,
+		Revision: diagram.Revision})
+}
+
+// conflicted tells the participants the revision the diagram was saved as
+// outside of the session. Snapshots are not asked for until a participant
+// saves on top of it.
+func (s *session) conflicted(c *client, msg *Message, cause error) {
+	diagram, err := FindDiagram(s.diagramID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		c.fail(msg, cause.Error())
+		return
+	}
+	s.conflict = diagram.Revision
+	s.broadcast(nil, &Message{Type: MessageConflict, UserID: c.participant.UserID, Sequence: msg.Sequence,
+		Revision: diagram.Revision, Error: cause.Error()})
+}
+
+// requestSnapshot asks the client for a snapshot of the unsaved operations,
+// unless one was asked for already or saving would conflict
+func (s *session) requestSnapshot(c *client) {
+	if s.snapshotClient != nil || s.conflict != 0 || len(s.operations) == 0 {
+		return
+	}
+	s.snapshotClient = c
+	c.deliver(&Message{Type: MessageSnapshotRequest, Sequence: s.sequence})
+}
+
+// unlock releases the locks the client holds on the elements, or all of them
+// when no elements are given, returning the released elements
+func (s *session) unlock(c *client, elementIDs []string) []string {
+	released := make([]string, 0)
+	if elementIDs == nil {
+		for id, holder := range s.locks {
+			if holder == c {
+				elementIDs = append(elementIDs, id)
+			}
+		}
+		sort.Strings(elementIDs)
+	}
+	for _, id := range elementIDs {
+		if s.locks[id] == c {
+			delete(s.locks, id)
+			released = append(released, id)
+		}
+	}
+	return released
+}
+
+// participants of the session ordered by user id
+func (s *session) participants() []*Participant {
+	participants := make([]*Participant, 0, len(s.clients))
+	for c := range s.clients {
+		participants = append(participants, c.participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].UserID < participants[j].UserID
+	})
+	return participants
+}
+
+// firstClient returns the client of the participant with the lowest user id
+func (s *session) firstClient() *client {
+	var first *client
+	for c := range s.clients {
+		if first == nil || c.participant.UserID < first.participant.UserID {
+			first = c
+		}
+	}
+	return first
+}
+
+// lockHolders returns the user holding the lock on each locked element
+func (s *session) lockHolders() map[string]uint {
+	holders := make(map[string]uint)
+	for id, c := range s.locks {
+		holders[id] = c.participant.UserID
+	}
+	return holders
+}
+
+// broadcast the message to every client of the session but the sender
+func (s *session) broadcast(sender *client, msg *Message) {
+	for c := range s.clients {
+		if c != sender {
+			c.deliver(msg)
+		}
+	}
+}
+
+// deliver queues the message for the client, dropping the connection of a
+// client that does not keep up
+func (c *client) deliver(msg *Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logrus.Errorf("Unable to encode %s message: %s", msg.Type, err)
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		c.conn.Close()
+	}
+}
+
+// fail tells the client that its message could not be handled
+func (c *client) fail(msg *Message, reason string) {
+	c.deliver(&Message{Type: MessageError, Sequence: msg.Sequence, Error: reason})
+}
+
+// readPump handles the messages of the client until its connection closes
+func (c *client) readPump() {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logrus.Debugf("Collaboration connection of user %d closed: %s", c.participant.UserID, err)
+			}
+			return
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			c.session.lock.Lock()
+			c.fail(msg, fmt.Sprintf("Malformed message: %s", err))
+			c.session.lock.Unlock()
+			continue
+		}
+		c.handle(msg)
+	}
+}
+
+// writePump writes the queued messages to the connection and pings it, until
+// the queue is closed when the client leaves
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, open := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !open {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
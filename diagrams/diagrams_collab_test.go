@@ -0,0 +1,291 @@
+package diagrams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+)
+
+// editor a participant collaborating on a diagram over a WebSocket
+type editor struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// collaboration serves the diagram API, asking for a snapshot every three
+// operations, and creates a diagram for the users to collaborate on
+func collaboration(t *testing.T, name string) (*httptest.Server, *Diagram) {
+	t.Helper()
+	e := echo.New()
+	Register(e.Group("/diagrams"), &Config{ResultsPerPage: 20, AutoSaveRevisions: 20, SnapshotOperations: 3})
+	server := httptest.NewServer(e)
+
+	owner := createUser(t, name)
+	diagram, err := CreateDiagram(&CreateRequest{Name: name, OwnerID: owner.ID, XML: document(name)})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, diagram
+}
+
+// connect connects a new user to the collaboration on the diagram and reads the
+// welcome
+func connect(t *testing.T, server *httptest.Server, diagram *Diagram, name string) (*editor, *Message) {
+	t.Helper()
+	user := createUser(t, name)
+	url := fmt.Sprintf("ws%s/diagrams/%d/collaborate?user=%d", strings.TrimPrefix(server.URL, "http"),
+		diagram.ID, user.ID)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &editor{t, conn}
+	return e, e.expect(MessageWelcome)
+}
+
+func (e *editor) send(msg *Message) {
+	e.t.Helper()
+	if err := e.conn.WriteJSON(msg); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// operate sends an operation on the element and returns its sequence number
+func (e *editor) operate(elementID string) int {
+	e.t.Helper()
+	e.send(&Message{Type: MessageOperation, Operation: json.RawMessage(`{"move":"` + elementID + `"}`),
+		ElementIDs: []string{elementID}})
+	return e.expect(MessageAck).Sequence
+}
+
+// expect reads messages until one of the type arrives, skipping the others
+func (e *editor) expect(kind string) *Message {
+	e.t.Helper()
+	e.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg := &Message{}
+		if err := e.conn.ReadJSON(msg); err != nil {
+			e.t.Fatalf("waiting for %s: %s", kind, err)
+		}
+		if msg.Type == kind {
+			return msg
+		}
+		if msg.Type == MessageError {
+			e.t.Fatalf("waiting for %s: %s", kind, msg.Error)
+		}
+	}
+}
+
+// presence waits until the participants number n
+func (e *editor) presence(n int) {
+	e.t.Helper()
+	for {
+		if msg := e.expect(MessagePresence); len(msg.Participants) == n {
+			return
+		}
+	}
+}
+
+// participantCount returns the number of participants in the session of the
+// diagram, -1 when there is no session
+func participantCount(diagramID uint) int {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	s := sessions[diagramID]
+	if s == nil {
+		return -1
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
+
+// waitForParticipants waits until the session of the diagram has n
+// participants, or for it to end when n is -1
+func waitForParticipants(t *testing.T, diagramID uint, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if participantCount(diagramID) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session of diagram %d has %d participants, expected %d", diagramID, participantCount(diagramID), n)
+}
+
+func TestCollaboration(t *testing.T) {
+	server, diagram := collaboration(t, "collaboration")
+	defer server.Close()
+
+	ada, welcome := connect(t, server, diagram, "ada")
+	if welcome.XML != diagram.XML || welcome.Revision != 1 || len(welcome.Participants) != 1 {
+		t.Errorf("welcome %+v", welcome)
+	}
+	bob, _ := connect(t, server, diagram, "bob")
+	ada.presence(2)
+
+	// operations are numbered and broadcast
+	if sequence := ada.operate("task"); sequence != 1 {
+		t.Errorf("sequence %d", sequence)
+	}
+	operation := bob.expect(MessageOperation)
+	if operation.Sequence != 1 || string(operation.Operation) != `{"move":"task"}` {
+		t.Errorf("operation %+v", operation)
+	}
+
+	// locks are denied to others and released when their holder leaves
+	ada.send(&Message{Type: MessageLock, ElementIDs: []string{"task"}})
+	bob.expect(MessageLocked)
+	bob.send(&Message{Type: MessageLock, ElementIDs: []string{"task", "gateway"}})
+	if denied := bob.expect(MessageLockDenied); fmt.Sprint(denied.ElementIDs) != "[task]" {
+		t.Errorf("denied %v", denied.ElementIDs)
+	}
+	ada.conn.Close()
+	if unlocked := bob.expect(MessageUnlocked); fmt.Sprint(unlocked.ElementIDs) != "[task]" {
+		t.Errorf("unlocked %v", unlocked.ElementIDs)
+	}
+
+	// saving drops the operations it reflects
+	bob.send(&Message{Type: MessageSave, Sequence: 1, XML: document("saved"), Comment: "moved"})
+	if saved := bob.expect(MessageSaved); saved.Sequence != 1 || saved.Revision != 2 {
+		t.Errorf("saved %+v", saved)
+	}
+	carl, welcome := connect(t, server, diagram, "carl")
+	if welcome.XML != document("saved") || welcome.Sequence != 1 || len(welcome.Operations) != 0 {
+		t.Errorf("welcome %+v", welcome)
+	}
+
+	bob.conn.Close()
+	carl.conn.Close()
+	waitForParticipants(t, diagram.ID, -1)
+}
+
+func TestCollaborationSnapshotHandover(t *testing.T) {
+	server, diagram := collaboration(t, "handover")
+	defer server.Close()
+	ada, _ := connect(t, server, diagram, "ada-handover")
+	bob, _ := connect(t, server, diagram, "bob-handover")
+	ada.presence(2)
+
+	for i := 0; i < 3; i++ {
+		ada.operate(fmt.Sprintf("task%d", i))
+	}
+	ada.expect(MessageSnapshotRequest)
+
+	// the snapshot is asked of another participant when the one asked leaves
+	ada.conn.Close()
+	request := bob.expect(MessageSnapshotRequest)
+	if request.Sequence != 3 {
+		t.Errorf("request %+v", request)
+	}
+	bob.send(&Message{Type: MessageSnapshot, Sequence: 3, XML: document("snapshot")})
+	if saved := bob.expect(MessageSaved); saved.Revision != 2 {
+		t.Errorf("saved %+v", saved)
+	}
+	revisions, err := GetRevisions(diagram.ID, 0, 1)
+	if err != nil || !revisions[0].AutoSave {
+		t.Errorf("revisions %+v: %v", revisions, err)
+	}
+	bob.conn.Close()
+}
+
+func TestCollaborationKeptUntilSaved(t *testing.T) {
+	server, diagram := collaboration(t, "kept")
+	defer server.Close()
+
+	// the session outlives participants who leave operations unsaved
+	ada, _ := connect(t, server, diagram, "ada-kept")
+	ada.operate("task")
+	ada.conn.Close()
+	waitForParticipants(t, diagram.ID, 0)
+
+	// the first to rejoin catches up and is asked to save them
+	bob, welcome := connect(t, server, diagram, "bob-kept")
+	if len(welcome.Operations) != 1 || welcome.Operations[0].Sequence != 1 {
+		t.Errorf("welcome %+v", welcome)
+	}
+	bob.expect(MessageSnapshotRequest)
+	bob.send(&Message{Type: MessageSnapshot, Sequence: 1, XML: document("recovered")})
+	bob.expect(MessageSaved)
+	if current, _ := FindDiagram(diagram.ID); current.XML != document("recovered") {
+		t.Errorf("diagram %s", current.XML)
+	}
+
+	bob.conn.Close()
+	waitForParticipants(t, diagram.ID, -1)
+}
+
+func TestCollaborationConflict(t *testing.T) {
+	server, diagram := collaboration(t, "conflict")
+	defer server.Close()
+	ada, _ := connect(t, server, diagram, "ada-conflict")
+	ada.operate("task")
+
+	// a revision saved outside of the session is not overwritten
+	outside := &SaveRequest{XML: document("outside"), UserID: diagram.OwnerID}
+	if _, _, err := SaveDiagram(diagram.ID, outside); err != nil {
+		t.Fatal(err)
+	}
+	ada.send(&Message{Type: MessageSave, Sequence: 1, XML: document("inside")})
+	conflict := ada.expect(MessageConflict)
+	if conflict.Revision != 2 || conflict.Sequence != 1 {
+		t.Errorf("conflict %+v", conflict)
+	}
+	if current, _ := FindDiagram(diagram.ID); current.XML != document("outside") {
+		t.Errorf("diagram %s", current.XML)
+	}
+
+	// those who join learn of it
+	bob, _ := connect(t, server, diagram, "bob-conflict")
+	if conflict := bob.expect(MessageConflict); conflict.Revision != 2 {
+		t.Errorf("conflict %+v", conflict)
+	}
+
+	// the merge is saved on top of the conflicting revision
+	ada.send(&Message{Type: MessageSave, Sequence: 1, XML: document("merged"), Revision: 2})
+	if saved := bob.expect(MessageSaved); saved.Revision != 3 {
+		t.Errorf("saved %+v", saved)
+	}
+	if current, _ := FindDiagram(diagram.ID); current.XML != document("merged") {
+		t.Errorf("diagram %s", current.XML)
+	}
+	ada.conn.Close()
+	bob.conn.Close()
+}
+
+func TestCollaborationSaveDoesNotBlock(t *testing.T) {
+	server, diagram := collaboration(t, "blocked")
+	defer server.Close()
+	ada, _ := connect(t, server, diagram, "ada-blocked")
+	bob, _ := connect(t, server, diagram, "bob-blocked")
+	ada.presence(2)
+	ada.operate("task")
+
+	// participants carry on while a save waits for the database
+	saveLock.Lock()
+	ada.send(&Message{Type: MessageSave, Sequence: 1, XML: document("slow")})
+	time.Sleep(50 * time.Millisecond)
+	if sequence := bob.operate("gateway"); sequence != 2 {
+		t.Errorf("sequence %d", sequence)
+	}
+	saveLock.Unlock()
+
+	saved := bob.expect(MessageSaved)
+	if saved.Sequence != 1 || saved.Revision != 2 {
+		t.Errorf("saved %+v", saved)
+	}
+	carl, welcome := connect(t, server, diagram, "carl-blocked")
+	if len(welcome.Operations) != 1 || welcome.Operations[0].Sequence != 2 {
+		t.Errorf("welcome %+v", welcome)
+	}
+	ada.conn.Close()
+	bob.conn.Close()
+	carl.conn.Close()
+}
@@ -0,0 +1,460 @@
+package diagrams
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nu7hatch/gouuid"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/users"
+	"github.com/sterrasi/stepwise/util"
+)
+
+var (
+	db *gorm.DB
+
+	// number of auto-saved revisions listed for each diagram
+	autoSaveRevisions = 20
+
+	// serializes the assignment of revision numbers
+	saveLock sync.Mutex
+)
+
+// document a new diagram starts from: an executable process with a start
+// event and the shape of the start event
+const blankDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<bpmn:definitions xmlns:bpmn="http://www.omg.org/spec/BPMN/20100524/MODEL" xmlns:bpmndi="http://www.omg.org/spec/BPMN/20100524/DI" xmlns:dc="http://www.omg.org/spec/DD/20100524/DC" id="Definitions_%[1]s" targetNamespace="http://bpmn.io/schema/bpmn">
+  <bpmn:process id="Process_%[1]s" name="%[2]s" isExecutable="true">
+    <bpmn:startEvent id="StartEvent_1" />
+  </bpmn:process>
+  <bpmndi:BPMNDiagram id="BPMNDiagram_1">
+    <bpmndi:BPMNPlane id="BPMNPlane_1" bpmnElement="Process_%[1]s">
+      <bpmndi:BPMNShape id="StartEvent_1_di" bpmnElement="StartEvent_1">
+        <dc:Bounds x="152" y="102" width="36" height="36" />
+      </bpmndi:BPMNShape>
+    </bpmndi:BPMNPlane>
+  </bpmndi:BPMNDiagram>
+</bpmn:definitions>
+`
+
+// ValidationError lists the issues that prevent a diagram from being changed
+type ValidationError struct {
+	Issues []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Issues, "; ")
+}
+
+// TableName for diagrams
+func (Diagram) TableName() string {
+	return "diagrams"
+}
+
+// TableName for diagram revisions
+func (DiagramRevision) TableName() string {
+	return "diagram_revisions"
+}
+
+// Init sets the database used to store diagrams
+func Init(database *gorm.DB) {
+	db = database
+}
+
+// CreateDiagram creates a diagram owned by a user, starting from a blank
+// document unless XML is given
+func CreateDiagram(req *CreateRequest) (*Diagram, error) {
+	data := req.XML
+	if data == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf(blankDocument, id.String()[:7], html.EscapeString(req.Name))
+	}
+	if err := checkDocument(data); err != nil {
+		return nil, err
+	}
+
+	tx := db.Begin()
+	if err := checkUser(tx, req.OwnerID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	diagram := &Diagram{Name: req.Name, OwnerID: req.OwnerID, XML: data}
+	if err := tx.Create(diagram).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := addRevision(tx, diagram, req.OwnerID, data, false, ""); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return diagram, nil
+}
+
+// FindDiagram returns the diagram with the given id
+func FindDiagram(id uint) (*Diagram, error) {
+	return findDiagram(db, id)
+}
+
+func findDiagram(tx *gorm.DB, id uint) (*Diagram, error) {
+	diagram := &Diagram{}
+	if err := tx.First(diagram, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return diagram, nil
+}
+
+// GetDiagram returns a specific diagram
+func GetDiagram(id int) (util.Entity, error) {
+	return FindDiagram(uint(id))
+}
+
+// DiagramFilter restricts the diagrams returned by GetDiagrams
+type DiagramFilter struct {
+	OwnerID uint
+
+	// part of the name
+	Name string
+}
+
+// GetDiagrams returns a page of diagrams, the most recently modified first
+func GetDiagrams(filter *DiagramFilter, offset int, limit int) ([]*Diagram, error) {
+	query := db
+	if filter.OwnerID != 0 {
+		query = query.Where("owner_id = ?", filter.OwnerID)
+	}
+	if filter.Name != "" {
+		query = query.Where("name LIKE ?", "%"+filter.Name+"%")
+	}
+
+	diagrams := make([]*Diagram, 0)
+	if err := query.Order("updated_at desc, id desc").Offset(offset).Limit(limit).Find(&diagrams).Error; err != nil {
+		return nil, err
+	}
+	return diagrams, nil
+}
+
+// SaveDiagram saves the XML of a diagram as a new revision. Saving XML that is
+// identical to the current revision is a no-op, unless an auto-saved revision
+// is saved by the user. The diagram is returned along with whether a revision
+// was created.
+func SaveDiagram(id uint, req *SaveRequest) (*Diagram, bool, error) {
+	if err := checkDocument(req.XML); err != nil {
+		return nil, false, err
+	}
+
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	tx := db.Begin()
+	diagram, err := findDiagram(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	if err := checkUser(tx, req.UserID); err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	if req.Revision != 0 && req.Revision != diagram.Revision {
+		tx.Rollback()
+		return nil, false, util.NewConflictError("Diagram %d was saved as revision %d after revision %d was loaded",
+			id, diagram.Revision, req.Revision)
+	}
+
+	if util.ContentHash([]byte(req.XML)) == diagram.Hash {
+		current, err := findRevision(tx, id, diagram.Revision)
+		if err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		if req.AutoSave || !current.AutoSave {
+			tx.Rollback()
+			return diagram, false, nil
+		}
+	}
+
+	if err := addRevision(tx, diagram, req.UserID, req.XML, req.AutoSave, req.Comment); err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	if req.AutoSave {
+		if err := pruneAutoSaves(tx, id); err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, false, err
+	}
+	return diagram, true, nil
+}
+
+// RenameDiagram changes the name of a diagram
+func RenameDiagram(id uint, name string) (*Diagram, error) {
+	diagram, err := FindDiagram(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Model(diagram).Update("name", name).Error; err != nil {
+		return nil, err
+	}
+	return diagram, nil
+}
+
+// DuplicateDiagram creates a diagram owned by the user from the current
+// revision of another diagram
+func DuplicateDiagram(id uint, req *DuplicateRequest) (*Diagram, error) {
+	original, err := FindDiagram(id)
+	if err != nil {
+		return nil, err
+	}
+	name := req.Name
+	if name == "" {
+		name = "Copy of " + original.Name
+	}
+
+	tx := db.Begin()
+	if err := checkUser(tx, req.UserID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	diagram := &Diagram{Name: name, OwnerID: req.UserID, XML: original.XML}
+	if err := tx.Create(diagram).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	comment := fmt.Sprintf("Duplicate of diagram %d revision %d", original.ID, original.Revision)
+	if err := addRevision(tx, diagram, req.UserID, original.XML, false, comment); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return diagram, nil
+}
+
+// PublishDiagram deploys the current revision of a diagram as process
+// definitions, which fails when the BPMN document does not validate
+func PublishDiagram(id uint) ([]*bpmn.ProcessDefinition, error) {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	diagram, err := FindDiagram(id)
+	if err != nil {
+		return nil, err
+	}
+	deployed, _, err := bpmn.Deploy(diagram.resourceName(), []byte(diagram.XML))
+	if err != nil {
+		return nil, err
+	}
+
+	// publishing leaves the draft as it is so it does not count as a modification
+	now := time.Now()
+	if err := db.Model(diagram).UpdateColumns(map[string]interface{}{
+		"published_revision": diagram.Revision,
+		"published_at":       &now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return deployed, nil
+}
+
+// GetRevisions returns a page of the revisions of a diagram, the latest first.
+// Pruned auto-saved revisions are left out.
+func GetRevisions(diagramID uint, offset int, limit int) ([]*DiagramRevision, error) {
+	if _, err := FindDiagram(diagramID); err != nil {
+		return nil, err
+	}
+	revisions := make([]*DiagramRevision, 0)
+	if err := db.Where("diagram_id = ?", diagramID).Order("number desc").
+		Offset(offset).Limit(limit).Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// FindRevision returns the revision of a diagram with the given number, which
+// may have been pruned
+func FindRevision(diagramID uint, number int) (*DiagramRevision, error) {
+	if _, err := FindDiagram(diagramID); err != nil {
+		return nil, err
+	}
+	return findRevision(db, diagramID, number)
+}
+
+// RestoreRevision saves the XML of an earlier revision of a diagram as a new
+// revision. The diagram is returned along with whether a revision was
+// created, which it is not when the XML is that of the current revision.
+func RestoreRevision(id uint, number int, req *RestoreRequest) (*Diagram, bool, error) {
+	revision, err := FindRevision(id, number)
+	if err != nil {
+		return nil, false, err
+	}
+	return SaveDiagram(id, &SaveRequest{
+		XML:      revision.XML,
+		UserID:   req.UserID,
+		Comment:  fmt.Sprintf("Restored revision %d", number),
+		Revision: req.Revision,
+	})
+}
+
+// DiffRevisions returns the semantic differences between two revisions of a
+// diagram, which fails when either is not a valid BPMN document
+func DiffRevisions(id uint, from int, to int) (*bpmn.Diff, error) {
+	definitions := make([]*bpmn.Definitions, 0, 2)
+	for _, number := range []int{from, to} {
+		revision, err := FindRevision(id, number)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := bpmn.ParseBytes([]byte(revision.XML))
+		if err != nil {
+			return nil, &ValidationError{[]string{fmt.Sprintf("Revision %d: %s", number, err)}}
+		}
+		definitions = append(definitions, parsed)
+	}
+	return bpmn.Compare(definitions[0], definitions[1]), nil
+}
+
+// DeleteDiagram deletes the diagram with the specified ID along with its revisions
+func DeleteDiagram(id int) error {
+	diagram, err := FindDiagram(uint(id))
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	if err := tx.Where("diagram_id = ?", diagram.ID).Delete(&DiagramRevision{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(diagram).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// addRevision stores the XML as the next revision of the diagram and makes it
+// the current one
+func addRevision(tx *gorm.DB, diagram *Diagram, userID uint, data string, autoSave bool, comment string) error {
+	revision := &DiagramRevision{
+		DiagramID: diagram.ID,
+		Number:    diagram.Revision + 1,
+		UserID:    userID,
+		AutoSave:  autoSave,
+		Comment:   comment,
+		XML:       data,
+		Hash:      util.ContentHash([]byte(data)),
+	}
+	if err := tx.Create(revision).Error; err != nil {
+		return err
+	}
+
+	diagram.XML = revision.XML
+	diagram.Hash = revision.Hash
+	diagram.Revision = revision.Number
+	return tx.Save(diagram).Error
+}
+
+func findRevision(tx *gorm.DB, diagramID uint, number int) (*DiagramRevision, error) {
+	revision := &DiagramRevision{}
+	err := tx.Unscoped().Where("diagram_id = ? AND number = ?", diagramID, number).First(revision).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return revision, nil
+}
+
+// pruneAutoSaves soft deletes the auto-saved revisions of a diagram beyond the
+// number that is listed, oldest first. They can still be found by number so
+// that they can be restored and compared.
+func pruneAutoSaves(tx *gorm.DB, diagramID uint) error {
+	var ids []uint
+	if err := tx.Model(&DiagramRevision{}).Where("diagram_id = ? AND auto_save = ?", diagramID, true).
+		Order("number desc").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+
+	// the current revision is never pruned
+	keep := autoSaveRevisions
+	if keep < 1 {
+		keep = 1
+	}
+	if len(ids) <= keep {
+		return nil
+	}
+	return tx.Where("id IN (?)", ids[keep:]).Delete(&DiagramRevision{}).Error
+}
+
+// checkUser fails when there is no user with the given id
+func checkUser(tx *gorm.DB, id uint) error {
+	_, err := findUser(tx, id)
+	return err
+}
+
+func findUser(tx *gorm.DB, id uint) (*users.User, error) {
+	user := &users.User{}
+	if err := tx.First(user, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, &ValidationError{[]string{fmt.Sprintf("User %d does not exist", id)}}
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkDocument fails unless the XML is well formed and has a BPMN
+// definitions root element. Drafts are not validated as processes so that
+// unfinished models can be saved.
+func checkDocument(data string) error {
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	root := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &ValidationError{[]string{fmt.Sprintf("Malformed BPMN document: %s", err)}}
+		}
+		if start, isStart := token.(xml.StartElement); isStart && !root {
+			if start.Name.Local != "definitions" {
+				return &ValidationError{[]string{fmt.Sprintf(
+					"Expected a definitions root element but found %s", start.Name.Local)}}
+			}
+			root = true
+		}
+	}
+	if !root {
+		return &ValidationError{[]string{"BPMN document is empty"}}
+	}
+	return nil
+}
+
+// resourceName is the name of the diagram as a deployed resource
+func (d *Diagram) resourceName() string {
+	if strings.HasSuffix(d.Name, ".bpmn") {
+		return d.Name
+	}
+	return d.Name + ".bpmn"
+}
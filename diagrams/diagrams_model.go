@@ -0,0 +1,38 @@
+package diagrams
+
+import (
+	"time"
+
+	"github.com/sterrasi/stepwise/util"
+)
+
+// Diagram an editable draft of a BPMN document owned by a user. Drafts are
+// kept apart from the deployed process definitions until they are published.
+type Diagram struct {
+	util.EntityImpl
+	Name    string `gorm:"type:varchar(255);not null"`
+	OwnerID uint   `gorm:"index;not null"`
+
+	// BPMN XML of the draft including its diagram interchange, the SHA-256 of
+	// the XML and the number of the revision it was last saved as
+	XML      string `gorm:"type:text;not null" json:"-"`
+	Hash     string `gorm:"type:varchar(64);not null"`
+	Revision int    `gorm:"not null"`
+
+	// revision that was last published as a deployment and when
+	PublishedRevision int
+	PublishedAt       *time.Time
+}
+
+// DiagramRevision a saved version of a diagram. Auto-saved revisions are
+// pruned from the listing while revisions saved by the user are kept.
+type DiagramRevision struct {
+	util.EntityImpl
+	DiagramID uint   `gorm:"unique_index:idx_diagram_revision;not null"`
+	Number    int    `gorm:"unique_index:idx_diagram_revision;not null"`
+	UserID    uint   `gorm:"index;not null"`
+	AutoSave  bool   `gorm:"not null"`
+	Comment   string `gorm:"type:varchar(255)"`
+	XML       string `gorm:"type:text;not null" json:"-"`
+	Hash      string `gorm:"type:varchar(64);not null"`
+}
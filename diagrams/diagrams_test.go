@@ -0,0 +1,114 @@
+package diagrams
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/sirupsen/logrus"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/users"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// TestMain runs the tests against a SQLite database in a temporary directory
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "stepwise-diagrams")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	database, err := gorm.Open("sqlite3", filepath.Join(dir, "diagrams.db"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+
+	database.AutoMigrate(&users.User{}, &bpmn.ProcessDefinition{}, &Diagram{}, &DiagramRevision{})
+	bpmn.Init(database)
+	Init(database)
+	logrus.SetOutput(ioutil.Discard)
+
+	return m.Run()
+}
+
+// createUser returns a user to own and edit diagrams, creating it unless it
+// exists
+func createUser(t *testing.T, name string) *users.User {
+	t.Helper()
+	user := &users.User{}
+	if err := db.Where(&users.User{PrimaryEmail: name + "@example.com"}).
+		Attrs(&users.User{UserName: name, FirstName: name, LastName: name, Organization: "test"}).
+		FirstOrCreate(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// document returns a BPMN document whose process has the name
+func document(name string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<definitions xmlns="http://www.omg.org/spec/BPMN/20100524/MODEL" id="definitions">
+  <process id="process" name="` + name + `" isExecutable="true"><startEvent id="start"/></process>
+</definitions>`
+}
+
+func TestPruneAutoSaves(t *testing.T) {
+	defer func(kept int) { autoSaveRevisions = kept }(autoSaveRevisions)
+	autoSaveRevisions = 2
+
+	owner := createUser(t, "pruner")
+	diagram, err := CreateDiagram(&CreateRequest{Name: "pruned", OwnerID: owner.ID, XML: document("v1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 5; i++ {
+		if _, _, err := SaveDiagram(diagram.ID, &SaveRequest{XML: document(fmt.Sprintf("v%d", i)),
+			UserID: owner.ID, AutoSave: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the revision saved by the user and the latest auto-saves are listed
+	revisions, err := GetRevisions(diagram.ID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := make([]int, 0)
+	for _, revision := range revisions {
+		numbers = append(numbers, revision.Number)
+	}
+	if fmt.Sprint(numbers) != "[5 4 1]" {
+		t.Errorf("listed revisions %v", numbers)
+	}
+
+	// pruned revisions can still be found, compared and restored
+	pruned, err := FindRevision(diagram.ID, 2)
+	if err != nil || pruned.XML != document("v2") {
+		t.Fatalf("pruned revision %v: %v", pruned, err)
+	}
+	diff, err := DiffRevisions(diagram.ID, 3, 5)
+	if err != nil || diff == nil {
+		t.Errorf("diff %+v: %v", diff, err)
+	}
+	restored, created, err := RestoreRevision(diagram.ID, 3, &RestoreRequest{UserID: owner.ID})
+	if err != nil || !created || restored.Revision != 6 || restored.XML != document("v3") {
+		t.Errorf("restored %v %v: %v", restored, created, err)
+	}
+
+	// revisions of other diagrams are not
+	if _, err := FindRevision(diagram.ID+1, 2); err != util.ErrNotFound {
+		t.Errorf("found the revision of a missing diagram: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package dmn
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// Config is the configuration for the decision API
+type Config struct {
+	ResultsPerPage int `mapstructure:"default-results-per-page"`
+}
+
+// EvaluateRequest the variables to evaluate a decision against
+type EvaluateRequest struct {
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Register the decision API
+func Register(e *echo.Group, config *Config) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+
+	/*
+	 * get decision definitions
+	 *   offset - [int] (default: 0) offset into the index
+	 *   limit  - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit int
+
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		defs, err := GetDecisionDefinitions(offset, limit)
+		if err != nil {
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, defs)
+	})
+
+	/*
+	 * deploy a DMN document, either as the "file" part of a multipart form or
+	 * as the raw XML request body. Redeploying identical XML is a no-op.
+	 *   name - [string] (default: decision.dmn) resource name of a raw upload
+	 */
+	e.POST("", func(c echo.Context) error {
+		name, data, err := resource.ReadUpload(c, "decision.dmn")
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		deployed, created, err := Deploy(name, data)
+		if err != nil {
+			if invalid, isInvalid := err.(*ValidationError); isInvalid {
+				return resource.BadRequest(invalid.Issues)
+			}
+			return resource.BadRequest(err)
+		}
+		if !created {
+			return c.JSON(http.StatusOK, deployed)
+		}
+		return c.JSON(http.StatusCreated, deployed)
+	})
+
+	/*
+	 * evaluate the latest version of a decision, returning a list with the
+	 * outputs of each result keyed by output name
+	 */
+	e.POST("/:key/evaluate", func(c echo.Context) error {
+		var key string
+
+		if err := resource.Param("key").InPath().String(c, &key); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &EvaluateRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		results, err := EvaluateDecision(key, req.Variables)
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.BadRequest(err)
+		}
+		return c.JSON(http.StatusOK, results)
+	})
+
+	/*
+	 * get the latest version of a decision definition
+	 */
+	e.GET("/key/:key", func(c echo.Context) error {
+		var key string
+
+		if err := resource.Param("key").InPath().String(c, &key); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		def, err := FindLatestDecisionDefinition(key)
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, def)
+	})
+
+	/*
+	 * get a decision definition by key and version
+	 */
+	e.GET("/key/:key/version/:version", func(c echo.Context) error {
+		var key string
+		var version int
+
+		if err := resource.Param("key").InPath().String(c, &key); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("version").InPath().Int(c, &version); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		def, err := FindDecisionDefinitionByKey(key, version)
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, def)
+	})
+
+	/*
+	 * download the DMN XML of a decision definition
+	 */
+	e.GET("/:id/xml", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		def, err := FindDecisionDefinition(uint(id))
+		if err != nil {
+			if err == util.ErrNotFound {
+				return resource.NotFound(err)
+			}
+			return resource.InternalServerError(err)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition,
+			fmt.Sprintf("attachment; filename=%q", def.ResourceName))
+		return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, []byte(def.XML))
+	})
+
+	resource.GetMethod(e, GetDecisionDefinition)
+	resource.DeleteMethod(e, DeleteDecisionDefinition)
+}
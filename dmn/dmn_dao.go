@@ -0,0 +1,202 @@
+package dmn
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/util"
+)
+
+var (
+	db *gorm.DB
+
+	// parsed and validated decisions keyed by decision definition id
+	decisionCache     = make(map[uint]*Decision)
+	decisionCacheLock sync.RWMutex
+
+	// serializes the assignment of definition versions
+	deployLock sync.Mutex
+)
+
+// TableName for decision definitions
+func (DecisionDefinition) TableName() string {
+	return "decision_definitions"
+}
+
+// VersionOf returns the version of the decision definition, the hash of its
+// XML and whether it is deleted
+func (def *DecisionDefinition) VersionOf() (int, string, bool) {
+	return def.Version, def.Hash, def.DeletedAt != nil
+}
+
+// Init sets the database used to store decision definitions
+func Init(database *gorm.DB) {
+	db = database
+}
+
+// Deploy parses the DMN document and stores a new version of the decision
+// definition for each decision within it. A decision whose latest version was
+// deployed from identical XML is left as is. The definitions are returned
+// along with whether any new version was created.
+func Deploy(resourceName string, data []byte) ([]*DecisionDefinition, bool, error) {
+	definitions, err := ParseBytes(data)
+	if err != nil {
+		return nil, false, err
+	}
+	issues := make([]string, 0)
+	for _, decision := range definitions.Decisions {
+		issues = append(issues, decision.Validate()...)
+	}
+	if len(issues) > 0 {
+		return nil, false, &ValidationError{issues}
+	}
+
+	hash := util.ContentHash(data)
+
+	deployLock.Lock()
+	defer deployLock.Unlock()
+
+	deployed := make([]*DecisionDefinition, 0)
+	created := false
+	tx := db.Begin()
+	for _, decision := range definitions.Decisions {
+		latest := &DecisionDefinition{}
+		version, err := util.NextVersion(tx, latest, decision.ID, hash)
+		if err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		if version == 0 {
+			deployed = append(deployed, latest)
+			continue
+		}
+
+		def := &DecisionDefinition{
+			Key:          decision.ID,
+			Version:      version,
+			Name:         decision.Name,
+			HitPolicy:    string(decision.Table.HitPolicy),
+			ResourceName: resourceName,
+			XML:          string(data),
+			Hash:         hash,
+		}
+		if err := tx.Create(def).Error; err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		deployed = append(deployed, def)
+		created = true
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, false, err
+	}
+	return deployed, created, nil
+}
+
+// FindDecisionDefinition returns the decision definition with the given id
+func FindDecisionDefinition(id uint) (*DecisionDefinition, error) {
+	def := &DecisionDefinition{}
+	if err := db.First(def, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// LoadDecision returns the parsed and validated decision of a decision
+// definition
+func LoadDecision(def *DecisionDefinition) (*Decision, error) {
+	decisionCacheLock.RLock()
+	decision, cached := decisionCache[def.ID]
+	decisionCacheLock.RUnlock()
+	if cached {
+		return decision, nil
+	}
+
+	definitions, err := ParseBytes([]byte(def.XML))
+	if err != nil {
+		return nil, err
+	}
+	if decision = definitions.Decision(def.Key); decision == nil {
+		return nil, fmt.Errorf("Decision %s not found in definition %d", def.Key, def.ID)
+	}
+	if issues := decision.Validate(); len(issues) > 0 {
+		return nil, &ValidationError{issues}
+	}
+
+	decisionCacheLock.Lock()
+	decisionCache[def.ID] = decision
+	decisionCacheLock.Unlock()
+	return decision, nil
+}
+
+// EvaluateDecision evaluates the latest version of the decision with the
+// given key against the variables
+func EvaluateDecision(key string, vars map[string]interface{}) ([]Result, error) {
+	def, err := FindLatestDecisionDefinition(key)
+	if err != nil {
+		return nil, err
+	}
+	decision, err := LoadDecision(def)
+	if err != nil {
+		return nil, err
+	}
+	return decision.Evaluate(vars)
+}
+
+// GetDecisionDefinitions returns a page of decision definitions
+func GetDecisionDefinitions(offset int, limit int) ([]*DecisionDefinition, error) {
+	defs := make([]*DecisionDefinition, 0)
+	if err := db.Order("key, version").Offset(offset).Limit(limit).Find(&defs).Error; err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// GetDecisionDefinition returns a specific decision definition
+func GetDecisionDefinition(id int) (util.Entity, error) {
+	return FindDecisionDefinition(uint(id))
+}
+
+// FindDecisionDefinitionByKey returns the decision definition with the given key and version
+func FindDecisionDefinitionByKey(key string, version int) (*DecisionDefinition, error) {
+	def := &DecisionDefinition{}
+	if err := db.Where(&DecisionDefinition{Key: key, Version: version}).First(def).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// FindLatestDecisionDefinition returns the latest version of the decision definition with the given key
+func FindLatestDecisionDefinition(key string) (*DecisionDefinition, error) {
+	def := &DecisionDefinition{}
+	if err := db.Where("key = ?", key).Order("version desc").First(def).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// DeleteDecisionDefinition deletes the decision definition with the specified ID
+func DeleteDecisionDefinition(id int) error {
+	def, err := FindDecisionDefinition(uint(id))
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(def).Error; err != nil {
+		return err
+	}
+
+	decisionCacheLock.Lock()
+	delete(decisionCache, def.ID)
+	decisionCacheLock.Unlock()
+	return nil
+}
@@ -0,0 +1,329 @@
+package dmn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// ValidationError lists the issues that prevent a DMN document from being deployed
+type ValidationError struct {
+	Issues []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Issues, "; ")
+}
+
+// Result the outputs of a matched rule keyed by output name
+type Result map[string]interface{}
+
+// Validate compiles the expressions and tests of the decision table,
+// returning the issues that prevent it from being evaluated
+func (d *Decision) Validate() []string {
+	response := make([]string, 0)
+	table := d.Table
+
+	switch table.HitPolicy {
+	case Unique, First, Any, RuleOrder:
+	case Priority:
+		prioritized := false
+		for _, output := range table.Outputs {
+			prioritized = prioritized || output.Values != ""
+		}
+		if !prioritized {
+			response = append(response, fmt.Sprintf("Decision %s needs output values to prioritize its rules", d.ID))
+		}
+	case Collect:
+		switch table.Aggregation {
+		case "":
+		case Sum, Min, Max, Count:
+			if len(table.Outputs) != 1 {
+				response = append(response, fmt.Sprintf("Decision %s aggregates its rules so it must have a single output", d.ID))
+			}
+		default:
+			response = append(response, fmt.Sprintf("Aggregation %s of decision %s is not one of SUM, MIN, MAX or COUNT",
+				table.Aggregation, d.ID))
+		}
+	default:
+		response = append(response, fmt.Sprintf("Hit policy %s of decision %s is not supported", table.HitPolicy, d.ID))
+	}
+	if table.Aggregation != "" && table.HitPolicy != Collect {
+		response = append(response, fmt.Sprintf("Decision %s aggregates its rules but its hit policy is %s",
+			d.ID, table.HitPolicy))
+	}
+
+	names := make(map[string]bool)
+	for _, output := range table.Outputs {
+		name := output.name(d)
+		if len(table.Outputs) > 1 && output.Name == "" {
+			response = append(response, fmt.Sprintf("Output %s of decision %s has no name", output.ID, d.ID))
+		}
+		if names[name] {
+			response = append(response, fmt.Sprintf("Duplicate output %s of decision %s", name, d.ID))
+		}
+		names[name] = true
+
+		output.values = make([]*expr.Expression, 0)
+		if output.Values != "" {
+			for _, value := range splitTests(output.Values) {
+				compiled, err := expr.Compile(value)
+				if err != nil {
+					response = append(response, fmt.Sprintf("Output values of %s of decision %s: %s", name, d.ID, err))
+					continue
+				}
+				output.values = append(output.values, compiled)
+			}
+		}
+		if output.Default != "" {
+			compiled, err := expr.Compile(output.Default)
+			if err != nil {
+				response = append(response, fmt.Sprintf("Default output of %s of decision %s: %s", name, d.ID, err))
+			}
+			output.defaultEntry = compiled
+		}
+	}
+
+	for i, input := range table.Inputs {
+		compiled, err := expr.Compile(input.Expression)
+		if err != nil {
+			response = append(response, fmt.Sprintf("Input %d of decision %s: %s", i+1, d.ID, err))
+		}
+		input.compiled = compiled
+	}
+
+	for i, rule := range table.Rules {
+		rule.tests = make([]*unaryTests, len(rule.InputEntries))
+		for j, entry := range rule.InputEntries {
+			tests, err := compileUnaryTests(entry)
+			if err != nil {
+				response = append(response, fmt.Sprintf("Input entry %d of rule %d of decision %s: %s", j+1, i+1, d.ID, err))
+			}
+			rule.tests[j] = tests
+		}
+		rule.outputs = make([]*expr.Expression, len(rule.OutputEntries))
+		for j, entry := range rule.OutputEntries {
+			if entry == "" {
+				continue
+			}
+			compiled, err := expr.Compile(entry)
+			if err != nil {
+				response = append(response, fmt.Sprintf("Output entry %d of rule %d of decision %s: %s", j+1, i+1, d.ID, err))
+			}
+			rule.outputs[j] = compiled
+		}
+	}
+	d.compiled = len(response) == 0
+	return response
+}
+
+// name returns the name of the output, which a single output of a decision
+// may leave to the decision
+func (output *Output) name(d *Decision) string {
+	if output.Name != "" {
+		return output.Name
+	}
+	return d.ID
+}
+
+// Evaluate the decision table against the given variables. A single hit policy
+// produces at most one result, or the default outputs when no rule matches,
+// while collect and rule order produce a result per matching rule. A collect
+// with an aggregation produces a single result holding the aggregate.
+func (d *Decision) Evaluate(vars map[string]interface{}) ([]Result, error) {
+	if vars == nil {
+		vars = make(map[string]interface{})
+	}
+	if !d.compiled {
+		return nil, fmt.Errorf("Decision %s has not been validated", d.ID)
+	}
+	table := d.Table
+
+	inputs := make([]interface{}, len(table.Inputs))
+	for i, input := range table.Inputs {
+		value, err := input.compiled.Evaluate(vars)
+		if err != nil {
+			return nil, fmt.Errorf("Input %s: %s", input.Expression, err)
+		}
+		inputs[i] = value
+	}
+
+	results := make([]Result, 0)
+	for i, rule := range table.Rules {
+		matches, err := rule.matches(inputs, vars)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %s", i+1, err)
+		}
+		if !matches {
+			continue
+		}
+		result, err := d.outputs(rule, vars)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %s", i+1, err)
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 && singleHit[table.HitPolicy] {
+		return d.defaults(vars)
+	}
+
+	switch table.HitPolicy {
+	case Unique:
+		if len(results) > 1 {
+			return nil, fmt.Errorf("Decision %s has the unique hit policy but %d rules matched", d.ID, len(results))
+		}
+	case First:
+		results = results[:1]
+	case Any:
+		for _, result := range results[1:] {
+			if !sameResult(results[0], result) {
+				return nil, fmt.Errorf("Decision %s has the any hit policy but the matching rules have different outputs", d.ID)
+			}
+		}
+		results = results[:1]
+	case Priority:
+		priorities := make([][]int, len(results))
+		for i, result := range results {
+			priority, err := d.priority(result, vars)
+			if err != nil {
+				return nil, err
+			}
+			priorities[i] = priority
+		}
+		sort.SliceStable(results, func(i, j int) bool {
+			for k := range priorities[i] {
+				if priorities[i][k] != priorities[j][k] {
+					return priorities[i][k] < priorities[j][k]
+				}
+			}
+			return false
+		})
+		results = results[:1]
+	case Collect:
+		if table.Aggregation != "" {
+			return d.aggregate(results)
+		}
+	}
+	return results, nil
+}
+
+// matches tells whether every input entry of the rule matches its input
+func (rule *Rule) matches(inputs []interface{}, vars map[string]interface{}) (bool, error) {
+	for i, tests := range rule.tests {
+		matches, err := tests.matches(inputs[i], vars)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// outputs evaluates the output entries of a matched rule
+func (d *Decision) outputs(rule *Rule, vars map[string]interface{}) (Result, error) {
+	result := make(Result)
+	for i, output := range d.Table.Outputs {
+		var value interface{}
+		if rule.outputs[i] != nil {
+			var err error
+			if value, err = rule.outputs[i].Evaluate(vars); err != nil {
+				return nil, fmt.Errorf("Output %s: %s", output.name(d), err)
+			}
+		}
+		result[output.name(d)] = value
+	}
+	return result, nil
+}
+
+// defaults returns the default outputs as the single result of a decision
+// where no rule matched, or no result when there are no defaults
+func (d *Decision) defaults(vars map[string]interface{}) ([]Result, error) {
+	result := make(Result)
+	found := false
+	for _, output := range d.Table.Outputs {
+		var value interface{}
+		if output.defaultEntry != nil {
+			var err error
+			if value, err = output.defaultEntry.Evaluate(vars); err != nil {
+				return nil, fmt.Errorf("Default output %s: %s", output.name(d), err)
+			}
+			found = true
+		}
+		result[output.name(d)] = value
+	}
+	if !found {
+		return make([]Result, 0), nil
+	}
+	return []Result{result}, nil
+}
+
+// priority returns the position of each output of the result within the
+// output values of its output, where values that are not listed come last and
+// outputs without values do not count
+func (d *Decision) priority(result Result, vars map[string]interface{}) ([]int, error) {
+	priority := make([]int, len(d.Table.Outputs))
+	for i, output := range d.Table.Outputs {
+		priority[i] = len(output.values)
+		for j, candidate := range output.values {
+			value, err := candidate.Evaluate(vars)
+			if err != nil {
+				return nil, fmt.Errorf("Output values of %s: %s", output.name(d), err)
+			}
+			if expr.Equal(value, result[output.name(d)]) {
+				priority[i] = j
+				break
+			}
+		}
+	}
+	return priority, nil
+}
+
+// aggregate combines the single output of the results
+func (d *Decision) aggregate(results []Result) ([]Result, error) {
+	name := d.Table.Outputs[0].name(d)
+	values := make([]float64, 0)
+	for _, result := range results {
+		switch value := result[name].(type) {
+		case nil:
+		case float64:
+			values = append(values, value)
+		default:
+			if d.Table.Aggregation != Count {
+				return nil, fmt.Errorf("Decision %s cannot aggregate the output %v as it is not a number", d.ID, value)
+			}
+			values = append(values, 0)
+		}
+	}
+
+	var aggregate interface{}
+	switch d.Table.Aggregation {
+	case Count:
+		aggregate = float64(len(values))
+	case Sum:
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		aggregate = sum
+	case Min, Max:
+		for _, value := range values {
+			if aggregate == nil || (d.Table.Aggregation == Min && value < aggregate.(float64)) ||
+				(d.Table.Aggregation == Max && value > aggregate.(float64)) {
+				aggregate = value
+			}
+		}
+	}
+	return []Result{{name: aggregate}}, nil
+}
+
+// sameResult tells whether two results have equal outputs
+func sameResult(a Result, b Result) bool {
+	for name, value := range a {
+		if !expr.Equal(value, b[name]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+package dmn
+
+import (
+	"github.com/sterrasi/stepwise/util"
+)
+
+// DecisionDefinition a deployed DMN decision table
+type DecisionDefinition struct {
+	util.EntityImpl
+	Key       string `gorm:"type:varchar(255);unique_index:idx_decision_definition_version;not null"`
+	Version   int    `gorm:"unique_index:idx_decision_definition_version;not null"`
+	Name      string `gorm:"type:varchar(255)"`
+	HitPolicy string `gorm:"type:varchar(20);not null"`
+
+	// name of the deployed resource, its DMN XML and the SHA-256 of the XML
+	ResourceName string `gorm:"type:varchar(255)"`
+	XML          string `gorm:"type:text;not null" json:"-"`
+	Hash         string `gorm:"type:varchar(64);index;not null"`
+}
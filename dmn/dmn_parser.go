@@ -0,0 +1,171 @@
+package dmn
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xmlElement is a generic XML element, decoded into a tree first and then
+// interpreted by local name
+type xmlElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr    `xml:",any,attr"`
+	Content  string        `xml:",chardata"`
+	Children []*xmlElement `xml:",any"`
+}
+
+func (e *xmlElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (e *xmlElement) child(name string) *xmlElement {
+	for _, c := range e.Children {
+		if c.XMLName.Local == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (e *xmlElement) children(name string) []*xmlElement {
+	matched := make([]*xmlElement, 0)
+	for _, c := range e.Children {
+		if c.XMLName.Local == name {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// text returns the content of the text child of the element, which is how
+// DMN wraps expressions and unary tests
+func (e *xmlElement) text() string {
+	if e == nil {
+		return ""
+	}
+	if t := e.child("text"); t != nil {
+		return strings.TrimSpace(t.Content)
+	}
+	return ""
+}
+
+// Parse reads a DMN 1.3 XML document. Only decisions made by decision tables
+// are supported.
+func Parse(r io.Reader) (*Definitions, error) {
+	root := &xmlElement{}
+	if err := xml.NewDecoder(r).Decode(root); err != nil {
+		return nil, fmt.Errorf("Malformed DMN document: %s", err)
+	}
+	if root.XMLName.Local != "definitions" {
+		return nil, fmt.Errorf("Expected a definitions root element but found %s", root.XMLName.Local)
+	}
+
+	definitions := &Definitions{
+		ID:        root.attr("id"),
+		Name:      root.attr("name"),
+		Decisions: make([]*Decision, 0),
+	}
+	for _, c := range root.children("decision") {
+		decision, err := parseDecision(c)
+		if err != nil {
+			return nil, err
+		}
+		if definitions.Decision(decision.ID) != nil {
+			return nil, fmt.Errorf("Duplicate decision id %s", decision.ID)
+		}
+		definitions.Decisions = append(definitions.Decisions, decision)
+	}
+
+	if len(definitions.Decisions) == 0 {
+		return nil, fmt.Errorf("DMN document does not contain a decision")
+	}
+	return definitions, nil
+}
+
+// ParseBytes reads a DMN 1.3 XML document from a byte slice
+func ParseBytes(data []byte) (*Definitions, error) {
+	return Parse(bytes.NewReader(data))
+}
+
+func parseDecision(e *xmlElement) (*Decision, error) {
+	decision := &Decision{
+		ID:   e.attr("id"),
+		Name: e.attr("name"),
+	}
+	if decision.ID == "" {
+		return nil, fmt.Errorf("Decision id is required")
+	}
+	table := e.child("decisionTable")
+	if table == nil {
+		return nil, fmt.Errorf("Decision %s is not made by a decision table", decision.ID)
+	}
+
+	decision.Table = &DecisionTable{
+		HitPolicy:   HitPolicy(strings.ToUpper(strings.TrimSpace(table.attr("hitPolicy")))),
+		Aggregation: Aggregation(strings.ToUpper(strings.TrimSpace(table.attr("aggregation")))),
+		Inputs:      make([]*Input, 0),
+		Outputs:     make([]*Output, 0),
+		Rules:       make([]*Rule, 0),
+	}
+	if decision.Table.HitPolicy == "" {
+		decision.Table.HitPolicy = Unique
+	}
+
+	for _, c := range table.children("input") {
+		input := &Input{
+			ID:    c.attr("id"),
+			Label: c.attr("label"),
+		}
+		if expression := c.child("inputExpression"); expression != nil {
+			input.Expression = expression.text()
+			input.TypeRef = expression.attr("typeRef")
+		}
+		decision.Table.Inputs = append(decision.Table.Inputs, input)
+	}
+	for _, c := range table.children("output") {
+		decision.Table.Outputs = append(decision.Table.Outputs, &Output{
+			ID:      c.attr("id"),
+			Name:    c.attr("name"),
+			Label:   c.attr("label"),
+			TypeRef: c.attr("typeRef"),
+			Values:  c.child("outputValues").text(),
+			Default: c.child("defaultOutputEntry").text(),
+		})
+	}
+	if len(decision.Table.Outputs) == 0 {
+		return nil, fmt.Errorf("Decision %s has no output", decision.ID)
+	}
+
+	for _, c := range table.children("rule") {
+		rule := &Rule{
+			ID:            c.attr("id"),
+			InputEntries:  make([]string, 0),
+			OutputEntries: make([]string, 0),
+		}
+		if description := c.child("description"); description != nil {
+			rule.Description = strings.TrimSpace(description.Content)
+		}
+		for _, entry := range c.children("inputEntry") {
+			rule.InputEntries = append(rule.InputEntries, entry.text())
+		}
+		for _, entry := range c.children("outputEntry") {
+			rule.OutputEntries = append(rule.OutputEntries, entry.text())
+		}
+		if len(rule.InputEntries) != len(decision.Table.Inputs) ||
+			len(rule.OutputEntries) != len(decision.Table.Outputs) {
+			return nil, fmt.Errorf("Rule %s of decision %s has %d input and %d output entries but the table has %d inputs and %d outputs",
+				rule.ID, decision.ID, len(rule.InputEntries), len(rule.OutputEntries),
+				len(decision.Table.Inputs), len(decision.Table.Outputs))
+		}
+		decision.Table.Rules = append(decision.Table.Rules, rule)
+	}
+	return decision, nil
+}
@@ -0,0 +1,131 @@
+package dmn
+
+import (
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// HitPolicy decides which of the matching rules of a decision table make up
+// its result
+type HitPolicy string
+
+const (
+
+	// Unique at most one rule may match
+	Unique HitPolicy = "UNIQUE"
+
+	// First the first matching rule in rule order
+	First HitPolicy = "FIRST"
+
+	// Priority the matching rule whose outputs come first in the output values
+	Priority HitPolicy = "PRIORITY"
+
+	// Any every matching rule must have the same outputs
+	Any HitPolicy = "ANY"
+
+	// Collect every matching rule in rule order, optionally aggregated
+	Collect HitPolicy = "COLLECT"
+
+	// RuleOrder every matching rule in rule order
+	RuleOrder HitPolicy = "RULE ORDER"
+)
+
+// hit policies that produce a single result
+var singleHit = map[HitPolicy]bool{
+	Unique:   true,
+	First:    true,
+	Priority: true,
+	Any:      true,
+}
+
+// Aggregation combines the single output of the rules matched by a decision
+// table with the collect hit policy
+type Aggregation string
+
+const (
+
+	// Sum adds up the outputs
+	Sum Aggregation = "SUM"
+
+	// Min is the smallest output
+	Min Aggregation = "MIN"
+
+	// Max is the largest output
+	Max Aggregation = "MAX"
+
+	// Count is the number of outputs
+	Count Aggregation = "COUNT"
+)
+
+// Definitions the decisions of a DMN document
+type Definitions struct {
+	ID        string
+	Name      string
+	Decisions []*Decision
+}
+
+// Decision returns the decision with the given id, or nil
+func (d *Definitions) Decision(id string) *Decision {
+	for _, decision := range d.Decisions {
+		if decision.ID == id {
+			return decision
+		}
+	}
+	return nil
+}
+
+// Decision a decision made by a decision table
+type Decision struct {
+	ID    string
+	Name  string
+	Table *DecisionTable
+
+	// the table was validated without issues and can be evaluated
+	compiled bool
+}
+
+// DecisionTable maps its inputs onto its outputs with rules, each of which
+// matches when every one of its input entries matches the value of its input
+type DecisionTable struct {
+	HitPolicy   HitPolicy
+	Aggregation Aggregation
+	Inputs      []*Input
+	Outputs     []*Output
+	Rules       []*Rule
+}
+
+// Input an input column, whose expression is evaluated with the variables
+// the decision is evaluated with
+type Input struct {
+	ID         string
+	Label      string
+	Expression string
+	TypeRef    string
+
+	compiled *expr.Expression
+}
+
+// Output an output column. Output values list the possible values in order of
+// priority, while the default is the output when no rule matches.
+type Output struct {
+	ID      string
+	Name    string
+	Label   string
+	TypeRef string
+	Values  string
+	Default string
+
+	values       []*expr.Expression
+	defaultEntry *expr.Expression
+}
+
+// Rule a row of a decision table. Input entries are unary tests of the value
+// of their input and output entries are expressions.
+type Rule struct {
+	ID            string
+	Description   string
+	InputEntries  []string
+	OutputEntries []string
+
+	tests   []*unaryTests
+	outputs []*expr.Expression
+}
@@ -0,0 +1,214 @@
+package dmn
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// unaryTests a compiled input entry, which is "-" to match any value, a comma
+// separated list of tests that matches when any test does, or such a list
+// wrapped in not(...). A test is a comparison such as "< 10", a range such as
+// "[1..10]" or "]1..10[" with open or closed ends, or an expression the value
+// must equal. The endpoints of tests are expressions evaluated with the
+// variables the decision is evaluated with.
+type unaryTests struct {
+	any    bool
+	negate bool
+	tests  []*unaryTest
+}
+
+// unaryTest a single comparison or range
+type unaryTest struct {
+	op       string
+	endpoint *expr.Expression
+
+	// upper end of a range, whose lower end is the endpoint
+	high              *expr.Expression
+	lowOpen, highOpen bool
+}
+
+// comparisons of the input with the endpoint of a test, evaluated by the
+// expression language so that numbers, strings and dates order the same way
+var comparisons = map[string]*expr.Expression{}
+
+func init() {
+	for _, op := range []string{"<", "<=", ">", ">="} {
+		comparison, err := expr.Compile("input " + op + " endpoint")
+		if err != nil {
+			panic(err)
+		}
+		comparisons[op] = comparison
+	}
+}
+
+// compileUnaryTests compiles an input entry
+func compileUnaryTests(source string) (*unaryTests, error) {
+	source = strings.TrimSpace(source)
+	if source == "" || source == "-" {
+		return &unaryTests{any: true}, nil
+	}
+
+	u := &unaryTests{tests: make([]*unaryTest, 0)}
+	if strings.HasPrefix(source, "not(") && strings.HasSuffix(source, ")") {
+		u.negate = true
+		source = strings.TrimSpace(source[4 : len(source)-1])
+	}
+	for _, part := range splitTests(source) {
+		test, err := compileUnaryTest(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		u.tests = append(u.tests, test)
+	}
+	return u, nil
+}
+
+func compileUnaryTest(source string) (*unaryTest, error) {
+	if source == "" {
+		return nil, fmt.Errorf("Empty test")
+	}
+
+	// ranges are bracketed and have their endpoints separated by ..
+	if strings.ContainsAny(source[:1], "[(]") && strings.ContainsAny(source[len(source)-1:], "])[") {
+		if separator := topLevelIndex(source, ".."); separator > 0 {
+			low, err := expr.Compile(source[1:separator])
+			if err != nil {
+				return nil, err
+			}
+			high, err := expr.Compile(source[separator+2 : len(source)-1])
+			if err != nil {
+				return nil, err
+			}
+			return &unaryTest{
+				op:       "range",
+				endpoint: low,
+				high:     high,
+				lowOpen:  source[0] != '[',
+				highOpen: source[len(source)-1] != ']',
+			}, nil
+		}
+	}
+
+	op := "=="
+	for _, prefix := range []string{"<=", ">=", "<", ">"} {
+		if strings.HasPrefix(source, prefix) {
+			op = prefix
+			source = source[len(prefix):]
+			break
+		}
+	}
+	endpoint, err := expr.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	return &unaryTest{op: op, endpoint: endpoint}, nil
+}
+
+// matches tells whether the value of the input passes the tests
+func (u *unaryTests) matches(input interface{}, vars map[string]interface{}) (bool, error) {
+	if u.any {
+		return true, nil
+	}
+	for _, test := range u.tests {
+		matched, err := test.matches(input, vars)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return !u.negate, nil
+		}
+	}
+	return u.negate, nil
+}
+
+func (test *unaryTest) matches(input interface{}, vars map[string]interface{}) (bool, error) {
+	endpoint, err := test.endpoint.Evaluate(vars)
+	if err != nil {
+		return false, err
+	}
+
+	switch test.op {
+	case "==":
+		return expr.Equal(input, endpoint), nil
+	case "range":
+		high, err := test.high.Evaluate(vars)
+		if err != nil {
+			return false, err
+		}
+		lowOp, highOp := ">=", "<="
+		if test.lowOpen {
+			lowOp = ">"
+		}
+		if test.highOpen {
+			highOp = "<"
+		}
+		above, err := compare(lowOp, input, endpoint)
+		if err != nil || !above {
+			return false, err
+		}
+		return compare(highOp, input, high)
+	}
+	return compare(test.op, input, endpoint)
+}
+
+// compare orders the input against an endpoint
+func compare(op string, input interface{}, endpoint interface{}) (bool, error) {
+	return comparisons[op].EvaluateBool(map[string]interface{}{"input": input, "endpoint": endpoint})
+}
+
+// splitTests splits a list of tests on the commas that are outside of
+// strings, calls and ranges
+func splitTests(source string) []string {
+	parts := make([]string, 0)
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range source {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(' || r == '[':
+			// the open upper end of a range closes it
+			rest := strings.TrimSpace(source[i+1:])
+			if r == '[' && depth > 0 && (rest == "" || strings.HasPrefix(rest, ",")) {
+				depth--
+			} else {
+				depth++
+			}
+		case r == ')' || r == ']':
+			// the open lower end of a range starts it
+			if r == ']' && strings.TrimSpace(source[start:i]) == "" {
+				depth++
+			} else {
+				depth--
+			}
+		case r == ',' && depth == 0:
+			parts = append(parts, source[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, source[start:])
+}
+
+// topLevelIndex returns the index of the separator outside of strings, or -1
+func topLevelIndex(source string, separator string) int {
+	var quote rune
+	for i, r := range source {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case strings.HasPrefix(source[i:], separator):
+			return i
+		}
+	}
+	return -1
+}
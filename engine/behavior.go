@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// behavior implements the execution semantics of a type of flow node
+type behavior interface {
+
+	// execute is called once a token becomes active on the flow node
+	execute(x *execution, t *Token, node *bpmn.FlowNode) error
+
+	// leave is called once the flow node has completed to move the token on
+	leave(x *execution, t *Token, node *bpmn.FlowNode) error
+}
+
+// waitState is implemented by behaviors that hold a token until it is triggered
+type waitState interface {
+	trigger(x *execution, t *Token, node *bpmn.FlowNode, variables map[string]interface{}) error
+}
+
+var behaviors = map[bpmn.ElementType]behavior{
+	bpmn.StartEvent: passThroughBehavior{},
+	bpmn.EndEvent:   endEventBehavior{},
+
+	// none intermediate events only mark a state of the process
+	bpmn.IntermediateThrowEvent: passThroughBehavior{},
+
+	bpmn.Task:             passThroughBehavior{},
+	bpmn.ManualTask:       passThroughBehavior{},
+	bpmn.ServiceTask:      serviceTaskBehavior{},
+	bpmn.ScriptTask:       scriptTaskBehavior{},
+	bpmn.SendTask:         passThroughBehavior{},
+	bpmn.BusinessRuleTask: businessRuleTaskBehavior{},
+	bpmn.UserTask:         userTaskBehavior{},
+	bpmn.SubProcess:       subProcessBehavior{},
+	bpmn.Transaction:      subProcessBehavior{},
+	bpmn.CallActivity:     callActivityBehavior{},
+	bpmn.ReceiveTask:      waitStateBehavior{},
+	bpmn.ExclusiveGateway: exclusiveGatewayBehavior{},
+	bpmn.ParallelGateway:  parallelGatewayBehavior{},
+	bpmn.InclusiveGateway: inclusiveGatewayBehavior{},
+}
+
+// behaviors of events with an event definition by element and event type
+var eventBehaviors = map[bpmn.ElementType]map[bpmn.EventType]behavior{
+	bpmn.StartEvent: {
+		bpmn.TimerEvent:      passThroughBehavior{},
+		bpmn.MessageEvent:    passThroughBehavior{},
+		bpmn.SignalEvent:     passThroughBehavior{},
+		bpmn.ErrorEvent:      passThroughBehavior{},
+		bpmn.EscalationEvent: passThroughBehavior{},
+	},
+	bpmn.EndEvent: {
+		bpmn.MessageEvent:    messageThrowBehavior{end: true},
+		bpmn.SignalEvent:     signalThrowBehavior{end: true},
+		bpmn.ErrorEvent:      errorEndBehavior{},
+		bpmn.EscalationEvent: escalationThrowBehavior{end: true},
+		bpmn.CompensateEvent: compensateThrowBehavior{},
+		bpmn.CancelEvent:     compensateThrowBehavior{},
+	},
+	bpmn.IntermediateCatchEvent: {
+		bpmn.TimerEvent:   timerCatchBehavior{},
+		bpmn.MessageEvent: subscriptionCatchBehavior{},
+		bpmn.SignalEvent:  subscriptionCatchBehavior{},
+	},
+	bpmn.IntermediateThrowEvent: {
+		bpmn.MessageEvent:    messageThrowBehavior{},
+		bpmn.SignalEvent:     signalThrowBehavior{},
+		bpmn.EscalationEvent: escalationThrowBehavior{},
+		bpmn.CompensateEvent: compensateThrowBehavior{},
+	},
+	bpmn.BoundaryEvent: {
+		bpmn.TimerEvent:      timerBoundaryBehavior{},
+		bpmn.MessageEvent:    subscriptionBoundaryBehavior{},
+		bpmn.SignalEvent:     subscriptionBoundaryBehavior{},
+		bpmn.ErrorEvent:      catchingBoundaryBehavior{},
+		bpmn.EscalationEvent: catchingBoundaryBehavior{},
+		bpmn.CompensateEvent: catchingBoundaryBehavior{},
+		bpmn.CancelEvent:     catchingBoundaryBehavior{},
+	},
+	bpmn.ReceiveTask: {
+		bpmn.MessageEvent: subscriptionCatchBehavior{},
+	},
+	bpmn.SendTask: {
+		bpmn.MessageEvent: messageThrowBehavior{},
+	},
+}
+
+// boundaryEvent is implemented by the behaviors of boundary events, which are
+// attached to every token that becomes active on their activity
+type boundaryEvent interface {
+	attach(x *execution, t *Token, boundary *bpmn.FlowNode) error
+}
+
+func behaviorOf(node *bpmn.FlowNode) (behavior, error) {
+	if node.Event != nil {
+		b, exists := eventBehaviors[node.Type][node.Event.Type]
+		if !exists {
+			return nil, fmt.Errorf("%s event %s of type %s is not supported", node.Event.Type, node.ID, node.Type)
+		}
+		return b, nil
+	}
+	b, exists := behaviors[node.Type]
+	if !exists {
+		return nil, fmt.Errorf("Element %s of type %s is not supported", node.ID, node.Type)
+	}
+	return b, nil
+}
+
+// validateSupported reports the flow nodes of an executable process that the
+// engine has no behavior for
+func validateSupported(process *bpmn.Process) []*bpmn.Issue {
+	issues := make([]*bpmn.Issue, 0)
+	if !process.IsExecutable {
+		return issues
+	}
+	for _, node := range process.Nodes {
+		if _, err := behaviorOf(node); err != nil {
+			issues = append(issues, &bpmn.Issue{
+				ProcessID: process.ID,
+				ElementID: node.ID,
+				Severity:  bpmn.SeverityError,
+				Message:   err.Error(),
+			})
+		}
+	}
+	return issues
+}
+
+// takeOutgoing leaves a flow node along every outgoing flow whose condition
+// holds, or along its default flow when none does
+type takeOutgoing struct{}
+
+func (takeOutgoing) leave(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.takeSelected(t, node, false)
+}
+
+// passThroughBehavior completes as soon as it is executed
+type passThroughBehavior struct {
+	takeOutgoing
+}
+
+func (passThroughBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.complete(t)
+}
+
+// waitStateBehavior holds the token until it is triggered
+type waitStateBehavior struct {
+	takeOutgoing
+}
+
+func (waitStateBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return nil
+}
+
+func (waitStateBehavior) trigger(x *execution, t *Token, node *bpmn.FlowNode, variables map[string]interface{}) error {
+	if err := x.setVariables(variables); err != nil {
+		return err
+	}
+	return x.complete(t)
+}
+
+// endEventBehavior ends the path of the token
+type endEventBehavior struct {
+	takeOutgoing
+}
+
+func (endEventBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.end(t)
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// callActivityBehavior starts an instance of the called process, passing it
+// the in variables, and waits for it to complete. The called instance runs
+// within the same transaction and links back to the token of the activity.
+type callActivityBehavior struct {
+	takeOutgoing
+}
+
+func (callActivityBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	def, err := x.calledDefinition(node.Call)
+	if err != nil {
+		return err
+	}
+	if def == nil {
+		return x.raiseIncident(t, IncidentCall, fmt.Sprintf("No %s version of process %s to call from %s",
+			node.Call.Binding, node.Call.Key, node.ID))
+	}
+	process, err := bpmn.LoadProcess(def)
+	if err != nil {
+		return err
+	}
+	start := process.NoneStartEvent()
+	if start == nil {
+		return x.raiseIncident(t, IncidentCall, fmt.Sprintf("Process %s called from %s does not have a none start event",
+			process.ID, node.ID))
+	}
+
+	vars, err := x.variables(t)
+	if err != nil {
+		return err
+	}
+	in, err := passVariables(node.Call.AllIn, node.Call.In, vars)
+	if err != nil {
+		return x.raiseIncident(t, IncidentExpression, fmt.Sprintf("In mapping of %s: %s", node.ID, err))
+	}
+
+	called := newInstance(def, x.instance.TenantID, x.instance.BusinessKey)
+	called.ParentInstanceID = x.instance.ID
+	called.ParentTokenID = t.ID
+	return startAt(x.tx, called, start, in, x)
+}
+
+// calledDefinition returns the definition selected by the binding of the
+// call, or nil when there is none
+func (x *execution) calledDefinition(call *bpmn.CallDefinition) (*bpmn.ProcessDefinition, error) {
+	query := x.tx.Where("key = ?", call.Key)
+	switch call.Binding {
+	case bpmn.BindingDeployment:
+		// definitions deployed from the same document share its hash
+		caller := &bpmn.ProcessDefinition{}
+		if err := x.tx.Unscoped().First(caller, x.instance.DefinitionID).Error; err != nil {
+			return nil, err
+		}
+		query = query.Where("hash = ?", caller.Hash)
+	case bpmn.BindingVersion:
+		query = query.Where("version = ?", call.Version)
+	}
+
+	def := &bpmn.ProcessDefinition{}
+	if err := query.Order("version desc").First(def).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// passVariables returns the variables passed to or from a called instance
+func passVariables(all bool, mappings []*bpmn.Mapping, vars map[string]interface{}) (map[string]interface{}, error) {
+	passed := make(map[string]interface{})
+	if all {
+		for name, value := range vars {
+			passed[name] = value
+		}
+	}
+	for _, m := range mappings {
+		value, err := expr.Evaluate(m.Expression, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Name, err)
+		}
+		passed[m.Name] = value
+	}
+	return passed, nil
+}
+
+// callerExecution returns the execution of the instance that called this one
+// through a call activity. That is the running execution when the call was
+// made from it and a new one otherwise, which this execution runs when it
+// finishes. Nil is returned when the instance was not called or its caller is
+// no longer active.
+func (x *execution) callerExecution() (*execution, error) {
+	if x.caller != nil || x.instance.ParentInstanceID == 0 {
+		return x.caller, nil
+	}
+	instance, err := findInstance(x.tx, x.instance.ParentInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if instance.State != InstanceActive {
+		return nil, nil
+	}
+	caller, err := newExecution(x.tx, instance)
+	if err != nil {
+		return nil, err
+	}
+	x.caller, x.resumesCaller = caller, true
+	return caller, nil
+}
+
+// callToken returns the active call activity token of the caller that
+// started this instance, or nil when it has since moved on
+func (x *execution) callToken(caller *execution) (*Token, error) {
+	t, err := findToken(caller.tx, x.instance.ParentTokenID)
+	if err != nil {
+		return nil, err
+	}
+	if t.State != TokenActive {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// returnToCaller passes the out variables of the completed instance to its
+// caller and completes the call activity that started it
+func (x *execution) returnToCaller() error {
+	caller, err := x.callerExecution()
+	if err != nil || caller == nil {
+		return err
+	}
+	t, err := x.callToken(caller)
+	if err != nil || t == nil {
+		return err
+	}
+	node, err := caller.node(t)
+	if err != nil {
+		return err
+	}
+
+	vars, err := x.vars.visible()
+	if err != nil {
+		return err
+	}
+	out, err := passVariables(node.Call.AllOut, node.Call.Out, vars)
+	if err != nil {
+		return caller.raiseIncident(t, IncidentExpression, fmt.Sprintf("Out mapping of %s: %s", node.ID, err))
+	}
+	for name, value := range out {
+		if err := caller.vars.set(caller.tx, caller.instance.ID, t.ParentID, name, "", value); err != nil {
+			return err
+		}
+	}
+	return caller.complete(t)
+}
+
+// cancelCalled cancels the instances started by the call activity of the
+// token that have not ended
+func (x *execution) cancelCalled(t *Token) error {
+	called := make([]*ProcessInstance, 0)
+	if err := x.tx.Where("parent_token_id = ? AND parent_instance_id = ? AND state IN (?)", t.ID, x.instance.ID,
+		[]string{InstanceActive, InstanceSuspended}).Find(&called).Error; err != nil {
+		return err
+	}
+	for _, instance := range called {
+		reason := fmt.Sprintf("Call activity %s of process instance %d was interrupted", t.ActivityID, x.instance.ID)
+		if err := cancelInstance(x.tx, instance, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
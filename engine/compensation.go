@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// compensateThrowBehavior undoes the completed activities of its scope, or
+// the single activity it references, by running their compensation handlers
+// one after the other in reverse order of completion. The token waits until
+// the last handler has completed. A cancel end event compensates its
+// transaction this way before cancelling it.
+type compensateThrowBehavior struct {
+	takeOutgoing
+}
+
+func (compensateThrowBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	scopeID, err := x.compensationScope(t)
+	if err != nil {
+		return err
+	}
+	claim := x.tx.Model(&Compensation{}).Where("instance_id = ? AND scope_id = ? AND throw_id = 0",
+		x.instance.ID, scopeID)
+	if node.Event.Type == bpmn.CompensateEvent && node.Event.Ref != "" {
+		claim = claim.Where("activity_id = ?", node.Event.Ref)
+	}
+	if err := claim.Update("throw_id", t.ID).Error; err != nil {
+		return err
+	}
+	return x.compensateNext(t.ID)
+}
+
+// compensationScope returns the id of the scope whose activities the event of
+// the token compensates. Within an event subprocess that is the scope the
+// event subprocess belongs to.
+func (x *execution) compensationScope(t *Token) (uint, error) {
+	if t.ParentID == 0 {
+		return 0, nil
+	}
+	scope, err := findToken(x.tx, t.ParentID)
+	if err != nil {
+		return 0, err
+	}
+	node, err := x.node(scope)
+	if err != nil {
+		return 0, err
+	}
+	if node.TriggeredByEvent {
+		return scope.ParentID, nil
+	}
+	return scope.ID, nil
+}
+
+// recordCompensation records the completed activity of the token within the
+// scope when it has a compensation handler, or when it is a subprocess with
+// completed activities of its own to compensate. Compensation handlers are
+// not compensated themselves.
+func (x *execution) recordCompensation(t *Token, node *bpmn.FlowNode, scopeID uint) error {
+	if node.ForCompensation {
+		return nil
+	}
+	record := &Compensation{InstanceID: x.instance.ID, ActivityID: node.ID, ScopeID: scopeID}
+
+	if handler := node.CompensationHandler(); handler != nil {
+		locals, err := x.vars.scope(t.ID)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(locals)
+		if err != nil {
+			return fmt.Errorf("Unable to record the variables of %s for compensation: %s", node.ID, err)
+		}
+		record.HandlerID, record.Variables = handler.ID, string(data)
+
+		// the handler of a subprocess compensates the activities within it
+		if err := x.tx.Unscoped().Where("instance_id = ? AND scope_id = ? AND throw_id = 0",
+			x.instance.ID, t.ID).Delete(&Compensation{}).Error; err != nil {
+			return err
+		}
+		return x.tx.Create(record).Error
+	}
+
+	if !node.Type.IsSubProcess() {
+		return nil
+	}
+	var within int
+	if err := x.tx.Model(&Compensation{}).Where("instance_id = ? AND scope_id = ? AND throw_id = 0",
+		x.instance.ID, t.ID).Count(&within).Error; err != nil {
+		return err
+	}
+	if within == 0 {
+		return nil
+	}
+	record.TokenID = t.ID
+	return x.tx.Create(record).Error
+}
+
+// compensateNext runs the handler of the most recently completed activity
+// that the event of the throw token has yet to compensate. The activities
+// within a subprocess without a handler are compensated in its place. Once
+// none remain the throw token completes, or cancels its transaction.
+func (x *execution) compensateNext(throwID uint) error {
+	throw, err := findToken(x.tx, throwID)
+	if err != nil {
+		return err
+	}
+	// the event may have been interrupted while a handler was running
+	if throw.State != TokenActive {
+		return nil
+	}
+
+	for {
+		record := &Compensation{}
+		err := x.tx.Where("throw_id = ?", throwID).Order("id desc").First(record).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return x.compensated(throw)
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.tx.Unscoped().Delete(record).Error; err != nil {
+			return err
+		}
+
+		if record.HandlerID == "" {
+			if err := x.tx.Model(&Compensation{}).Where("instance_id = ? AND scope_id = ? AND throw_id = 0",
+				x.instance.ID, record.TokenID).Update("throw_id", throwID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		return x.startHandler(throw, record)
+	}
+}
+
+// startHandler enters a token for the compensation handler of the record
+// within the scope of the throw token, giving it the local variables the
+// compensated activity had when it completed
+func (x *execution) startHandler(throw *Token, record *Compensation) error {
+	handler := x.process.Node(record.HandlerID)
+	if handler == nil {
+		return fmt.Errorf("Compensation handler %s not found in process %s", record.HandlerID, x.process.ID)
+	}
+	locals := make(map[string]interface{})
+	if record.Variables != "" {
+		if err := json.Unmarshal([]byte(record.Variables), &locals); err != nil {
+			return fmt.Errorf("Unable to read the variables of %s for compensation: %s", record.ActivityID, err)
+		}
+	}
+
+	t := &Token{ParentID: throw.ParentID, ThrowID: throw.ID}
+	if err := x.enter(t, handler, nil); err != nil {
+		return err
+	}
+	for name, value := range locals {
+		if err := x.vars.set(x.tx, x.instance.ID, t.ID, name, "", value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compensated moves the throw token on once every handler has run. A cancel
+// end event then interrupts its transaction through the cancel boundary
+// event of the transaction.
+func (x *execution) compensated(throw *Token) error {
+	node, err := x.node(throw)
+	if err != nil {
+		return err
+	}
+	if node.Event.Type != bpmn.CancelEvent {
+		return x.complete(throw)
+	}
+
+	transaction, err := findToken(x.tx, throw.ParentID)
+	if err != nil {
+		return err
+	}
+	// boundary events belong to a multi-instance transaction as a whole
+	if transaction.Loop > 0 {
+		if transaction, err = findToken(x.tx, transaction.ParentID); err != nil {
+			return err
+		}
+	}
+	activity, err := x.node(transaction)
+	if err != nil {
+		return err
+	}
+	if boundary := catching(activity.Boundaries, bpmn.CancelEvent, ""); boundary != nil {
+		return x.fireBoundary(transaction, boundary)
+	}
+	return x.interrupt(transaction)
+}
+
+// clearCompensations removes the compensation records of the instance
+func clearCompensations(tx *gorm.DB, instanceID uint) error {
+	return tx.Unscoped().Where("instance_id = ?", instanceID).Delete(&Compensation{}).Error
+}
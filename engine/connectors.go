@@ -0,0 +1,264 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+	"github.com/sterrasi/stepwise/util"
+)
+
+const (
+
+	// timeout of a request made by an HTTP connector that does not set one
+	httpTimeout = 30 * time.Second
+
+	// longest part of a response body kept in the error of a failed request
+	httpErrorBody = 512
+)
+
+// httpResponse is what an HTTP connector received, which is kept in the local
+// variable response of the task so that output mappings can read it
+type httpResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// variable returns the response as an object with the status, the headers
+// and the body, which is decoded when it is JSON
+func (r *httpResponse) variable() map[string]interface{} {
+	headers := make(map[string]interface{})
+	for name := range r.headers {
+		headers[strings.ToLower(name)] = r.headers.Get(name)
+	}
+
+	var body interface{} = string(r.body)
+	if strings.Contains(r.headers.Get("Content-Type"), "json") {
+		var decoded interface{}
+		if err := json.Unmarshal(r.body, &decoded); err == nil {
+			body = decoded
+		}
+	}
+	return map[string]interface{}{
+		"status":  float64(r.status),
+		"headers": headers,
+		"body":    body,
+	}
+}
+
+// connectorJob schedules the request of a service task with an HTTP
+// connector, which the job executor makes outside of the transaction
+func (x *execution) connectorJob(t *Token, node *bpmn.FlowNode) error {
+	retries := node.HTTP.Retries
+	if retries == 0 {
+		retries = jobRetries
+	}
+	return x.tx.Create(&Job{
+		Type:       JobHTTP,
+		InstanceID: x.instance.ID,
+		TokenID:    t.ID,
+		ActivityID: node.ID,
+		DueAt:      time.Now(),
+		Retries:    retries,
+		Backoff:    node.HTTP.RetryBackoff,
+	}).Error
+}
+
+// callHTTP builds the request of an HTTP connector job from the variables
+// visible to its token. Jobs of tokens that have moved on are dropped while
+// those of suspended instances are postponed.
+func callHTTP(tx *gorm.DB, job *Job) (func() jobHandler, error) {
+	x, t, node, err := connectorToken(tx, job)
+	if err != nil || x == nil {
+		return nil, err
+	}
+	connector := node.HTTP
+
+	req, err := x.httpRequest(t, connector)
+	if err != nil {
+		return nil, abandonJob(tx, job, fmt.Errorf("HTTP connector of %s: %s", node.ID, err))
+	}
+	timeout := connector.Timeout
+	if timeout == 0 {
+		timeout = httpTimeout
+	}
+	// the lock is held for the duration of the request on top of the lock
+	// duration of the executor
+	if err := tx.Model(job).Update("lock_expires_at", job.LockExpiresAt.Add(timeout)).Error; err != nil {
+		return nil, err
+	}
+
+	return func() jobHandler {
+		client := &http.Client{Timeout: timeout}
+		response, err := doHTTP(client, req)
+		return func(tx *gorm.DB, job *Job) (bool, error) {
+			if err != nil {
+				return false, fmt.Errorf("%s %s: %s", req.Method, req.URL, err)
+			}
+			return handleResponse(tx, job, req, response)
+		}
+	}, nil
+}
+
+// connectorToken returns an execution of the instance of a connector job
+// along with the token waiting for it and its task. No execution is returned
+// when the job has been dealt with.
+func connectorToken(tx *gorm.DB, job *Job) (*execution, *Token, *bpmn.FlowNode, error) {
+	instance, err := findInstance(tx, job.InstanceID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch instance.State {
+	case InstanceSuspended:
+		return nil, nil, nil, postpone(tx, job)
+	case InstanceActive:
+	default:
+		return nil, nil, nil, tx.Unscoped().Delete(job).Error
+	}
+
+	t, err := findToken(tx, job.TokenID)
+	if err != nil && err != util.ErrNotFound {
+		return nil, nil, nil, err
+	}
+	if err != nil || t.State != TokenActive || t.ActivityID != job.ActivityID {
+		return nil, nil, nil, tx.Unscoped().Delete(job).Error
+	}
+	x, err := newExecution(tx, instance)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	node := x.process.Node(job.ActivityID)
+	if node == nil || node.HTTP == nil {
+		return nil, nil, nil, tx.Unscoped().Delete(job).Error
+	}
+	return x, t, node, nil
+}
+
+// httpRequest fills in the URL, headers and body of the connector. A body
+// that evaluates to anything but a string is sent as JSON.
+func (x *execution) httpRequest(t *Token, connector *bpmn.HTTPConnector) (*http.Request, error) {
+	vars, err := x.variables(t)
+	if err != nil {
+		return nil, err
+	}
+	url, err := expr.RenderTemplate(connector.URL, vars)
+	if err != nil {
+		return nil, fmt.Errorf("url: %s", err)
+	}
+
+	var body []byte
+	isJSON := false
+	if connector.Body != "" {
+		template, err := expr.CompileTemplate(connector.Body)
+		if err != nil {
+			return nil, fmt.Errorf("body: %s", err)
+		}
+		value, err := template.Evaluate(vars)
+		if err != nil {
+			return nil, fmt.Errorf("body: %s", err)
+		}
+		if s, isString := value.(string); isString {
+			body = []byte(s)
+		} else if body, err = jsonMarshal(value); err != nil {
+			return nil, fmt.Errorf("body: %s", err)
+		} else {
+			isJSON = true
+		}
+	}
+
+	req, err := http.NewRequest(connector.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, h := range connector.Headers {
+		value, err := expr.RenderTemplate(h.Expression, vars)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %s", h.Name, err)
+		}
+		req.Header.Set(h.Name, value)
+	}
+	return req, nil
+}
+
+func jsonMarshal(value interface{}) ([]byte, error) {
+	if date, isDate := value.(time.Time); isDate {
+		value = date.Format(time.RFC3339)
+	}
+	return json.Marshal(value)
+}
+
+func doHTTP(client *http.Client, req *http.Request) (*httpResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &httpResponse{status: resp.StatusCode, headers: resp.Header, body: body}, nil
+}
+
+// handleResponse decides the outcome of a response by the first status
+// mapping that matches it. Completing the task and throwing an error leave
+// the response in the local variable response.
+func handleResponse(tx *gorm.DB, job *Job, req *http.Request, response *httpResponse) (bool, error) {
+	x, t, node, err := connectorToken(tx, job)
+	if err != nil || x == nil {
+		return false, err
+	}
+
+	outcome, code := bpmn.OutcomeRetry, ""
+	if response.status >= 200 && response.status < 300 {
+		outcome = bpmn.OutcomeComplete
+	}
+	for _, status := range node.HTTP.Statuses {
+		if status.Matches(response.status) {
+			outcome, code = status.Outcome, status.ErrorCode
+			break
+		}
+	}
+
+	cause := fmt.Errorf("%s %s returned %d %s", req.Method, req.URL, response.status, responseSnippet(response))
+	switch outcome {
+	case bpmn.OutcomeRetry:
+		return false, cause
+	case bpmn.OutcomeIncident:
+		return false, abandonJob(tx, job, cause)
+	}
+
+	if err := x.vars.set(tx, x.instance.ID, t.ID, "response", "", response.variable()); err != nil {
+		return false, err
+	}
+	if outcome == bpmn.OutcomeError {
+		err = x.throwError(t, &BPMNError{Code: code, Message: http.StatusText(response.status)})
+	} else {
+		err = x.complete(t)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, x.run()
+}
+
+// responseSnippet returns the start of the body of a response for errors
+func responseSnippet(response *httpResponse) string {
+	body := strings.TrimSpace(string(response.body))
+	if len(body) > httpErrorBody {
+		body = body[:httpErrorBody] + "..."
+	}
+	return body
+}
@@ -0,0 +1,342 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// received a request made to the test server
+type received struct {
+	method  string
+	uri     string
+	headers http.Header
+	body    string
+}
+
+// service an HTTP server standing in for the service a connector calls,
+// which records the requests it receives
+type service struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []*received
+}
+
+// newService starts a service that responds to requests with handler
+func newService(handler http.HandlerFunc) *service {
+	s := &service{requests: make([]*received, 0)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.lock.Lock()
+		s.requests = append(s.requests, &received{r.Method, r.RequestURI, r.Header, string(body)})
+		s.lock.Unlock()
+		handler(w, r)
+	}))
+	return s
+}
+
+func (s *service) calls() []*received {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*received{}, s.requests...)
+}
+
+// connectorProcess is a process calling a service with an HTTP connector,
+// whose failures with the error code FAILED are caught
+const connectorProcess = `
+<error id="failed" errorCode="FAILED"/>
+<process id="%s" isExecutable="true">
+  <startEvent id="start"/>
+  <sequenceFlow id="f1" sourceRef="start" targetRef="call"/>
+  <serviceTask id="call">
+    <extensionElements>
+      %s
+    </extensionElements>
+  </serviceTask>
+  <boundaryEvent id="callFailed" attachedToRef="call">
+    <errorEventDefinition errorRef="failed"/>
+  </boundaryEvent>
+  <sequenceFlow id="f2" sourceRef="call" targetRef="called"/>
+  <userTask id="called"/>
+  <sequenceFlow id="f3" sourceRef="callFailed" targetRef="handleFailure"/>
+  <userTask id="handleFailure"/>
+</process>`
+
+// instanceJob returns the single pending job of the instance
+func instanceJob(t *testing.T, instanceID uint) *Job {
+	t.Helper()
+	jobs, err := GetJobs(instanceID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("instance %d has %d jobs", instanceID, len(jobs))
+	}
+	return jobs[0]
+}
+
+func TestHTTPConnectorTemplates(t *testing.T) {
+	s := newService(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer s.Close()
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorTemplates", `
+      <sw:http method="put" url="${baseUrl}/customers/${urlEncode(customer.name)}/orders?quantity=${quantity}">
+        <sw:header name="Authorization">Bearer ${token}</sw:header>
+        <sw:header name="X-Order-Count">${quantity + 1}</sw:header>
+        <sw:body>${order}</sw:body>
+      </sw:http>`))
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorTextBody", `
+      <sw:http method="post" url="${baseUrl}/notes">
+        <sw:header name="Content-Type">text/plain</sw:header>
+        <sw:body>Order of ${quantity} for ${customer.name}</sw:body>
+      </sw:http>`))
+	variables := map[string]interface{}{
+		"baseUrl":  s.URL,
+		"customer": map[string]interface{}{"name": "Ada Lovelace"},
+		"quantity": 2,
+		"token":    "secret",
+		"order":    map[string]interface{}{"item": "lamp", "quantity": 2},
+	}
+
+	// a body evaluating to an object is sent as JSON
+	instance := startProcess(t, "connectorTemplates", variables)
+	expectActivities(t, instance.ID, "call")
+	if ran := runJobs(t, instance.ID); ran != 1 {
+		t.Fatalf("ran %d jobs", ran)
+	}
+	expectActivities(t, instance.ID, "called")
+
+	calls := s.calls()
+	if len(calls) != 1 {
+		t.Fatalf("received %d requests", len(calls))
+	}
+	call := calls[0]
+	if call.method != http.MethodPut || call.uri != "/customers/Ada+Lovelace/orders?quantity=2" {
+		t.Errorf("received %s %s", call.method, call.uri)
+	}
+	if call.headers.Get("Authorization") != "Bearer secret" || call.headers.Get("X-Order-Count") != "3" ||
+		call.headers.Get("Content-Type") != "application/json" {
+		t.Errorf("received headers %v", call.headers)
+	}
+	order := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(call.body), &order); err != nil || order["item"] != "lamp" || order["quantity"] != 2.0 {
+		t.Errorf("received body %s", call.body)
+	}
+
+	// a body evaluating to a string is sent as is
+	instance = startProcess(t, "connectorTextBody", variables)
+	runJobs(t, instance.ID)
+	expectActivities(t, instance.ID, "called")
+	call = s.calls()[1]
+	if call.method != http.MethodPost || call.body != "Order of 2 for Ada Lovelace" ||
+		call.headers.Get("Content-Type") != "text/plain" {
+		t.Errorf("received %s %s %v", call.method, call.body, call.headers)
+	}
+
+	// a template that cannot be evaluated raises an incident without a request
+	delete(variables, "customer")
+	instance = startProcess(t, "connectorTemplates", variables)
+	runJobs(t, instance.ID)
+	expectActivities(t, instance.ID, "call")
+	if incidents := instanceIncidents(t, instance.ID); len(incidents) != 1 || incidents[0].Type != IncidentFailedJob {
+		t.Errorf("incidents %+v", incidents)
+	}
+	if len(s.calls()) != 2 {
+		t.Errorf("received %d requests", len(s.calls()))
+	}
+}
+
+func TestHTTPConnectorResponseMapping(t *testing.T) {
+	s := newService(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", "r-1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "o-42", "lines": [{"sku": "lamp"}]}`))
+	})
+	defer s.Close()
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorResponse", `
+      <sw:http method="post" url="${baseUrl}/orders"/>
+      <sw:inputOutput>
+        <sw:outputParameter name="orderId">${response.body.id}</sw:outputParameter>
+        <sw:outputParameter name="firstSku">${response.body.lines[0].sku}</sw:outputParameter>
+        <sw:outputParameter name="status">${response.status}</sw:outputParameter>
+        <sw:outputParameter name="requestId">${response.headers["x-request-id"]}</sw:outputParameter>
+      </sw:inputOutput>`))
+
+	instance := startProcess(t, "connectorResponse", map[string]interface{}{"baseUrl": s.URL})
+	runJobs(t, instance.ID)
+	expectActivities(t, instance.ID, "called")
+
+	for name, expected := range map[string]interface{}{
+		"orderId":   "o-42",
+		"firstSku":  "lamp",
+		"status":    "201",
+		"requestId": "r-1",
+	} {
+		if value := instanceVariable(t, instance.ID, name); fmt.Sprint(value) != expected {
+			t.Errorf("%s is %v, expected %v", name, value, expected)
+		}
+	}
+
+	// the response is local to the task
+	if response := instanceVariable(t, instance.ID, "response"); response != nil {
+		t.Errorf("response leaked into the instance: %v", response)
+	}
+}
+
+func TestHTTPConnectorTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s := newService(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer s.Close()
+	defer close(release)
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorTimeout", `
+      <sw:http url="${baseUrl}/slow" timeout="100ms" retries="2"/>`))
+
+	instance := startProcess(t, "connectorTimeout", map[string]interface{}{"baseUrl": s.URL})
+	started := time.Now()
+	runJobs(t, instance.ID)
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("the request was not cut off by its timeout after %s", elapsed)
+	}
+
+	job := instanceJob(t, instance.ID)
+	if job.Retries != 1 || job.Failures != 1 || !strings.Contains(job.Error, "GET "+s.URL+"/slow") ||
+		!strings.Contains(strings.ToLower(job.Error), "timeout") {
+		t.Errorf("job has %d retries and %d failures after %q", job.Retries, job.Failures, job.Error)
+	}
+	expectActivities(t, instance.ID, "call")
+}
+
+func TestHTTPConnectorRetries(t *testing.T) {
+	s := newService(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("down for maintenance"))
+	})
+	defer s.Close()
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorRetries", `
+      <sw:http url="${baseUrl}/flaky" retries="3" retryBackoff="1h"/>`))
+	instance := startProcess(t, "connectorRetries", map[string]interface{}{"baseUrl": s.URL})
+
+	// the backoff doubles with every failure
+	for failures, backoff := range []time.Duration{time.Hour, 2 * time.Hour} {
+		failed := time.Now()
+		runJobs(t, instance.ID)
+		job := instanceJob(t, instance.ID)
+		if job.Retries != 2-failures || job.Failures != failures+1 {
+			t.Fatalf("job has %d retries and %d failures", job.Retries, job.Failures)
+		}
+		if delay := job.DueAt.Sub(failed); delay < backoff || delay > backoff+time.Minute {
+			t.Errorf("job retried after %s, expected %s", delay, backoff)
+		}
+		if !strings.Contains(job.Error, "returned 503 down for maintenance") {
+			t.Errorf("job failed with %q", job.Error)
+		}
+		if len(instanceIncidents(t, instance.ID)) != 0 {
+			t.Fatal("incident raised with retries left")
+		}
+	}
+
+	// the last retry raises an incident
+	runJobs(t, instance.ID)
+	if calls := len(s.calls()); calls != 3 {
+		t.Errorf("received %d requests", calls)
+	}
+	incidents := instanceIncidents(t, instance.ID)
+	if len(incidents) != 1 || incidents[0].Type != IncidentFailedJob || incidents[0].ActivityID != "call" {
+		t.Fatalf("incidents %+v", incidents)
+	}
+	if runJobs(t, instance.ID) != 0 {
+		t.Error("ran a job without retries")
+	}
+	expectActivities(t, instance.ID, "call")
+}
+
+func TestHTTPConnectorStatusMapping(t *testing.T) {
+	s := newService(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"reason": "no such customer"}`))
+		case "/invalid":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("quantity is required"))
+		case "/accepted":
+			w.WriteHeader(http.StatusAccepted)
+		case "/moved":
+			w.WriteHeader(http.StatusNotModified)
+		}
+	})
+	defer s.Close()
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorStatuses", `
+      <sw:http url="${baseUrl}/${path}" retries="5">
+        <sw:status code="404" outcome="error" errorCode="FAILED"/>
+        <sw:status code="202" outcome="incident"/>
+        <sw:status code="4xx" outcome="incident"/>
+        <sw:status code="3xx" outcome="complete"/>
+      </sw:http>
+      <sw:inputOutput>
+        <sw:outputParameter name="status">${response.status}</sw:outputParameter>
+      </sw:inputOutput>`))
+	start := func(path string) *ProcessInstance {
+		instance := startProcess(t, "connectorStatuses", map[string]interface{}{"baseUrl": s.URL, "path": path})
+		runJobs(t, instance.ID)
+		return instance
+	}
+
+	// a status mapped to a BPMN error is caught by the boundary event
+	instance := start("missing")
+	expectActivities(t, instance.ID, "handleFailure")
+	if jobs, _ := GetJobs(instance.ID, 0, 10); len(jobs) != 0 {
+		t.Errorf("jobs left %v", jobs)
+	}
+
+	// a status mapped to an incident is not retried, even when it succeeded
+	for _, path := range []string{"invalid", "accepted"} {
+		instance = start(path)
+		expectActivities(t, instance.ID, "call")
+		incidents := instanceIncidents(t, instance.ID)
+		if len(incidents) != 1 || incidents[0].Type != IncidentFailedJob {
+			t.Fatalf("%s: incidents %+v", path, incidents)
+		}
+		if job := instanceJob(t, instance.ID); job.Retries != 0 || job.Failures != 1 {
+			t.Errorf("%s: job has %d retries and %d failures", path, job.Retries, job.Failures)
+		}
+	}
+	if !strings.Contains(instanceIncidents(t, instance.ID)[0].Message, "returned 202") {
+		t.Errorf("incident %q", instanceIncidents(t, instance.ID)[0].Message)
+	}
+
+	// a status mapped to complete completes the task even when it is not 2xx
+	instance = start("moved")
+	expectActivities(t, instance.ID, "called")
+	if status := instanceVariable(t, instance.ID, "status"); fmt.Sprint(status) != "304" {
+		t.Errorf("status %v", status)
+	}
+}
+
+func TestHTTPConnectorTokenMovedOn(t *testing.T) {
+	s := newService(func(w http.ResponseWriter, r *http.Request) {})
+	defer s.Close()
+	deployProcess(t, fmt.Sprintf(connectorProcess, "connectorCancelled", `
+      <sw:http url="${baseUrl}/ignored"/>`))
+
+	// the job of a token that has moved on is dropped without a request
+	instance := startProcess(t, "connectorCancelled", map[string]interface{}{"baseUrl": s.URL})
+	if err := CancelInstance(instance.ID, "no longer needed"); err != nil {
+		t.Fatal(err)
+	}
+	runJobs(t, instance.ID)
+	if jobs, _ := GetJobs(instance.ID, 0, 10); len(jobs) != 0 || len(s.calls()) != 0 {
+		t.Errorf("%d jobs left after %d requests", len(jobs), len(s.calls()))
+	}
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/dmn"
+)
+
+// businessRuleTaskBehavior evaluates the decision named by the decisionRef
+// attribute, the latest version or the one given by decisionRefVersion, with
+// the variables visible to the token. The results are mapped onto the
+// variable named by resultVariable as set by mapDecisionResult, or when there
+// is no result variable the outputs of the single result become variables.
+// A business rule task without a decision completes straight away.
+type businessRuleTaskBehavior struct {
+	takeOutgoing
+}
+
+func (businessRuleTaskBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	key := node.Attribute("decisionRef")
+	if key == "" {
+		return x.complete(t)
+	}
+
+	def, err := x.decisionDefinition(key, node.Attribute("decisionRefVersion"))
+	if err != nil {
+		return err
+	}
+	if def == nil {
+		return x.raiseIncident(t, IncidentDecision, fmt.Sprintf("No decision %s to evaluate from %s", key, node.ID))
+	}
+	decision, err := dmn.LoadDecision(def)
+	if err != nil {
+		return err
+	}
+
+	vars, err := x.variables(t)
+	if err != nil {
+		return err
+	}
+	results, err := decision.Evaluate(vars)
+	if err != nil {
+		return x.raiseIncident(t, IncidentDecision, fmt.Sprintf("Decision %s of %s: %s", key, node.ID, err))
+	}
+
+	name := node.Attribute("resultVariable")
+	if name == "" {
+		if len(results) > 1 {
+			return x.raiseIncident(t, IncidentDecision, fmt.Sprintf(
+				"Decision %s of %s has %d results which need a resultVariable", key, node.ID, len(results)))
+		}
+		for _, result := range results {
+			if err := x.setVariables(result); err != nil {
+				return err
+			}
+		}
+		return x.complete(t)
+	}
+
+	value, err := mapDecisionResult(node.Attribute("mapDecisionResult"), results)
+	if err != nil {
+		return x.raiseIncident(t, IncidentDecision, fmt.Sprintf("Decision %s of %s: %s", key, node.ID, err))
+	}
+	if err := x.vars.set(x.tx, x.instance.ID, 0, name, "", value); err != nil {
+		return err
+	}
+	return x.complete(t)
+}
+
+// decisionDefinition returns the latest or the given version of the decision,
+// or nil when there is none
+func (x *execution) decisionDefinition(key string, version string) (*dmn.DecisionDefinition, error) {
+	query := x.tx.Where("key = ?", key)
+	if version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("decisionRefVersion %q is not a number", version)
+		}
+		query = query.Where("version = ?", v)
+	}
+
+	def := &dmn.DecisionDefinition{}
+	if err := query.Order("version desc").First(def).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return def, nil
+}
+
+// mapDecisionResult maps the results of a decision onto the value of the
+// result variable, which is the whole result list unless asked otherwise
+func mapDecisionResult(mapping string, results []dmn.Result) (interface{}, error) {
+	switch mapping {
+	case bpmn.MapSingleEntry, bpmn.MapSingleResult:
+		if len(results) > 1 {
+			return nil, fmt.Errorf("%s needs at most one result but there are %d", mapping, len(results))
+		}
+		if len(results) == 0 {
+			return nil, nil
+		}
+		if mapping == bpmn.MapSingleResult {
+			return map[string]interface{}(results[0]), nil
+		}
+		return singleEntry(results[0])
+
+	case bpmn.MapCollectEntries:
+		entries := make([]interface{}, 0, len(results))
+		for _, result := range results {
+			entry, err := singleEntry(result)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+
+	list := make([]interface{}, 0, len(results))
+	for _, result := range results {
+		list = append(list, map[string]interface{}(result))
+	}
+	return list, nil
+}
+
+// singleEntry returns the output of a result that has a single output
+func singleEntry(result dmn.Result) (interface{}, error) {
+	if len(result) != 1 {
+		return nil, fmt.Errorf("a single entry is needed but the result has %d outputs", len(result))
+	}
+	for _, value := range result {
+		return value, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/util"
+)
+
+var (
+	// serializes changes to runtime state
+	lock sync.Mutex
+)
+
+// inTransaction runs fn within a transaction that is committed when fn succeeds
+// and rolled back when it fails or panics
+func inTransaction(fn func(tx *gorm.DB) error) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx := db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Start starts a new instance of the process definition identified by the
+// request, which may also place the instance in a tenant
+func Start(req *StartRequest) (*ProcessInstance, error) {
+	var def *bpmn.ProcessDefinition
+	var err error
+	if req.DefinitionID != 0 {
+		def, err = bpmn.FindProcessDefinition(req.DefinitionID)
+	} else {
+		def, err = bpmn.FindLatestProcessDefinition(req.DefinitionKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return startInstance(def, req.TenantID, req.BusinessKey, req.Variables)
+}
+
+func startInstance(def *bpmn.ProcessDefinition, tenantID string, businessKey string, variables map[string]interface{}) (*ProcessInstance, error) {
+	process, err := bpmn.LoadProcess(def)
+	if err != nil {
+		return nil, err
+	}
+	start := process.NoneStartEvent()
+	if start == nil {
+		return nil, fmt.Errorf("Process %s does not have a none start event", process.ID)
+	}
+
+	instance := newInstance(def, tenantID, businessKey)
+	err = inTransaction(func(tx *gorm.DB) error {
+		return startAt(tx, instance, start, variables, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func newInstance(def *bpmn.ProcessDefinition, tenantID string, businessKey string) *ProcessInstance {
+	return &ProcessInstance{
+		DefinitionID:  def.ID,
+		DefinitionKey: def.Key,
+		TenantID:      tenantID,
+		BusinessKey:   businessKey,
+		State:         InstanceActive,
+	}
+}
+
+// startAt creates the instance and runs it from the start event. The caller
+// is the running execution of the call activity that started the instance,
+// if any.
+func startAt(tx *gorm.DB, instance *ProcessInstance, start *bpmn.FlowNode, variables map[string]interface{},
+	caller *execution) error {
+
+	if err := tx.Create(instance).Error; err != nil {
+		return err
+	}
+	if err := recordInstanceStart(tx, instance); err != nil {
+		return err
+	}
+	x, err := newExecution(tx, instance)
+	if err != nil {
+		return err
+	}
+	x.caller = caller
+	if err := x.setVariables(variables); err != nil {
+		return err
+	}
+	if err := x.openScope(nil); err != nil {
+		return err
+	}
+	if err := x.enter(&Token{}, start, nil); err != nil {
+		return err
+	}
+	return x.run()
+}
+
+// Trigger continues a token of the instance that is waiting in a wait state
+// such as a receive task. Tokens waiting at user tasks continue when their
+// task is completed.
+func Trigger(instanceID uint, tokenID uint, variables map[string]interface{}) error {
+	return inTransaction(func(tx *gorm.DB) error {
+		t, err := findToken(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		if t.InstanceID != instanceID {
+			return util.ErrNotFound
+		}
+		var tasks int
+		if err := tx.Model(&Task{}).Where("token_id = ? AND state = ?", t.ID, TaskOpen).Count(&tasks).Error; err != nil {
+			return err
+		}
+		if tasks > 0 {
+			return util.NewConflictError("Token %d is waiting for its task to be completed", t.ID)
+		}
+		return trigger(tx, t, variables)
+	})
+}
+
+func trigger(tx *gorm.DB, t *Token, variables map[string]interface{}) error {
+	instance, err := findInstance(tx, t.InstanceID)
+	if err != nil {
+		return err
+	}
+	if instance.State != InstanceActive {
+		return util.NewConflictError("Process instance %d is %s", instance.ID, instance.State)
+	}
+
+	x, err := newExecution(tx, instance)
+	if err != nil {
+		return err
+	}
+	node, err := x.node(t)
+	if err != nil {
+		return err
+	}
+	b, err := behaviorOf(node)
+	if err != nil {
+		return err
+	}
+	// a multi-instance activity waits in its instances
+	ws, isWaitState := b.(waitState)
+	if !isWaitState || t.State != TokenActive || (node.Loop != nil && t.Loop == 0) {
+		return util.NewConflictError("Token %d is not waiting at %s", t.ID, node.ID)
+	}
+
+	if err := ws.trigger(x, t, node, variables); err != nil {
+		return err
+	}
+	return x.run()
+}
+
+// SuspendInstance stops an active instance from moving until it is resumed
+func SuspendInstance(id uint) error {
+	return changeInstanceState(id, InstanceSuspended, InstanceActive)
+}
+
+// ResumeInstance lets a suspended instance move again
+func ResumeInstance(id uint) error {
+	return changeInstanceState(id, InstanceActive, InstanceSuspended)
+}
+
+// CancelInstance ends an instance that has not yet completed along with the
+// instances started by its call activities
+func CancelInstance(id uint, reason string) error {
+	return inTransaction(func(tx *gorm.DB) error {
+		instance, err := findInstance(tx, id)
+		if err != nil {
+			return err
+		}
+		if instance.State != InstanceActive && instance.State != InstanceSuspended {
+			return util.NewConflictError("Process instance %d is %s", instance.ID, instance.State)
+		}
+		return cancelInstance(tx, instance, reason)
+	})
+}
+
+func cancelInstance(tx *gorm.DB, instance *ProcessInstance, reason string) error {
+	id := instance.ID
+	if err := tx.Model(&Token{}).Where("instance_id = ? AND state <> ?", id, TokenCompleted).
+		Update("state", TokenCompleted).Error; err != nil {
+		return err
+	}
+	tasks := make([]*Task, 0)
+	if err := tx.Where("instance_id = ? AND state = ?", id, TaskOpen).Find(&tasks).Error; err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if err := tx.Model(task).Update("state", TaskCancelled).Error; err != nil {
+			return err
+		}
+		if err := recordTaskEvent(tx, task, TaskCancelledEvent, nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where("instance_id = ?", id).Delete(&Job{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("instance_id = ?", id).Delete(&EventSubscription{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("instance_id = ?", id).Delete(&ExternalTask{}).Error; err != nil {
+		return err
+	}
+	if err := recordIncidentEnd(tx, IncidentDeleted, "instance_id = ?", id); err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("instance_id = ?", id).Delete(&Incident{}).Error; err != nil {
+		return err
+	}
+	if err := clearCompensations(tx, id); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	instance.State = InstanceCancelled
+	instance.CancelReason = reason
+	instance.EndedAt = &now
+	if err := tx.Save(instance).Error; err != nil {
+		return err
+	}
+	if err := recordInstanceState(tx, instance); err != nil {
+		return err
+	}
+	if err := recordActivityEnd(tx, true, "instance_id = ?", id); err != nil {
+		return err
+	}
+
+	called := make([]*ProcessInstance, 0)
+	if err := tx.Where("parent_instance_id = ? AND state IN (?)", id,
+		[]string{InstanceActive, InstanceSuspended}).Find(&called).Error; err != nil {
+		return err
+	}
+	for _, c := range called {
+		if err := cancelInstance(tx, c, fmt.Sprintf("Calling process instance %d was cancelled", id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func changeInstanceState(id uint, state string, from string) error {
+	return inTransaction(func(tx *gorm.DB) error {
+		instance, err := findInstance(tx, id)
+		if err != nil {
+			return err
+		}
+		if instance.State != from {
+			return util.NewConflictError("Process instance %d is %s", instance.ID, instance.State)
+		}
+		instance.State = state
+		if err := tx.Save(instance).Error; err != nil {
+			return err
+		}
+		return recordInstanceState(tx, instance)
+	})
+}
@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// Config is the configuration for the process instance API
+type Config struct {
+	ResultsPerPage int `mapstructure:"default-results-per-page"`
+
+	// tasks without candidate users or groups may be claimed by any user
+	OpenTasks bool `mapstructure:"open-to-all"`
+}
+
+// StartRequest identifies the process definition to start an instance of,
+// either by id or by the key of its latest version
+type StartRequest struct {
+	DefinitionID  uint                   `json:"definitionId"`
+	DefinitionKey string                 `json:"definitionKey"`
+	TenantID      string                 `json:"tenantId"`
+	BusinessKey   string                 `json:"businessKey"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Validate the StartRequest
+func (req *StartRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.DefinitionID == 0 && req.DefinitionKey == "" {
+		response = append(response, "Definition ID or Definition Key is required")
+	}
+	if req.DefinitionID != 0 && req.DefinitionKey != "" {
+		response = append(response, "Only one of Definition ID or Definition Key may be specified")
+	}
+	return response
+}
+
+// CancelRequest cancels a process instance
+type CancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Validate the CancelRequest
+func (req *CancelRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.Reason == "" {
+		response = append(response, "Reason is required")
+	}
+	return response
+}
+
+// TriggerRequest continues a token waiting in a wait state
+type TriggerRequest struct {
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Register the process instance API
+func Register(e *echo.Group, config *Config) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+
+	/*
+	 * get process instances
+	 *   definitionId     - [int] process definition id
+	 *   definitionKey    - [string] process definition key
+	 *   state            - [string] one of active, suspended, completed or cancelled
+	 *   businessKey      - [string] business key given when the instance was started
+	 *   tenantId         - [string] tenant the instance belongs to
+	 *   parentInstanceId - [int] instance whose call activities started the instances
+	 *   offset           - [int] (default: 0) offset into the index
+	 *   limit            - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit, definitionID, parentInstanceID int
+		filter := &InstanceFilter{}
+
+		if err := resource.Param("definitionId").Optional("0").Int(c, &definitionID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.DefinitionID = uint(definitionID)
+		if err := resource.Param("definitionKey").Optional("").String(c, &filter.DefinitionKey); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("state").Optional("").String(c, &filter.State); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("businessKey").Optional("").String(c, &filter.BusinessKey); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("tenantId").Optional("").String(c, &filter.TenantID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("parentInstanceId").Optional("0").Int(c, &parentInstanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.ParentInstanceID = uint(parentInstanceID)
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		instances, err := GetInstances(filter, offset, limit)
+		if err != nil {
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, instances)
+	})
+
+	/*
+	 * start a process instance
+	 */
+	e.POST("", func(c echo.Context) error {
+		req := &StartRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		instance, err := Start(req)
+		if err != nil {
+			return failure(err)
+		}
+		return resource.Created(c, instance.ID)
+	})
+
+	/*
+	 * get the tokens of an instance that have not completed
+	 */
+	e.GET("/:id/tokens", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if _, err := FindInstance(uint(id)); err != nil {
+			return failure(err)
+		}
+
+		tokens, err := GetActiveTokens(uint(id))
+		if err != nil {
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, tokens)
+	})
+
+	/*
+	 * continue a token of an instance that is waiting in a wait state, such as
+	 * a receive task, setting the given variables on the instance
+	 */
+	e.POST("/:id/tokens/:tokenId/trigger", func(c echo.Context) error {
+		var id, tokenID int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("tokenId").InPath().Int(c, &tokenID); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &TriggerRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := Trigger(uint(id), uint(tokenID), req.Variables); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * get the pending jobs of an instance, ordered by when they are due
+	 *   offset - [int] (default: 0) offset into the index
+	 *   limit  - [int] (default: 20) number of results to return
+	 */
+	e.GET("/:id/jobs", func(c echo.Context) error {
+		var id, offset, limit int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+		if _, err := FindInstance(uint(id)); err != nil {
+			return failure(err)
+		}
+
+		jobs, err := GetJobs(uint(id), offset, limit)
+		if err != nil {
+			return resource.InternalServerError(err)
+		}
+		return c.JSON(http.StatusOK, jobs)
+	})
+
+	/*
+	 * suspend an active instance
+	 */
+	e.POST("/:id/suspend", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := SuspendInstance(uint(id)); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * resume a suspended instance
+	 */
+	e.POST("/:id/resume", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := ResumeInstance(uint(id)); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * cancel an instance that has not completed
+	 */
+	e.POST("/:id/cancel", func(c echo.Context) error {
+		var id int
+
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &CancelRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := CancelInstance(uint(id), req.Reason); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	registerVariables(e)
+	resource.GetMethod(e, GetInstance)
+}
+
+// failure maps an engine error onto an http error
+func failure(err error) error {
+	switch {
+	case err == util.ErrNotFound:
+		return resource.NotFound(err)
+	case util.IsConflictError(err):
+		return resource.Conflict(err)
+	case util.IsValidationError(err):
+		return resource.BadRequest(err)
+	default:
+		return resource.InternalServerError(err)
+	}
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// triggerToken posts to the trigger endpoint of a token of an instance
+func triggerToken(t *testing.T, server *httptest.Server, instanceID uint, tokenID uint,
+	variables map[string]interface{}) int {
+
+	t.Helper()
+	body, err := json.Marshal(&TriggerRequest{Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("%s/process-instances/%d/tokens/%d/trigger", server.URL, instanceID, tokenID)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// activeToken returns the active token of the instance at the activity
+func activeToken(t *testing.T, instanceID uint, activityID string) *Token {
+	t.Helper()
+	tokens, err := GetActiveTokens(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		if token.State == TokenActive && token.ActivityID == activityID {
+			return token
+		}
+	}
+	t.Fatalf("instance %d has no token at %s", instanceID, activityID)
+	return nil
+}
+
+func TestTriggerToken(t *testing.T) {
+	e := echo.New()
+	Register(e.Group("/process-instances"), &Config{ResultsPerPage: 20})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	deployProcess(t, `
+<process id="triggerToken" isExecutable="true">
+  <startEvent id="start"/>
+  <sequenceFlow id="f1" sourceRef="start" targetRef="split"/>
+  <parallelGateway id="split"/>
+  <sequenceFlow id="f2" sourceRef="split" targetRef="wait"/>
+  <sequenceFlow id="f3" sourceRef="split" targetRef="review"/>
+  <receiveTask id="wait"/>
+  <userTask id="review"/>
+  <sequenceFlow id="f4" sourceRef="wait" targetRef="waited"/>
+  <userTask id="waited"/>
+</process>`)
+	instance := startProcess(t, "triggerToken", nil)
+	other := startProcess(t, "triggerToken", nil)
+	waiting := activeToken(t, instance.ID, "wait")
+
+	// tokens of other instances are not found
+	if status := triggerToken(t, server, other.ID, waiting.ID, nil); status != http.StatusNotFound {
+		t.Errorf("responded with %d", status)
+	}
+
+	// tokens waiting for their task are completed with it
+	reviewing := activeToken(t, instance.ID, "review")
+	if status := triggerToken(t, server, instance.ID, reviewing.ID, nil); status != http.StatusConflict {
+		t.Errorf("responded with %d", status)
+	}
+
+	status := triggerToken(t, server, instance.ID, waiting.ID, map[string]interface{}{"received": true})
+	if status != http.StatusNoContent {
+		t.Fatalf("responded with %d", status)
+	}
+	expectActivities(t, instance.ID, "waited", "review")
+	if received := instanceVariable(t, instance.ID, "received"); received != true {
+		t.Errorf("received %v", received)
+	}
+}
@@ -0,0 +1,511 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/users"
+	"github.com/sterrasi/stepwise/util"
+)
+
+var (
+	db *gorm.DB
+)
+
+// TableName for process instances
+func (ProcessInstance) TableName() string {
+	return "process_instances"
+}
+
+// TableName for tokens
+func (Token) TableName() string {
+	return "tokens"
+}
+
+// TableName for incidents
+func (Incident) TableName() string {
+	return "incidents"
+}
+
+// TableName for variables
+func (Variable) TableName() string {
+	return "variables"
+}
+
+// TableName for tasks
+func (Task) TableName() string {
+	return "tasks"
+}
+
+// TableName for task candidates
+func (TaskCandidate) TableName() string {
+	return "task_candidates"
+}
+
+// TableName for jobs
+func (Job) TableName() string {
+	return "jobs"
+}
+
+// TableName for event subscriptions
+func (EventSubscription) TableName() string {
+	return "event_subscriptions"
+}
+
+// TableName for external tasks
+func (ExternalTask) TableName() string {
+	return "external_tasks"
+}
+
+// TableName for compensation records
+func (Compensation) TableName() string {
+	return "compensations"
+}
+
+// TableName for instance history
+func (HistoricInstance) TableName() string {
+	return "history_instances"
+}
+
+// TableName for activity history
+func (HistoricActivity) TableName() string {
+	return "history_activities"
+}
+
+// TableName for variable history
+func (HistoricVariable) TableName() string {
+	return "history_variables"
+}
+
+// TableName for task history
+func (HistoricTask) TableName() string {
+	return "history_tasks"
+}
+
+// TableName for incident history
+func (HistoricIncident) TableName() string {
+	return "history_incidents"
+}
+
+// Init sets the database used to store runtime state
+func Init(database *gorm.DB) {
+	db = database
+	bpmn.OnDeploy(scheduleStartTimers)
+	bpmn.OnDeploy(subscribeStartEvents)
+	bpmn.OnValidate(validateSupported)
+}
+
+// FindInstance returns the process instance with the given id
+func FindInstance(id uint) (*ProcessInstance, error) {
+	return findInstance(db, id)
+}
+
+// InstanceFilter restricts the process instances returned by GetInstances
+type InstanceFilter struct {
+	DefinitionID  uint
+	DefinitionKey string
+	State         string
+	BusinessKey   string
+	TenantID      string
+
+	// only the instances started by call activities of this instance
+	ParentInstanceID uint
+}
+
+// GetInstances returns a page of the process instances matching the filter
+func GetInstances(filter *InstanceFilter, offset int, limit int) ([]*ProcessInstance, error) {
+	instances := make([]*ProcessInstance, 0)
+	query := db.Where(&ProcessInstance{
+		DefinitionID:     filter.DefinitionID,
+		DefinitionKey:    filter.DefinitionKey,
+		State:            filter.State,
+		BusinessKey:      filter.BusinessKey,
+		TenantID:         filter.TenantID,
+		ParentInstanceID: filter.ParentInstanceID,
+	})
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&instances).Error; err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// GetInstance returns a specific process instance
+func GetInstance(id int) (util.Entity, error) {
+	return FindInstance(uint(id))
+}
+
+// GetActiveTokens returns the tokens of an instance that have not completed
+func GetActiveTokens(instanceID uint) ([]*Token, error) {
+	tokens := make([]*Token, 0)
+	if err := db.Where("instance_id = ? AND state <> ?", instanceID, TokenCompleted).
+		Order("id").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// sameKey selects the ids of every version of a process definition
+func sameKey(tx *gorm.DB, key string) interface{} {
+	return tx.Unscoped().Table("process_definitions").Select("id").Where("key = ?", key).QueryExpr()
+}
+
+func findInstance(tx *gorm.DB, id uint) (*ProcessInstance, error) {
+	instance := &ProcessInstance{}
+	if err := tx.First(instance, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return instance, nil
+}
+
+// scopeChain returns the ids of the scopes of the token from the outermost
+// subprocess it is within to the token itself
+func scopeChain(tx *gorm.DB, t *Token) ([]uint, error) {
+	chain := []uint{t.ID}
+	for parentID := t.ParentID; parentID != 0; {
+		parent, err := findToken(tx, parentID)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]uint{parent.ID}, chain...)
+		parentID = parent.ParentID
+	}
+	return chain, nil
+}
+
+func findToken(tx *gorm.DB, id uint) (*Token, error) {
+	token := &Token{}
+	if err := tx.First(token, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+// TaskFilter restricts the tasks returned by GetTasks
+type TaskFilter struct {
+
+	// only tasks assigned to the user or that the user may claim
+	UserID uint
+
+	// only tasks assigned to the user
+	Assigned bool
+
+	// only unassigned tasks the user may claim
+	Claimable bool
+
+	InstanceID uint
+}
+
+// GetTasks returns a page of the open tasks matching the filter, ordered by
+// due date
+func GetTasks(filter *TaskFilter, offset int, limit int) ([]*Task, error) {
+	query := db.Preload("Candidates").Where("state = ?", TaskOpen)
+	if filter.InstanceID != 0 {
+		query = query.Where("instance_id = ?", filter.InstanceID)
+	}
+
+	if filter.UserID != 0 {
+		user, err := findUser(db, filter.UserID)
+		if err != nil {
+			return nil, err
+		}
+		assigned := "assignee_id = ?"
+		claimable := `assignee_id IS NULL AND (
+			id IN (SELECT task_id FROM task_candidates WHERE deleted_at IS NULL AND (user_id = ? OR group_name = ?))`
+		if openTasks {
+			claimable += `
+			OR id NOT IN (SELECT task_id FROM task_candidates WHERE deleted_at IS NULL)`
+		}
+		claimable += ")"
+
+		switch {
+		case filter.Assigned:
+			query = query.Where(assigned, user.ID)
+		case filter.Claimable:
+			query = query.Where(claimable, user.ID, user.Organization)
+		default:
+			query = query.Where(assigned+" OR ("+claimable+")", user.ID, user.ID, user.Organization)
+		}
+	}
+
+	tasks := make([]*Task, 0)
+	if err := query.Order("due_date IS NULL, due_date, id").Offset(offset).Limit(limit).
+		Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// GetTask returns a specific task
+func GetTask(id int) (util.Entity, error) {
+	return findTask(db, uint(id))
+}
+
+func findTask(tx *gorm.DB, id uint) (*Task, error) {
+	task := &Task{}
+	if err := tx.Preload("Candidates").First(task, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return task, nil
+}
+
+func findUser(tx *gorm.DB, id uint) (*users.User, error) {
+	user := &users.User{}
+	if err := tx.First(user, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func findUserByName(tx *gorm.DB, name string) (*users.User, error) {
+	user := &users.User{}
+	if err := tx.Where(&users.User{UserName: name}).First(user).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetJobs returns a page of the jobs of an instance ordered by when they are due
+func GetJobs(instanceID uint, offset int, limit int) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	if err := db.Where("instance_id = ?", instanceID).Order("due_at, id").
+		Offset(offset).Limit(limit).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// IncidentFilter restricts the incidents returned by GetIncidents
+type IncidentFilter struct {
+	InstanceID uint
+	ActivityID string
+	Type       string
+}
+
+// GetIncidents returns a page of the incidents matching the filter, oldest
+// first
+func GetIncidents(filter *IncidentFilter, offset int, limit int) ([]*Incident, error) {
+	incidents := make([]*Incident, 0)
+	query := db.Where(&Incident{
+		InstanceID: filter.InstanceID,
+		ActivityID: filter.ActivityID,
+		Type:       filter.Type,
+	})
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&incidents).Error; err != nil {
+		return nil, err
+	}
+	return incidents, nil
+}
+
+// GetIncident returns a specific incident
+func GetIncident(id int) (util.Entity, error) {
+	return findIncident(db, uint(id))
+}
+
+func findIncident(tx *gorm.DB, id uint) (*Incident, error) {
+	incident := &Incident{}
+	if err := tx.First(incident, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return incident, nil
+}
+
+// ExternalTaskFilter restricts the external tasks returned by GetExternalTasks
+type ExternalTaskFilter struct {
+	Topic      string
+	WorkerID   string
+	InstanceID uint
+}
+
+// GetExternalTasks returns a page of the external tasks matching the filter
+func GetExternalTasks(filter *ExternalTaskFilter, offset int, limit int) ([]*ExternalTask, error) {
+	tasks := make([]*ExternalTask, 0)
+	query := db.Where(&ExternalTask{
+		Topic:      filter.Topic,
+		WorkerID:   filter.WorkerID,
+		InstanceID: filter.InstanceID,
+	})
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// GetExternalTask returns a specific external task
+func GetExternalTask(id int) (util.Entity, error) {
+	return findExternalTask(db, uint(id))
+}
+
+func findExternalTask(tx *gorm.DB, id uint) (*ExternalTask, error) {
+	task := &ExternalTask{}
+	if err := tx.First(task, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return task, nil
+}
+
+// HistoricInstanceFilter restricts the instances returned by
+// GetHistoricInstances
+type HistoricInstanceFilter struct {
+	DefinitionKey string
+	BusinessKey   string
+	State         string
+	TenantID      string
+
+	// only the instances started within the period
+	StartedAfter  *time.Time
+	StartedBefore *time.Time
+}
+
+// GetHistoricInstances returns a page of the history of the process instances
+// matching the filter, in the order they started
+func GetHistoricInstances(filter *HistoricInstanceFilter, offset int, limit int) ([]*HistoricInstance, error) {
+	instances := make([]*HistoricInstance, 0)
+	query := db.Where(&HistoricInstance{
+		DefinitionKey: filter.DefinitionKey,
+		BusinessKey:   filter.BusinessKey,
+		State:         filter.State,
+		TenantID:      filter.TenantID,
+	})
+	if filter.StartedAfter != nil {
+		query = query.Where("started_at >= ?", *filter.StartedAfter)
+	}
+	if filter.StartedBefore != nil {
+		query = query.Where("started_at < ?", *filter.StartedBefore)
+	}
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&instances).Error; err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// GetHistoricInstance returns the history of a specific process instance,
+// given the id of the instance
+func GetHistoricInstance(id int) (util.Entity, error) {
+	instance := &HistoricInstance{}
+	if err := db.Where("instance_id = ?", id).First(instance).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, util.ErrNotFound
+		}
+		return nil, err
+	}
+	return instance, nil
+}
+
+// HistoricActivityFilter restricts the activities returned by
+// GetHistoricActivities
+type HistoricActivityFilter struct {
+	InstanceID   uint
+	ActivityID   string
+	ActivityType string
+}
+
+// GetHistoricActivities returns a page of the activities matching the filter,
+// in the order they started
+func GetHistoricActivities(filter *HistoricActivityFilter, offset int, limit int) ([]*HistoricActivity, error) {
+	activities := make([]*HistoricActivity, 0)
+	query := db.Where(&HistoricActivity{
+		InstanceID:   filter.InstanceID,
+		ActivityID:   filter.ActivityID,
+		ActivityType: filter.ActivityType,
+	})
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&activities).Error; err != nil {
+		return nil, err
+	}
+	return activities, nil
+}
+
+// HistoricVariableFilter restricts the variable changes returned by
+// GetHistoricVariables
+type HistoricVariableFilter struct {
+	InstanceID uint
+	Name       string
+}
+
+// GetHistoricVariables returns a page of the variable changes matching the
+// filter, oldest first
+func GetHistoricVariables(filter *HistoricVariableFilter, offset int, limit int) ([]*HistoricVariable, error) {
+	variables := make([]*HistoricVariable, 0)
+	query := db.Where(&HistoricVariable{
+		InstanceID: filter.InstanceID,
+		Name:       filter.Name,
+	})
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&variables).Error; err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// HistoricTaskFilter restricts the task events returned by GetHistoricTasks
+type HistoricTaskFilter struct {
+	InstanceID uint
+	TaskID     uint
+	Event      string
+
+	// only the events of the user acting on a task
+	UserID uint
+}
+
+// GetHistoricTasks returns a page of the task events matching the filter,
+// oldest first
+func GetHistoricTasks(filter *HistoricTaskFilter, offset int, limit int) ([]*HistoricTask, error) {
+	tasks := make([]*HistoricTask, 0)
+	query := db.Where(&HistoricTask{
+		InstanceID: filter.InstanceID,
+		TaskID:     filter.TaskID,
+		Event:      filter.Event,
+	})
+	if filter.UserID != 0 {
+		query = query.Where("user_id = ?", filter.UserID)
+	}
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// HistoricIncidentFilter restricts the incidents returned by
+// GetHistoricIncidents
+type HistoricIncidentFilter struct {
+	InstanceID uint
+	ActivityID string
+	Type       string
+	State      string
+}
+
+// GetHistoricIncidents returns a page of the incidents matching the filter,
+// in the order they were raised
+func GetHistoricIncidents(filter *HistoricIncidentFilter, offset int, limit int) ([]*HistoricIncident, error) {
+	incidents := make([]*HistoricIncident, 0)
+	query := db.Where(&HistoricIncident{
+		InstanceID: filter.InstanceID,
+		ActivityID: filter.ActivityID,
+		Type:       filter.Type,
+		State:      filter.State,
+	})
+	if err := query.Order("id").Offset(offset).Limit(limit).Find(&incidents).Error; err != nil {
+		return nil, err
+	}
+	return incidents, nil
+}
@@ -0,0 +1,476 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/sterrasi/stepwise/util"
+)
+
+const (
+
+	/* INSTANCE STATES */
+
+	// InstanceActive the instance has tokens that have not completed
+	InstanceActive = "active"
+
+	// InstanceCompleted every token of the instance has completed
+	InstanceCompleted = "completed"
+
+	// InstanceSuspended the instance does not move until it is resumed
+	InstanceSuspended = "suspended"
+
+	// InstanceCancelled the instance was ended before it completed
+	InstanceCancelled = "cancelled"
+
+	/* TOKEN STATES */
+
+	// TokenReady the token has arrived at an activity
+	TokenReady = "ready"
+
+	// TokenActive the activity is executing or waiting
+	TokenActive = "active"
+
+	// TokenCompleting the activity has finished and the token is about to leave
+	TokenCompleting = "completing"
+
+	// TokenCompleted the token has reached the end of its path
+	TokenCompleted = "completed"
+
+	/* INCIDENT TYPES */
+
+	// IncidentNoOutgoingFlow none of the outgoing flows of an element could be taken
+	IncidentNoOutgoingFlow = "no-outgoing-flow"
+
+	// IncidentCondition the condition of an outgoing sequence flow could not
+	// be evaluated
+	IncidentCondition = "condition"
+
+	// IncidentExpression an expression could not be evaluated
+	IncidentExpression = "expression"
+
+	// IncidentAssignment the assignee or candidates of a user task could not be resolved
+	IncidentAssignment = "assignment"
+
+	// IncidentFailedJob a job failed and has no retries left
+	IncidentFailedJob = "failed-job"
+
+	// IncidentCorrelation a thrown message matched no receiver or several
+	IncidentCorrelation = "correlation"
+
+	// IncidentUnhandledError a BPMN error was thrown that no event catches
+	IncidentUnhandledError = "unhandled-error"
+
+	// IncidentCall the process of a call activity could not be started
+	IncidentCall = "call"
+
+	// IncidentDecision the decision of a business rule task could not be
+	// evaluated or its result could not be mapped
+	IncidentDecision = "decision"
+
+	// IncidentFailedExternalTask a worker failed an external task leaving it
+	// no retries
+	IncidentFailedExternalTask = "failed-external-task"
+
+	/* JOB TYPES */
+
+	// JobTimer fires a timer event
+	JobTimer = "timer"
+
+	// JobHTTP makes the request of a service task with an HTTP connector
+	JobHTTP = "http"
+
+	/* TASK STATES */
+
+	// TaskOpen the task is waiting to be worked on
+	TaskOpen = "open"
+
+	// TaskCompleted the task was completed and its token has moved on
+	TaskCompleted = "completed"
+
+	// TaskCancelled the task was ended without being completed
+	TaskCancelled = "cancelled"
+
+	/* DELEGATION STATES */
+
+	// DelegationPending the task was delegated and the delegate has not resolved it
+	DelegationPending = "pending"
+
+	// DelegationResolved the delegate resolved the task and handed it back to its owner
+	DelegationResolved = "resolved"
+
+	/* HISTORY LEVELS */
+
+	// HistoryNone records no history
+	HistoryNone = "none"
+
+	// HistoryActivity records the instances, activities, tasks and incidents
+	HistoryActivity = "activity"
+
+	// HistoryFull also records every variable update
+	HistoryFull = "full"
+
+	/* TASK EVENTS */
+
+	// TaskCreated the task was created for its activity
+	TaskCreated = "create"
+
+	// TaskClaimed a candidate claimed the task
+	TaskClaimed = "claim"
+
+	// TaskUnclaimed the assignee gave the task back to its candidates
+	TaskUnclaimed = "unclaim"
+
+	// TaskDelegated the assignee delegated the task
+	TaskDelegated = "delegate"
+
+	// TaskResolved the delegate resolved the task, handing it back
+	TaskResolved = "resolve"
+
+	// TaskDueDateSet the due date of the task was set or cleared
+	TaskDueDateSet = "due-date"
+
+	// TaskCompletedEvent the task was completed
+	TaskCompletedEvent = "complete"
+
+	// TaskCancelledEvent the task was ended without being completed
+	TaskCancelledEvent = "cancel"
+
+	/* VARIABLE OPERATIONS */
+
+	// VariableCreated the variable was given its first value
+	VariableCreated = "create"
+
+	// VariableUpdated the value of the variable changed
+	VariableUpdated = "update"
+
+	// VariableDeleted the variable was deleted
+	VariableDeleted = "delete"
+
+	/* INCIDENT STATES */
+
+	// IncidentOpen the incident has yet to be resolved
+	IncidentOpen = "open"
+
+	// IncidentResolved the incident was resolved by retrying
+	IncidentResolved = "resolved"
+
+	// IncidentDeleted the incident was removed along with its token, instance or
+	// job
+	IncidentDeleted = "deleted"
+
+	/* VARIABLE TYPES */
+
+	// NullType variable without a value
+	NullType = "null"
+
+	// StringType text variable
+	StringType = "string"
+
+	// LongType 64 bit integer variable
+	LongType = "long"
+
+	// DoubleType 64 bit floating point variable
+	DoubleType = "double"
+
+	// BooleanType true or false variable
+	BooleanType = "boolean"
+
+	// DateType point in time variable
+	DateType = "date"
+
+	// JSONType structured variable holding any JSON value
+	JSONType = "json"
+
+	// BinaryType variable holding raw bytes
+	BinaryType = "binary"
+)
+
+// ProcessInstance a running or finished execution of a process definition
+type ProcessInstance struct {
+	util.EntityImpl
+	DefinitionID  uint   `gorm:"index;not null"`
+	DefinitionKey string `gorm:"type:varchar(255);index;not null"`
+	BusinessKey   string `gorm:"type:varchar(255);index"`
+	State         string `gorm:"type:varchar(20);index;not null"`
+
+	// optional tenant the instance belongs to, which scopes the signals and
+	// messages it receives
+	TenantID string `gorm:"type:varchar(255);index"`
+
+	// instance and call activity token that started the instance, zero when
+	// it was started directly
+	ParentInstanceID uint `gorm:"index"`
+	ParentTokenID    uint
+
+	EndedAt      *time.Time
+	CancelReason string `gorm:"type:text"`
+}
+
+// Token marks the position of a path of execution within a process instance
+type Token struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+	State      string `gorm:"type:varchar(20);index;not null"`
+
+	// sequence flow the token arrived on
+	FlowID string `gorm:"type:varchar(255)"`
+
+	// token of the subprocess the token is within, zero at process level
+	ParentID uint `gorm:"index"`
+
+	// position of an instance of a multi-instance activity counting from
+	// one, whose parent is the token of the activity as a whole
+	Loop int
+
+	// token of the compensate or cancel event whose compensation handler the
+	// token runs, zero otherwise
+	ThrowID uint
+}
+
+// Incident a problem that stops a token from moving until it is resolved
+type Incident struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"index;not null"`
+	TokenID    uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+	Type       string `gorm:"type:varchar(50);index;not null"`
+	Message    string `gorm:"type:text"`
+
+	// job that ran out of retries, zero for other incidents. Jobs of timer
+	// start events belong to neither an instance nor a token, which are zero.
+	JobID uint `gorm:"index"`
+
+	// stack of the panic that failed the job, or otherwise the chain of errors
+	// that failed it. Empty for incidents that are not raised by a job.
+	StackTrace string `gorm:"type:text"`
+}
+
+// Variable a typed process variable. Variables belong to the instance when
+// their scope is zero and are otherwise local to the activity the token with
+// the scope id is positioned on, which for a subprocess makes them visible to
+// every token within it. Each type is stored in a fixed column:
+//
+//	string, json and date (RFC 3339) - TextValue
+//	long and boolean (0 or 1)        - LongValue
+//	double                           - DoubleValue
+//	binary                           - BinaryValue
+type Variable struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"unique_index:idx_variable_scope;not null"`
+	ScopeID    uint   `gorm:"unique_index:idx_variable_scope;not null"`
+	Name       string `gorm:"type:varchar(255);unique_index:idx_variable_scope;not null"`
+	Type       string `gorm:"type:varchar(20);not null"`
+
+	TextValue   string `gorm:"type:text"`
+	LongValue   *int64
+	DoubleValue *float64
+	BinaryValue []byte
+}
+
+// Task a user task waiting to be worked on. A task without an assignee may
+// only be claimed by its candidate users and by the users whose organization is
+// one of its candidate groups. A task without candidates can be claimed by
+// anyone only when tasks are open to all, otherwise it must be assigned.
+type Task struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"index;not null"`
+	TokenID    uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+	Name       string `gorm:"type:varchar(255)"`
+	State      string `gorm:"type:varchar(20);index;not null"`
+
+	AssigneeID *uint `gorm:"index"`
+
+	// the assignee that delegated the task, who gets it back once resolved
+	OwnerID         *uint  `gorm:"index"`
+	DelegationState string `gorm:"type:varchar(20)"`
+
+	DueDate     *time.Time
+	CompletedAt *time.Time
+
+	Candidates []*TaskCandidate `gorm:"foreignkey:TaskID"`
+}
+
+// TaskCandidate a user or group that may claim a task
+type TaskCandidate struct {
+	util.EntityImpl
+	TaskID    uint   `gorm:"index;not null"`
+	UserID    *uint  `gorm:"index"`
+	GroupName string `gorm:"type:varchar(255);index"`
+}
+
+// Job work run in the background by the job executor once it is due. Jobs
+// are locked by the executor running them until the lock expires so that a
+// job left locked by an executor that stopped is picked up again.
+type Job struct {
+	util.EntityImpl
+	Type       string `gorm:"type:varchar(50);not null"`
+	InstanceID uint   `gorm:"index"`
+	TokenID    uint   `gorm:"index"`
+
+	// definition of the timer start event jobs which have no instance
+	DefinitionID uint   `gorm:"index"`
+	ActivityID   string `gorm:"type:varchar(255);not null"`
+
+	DueAt time.Time `gorm:"index;not null"`
+
+	// cycle of a repeating timer and the number of times it has left to
+	// fire, including the pending one
+	Timer       string `gorm:"type:varchar(255)"`
+	Repetitions int
+
+	Retries  int
+	Failures int
+	Error    string `gorm:"type:text"`
+
+	// delay before the first retry, which doubles with every failure, zero
+	// for the backoff of the executor
+	Backoff time.Duration
+
+	LockOwner     string `gorm:"type:varchar(255);index"`
+	LockExpiresAt *time.Time
+}
+
+// EventSubscription a token waiting for a named event such as a message, or a
+// start event of a process definition when it has no instance
+type EventSubscription struct {
+	util.EntityImpl
+	Type       string `gorm:"type:varchar(20);index:idx_subscription_event;not null"`
+	Name       string `gorm:"type:varchar(255);index:idx_subscription_event;not null"`
+	InstanceID uint   `gorm:"index"`
+	TokenID    uint   `gorm:"index"`
+
+	DefinitionID uint   `gorm:"index"`
+	ActivityID   string `gorm:"type:varchar(255);not null"`
+}
+
+// Compensation a completed activity that can be undone by its compensation
+// handler. Records are replayed in reverse order of completion by a
+// compensate or cancel event thrown within the scope of the activity.
+type Compensation struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+
+	// token of the subprocess the activity completed within, zero at process
+	// level
+	ScopeID uint `gorm:"index"`
+
+	// handler activity, which is given the local variables the activity had
+	// when it completed as JSON. A subprocess without a handler has its own
+	// token instead so that the activities within it are compensated.
+	HandlerID string `gorm:"type:varchar(255)"`
+	Variables string `gorm:"type:text"`
+	TokenID   uint
+
+	// token of the event replaying the record, zero until compensation is
+	// thrown
+	ThrowID uint `gorm:"index"`
+}
+
+// ExternalTask a service task worked on by a worker outside of the engine.
+// Workers fetch and lock the tasks of the topics they subscribe to and then
+// complete or fail them while they hold the lock.
+type ExternalTask struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"index;not null"`
+	TokenID    uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+	Topic      string `gorm:"type:varchar(255);index;not null"`
+
+	// worker holding the lock, which others may take once it expires
+	WorkerID      string `gorm:"type:varchar(255);index"`
+	LockExpiresAt *time.Time
+
+	// retries left as given by the last failure, nil until the task first
+	// fails. A failed task is not fetched again until it is available.
+	Retries      *int
+	AvailableAt  *time.Time
+	ErrorMessage string `gorm:"type:text"`
+	ErrorDetails string `gorm:"type:text"`
+}
+
+// HistoricInstance the history of a process instance, which is kept after the
+// instance has ended
+type HistoricInstance struct {
+	util.EntityImpl
+	InstanceID       uint   `gorm:"unique_index;not null"`
+	DefinitionID     uint   `gorm:"index;not null"`
+	DefinitionKey    string `gorm:"type:varchar(255);index;not null"`
+	BusinessKey      string `gorm:"type:varchar(255);index"`
+	TenantID         string `gorm:"type:varchar(255);index"`
+	ParentInstanceID uint   `gorm:"index"`
+	State            string `gorm:"type:varchar(20);index;not null"`
+	CancelReason     string `gorm:"type:text"`
+
+	StartedAt time.Time `gorm:"index;not null"`
+	EndedAt   *time.Time
+
+	// milliseconds from start to end, nil while the instance runs
+	Duration *int64
+}
+
+// HistoricActivity a flow node a token was positioned on, from when it
+// entered the node until it left it or was interrupted
+type HistoricActivity struct {
+	util.EntityImpl
+	InstanceID   uint   `gorm:"index;not null"`
+	TokenID      uint   `gorm:"index;not null"`
+	ActivityID   string `gorm:"type:varchar(255);index;not null"`
+	ActivityName string `gorm:"type:varchar(255)"`
+	ActivityType string `gorm:"type:varchar(50);not null"`
+
+	StartedAt time.Time `gorm:"not null"`
+	EndedAt   *time.Time
+
+	// milliseconds from start to end, nil while the activity runs
+	Duration *int64
+
+	// the activity was interrupted rather than completed
+	Cancelled bool
+}
+
+// HistoricVariable a change to a variable. Values are JSON encoded, where the
+// old value is empty when the variable was created and the new value is
+// empty when it was deleted.
+type HistoricVariable struct {
+	util.EntityImpl
+	InstanceID uint   `gorm:"index;not null"`
+	ScopeID    uint   `gorm:"not null"`
+	Name       string `gorm:"type:varchar(255);index;not null"`
+	Type       string `gorm:"type:varchar(20)"`
+	Operation  string `gorm:"type:varchar(20);not null"`
+	OldValue   string `gorm:"type:text"`
+	NewValue   string `gorm:"type:text"`
+}
+
+// HistoricTask something that happened to a user task, recording the user
+// acting on it and who it was assigned to afterwards
+type HistoricTask struct {
+	util.EntityImpl
+	TaskID     uint   `gorm:"index;not null"`
+	InstanceID uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+	Name       string `gorm:"type:varchar(255)"`
+	Event      string `gorm:"type:varchar(20);index;not null"`
+
+	// user acting on the task, nil when the engine did
+	UserID     *uint `gorm:"index"`
+	AssigneeID *uint
+}
+
+// HistoricIncident an incident from when it was raised until it was resolved
+// or removed
+type HistoricIncident struct {
+	util.EntityImpl
+	IncidentID uint   `gorm:"index;not null"`
+	InstanceID uint   `gorm:"index;not null"`
+	TokenID    uint   `gorm:"index;not null"`
+	ActivityID string `gorm:"type:varchar(255);not null"`
+	Type       string `gorm:"type:varchar(50);index;not null"`
+	Message    string `gorm:"type:text"`
+	JobID      uint
+	State      string `gorm:"type:varchar(20);index;not null"`
+	EndedAt    *time.Time
+}
@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/sirupsen/logrus"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/dmn"
+	"github.com/sterrasi/stepwise/users"
+)
+
+// TestMain runs the tests against a SQLite database in a temporary directory.
+// The tests share the database, so each deploys processes with its own keys.
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "stepwise-engine")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	database, err := gorm.Open("sqlite3", filepath.Join(dir, "engine.db"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+
+	database.AutoMigrate(&users.User{}, &bpmn.ProcessDefinition{}, &dmn.DecisionDefinition{},
+		&ProcessInstance{}, &Token{}, &Incident{}, &Variable{}, &Task{}, &TaskCandidate{}, &Job{},
+		&EventSubscription{}, &Compensation{}, &ExternalTask{}, &HistoricInstance{}, &HistoricActivity{},
+		&HistoricVariable{}, &HistoricTask{}, &HistoricIncident{})
+	bpmn.Init(database)
+	dmn.Init(database)
+	Init(database)
+	logrus.SetOutput(ioutil.Discard)
+
+	return m.Run()
+}
+
+// deployProcess deploys a BPMN document made up of the given root elements
+func deployProcess(t *testing.T, elements string) *bpmn.ProcessDefinition {
+	document := `<?xml version="1.0" encoding="UTF-8"?>
+<definitions xmlns="http://www.omg.org/spec/BPMN/20100524/MODEL"
+  xmlns:sw="http://stepwise.com/schema/bpmn" id="definitions">` + elements + `</definitions>`
+
+	definitions, _, err := bpmn.Deploy("test.bpmn", []byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return definitions[0]
+}
+
+// startProcess starts an instance of the latest version of the process
+func startProcess(t *testing.T, key string, variables map[string]interface{}) *ProcessInstance {
+	instance, err := Start(&StartRequest{DefinitionKey: key, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance
+}
+
+// activeActivities returns the activities the tokens of the instance that
+// have not completed are at
+func activeActivities(t *testing.T, instanceID uint) []string {
+	tokens, err := GetActiveTokens(instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activities := make([]string, 0)
+	for _, token := range tokens {
+		if token.State == TokenActive {
+			activities = append(activities, token.ActivityID)
+		}
+	}
+	return activities
+}
+
+// expectActivities fails the test unless the active tokens of the instance
+// are at the activities
+func expectActivities(t *testing.T, instanceID uint, activities ...string) {
+	t.Helper()
+	if got := activeActivities(t, instanceID); fmt.Sprint(got) != fmt.Sprint(activities) {
+		t.Fatalf("instance %d is at %v, expected %v", instanceID, got, activities)
+	}
+}
+
+// instanceIncidents returns the open incidents of the instance
+func instanceIncidents(t *testing.T, instanceID uint) []*Incident {
+	incidents, err := GetIncidents(&IncidentFilter{InstanceID: instanceID}, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return incidents
+}
+
+// instanceVariable returns the value of an instance variable
+func instanceVariable(t *testing.T, instanceID uint, name string) interface{} {
+	variables, err := GetVariables(instanceID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variables[name] == nil {
+		return nil
+	}
+	return variables[name].Value
+}
+
+// runJobs makes the pending jobs of the instance due and runs them on the
+// calling goroutine, returning how many ran
+func runJobs(t *testing.T, instanceID uint) int {
+	executor, err := NewExecutor(&ExecutorConfig{Workers: 1, BatchSize: 10, PollInterval: time.Second,
+		LockDuration: time.Minute, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Job{}).Where("instance_id = ? AND retries > 0", instanceID).
+		Update("due_at", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	ids, err := executor.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		executor.execute(id)
+	}
+	return len(ids)
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// BPMNError is returned by an activity to raise a business exception that the
+// process handles. It is caught by an error boundary event or error event
+// subprocess with the same code, or without a code, which interrupts the
+// scope it is caught in.
+type BPMNError struct {
+	Code    string
+	Message string
+}
+
+func (e *BPMNError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("BPMN error %s", e.Code)
+	}
+	return fmt.Sprintf("BPMN error %s: %s", e.Code, e.Message)
+}
+
+// errorEndBehavior throws its error from the scope it ends
+type errorEndBehavior struct {
+	takeOutgoing
+}
+
+func (errorEndBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return &BPMNError{Code: node.Event.Code, Message: node.Event.Name}
+}
+
+// escalationThrowBehavior raises its escalation and carries on
+type escalationThrowBehavior struct {
+	takeOutgoing
+
+	// ends the path of the token once the escalation was raised
+	end bool
+}
+
+func (b escalationThrowBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	if err := x.escalate(t, node.Event); err != nil {
+		return err
+	}
+	if b.end {
+		return x.end(t)
+	}
+	return x.complete(t)
+}
+
+// catchingBoundaryBehavior is a boundary event that fires when an error,
+// escalation or cancel is thrown within its activity, or that associates the
+// activity with its compensation handler, so there is nothing to attach
+type catchingBoundaryBehavior struct {
+	passThroughBehavior
+}
+
+func (catchingBoundaryBehavior) attach(x *execution, t *Token, boundary *bpmn.FlowNode) error {
+	return nil
+}
+
+// handler is an event that catches an error or escalation, either a boundary
+// event of the activity of a token or the start event of an event subprocess
+// within a scope, along with the execution of the instance it belongs to
+type handler struct {
+	x       *execution
+	token   *Token
+	scopeID uint
+	event   *bpmn.FlowNode
+}
+
+// throwError routes a BPMN error raised by the token to the event that
+// catches it, raising an incident when nothing does. The code and message are
+// stored in the variables named by the errorCodeVariable and
+// errorMessageVariable attributes of the catching event.
+func (x *execution) throwError(t *Token, e *BPMNError) error {
+	h, err := x.findHandler(t, bpmn.ErrorEvent, e.Code)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return x.raiseIncident(t, IncidentUnhandledError, fmt.Sprintf("Unhandled %s", e))
+	}
+	return x.handle(h, map[string]interface{}{
+		"errorCodeVariable":    e.Code,
+		"errorMessageVariable": e.Message,
+	})
+}
+
+// escalate routes an escalation raised by the token to the event that catches
+// it. The activity carries on unless the event interrupts it and escalations
+// that are not caught are ignored.
+func (x *execution) escalate(t *Token, event *bpmn.EventDefinition) error {
+	h, err := x.findHandler(t, bpmn.EscalationEvent, event.Code)
+	if err != nil || h == nil {
+		return err
+	}
+	return x.handle(h, map[string]interface{}{
+		"escalationCodeVariable": event.Code,
+	})
+}
+
+// findHandler returns the event that catches the error or escalation with the
+// code raised by the token. Starting at the token, the boundary events of its
+// activity are tried followed by the event subprocesses of its scope, after
+// which the search moves on to the enclosing subprocess or multi-instance
+// activity and finally to the call activity that started the instance. An
+// event with the code is preferred over one without.
+func (x *execution) findHandler(t *Token, kind bpmn.EventType, code string) (*handler, error) {
+	hx, current := x, t
+	for {
+		node, err := hx.node(current)
+		if err != nil {
+			return nil, err
+		}
+		// the instances of a multi-instance activity are caught by the
+		// activity as a whole
+		if boundary := catching(node.Boundaries, kind, code); boundary != nil && current.Loop == 0 {
+			return &handler{x: hx, token: current, event: boundary}, nil
+		}
+
+		// an event subprocess is not caught by the event subprocesses beside it
+		if !node.TriggeredByEvent && current.Loop == 0 {
+			starts := make([]*bpmn.FlowNode, 0)
+			for _, sub := range hx.process.EventSubprocesses(node.Parent) {
+				starts = append(starts, sub.StartEvent())
+			}
+			if start := catching(starts, kind, code); start != nil {
+				return &handler{x: hx, scopeID: current.ParentID, event: start}, nil
+			}
+		}
+
+		if current.ParentID != 0 {
+			if current, err = findToken(hx.tx, current.ParentID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		caller, err := hx.callerExecution()
+		if err != nil || caller == nil {
+			return nil, err
+		}
+		if current, err = hx.callToken(caller); err != nil || current == nil {
+			return nil, err
+		}
+		hx = caller
+	}
+}
+
+func catching(events []*bpmn.FlowNode, kind bpmn.EventType, code string) *bpmn.FlowNode {
+	var catchAll *bpmn.FlowNode
+	for _, event := range events {
+		if event.Event == nil || event.Event.Type != kind {
+			continue
+		}
+		if event.Event.Code == code && code != "" {
+			return event
+		}
+		if event.Event.Code == "" && catchAll == nil {
+			catchAll = event
+		}
+	}
+	return catchAll
+}
+
+// handle fires the handler. When it interrupts and belongs to a calling
+// instance, the called instances in between are cancelled first.
+func (x *execution) handle(h *handler, values map[string]interface{}) error {
+	if h.event.CancelActivity {
+		for called := x; called != h.x; called = called.caller {
+			reason := fmt.Sprintf("Interrupted by %s of process instance %d", h.event.ID, h.x.instance.ID)
+			if err := cancelInstance(called.tx, called.instance, reason); err != nil {
+				return err
+			}
+		}
+	}
+	if err := h.x.setNamedVariables(h.event, values); err != nil {
+		return err
+	}
+	if h.token == nil {
+		return h.x.startEventSubprocess(h.scopeID, h.event)
+	}
+	return h.x.fireBoundary(h.token, h.event)
+}
+
+// setNamedVariables sets instance variables named by attributes of the node,
+// skipping the attributes that are not given
+func (x *execution) setNamedVariables(node *bpmn.FlowNode, values map[string]interface{}) error {
+	for attribute, value := range values {
+		if name := node.Attribute(attribute); name != "" {
+			if err := x.vars.set(x.tx, x.instance.ID, 0, name, "", value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// execution is a single run of the engine against a process instance. Tokens
+// are placed on the agenda as they change state and are stepped until every
+// token has either completed or is waiting. All changes are made through the
+// transaction which the caller commits once the run has finished.
+type execution struct {
+	tx       *gorm.DB
+	instance *ProcessInstance
+	process  *bpmn.Process
+	vars     variables
+	agenda   []*Token
+
+	// execution of the instance that called this one through a call
+	// activity, once needed, and whether it was created by this execution
+	// which then runs it when it finishes
+	caller        *execution
+	resumesCaller bool
+}
+
+func newExecution(tx *gorm.DB, instance *ProcessInstance) (*execution, error) {
+	def := &bpmn.ProcessDefinition{}
+	// deleted definitions still run the instances that were started on them
+	if err := tx.Unscoped().First(def, instance.DefinitionID).Error; err != nil {
+		return nil, fmt.Errorf("Unable to load process definition %d: %s", instance.DefinitionID, err)
+	}
+	process, err := bpmn.LoadProcess(def)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := loadVariables(tx, instance.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &execution{
+		tx:       tx,
+		instance: instance,
+		process:  process,
+		vars:     vars,
+		agenda:   make([]*Token, 0),
+	}, nil
+}
+
+// setVariables merges the given variables into the instance variables
+func (x *execution) setVariables(variables map[string]interface{}) error {
+	for name, value := range variables {
+		if err := x.vars.set(x.tx, x.instance.ID, 0, name, "", value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variables returns the values of the variables visible to the token, which
+// include those of the subprocesses it is within
+func (x *execution) variables(t *Token) (map[string]interface{}, error) {
+	if t.ID == 0 {
+		return x.vars.visible()
+	}
+	scopes, err := scopeChain(x.tx, t)
+	if err != nil {
+		return nil, err
+	}
+	return x.vars.visible(scopes...)
+}
+
+// node returns the flow node the token is positioned on
+func (x *execution) node(t *Token) (*bpmn.FlowNode, error) {
+	node := x.process.Node(t.ActivityID)
+	if node == nil {
+		return nil, fmt.Errorf("Activity %s not found in process %s", t.ActivityID, x.process.ID)
+	}
+	return node, nil
+}
+
+// save persists the token and places it on the agenda
+func (x *execution) save(t *Token) error {
+	if err := x.tx.Save(t).Error; err != nil {
+		return err
+	}
+	x.agenda = append(x.agenda, t)
+	return nil
+}
+
+// enter moves the token onto a flow node
+func (x *execution) enter(t *Token, node *bpmn.FlowNode, flow *bpmn.SequenceFlow) error {
+	t.InstanceID = x.instance.ID
+	t.ActivityID = node.ID
+	t.State = TokenReady
+	t.FlowID = ""
+	if flow != nil {
+		t.FlowID = flow.ID
+	}
+	if t.ID != 0 {
+		if err := recordActivityEnd(x.tx, false, "token_id = ?", t.ID); err != nil {
+			return err
+		}
+	}
+	if err := x.save(t); err != nil {
+		return err
+	}
+	return x.recordActivityStart(t, node)
+}
+
+// complete marks the activity the token is positioned on as finished
+func (x *execution) complete(t *Token) error {
+	t.State = TokenCompleting
+	return x.save(t)
+}
+
+// end finishes the path of execution of the token, completing the
+// subprocess it is within once no other token remains in it. A token that ran
+// a compensation handler moves its compensation on to the next handler.
+func (x *execution) end(t *Token) error {
+	t.State = TokenCompleted
+	if err := x.tx.Save(t).Error; err != nil {
+		return err
+	}
+	if err := recordActivityEnd(x.tx, false, "token_id = ?", t.ID); err != nil {
+		return err
+	}
+	if t.ThrowID != 0 {
+		if err := x.compensateNext(t.ThrowID); err != nil {
+			return err
+		}
+	}
+	if t.ParentID == 0 {
+		return nil
+	}
+	return x.completeScope(t.ParentID)
+}
+
+// take moves the token along the given flows. A new token is forked for every
+// flow beyond the first and the token ends when there are no flows to take.
+func (x *execution) take(t *Token, flows []*bpmn.SequenceFlow) error {
+	if len(flows) == 0 {
+		return x.end(t)
+	}
+	if err := x.enter(t, flows[0].Target, flows[0]); err != nil {
+		return err
+	}
+	for _, flow := range flows[1:] {
+		if err := x.enter(&Token{ParentID: t.ParentID}, flow.Target, flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectFlows returns the outgoing flows of the node whose condition holds, in
+// document order. Flows without a condition always hold and the default flow is
+// only selected when no other flow is. When first is set at most one flow is
+// selected.
+func (x *execution) selectFlows(t *Token, node *bpmn.FlowNode, first bool) ([]*bpmn.SequenceFlow, error) {
+	vars, err := x.variables(t)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]*bpmn.SequenceFlow, 0)
+	for _, flow := range node.Outgoing {
+		if flow.IsDefault() {
+			continue
+		}
+		if flow.Condition != "" {
+			holds, err := expr.EvaluateBool(flow.Condition, vars)
+			if err != nil {
+				return nil, fmt.Errorf("Condition of sequence flow %s: %s", flow.ID, err)
+			}
+			if !holds {
+				continue
+			}
+		}
+		selected = append(selected, flow)
+		if first {
+			return selected, nil
+		}
+	}
+	if len(selected) == 0 && node.Default != nil {
+		selected = append(selected, node.Default)
+	}
+	return selected, nil
+}
+
+// takeSelected moves the token along the selected outgoing flows of the node,
+// raising an incident when no flow can be taken
+func (x *execution) takeSelected(t *Token, node *bpmn.FlowNode, first bool) error {
+	flows, err := x.selectFlows(t, node, first)
+	if err != nil {
+		return x.raiseIncident(t, IncidentCondition, err.Error())
+	}
+	if len(flows) == 0 && len(node.Outgoing) > 0 {
+		return x.raiseIncident(t, IncidentNoOutgoingFlow,
+			fmt.Sprintf("No condition of the outgoing flows of %s holds and there is no default flow", node.ID))
+	}
+	return x.take(t, flows)
+}
+
+// raiseIncident records a problem with the token which stays where it is
+// until the incident is resolved
+func (x *execution) raiseIncident(t *Token, kind string, message string) error {
+	return createIncident(x.tx, &Incident{
+		InstanceID: x.instance.ID,
+		TokenID:    t.ID,
+		ActivityID: t.ActivityID,
+		Type:       kind,
+		Message:    message,
+	})
+}
+
+// waitingTokens returns the other active tokens of the instance that are
+// positioned on the node within the same scope as the token
+func (x *execution) waitingTokens(t *Token, node *bpmn.FlowNode) ([]*Token, error) {
+	tokens := make([]*Token, 0)
+	if err := x.tx.Where("instance_id = ? AND activity_id = ? AND state = ? AND parent_id = ? AND id <> ?",
+		x.instance.ID, node.ID, TokenActive, t.ParentID, t.ID).Order("id").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// run steps tokens until the agenda is empty and no waiting join can fire
+func (x *execution) run() error {
+	for len(x.agenda) > 0 {
+		for len(x.agenda) > 0 {
+			t := x.agenda[0]
+			x.agenda = x.agenda[1:]
+
+			if err := x.step(t); err != nil {
+				return err
+			}
+		}
+		if err := x.resumeJoins(); err != nil {
+			return err
+		}
+	}
+	return x.finish()
+}
+
+// step advances the token from its current state
+func (x *execution) step(t *Token) error {
+	// the token may have ended since it was placed on the agenda, such as
+	// when the scope it is within was interrupted
+	if err := x.tx.First(t, t.ID).Error; err != nil {
+		return err
+	}
+	node, err := x.node(t)
+	if err != nil {
+		return err
+	}
+	b, err := behaviorOf(node)
+	if err != nil {
+		return err
+	}
+
+	switch t.State {
+	case TokenReady:
+		if node.Loop != nil && t.Loop == 0 {
+			return x.startLoop(t, node)
+		}
+		if err := x.applyMappings(t, node.Inputs, t.ID); err != nil {
+			return x.raiseIncident(t, IncidentExpression, fmt.Sprintf("Input mapping of %s: %s", node.ID, err))
+		}
+		t.State = TokenActive
+		if err := x.tx.Save(t).Error; err != nil {
+			return err
+		}
+		if t.Loop == 0 {
+			if err := x.attachBoundaries(t, node); err != nil {
+				return err
+			}
+		}
+
+		// business exceptions are handled by the process rather than failing it
+		err := b.execute(x, t, node)
+		if raised, isRaised := err.(*BPMNError); isRaised {
+			return x.throwError(t, raised)
+		}
+		return err
+
+	case TokenCompleting:
+		if t.Loop > 0 {
+			return x.completeLoopInstance(t, node)
+		}
+
+		// the outputs of a multi-instance activity are mapped by its
+		// instances, which are also compensated one by one
+		if node.Loop == nil {
+			if err := x.applyMappings(t, node.Outputs, t.ParentID); err != nil {
+				return x.raiseIncident(t, IncidentExpression, fmt.Sprintf("Output mapping of %s: %s", node.ID, err))
+			}
+			if err := x.recordCompensation(t, node, t.ParentID); err != nil {
+				return err
+			}
+		}
+
+		// local variables and boundary events do not outlive the activity
+		if err := x.vars.clear(x.tx, t.ID); err != nil {
+			return err
+		}
+		if err := x.detach(t); err != nil {
+			return err
+		}
+		return b.leave(x, t, node)
+	}
+	return nil
+}
+
+// attachBoundaries attaches the boundary events of the node to the token
+func (x *execution) attachBoundaries(t *Token, node *bpmn.FlowNode) error {
+	for _, boundary := range node.Boundaries {
+		b, err := behaviorOf(boundary)
+		if err != nil {
+			return err
+		}
+		be, isBoundary := b.(boundaryEvent)
+		if !isBoundary {
+			return fmt.Errorf("Element %s of type %s cannot be a boundary event", boundary.ID, boundary.Type)
+		}
+		if err := be.attach(x, t, boundary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detach removes the jobs scheduled, the events subscribed to, the external
+// tasks created for the token and its incidents and releases the
+// compensation records it has yet to replay
+func (x *execution) detach(t *Token) error {
+	if err := recordIncidentEnd(x.tx, IncidentDeleted, "token_id = ?", t.ID); err != nil {
+		return err
+	}
+	if err := x.tx.Unscoped().Where("token_id = ?", t.ID).Delete(&Incident{}).Error; err != nil {
+		return err
+	}
+	if err := x.tx.Unscoped().Where("token_id = ?", t.ID).Delete(&Job{}).Error; err != nil {
+		return err
+	}
+	if err := x.tx.Unscoped().Where("token_id = ?", t.ID).Delete(&ExternalTask{}).Error; err != nil {
+		return err
+	}
+	if err := x.tx.Unscoped().Where("token_id = ?", t.ID).Delete(&EventSubscription{}).Error; err != nil {
+		return err
+	}
+	return x.tx.Model(&Compensation{}).Where("instance_id = ? AND throw_id = ?", x.instance.ID, t.ID).
+		Update("throw_id", 0).Error
+}
+
+// fireBoundary moves a new token onto the boundary event, ending the token of
+// the activity when the event interrupts it. The new token enters first so
+// that the scope of the activity does not complete in between.
+func (x *execution) fireBoundary(t *Token, boundary *bpmn.FlowNode) error {
+	if err := x.enter(&Token{ParentID: t.ParentID}, boundary, nil); err != nil {
+		return err
+	}
+	if boundary.CancelActivity {
+		return x.interrupt(t)
+	}
+	return nil
+}
+
+// interrupt ends the token while its activity is still active, cancelling
+// whatever the activity was waiting on, the tokens within a subprocess and
+// the instances started by a call activity
+func (x *execution) interrupt(t *Token) error {
+	if err := x.closeTasks(t, TaskCancelled); err != nil {
+		return err
+	}
+	if err := x.vars.clear(x.tx, t.ID); err != nil {
+		return err
+	}
+	if err := x.detach(t); err != nil {
+		return err
+	}
+	if err := recordActivityEnd(x.tx, true, "token_id = ?", t.ID); err != nil {
+		return err
+	}
+	if err := x.end(t); err != nil {
+		return err
+	}
+	if err := x.interruptScope(t.ID, 0); err != nil {
+		return err
+	}
+	return x.cancelCalled(t)
+}
+
+// applyMappings evaluates each mapping with the variables visible to the token
+// and assigns the result to a variable of the given scope. Inputs are local to
+// the activity while outputs are written to the scope enclosing it, which is
+// the instance at process level.
+func (x *execution) applyMappings(t *Token, mappings []*bpmn.Mapping, scopeID uint) error {
+	for _, m := range mappings {
+		vars, err := x.variables(t)
+		if err != nil {
+			return err
+		}
+		value, err := expr.Evaluate(m.Expression, vars)
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		if err := x.vars.set(x.tx, x.instance.ID, scopeID, m.Name, "", value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish saves the instance, completing it when none of its tokens remain.
+// A completed instance that was called by a call activity hands back to its
+// caller, which is run when it was not already running.
+func (x *execution) finish() error {
+	var remaining int
+	if err := x.tx.Model(&Token{}).Where("instance_id = ? AND state <> ?",
+		x.instance.ID, TokenCompleted).Count(&remaining).Error; err != nil {
+		return err
+	}
+	completed := remaining == 0 && x.instance.State == InstanceActive
+	if completed {
+		now := time.Now()
+		x.instance.State = InstanceCompleted
+		x.instance.EndedAt = &now
+
+		// the event subprocesses at process level no longer listen and
+		// nothing is left to compensate
+		if err := x.closeEventSubprocesses(0, nil); err != nil {
+			return err
+		}
+		if err := clearCompensations(x.tx, x.instance.ID); err != nil {
+			return err
+		}
+	}
+	if err := x.tx.Save(x.instance).Error; err != nil {
+		return err
+	}
+	if completed {
+		if err := recordInstanceState(x.tx, x.instance); err != nil {
+			return err
+		}
+	}
+
+	if completed && x.instance.ParentInstanceID != 0 {
+		if err := x.returnToCaller(); err != nil {
+			return err
+		}
+	}
+	if x.resumesCaller {
+		return x.caller.run()
+	}
+	return nil
+}
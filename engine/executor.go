@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nu7hatch/gouuid"
+	"github.com/sirupsen/logrus"
+)
+
+// ExecutorConfig is the configuration for the job executor
+type ExecutorConfig struct {
+	Workers      int           `mapstructure:"workers"`
+	BatchSize    int           `mapstructure:"batch-size"`
+	PollInterval time.Duration `mapstructure:"poll-interval"`
+	LockDuration time.Duration `mapstructure:"lock-duration"`
+	Backoff      time.Duration `mapstructure:"backoff"`
+}
+
+// Executor runs due jobs on a pool of goroutines. Jobs are locked by the
+// executor before they run so that several executors may share a database.
+type Executor struct {
+	config *ExecutorConfig
+	owner  string
+	jobs   chan uint
+	stop   chan struct{}
+	done   sync.WaitGroup
+}
+
+// NewExecutor creates a job executor identified by the host, process and a
+// random suffix
+func NewExecutor(config *ExecutorConfig) (*Executor, error) {
+	if config.Workers < 1 || config.BatchSize < 1 || config.PollInterval <= 0 || config.LockDuration <= 0 {
+		return nil, fmt.Errorf("Job executor workers, batch size, poll interval and lock duration must be positive")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Executor{
+		config: config,
+		owner:  fmt.Sprintf("%s-%d-%s", host, os.Getpid(), id.String()[:8]),
+		jobs:   make(chan uint, config.BatchSize),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Start polls for due jobs until the executor is stopped
+func (e *Executor) Start() {
+	for i := 0; i < e.config.Workers; i++ {
+		e.done.Add(1)
+		go e.work()
+	}
+
+	e.done.Add(1)
+	go func() {
+		defer e.done.Done()
+		defer close(e.jobs)
+
+		ticker := time.NewTicker(e.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			e.poll()
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	logrus.Infof("Started job executor %s with %d workers", e.owner, e.config.Workers)
+}
+
+// Stop waits for the running jobs to finish. Jobs that were locked but not
+// yet started are picked up again once their lock expires.
+func (e *Executor) Stop() {
+	close(e.stop)
+	e.done.Wait()
+}
+
+// poll locks a batch of due jobs and hands them to the workers
+func (e *Executor) poll() {
+	ids, err := e.acquire()
+	if err != nil {
+		logrus.Errorf("Job executor %s could not acquire jobs: %s", e.owner, err)
+		return
+	}
+	for _, id := range ids {
+		select {
+		case e.jobs <- id:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// acquire locks the due jobs that are not locked or whose lock has expired
+func (e *Executor) acquire() ([]uint, error) {
+	ids := make([]uint, 0)
+	err := inTransaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		jobs := make([]*Job, 0)
+		if err := tx.Where("due_at <= ? AND retries > 0 AND (lock_owner = '' OR lock_expires_at < ?)", now, now).
+			Order("due_at, id").Limit(e.config.BatchSize).Find(&jobs).Error; err != nil {
+			return err
+		}
+
+		expires := now.Add(e.config.LockDuration)
+		for _, job := range jobs {
+			locked := tx.Model(&Job{}).
+				Where("id = ? AND (lock_owner = '' OR lock_expires_at < ?)", job.ID, now).
+				Updates(map[string]interface{}{"lock_owner": e.owner, "lock_expires_at": expires})
+			if locked.Error != nil {
+				return locked.Error
+			}
+			if locked.RowsAffected == 1 {
+				ids = append(ids, job.ID)
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// panicError is a panic of a job handler turned into an error, which keeps
+// the stack of the panic for the incident raised when the job runs out of
+// retries
+type panicError struct {
+	value interface{}
+	stack string
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.value)
+}
+
+// guard runs fn, recovering from a panic so that a job cannot stop its worker
+func guard(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &panicError{value: r, stack: string(debug.Stack())}
+		}
+	}()
+	return fn()
+}
+
+// prepare returns the handler of a locked job, first doing the work of a job
+// with a call. No handler is returned when the lock was lost or the call has
+// already dealt with the job.
+func (e *Executor) prepare(id uint) (jobHandler, error) {
+	var handler jobHandler
+	var work func() jobHandler
+	err := inTransaction(func(tx *gorm.DB) error {
+		job := &Job{}
+		if err := tx.Where("id = ? AND lock_owner = ?", id, e.owner).First(job).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+		if call, exists := jobCalls[job.Type]; exists {
+			var err error
+			work, err = call(tx, job)
+			return err
+		}
+
+		var exists bool
+		if handler, exists = jobHandlers[job.Type]; !exists {
+			return fmt.Errorf("Unknown job type %s", job.Type)
+		}
+		return nil
+	})
+	if err != nil || work == nil {
+		return handler, err
+	}
+	return work(), nil
+}
+
+func (e *Executor) work() {
+	defer e.done.Done()
+	for id := range e.jobs {
+		e.execute(id)
+	}
+}
+
+// execute runs a locked job, skipping it when its lock was lost, and records
+// the failure in a separate transaction when it does not succeed
+func (e *Executor) execute(id uint) {
+	err := guard(func() error {
+		handler, err := e.prepare(id)
+		if err != nil || handler == nil {
+			return err
+		}
+		return inTransaction(func(tx *gorm.DB) error {
+			job := &Job{}
+			if err := tx.Where("id = ? AND lock_owner = ?", id, e.owner).First(job).Error; err != nil {
+				if gorm.IsRecordNotFoundError(err) {
+					return nil
+				}
+				return err
+			}
+
+			finished, err := handler(tx, job)
+			if err != nil || !finished {
+				return err
+			}
+			return finishJob(tx, job)
+		})
+	})
+	if err == nil {
+		return
+	}
+
+	cause := err
+	err = inTransaction(func(tx *gorm.DB) error {
+		job := &Job{}
+		if err := tx.Where("id = ? AND lock_owner = ?", id, e.owner).First(job).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+		return failJob(tx, job, cause, e.config.Backoff)
+	})
+	if err != nil {
+		logrus.Errorf("Unable to record the failure of job %d: %s", id, err)
+	}
+}
@@ -0,0 +1,327 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// how often a waiting fetch looks for tasks whose lock expired or that became
+// available again after failing
+const externalTaskPoll = time.Second
+
+var (
+	// closed and replaced whenever an external task is created to wake the
+	// fetches waiting for one
+	externalTasksCreated = make(chan struct{})
+	externalTasksLock    sync.Mutex
+)
+
+// serviceTaskBehavior hands the token to an external worker when the task has
+// a topic and to the job executor when it has an HTTP connector, and
+// otherwise completes as soon as it is executed
+type serviceTaskBehavior struct {
+	takeOutgoing
+}
+
+func (serviceTaskBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	if node.HTTP != nil {
+		return x.connectorJob(t, node)
+	}
+	topic := node.Attribute("topic")
+	if topic == "" {
+		return x.complete(t)
+	}
+	if err := x.tx.Create(&ExternalTask{
+		InstanceID: x.instance.ID,
+		TokenID:    t.ID,
+		ActivityID: node.ID,
+		Topic:      topic,
+	}).Error; err != nil {
+		return err
+	}
+	announceExternalTask()
+	return nil
+}
+
+// announceExternalTask wakes the waiting fetches, which are held up by the
+// transaction lock until the task is committed
+func announceExternalTask() {
+	externalTasksLock.Lock()
+	defer externalTasksLock.Unlock()
+	close(externalTasksCreated)
+	externalTasksCreated = make(chan struct{})
+}
+
+func externalTaskAnnounced() <-chan struct{} {
+	externalTasksLock.Lock()
+	defer externalTasksLock.Unlock()
+	return externalTasksCreated
+}
+
+// FetchRequest locks up to MaxTasks external tasks of the topics for a worker.
+// When there are none the request waits up to AsyncResponseTimeout
+// milliseconds for one to be created.
+type FetchRequest struct {
+	WorkerID             string        `json:"workerId"`
+	MaxTasks             int           `json:"maxTasks"`
+	AsyncResponseTimeout int64         `json:"asyncResponseTimeout"`
+	Topics               []*FetchTopic `json:"topics"`
+}
+
+// FetchTopic a topic to fetch tasks of, which are locked for LockDuration
+// milliseconds. Only the named variables are fetched, or every variable
+// visible to the task when none are named.
+type FetchTopic struct {
+	TopicName    string   `json:"topicName"`
+	LockDuration int64    `json:"lockDuration"`
+	Variables    []string `json:"variables"`
+}
+
+// Validate the FetchRequest
+func (req *FetchRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.WorkerID == "" {
+		response = append(response, "Worker ID is required")
+	}
+	if req.MaxTasks < 1 {
+		response = append(response, "Max tasks must be positive")
+	}
+	if req.AsyncResponseTimeout < 0 {
+		response = append(response, "Async response timeout cannot be negative")
+	}
+	if len(req.Topics) == 0 {
+		response = append(response, "At least one topic is required")
+	}
+	for _, topic := range req.Topics {
+		if topic.TopicName == "" {
+			response = append(response, "Topic name is required")
+		}
+		if topic.LockDuration < 1 {
+			response = append(response, fmt.Sprintf("Lock duration of topic %s must be positive", topic.TopicName))
+		}
+	}
+	return response
+}
+
+// LockedExternalTask an external task locked by a worker along with the
+// variables it fetched
+type LockedExternalTask struct {
+	*ExternalTask
+	BusinessKey string
+	Variables   map[string]*TypedValue
+}
+
+// FetchAndLock locks external tasks of the topics for the worker, waiting for
+// tasks to become available until the timeout of the request has passed or
+// the context is done
+func FetchAndLock(ctx context.Context, req *FetchRequest, maxWait time.Duration) ([]*LockedExternalTask, error) {
+	wait := time.Duration(req.AsyncResponseTimeout) * time.Millisecond
+	if wait > maxWait {
+		wait = maxWait
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		created := externalTaskAnnounced()
+		locked, err := fetchAndLock(req)
+		if err != nil || len(locked) > 0 {
+			return locked, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return locked, nil
+		}
+		if remaining > externalTaskPoll {
+			remaining = externalTaskPoll
+		}
+		select {
+		case <-created:
+		case <-time.After(remaining):
+		case <-ctx.Done():
+			return locked, nil
+		}
+	}
+}
+
+func fetchAndLock(req *FetchRequest) ([]*LockedExternalTask, error) {
+	topics := make(map[string]*FetchTopic)
+	names := make([]string, 0)
+	for _, topic := range req.Topics {
+		topics[topic.TopicName] = topic
+		names = append(names, topic.TopicName)
+	}
+
+	locked := make([]*LockedExternalTask, 0)
+	err := inTransaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		// tasks of suspended instances are left until they are resumed
+		tasks := make([]*ExternalTask, 0)
+		if err := tx.Select("external_tasks.*").
+			Joins("JOIN process_instances ON process_instances.id = external_tasks.instance_id").
+			Where("process_instances.state = ? AND external_tasks.topic IN (?)", InstanceActive, names).
+			Where("external_tasks.worker_id = '' OR external_tasks.lock_expires_at < ?", now).
+			Where("external_tasks.retries IS NULL OR external_tasks.retries > 0").
+			Where("external_tasks.available_at IS NULL OR external_tasks.available_at <= ?", now).
+			Order("external_tasks.id").Limit(req.MaxTasks).Find(&tasks).Error; err != nil {
+			return err
+		}
+
+		for _, task := range tasks {
+			topic := topics[task.Topic]
+			expires := now.Add(time.Duration(topic.LockDuration) * time.Millisecond)
+			task.WorkerID, task.LockExpiresAt = req.WorkerID, &expires
+			if err := tx.Save(task).Error; err != nil {
+				return err
+			}
+
+			instance, err := findInstance(tx, task.InstanceID)
+			if err != nil {
+				return err
+			}
+			variables, err := externalTaskVariables(tx, instance, task, topic.Variables)
+			if err != nil {
+				return err
+			}
+			locked = append(locked, &LockedExternalTask{
+				ExternalTask: task,
+				BusinessKey:  instance.BusinessKey,
+				Variables:    variables,
+			})
+		}
+		return nil
+	})
+	return locked, err
+}
+
+// externalTaskVariables returns the named variables visible to the task, or
+// every one of them when none are named
+func externalTaskVariables(tx *gorm.DB, instance *ProcessInstance, task *ExternalTask,
+	names []string) (map[string]*TypedValue, error) {
+
+	t, err := findToken(tx, task.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	scopes, err := scopeChain(tx, t)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := loadVariables(tx, instance.ID)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := vars.typedVisible(scopes...)
+	if err != nil || len(names) == 0 {
+		return visible, err
+	}
+
+	named := make(map[string]*TypedValue)
+	for _, name := range names {
+		if value, exists := visible[name]; exists {
+			named[name] = value
+		}
+	}
+	return named, nil
+}
+
+// CompleteExternalTask completes an external task locked by the worker,
+// setting the given variables on the instance
+func CompleteExternalTask(id uint, workerID string, variables map[string]interface{}) error {
+	return withExternalTask(id, workerID, func(x *execution, t *Token, task *ExternalTask) error {
+		if err := x.setVariables(variables); err != nil {
+			return err
+		}
+		if err := x.tx.Unscoped().Delete(task).Error; err != nil {
+			return err
+		}
+		return x.complete(t)
+	})
+}
+
+// FailExternalTask records a failure of an external task locked by the
+// worker, which gives the retries left and how long to wait before the task
+// is fetched again. An incident is raised once no retries are left.
+func FailExternalTask(id uint, workerID string, message string, details string, retries int,
+	retryTimeout time.Duration) error {
+
+	return withExternalTask(id, workerID, func(x *execution, t *Token, task *ExternalTask) error {
+		available := time.Now().Add(retryTimeout)
+		task.Retries = &retries
+		task.AvailableAt = &available
+		task.ErrorMessage, task.ErrorDetails = message, details
+		task.WorkerID, task.LockExpiresAt = "", nil
+		if err := x.tx.Save(task).Error; err != nil {
+			return err
+		}
+		if retries > 0 {
+			return nil
+		}
+		return x.raiseIncident(t, IncidentFailedExternalTask, message)
+	})
+}
+
+// ExternalTaskError reports a BPMN error for an external task locked by the
+// worker, which is handled by the process like an error thrown by the task
+func ExternalTaskError(id uint, workerID string, code string, message string, variables map[string]interface{}) error {
+	return withExternalTask(id, workerID, func(x *execution, t *Token, task *ExternalTask) error {
+		if err := x.setVariables(variables); err != nil {
+			return err
+		}
+		if err := x.tx.Unscoped().Delete(task).Error; err != nil {
+			return err
+		}
+		return x.throwError(t, &BPMNError{Code: code, Message: message})
+	})
+}
+
+// ExtendExternalTaskLock extends the lock the worker holds on an external task
+// to the duration from now
+func ExtendExternalTaskLock(id uint, workerID string, duration time.Duration) error {
+	return withExternalTask(id, workerID, func(x *execution, t *Token, task *ExternalTask) error {
+		expires := time.Now().Add(duration)
+		return x.tx.Model(task).Update("lock_expires_at", expires).Error
+	})
+}
+
+// withExternalTask runs fn with an external task that the worker holds an
+// unexpired lock on and then runs the instance
+func withExternalTask(id uint, workerID string, fn func(x *execution, t *Token, task *ExternalTask) error) error {
+	return inTransaction(func(tx *gorm.DB) error {
+		task, err := findExternalTask(tx, id)
+		if err != nil {
+			return err
+		}
+		if task.WorkerID != workerID || task.LockExpiresAt == nil || task.LockExpiresAt.Before(time.Now()) {
+			return util.NewConflictError("External task %d is not locked by worker %s", task.ID, workerID)
+		}
+		instance, err := findInstance(tx, task.InstanceID)
+		if err != nil {
+			return err
+		}
+		if instance.State != InstanceActive {
+			return util.NewConflictError("Process instance %d is %s", instance.ID, instance.State)
+		}
+		t, err := findToken(tx, task.TokenID)
+		if err != nil {
+			return err
+		}
+
+		x, err := newExecution(tx, instance)
+		if err != nil {
+			return err
+		}
+		if err := fn(x, t, task); err != nil {
+			return err
+		}
+		return x.run()
+	})
+}
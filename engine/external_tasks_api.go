@@ -0,0 +1,257 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+)
+
+// ExternalTaskConfig is the configuration for the external task API
+type ExternalTaskConfig struct {
+	ResultsPerPage int `mapstructure:"default-results-per-page"`
+
+	// longest a fetch waits for tasks to become available
+	MaxAsyncResponseTimeout time.Duration `mapstructure:"max-async-response-timeout"`
+}
+
+// WorkerRequest identifies the worker acting on an external task
+type WorkerRequest struct {
+	WorkerID string `json:"workerId"`
+}
+
+// Validate the WorkerRequest
+func (req *WorkerRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.WorkerID == "" {
+		response = append(response, "Worker ID is required")
+	}
+	return response
+}
+
+// CompleteExternalTaskRequest completes an external task
+type CompleteExternalTaskRequest struct {
+	WorkerRequest
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// FailureRequest reports a failure of an external task along with the retries
+// left and the milliseconds to wait before it is fetched again
+type FailureRequest struct {
+	WorkerRequest
+	ErrorMessage string `json:"errorMessage"`
+	ErrorDetails string `json:"errorDetails"`
+	Retries      int    `json:"retries"`
+	RetryTimeout int64  `json:"retryTimeout"`
+}
+
+// Validate the FailureRequest
+func (req *FailureRequest) Validate() []string {
+	response := req.WorkerRequest.Validate()
+
+	if req.Retries < 0 {
+		response = append(response, "Retries cannot be negative")
+	}
+	if req.RetryTimeout < 0 {
+		response = append(response, "Retry timeout cannot be negative")
+	}
+	return response
+}
+
+// BPMNErrorRequest reports a BPMN error for an external task
+type BPMNErrorRequest struct {
+	WorkerRequest
+	ErrorCode    string                 `json:"errorCode"`
+	ErrorMessage string                 `json:"errorMessage"`
+	Variables    map[string]interface{} `json:"variables"`
+}
+
+// Validate the BPMNErrorRequest
+func (req *BPMNErrorRequest) Validate() []string {
+	response := req.WorkerRequest.Validate()
+
+	if req.ErrorCode == "" {
+		response = append(response, "Error code is required")
+	}
+	return response
+}
+
+// ExtendLockRequest extends the lock on an external task to the milliseconds
+// from now
+type ExtendLockRequest struct {
+	WorkerRequest
+	NewDuration int64 `json:"newDuration"`
+}
+
+// Validate the ExtendLockRequest
+func (req *ExtendLockRequest) Validate() []string {
+	response := req.WorkerRequest.Validate()
+
+	if req.NewDuration < 1 {
+		response = append(response, "New duration must be positive")
+	}
+	return response
+}
+
+// RegisterExternalTasks registers the external task API used by workers
+// outside of the engine
+func RegisterExternalTasks(e *echo.Group, config *ExternalTaskConfig) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+
+	/*
+	 * get external tasks
+	 *   topic      - [string] topic of the tasks
+	 *   workerId   - [string] worker that locked the tasks
+	 *   instanceId - [int] process instance id
+	 *   offset     - [int] (default: 0) offset into the index
+	 *   limit      - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit, instanceID int
+		filter := &ExternalTaskFilter{}
+
+		if err := resource.Param("topic").Optional("").String(c, &filter.Topic); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("workerId").Optional("").String(c, &filter.WorkerID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.InstanceID = uint(instanceID)
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		tasks, err := GetExternalTasks(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, tasks)
+	})
+
+	/*
+	 * lock external tasks of the topics for a worker, waiting for them up to
+	 * the async response timeout when there are none
+	 */
+	e.POST("/fetch-and-lock", func(c echo.Context) error {
+		req := &FetchRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		tasks, err := FetchAndLock(c.Request().Context(), req, config.MaxAsyncResponseTimeout)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, tasks)
+	})
+
+	/*
+	 * complete a locked external task
+	 */
+	e.POST("/:id/complete", func(c echo.Context) error {
+		id, err := externalTaskID(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &CompleteExternalTaskRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := CompleteExternalTask(id, req.WorkerID, req.Variables); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * report the failure of a locked external task
+	 */
+	e.POST("/:id/failure", func(c echo.Context) error {
+		id, err := externalTaskID(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &FailureRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := FailExternalTask(id, req.WorkerID, req.ErrorMessage, req.ErrorDetails, req.Retries,
+			time.Duration(req.RetryTimeout)*time.Millisecond); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * report a BPMN error for a locked external task
+	 */
+	e.POST("/:id/bpmn-error", func(c echo.Context) error {
+		id, err := externalTaskID(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &BPMNErrorRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := ExternalTaskError(id, req.WorkerID, req.ErrorCode, req.ErrorMessage,
+			req.Variables); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * extend the lock on an external task
+	 */
+	e.POST("/:id/extend-lock", func(c echo.Context) error {
+		id, err := externalTaskID(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &ExtendLockRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := ExtendExternalTaskLock(id, req.WorkerID,
+			time.Duration(req.NewDuration)*time.Millisecond); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	resource.GetMethod(e, GetExternalTask)
+}
+
+// externalTaskID reads the id of the external task from the path
+func externalTaskID(c echo.Context) (uint, error) {
+	var id int
+	if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
@@ -0,0 +1,345 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// worker a stand-in for a worker outside of the engine, which only talks to
+// the external task API
+type worker struct {
+	url string
+	id  string
+}
+
+// newWorkerAPI serves the external task API
+func newWorkerAPI() *httptest.Server {
+	e := echo.New()
+	RegisterExternalTasks(e.Group("/external-tasks"), &ExternalTaskConfig{
+		ResultsPerPage:          20,
+		MaxAsyncResponseTimeout: 10 * time.Second,
+	})
+	return httptest.NewServer(e)
+}
+
+// fetch locks up to one task of the topic, waiting up to wait for one
+func (w *worker) fetch(topic string, lock time.Duration, wait time.Duration,
+	variables ...string) ([]*LockedExternalTask, error) {
+
+	req := &FetchRequest{
+		WorkerID:             w.id,
+		MaxTasks:             1,
+		AsyncResponseTimeout: int64(wait / time.Millisecond),
+		Topics: []*FetchTopic{{
+			TopicName:    topic,
+			LockDuration: int64(lock / time.Millisecond),
+			Variables:    variables,
+		}},
+	}
+	tasks := make([]*LockedExternalTask, 0)
+	status, err := w.post("/fetch-and-lock", req, &tasks)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("fetch and lock responded with %d", status)
+	}
+	return tasks, nil
+}
+
+// act posts the request to an endpoint of the task and returns the status of
+// the response
+func (w *worker) act(task *LockedExternalTask, action string, req interface{}) (int, error) {
+	return w.post(fmt.Sprintf("/%d/%s", task.ID, action), req, nil)
+}
+
+// complete completes the task, setting the variables
+func (w *worker) complete(task *LockedExternalTask, variables map[string]interface{}) (int, error) {
+	return w.act(task, "complete", &CompleteExternalTaskRequest{
+		WorkerRequest: WorkerRequest{WorkerID: w.id},
+		Variables:     variables,
+	})
+}
+
+// extendLock extends the lock on the task to the milliseconds from now
+func (w *worker) extendLock(task *LockedExternalTask, duration int64) (int, error) {
+	return w.act(task, "extend-lock", &ExtendLockRequest{
+		WorkerRequest: WorkerRequest{WorkerID: w.id},
+		NewDuration:   duration,
+	})
+}
+
+func (w *worker) post(path string, req interface{}, response interface{}) (int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(w.url+"/external-tasks"+path, echo.MIMEApplicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if response != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// fetchOne fetches a task of the topic without waiting and fails the test
+// unless exactly one was locked
+func (w *worker) fetchOne(t *testing.T, topic string, lock time.Duration) *LockedExternalTask {
+	t.Helper()
+	tasks, err := w.fetch(topic, lock, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("worker %s fetched %d tasks of topic %s", w.id, len(tasks), topic)
+	}
+	return tasks[0]
+}
+
+// expectStatus fails the test unless the worker's request responded with the
+// status
+func expectStatus(t *testing.T, status int, err error, expected int) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != expected {
+		t.Fatalf("responded with %d, expected %d", status, expected)
+	}
+}
+
+const shippingProcess = `
+<error id="noStock" errorCode="NO_STOCK"/>
+<process id="%[1]s" isExecutable="true">
+  <startEvent id="start"/>
+  <sequenceFlow id="f1" sourceRef="start" targetRef="ship"/>
+  <serviceTask id="ship" sw:topic="%[1]s"/>
+  <boundaryEvent id="outOfStock" attachedToRef="ship">
+    <errorEventDefinition errorRef="noStock"/>
+  </boundaryEvent>
+  <sequenceFlow id="f2" sourceRef="ship" targetRef="shipped"/>
+  <userTask id="shipped"/>
+  <sequenceFlow id="f3" sourceRef="outOfStock" targetRef="backorder"/>
+  <userTask id="backorder"/>
+</process>`
+
+func TestExternalTaskLongPoll(t *testing.T) {
+	api := newWorkerAPI()
+	defer api.Close()
+	deployProcess(t, fmt.Sprintf(shippingProcess, "longPoll"))
+
+	// the worker waits for a task before there is one, and completes it
+	done := make(chan error, 1)
+	go func() {
+		w := &worker{url: api.URL, id: "poller"}
+		tasks, err := w.fetch("longPoll", time.Minute, 5*time.Second, "order")
+		if err != nil {
+			done <- err
+			return
+		}
+		if len(tasks) != 1 {
+			done <- fmt.Errorf("fetched %d tasks", len(tasks))
+			return
+		}
+		task := tasks[0]
+		if len(task.Variables) != 1 || task.Variables["order"] == nil || task.Variables["order"].Value != "o-1" {
+			done <- fmt.Errorf("fetched variables %v rather than only the order", task.Variables)
+			return
+		}
+		status, err := w.complete(task, map[string]interface{}{"trackingNumber": "T-1"})
+		if err == nil && status != http.StatusNoContent {
+			err = fmt.Errorf("complete responded with %d", status)
+		}
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	instance := startProcess(t, "longPoll", map[string]interface{}{"order": "o-1", "customer": "c-1"})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the worker did not complete the task")
+	}
+	expectActivities(t, instance.ID, "shipped")
+	if tracking := instanceVariable(t, instance.ID, "trackingNumber"); tracking != "T-1" {
+		t.Errorf("tracking number %v", tracking)
+	}
+
+	// a fetch without tasks returns once the timeout has passed
+	w := &worker{url: api.URL, id: "poller"}
+	started := time.Now()
+	tasks, err := w.fetch("longPoll", time.Minute, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 0 || time.Since(started) < 200*time.Millisecond {
+		t.Errorf("fetched %d tasks after %s", len(tasks), time.Since(started))
+	}
+}
+
+func TestExternalTaskLocks(t *testing.T) {
+	api := newWorkerAPI()
+	defer api.Close()
+	deployProcess(t, fmt.Sprintf(shippingProcess, "locks"))
+	instance := startProcess(t, "locks", map[string]interface{}{"order": "o-2"})
+
+	first := &worker{url: api.URL, id: "first"}
+	second := &worker{url: api.URL, id: "second"}
+	task := first.fetchOne(t, "locks", 200*time.Millisecond)
+	if task.InstanceID != instance.ID || task.ActivityID != "ship" || task.Variables["order"] == nil {
+		t.Fatalf("fetched %+v", task)
+	}
+
+	// the lock keeps other workers from fetching or completing the task
+	if tasks, err := second.fetch("locks", time.Minute, 0); err != nil || len(tasks) != 0 {
+		t.Fatalf("fetched a locked task: %v %v", tasks, err)
+	}
+	status, err := second.complete(task, nil)
+	expectStatus(t, status, err, http.StatusConflict)
+
+	// an extended lock outlives the duration it was fetched with
+	status, err = first.extendLock(task, 60000)
+	expectStatus(t, status, err, http.StatusNoContent)
+	status, err = second.extendLock(task, 60000)
+	expectStatus(t, status, err, http.StatusConflict)
+	time.Sleep(300 * time.Millisecond)
+	if tasks, err := second.fetch("locks", time.Minute, 0); err != nil || len(tasks) != 0 {
+		t.Fatalf("fetched a task whose lock was extended: %v %v", tasks, err)
+	}
+
+	// once a lock expires the task goes to whichever worker fetches it next
+	status, err = first.extendLock(task, 1)
+	expectStatus(t, status, err, http.StatusNoContent)
+	time.Sleep(50 * time.Millisecond)
+	second.fetchOne(t, "locks", time.Minute)
+	status, err = first.complete(task, nil)
+	expectStatus(t, status, err, http.StatusConflict)
+	status, err = second.complete(task, nil)
+	expectStatus(t, status, err, http.StatusNoContent)
+	expectActivities(t, instance.ID, "shipped")
+}
+
+func TestExternalTaskFailures(t *testing.T) {
+	api := newWorkerAPI()
+	defer api.Close()
+	deployProcess(t, fmt.Sprintf(shippingProcess, "failures"))
+	instance := startProcess(t, "failures", nil)
+	w := &worker{url: api.URL, id: "failing"}
+
+	// a failure with retries left hides the task until the retry timeout
+	task := w.fetchOne(t, "failures", time.Minute)
+	status, err := w.act(task, "failure", &FailureRequest{
+		WorkerRequest: WorkerRequest{WorkerID: "failing"},
+		ErrorMessage:  "carrier unavailable",
+		Retries:       2,
+		RetryTimeout:  100,
+	})
+	expectStatus(t, status, err, http.StatusNoContent)
+	if tasks, err := w.fetch("failures", time.Minute, 0); err != nil || len(tasks) != 0 {
+		t.Fatalf("fetched a task before its retry timeout: %v %v", tasks, err)
+	}
+	tasks, err := w.fetch("failures", time.Minute, 3*time.Second)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("did not fetch the task after its retry timeout: %v %v", tasks, err)
+	}
+	task = tasks[0]
+	if task.Retries == nil || *task.Retries != 2 || task.ErrorMessage != "carrier unavailable" {
+		t.Errorf("fetched retries %v and error %q", task.Retries, task.ErrorMessage)
+	}
+
+	// counting the retries down to none raises an incident
+	for _, retries := range []int{1, 0} {
+		status, err = w.act(task, "failure", &FailureRequest{
+			WorkerRequest: WorkerRequest{WorkerID: "failing"},
+			ErrorMessage:  fmt.Sprintf("carrier unavailable, %d retries left", retries),
+			ErrorDetails:  "connection refused",
+			Retries:       retries,
+		})
+		expectStatus(t, status, err, http.StatusNoContent)
+		if retries > 0 {
+			task = w.fetchOne(t, "failures", time.Minute)
+		}
+	}
+	if tasks, err := w.fetch("failures", time.Minute, 0); err != nil || len(tasks) != 0 {
+		t.Fatalf("fetched a task without retries: %v %v", tasks, err)
+	}
+	incidents := instanceIncidents(t, instance.ID)
+	if len(incidents) != 1 || incidents[0].Type != IncidentFailedExternalTask ||
+		incidents[0].Message != "carrier unavailable, 0 retries left" {
+		t.Fatalf("incidents %+v", incidents)
+	}
+	expectActivities(t, instance.ID, "ship")
+
+	// retries cannot be negative
+	status, err = w.act(task, "failure", &FailureRequest{
+		WorkerRequest: WorkerRequest{WorkerID: "failing"},
+		Retries:       -1,
+	})
+	expectStatus(t, status, err, http.StatusBadRequest)
+}
+
+func TestExternalTaskBPMNError(t *testing.T) {
+	api := newWorkerAPI()
+	defer api.Close()
+	deployProcess(t, fmt.Sprintf(shippingProcess, "bpmnError"))
+	instance := startProcess(t, "bpmnError", nil)
+	w := &worker{url: api.URL, id: "erring"}
+
+	task := w.fetchOne(t, "bpmnError", time.Minute)
+	status, err := w.act(task, "bpmn-error", &BPMNErrorRequest{WorkerRequest: WorkerRequest{WorkerID: "erring"}})
+	expectStatus(t, status, err, http.StatusBadRequest)
+
+	// the error is caught by the boundary event, which ends the task
+	status, err = w.act(task, "bpmn-error", &BPMNErrorRequest{
+		WorkerRequest: WorkerRequest{WorkerID: "erring"},
+		ErrorCode:     "NO_STOCK",
+		ErrorMessage:  "item 7 is out of stock",
+		Variables:     map[string]interface{}{"missingItem": 7},
+	})
+	expectStatus(t, status, err, http.StatusNoContent)
+	expectActivities(t, instance.ID, "backorder")
+	if item := instanceVariable(t, instance.ID, "missingItem"); fmt.Sprint(item) != "7" {
+		t.Errorf("missing item %v", item)
+	}
+
+	tasks, err := GetExternalTasks(&ExternalTaskFilter{InstanceID: instance.ID}, 0, 10)
+	if err != nil || len(tasks) != 0 {
+		t.Fatalf("external tasks left %v %v", tasks, err)
+	}
+	status, err = w.complete(task, nil)
+	expectStatus(t, status, err, http.StatusNotFound)
+}
+
+func TestFetchAndLockValidation(t *testing.T) {
+	api := newWorkerAPI()
+	defer api.Close()
+	w := &worker{url: api.URL}
+
+	topics := []*FetchTopic{{TopicName: "topic", LockDuration: 1000}}
+	for _, req := range []*FetchRequest{
+		{MaxTasks: 1, Topics: topics},
+		{WorkerID: "w", Topics: topics},
+		{WorkerID: "w", MaxTasks: 1},
+		{WorkerID: "w", MaxTasks: 1, Topics: []*FetchTopic{{TopicName: "topic"}}},
+		{WorkerID: "w", MaxTasks: 1, AsyncResponseTimeout: -1, Topics: topics},
+	} {
+		status, err := w.post("/fetch-and-lock", req, nil)
+		expectStatus(t, status, err, http.StatusBadRequest)
+	}
+}
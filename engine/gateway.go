@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// exclusiveGatewayBehavior passes every arriving token through and takes the
+// first outgoing flow whose condition holds
+type exclusiveGatewayBehavior struct{}
+
+func (exclusiveGatewayBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.complete(t)
+}
+
+func (exclusiveGatewayBehavior) leave(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.takeSelected(t, node, true)
+}
+
+// parallelGatewayBehavior waits for a token on every incoming flow and then
+// takes every outgoing flow regardless of their conditions
+type parallelGatewayBehavior struct{}
+
+func (parallelGatewayBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	joined, arrived, err := x.joinTokens(t, node)
+	if err != nil || !arrived {
+		return err
+	}
+	return x.join(t, joined)
+}
+
+func (parallelGatewayBehavior) leave(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.take(t, node.Outgoing)
+}
+
+// inclusiveGatewayBehavior waits for a token on every incoming flow that can
+// still be activated and then takes every outgoing flow whose condition holds
+type inclusiveGatewayBehavior struct{}
+
+func (b inclusiveGatewayBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	_, err := b.tryJoin(x, t, node)
+	return err
+}
+
+func (inclusiveGatewayBehavior) leave(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.takeSelected(t, node, false)
+}
+
+// tryJoin joins the tokens waiting at the gateway once no other token within
+// the same scope can reach it, returning true when the join happened. Tokens
+// within a subprocess of the scope are accounted for by the subprocess.
+func (inclusiveGatewayBehavior) tryJoin(x *execution, t *Token, node *bpmn.FlowNode) (bool, error) {
+	joined, arrived, err := x.joinTokens(t, node)
+	if err != nil {
+		return false, err
+	}
+
+	if !arrived {
+		others := make([]*Token, 0)
+		if err := x.tx.Where("instance_id = ? AND activity_id <> ? AND state <> ? AND parent_id = ?",
+			x.instance.ID, node.ID, TokenCompleted, t.ParentID).Find(&others).Error; err != nil {
+			return false, err
+		}
+		for _, other := range others {
+			position, err := x.node(other)
+			if err != nil {
+				return false, err
+			}
+			if position.CanReach(node) {
+				return false, nil
+			}
+		}
+	}
+	return true, x.join(t, joined)
+}
+
+// joinTokens returns a waiting token for every incoming flow of the node other
+// than the one the token arrived on, and whether every incoming flow has one
+func (x *execution) joinTokens(t *Token, node *bpmn.FlowNode) ([]*Token, bool, error) {
+	waiting, err := x.waitingTokens(t, node)
+	if err != nil {
+		return nil, false, err
+	}
+
+	byFlow := map[string]*Token{t.FlowID: t}
+	joined := make([]*Token, 0)
+	for _, w := range waiting {
+		if byFlow[w.FlowID] == nil {
+			byFlow[w.FlowID] = w
+			joined = append(joined, w)
+		}
+	}
+
+	for _, flow := range node.Incoming {
+		if byFlow[flow.ID] == nil {
+			return joined, false, nil
+		}
+	}
+	return joined, true, nil
+}
+
+// join ends the joined tokens and completes the gateway with the token that
+// arrived last
+func (x *execution) join(t *Token, joined []*Token) error {
+	for _, other := range joined {
+		if err := x.end(other); err != nil {
+			return err
+		}
+	}
+	return x.complete(t)
+}
+
+// resumeJoins fires inclusive gateway joins that were waiting on tokens which
+// have since completed or moved past the gateway
+func (x *execution) resumeJoins() error {
+	waiting := make([]*Token, 0)
+	if err := x.tx.Where("instance_id = ? AND state = ?", x.instance.ID, TokenActive).
+		Order("id").Find(&waiting).Error; err != nil {
+		return err
+	}
+
+	// a gateway is joined once per scope
+	attempted := make(map[string]bool)
+	for _, t := range waiting {
+		node, err := x.node(t)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%d/%s", t.ParentID, node.ID)
+		if node.Type != bpmn.InclusiveGateway || attempted[key] {
+			continue
+		}
+		attempted[key] = true
+
+		if _, err := (inclusiveGatewayBehavior{}).tryJoin(x, t, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
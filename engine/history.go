@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// order of the history levels, each of which records everything the levels
+// before it do
+var historyLevels = map[string]int{
+	HistoryNone:     0,
+	HistoryActivity: 1,
+	HistoryFull:     2,
+}
+
+var historyLevel = HistoryActivity
+
+// SetHistoryLevel sets how much history is recorded as instances run, which
+// is one of none, activity or full
+func SetHistoryLevel(level string) error {
+	if _, exists := historyLevels[level]; !exists {
+		return fmt.Errorf("History level must be one of none, activity or full but was %q", level)
+	}
+	historyLevel = level
+	return nil
+}
+
+// recordsHistory tells whether the history level records the given level
+func recordsHistory(level string) bool {
+	return historyLevels[historyLevel] >= historyLevels[level]
+}
+
+// millisBetween returns the milliseconds from start to end
+func millisBetween(start time.Time, end time.Time) *int64 {
+	millis := int64(end.Sub(start) / time.Millisecond)
+	return &millis
+}
+
+// recordInstanceStart records the start of an instance
+func recordInstanceStart(tx *gorm.DB, instance *ProcessInstance) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	return tx.Create(&HistoricInstance{
+		InstanceID:       instance.ID,
+		DefinitionID:     instance.DefinitionID,
+		DefinitionKey:    instance.DefinitionKey,
+		BusinessKey:      instance.BusinessKey,
+		TenantID:         instance.TenantID,
+		ParentInstanceID: instance.ParentInstanceID,
+		State:            instance.State,
+		StartedAt:        instance.CreatedAt,
+	}).Error
+}
+
+// recordInstanceState records a change to the state of an instance along with
+// its duration once it has ended
+func recordInstanceState(tx *gorm.DB, instance *ProcessInstance) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	updates := map[string]interface{}{
+		"state":         instance.State,
+		"cancel_reason": instance.CancelReason,
+	}
+	if instance.EndedAt != nil {
+		updates["ended_at"] = *instance.EndedAt
+		updates["duration"] = *millisBetween(instance.CreatedAt, *instance.EndedAt)
+	}
+	return tx.Model(&HistoricInstance{}).Where("instance_id = ?", instance.ID).Updates(updates).Error
+}
+
+// recordActivityStart records the token entering a flow node
+func (x *execution) recordActivityStart(t *Token, node *bpmn.FlowNode) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	return x.tx.Create(&HistoricActivity{
+		InstanceID:   x.instance.ID,
+		TokenID:      t.ID,
+		ActivityID:   node.ID,
+		ActivityName: node.Name,
+		ActivityType: string(node.Type),
+		StartedAt:    time.Now(),
+	}).Error
+}
+
+// recordActivityEnd records the tokens matched by the condition leaving the
+// flow nodes they are on, which they either completed or were interrupted on
+func recordActivityEnd(tx *gorm.DB, cancelled bool, condition string, args ...interface{}) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	open := make([]*HistoricActivity, 0)
+	if err := tx.Where(condition, args...).Where("ended_at IS NULL").Find(&open).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, activity := range open {
+		activity.EndedAt = &now
+		activity.Duration = millisBetween(activity.StartedAt, now)
+		activity.Cancelled = cancelled
+		if err := tx.Save(activity).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordVariable records a change to a variable given its value before the
+// change, which is nil when the variable was created, and the row after the
+// change, which is nil when the variable was deleted
+func recordVariable(tx *gorm.DB, before *Variable, after *Variable) error {
+	if !recordsHistory(HistoryFull) {
+		return nil
+	}
+	change := &HistoricVariable{Operation: VariableUpdated}
+	for _, v := range []struct {
+		row    *Variable
+		target *string
+	}{{before, &change.OldValue}, {after, &change.NewValue}} {
+		if v.row == nil {
+			continue
+		}
+		change.InstanceID, change.ScopeID, change.Name, change.Type = v.row.InstanceID, v.row.ScopeID, v.row.Name, v.row.Type
+		value, err := v.row.decode()
+		if err != nil {
+			return err
+		}
+		if date, isDate := value.(time.Time); isDate {
+			value = date.Format(time.RFC3339Nano)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("Unable to record the history of variable %s: %s", v.row.Name, err)
+		}
+		*v.target = string(data)
+	}
+
+	switch {
+	case before == nil:
+		change.Operation = VariableCreated
+	case after == nil:
+		change.Operation = VariableDeleted
+	case change.OldValue == change.NewValue && before.Type == after.Type:
+		return nil
+	}
+	return tx.Create(change).Error
+}
+
+// recordTaskEvent records something that happened to a task along with the
+// user acting on it, nil when the engine did
+func recordTaskEvent(tx *gorm.DB, task *Task, event string, userID *uint) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	return tx.Create(&HistoricTask{
+		TaskID:     task.ID,
+		InstanceID: task.InstanceID,
+		ActivityID: task.ActivityID,
+		Name:       task.Name,
+		Event:      event,
+		UserID:     userID,
+		AssigneeID: task.AssigneeID,
+	}).Error
+}
+
+// recordIncident records an incident being raised
+func recordIncident(tx *gorm.DB, incident *Incident) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	return tx.Create(&HistoricIncident{
+		IncidentID: incident.ID,
+		InstanceID: incident.InstanceID,
+		TokenID:    incident.TokenID,
+		ActivityID: incident.ActivityID,
+		Type:       incident.Type,
+		Message:    incident.Message,
+		JobID:      incident.JobID,
+		State:      IncidentOpen,
+	}).Error
+}
+
+// recordIncidentEnd records the open incidents matched by the condition
+// ending in the given state
+func recordIncidentEnd(tx *gorm.DB, state string, condition string, args ...interface{}) error {
+	if !recordsHistory(HistoryActivity) {
+		return nil
+	}
+	return tx.Model(&HistoricIncident{}).Where(condition, args...).Where("state = ?", IncidentOpen).
+		Updates(map[string]interface{}{"state": state, "ended_at": time.Now()}).Error
+}
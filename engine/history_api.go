@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+)
+
+// HistoryConfig is the configuration for the history of process instances
+type HistoryConfig struct {
+	ResultsPerPage int `mapstructure:"default-results-per-page"`
+
+	// how much history is recorded: none, activity or full, which adds the
+	// changes to variables
+	Level string `mapstructure:"level"`
+}
+
+// RegisterHistory registers the history API, the audit trail of process
+// instances that is kept after they have ended
+func RegisterHistory(e *echo.Group, config *HistoryConfig) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+
+	/*
+	 * get the history of process instances, in the order they started
+	 *   definitionKey - [string] key of the process definition
+	 *   businessKey   - [string] business key of the instance
+	 *   state         - [string] state of the instance
+	 *   tenantId      - [string] tenant of the instance
+	 *   startedAfter  - [time] only instances started at or after this time
+	 *   startedBefore - [time] only instances started before this time
+	 *   offset        - [int] (default: 0) offset into the index
+	 *   limit         - [int] (default: 20) number of results to return
+	 */
+	e.GET("/instances", func(c echo.Context) error {
+		var offset, limit int
+		filter := &HistoricInstanceFilter{}
+
+		if err := resource.Param("definitionKey").Optional("").String(c, &filter.DefinitionKey); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("businessKey").Optional("").String(c, &filter.BusinessKey); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("state").Optional("").String(c, &filter.State); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("tenantId").Optional("").String(c, &filter.TenantID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("startedAfter").Optional("").Time(c, &filter.StartedAfter); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("startedBefore").Optional("").Time(c, &filter.StartedBefore); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		instances, err := GetHistoricInstances(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, instances)
+	})
+
+	// the history of an instance, given the id of the instance
+	resource.GetMethod(e.Group("/instances"), GetHistoricInstance)
+
+	/*
+	 * get the activities tokens were positioned on, in the order they started
+	 *   instanceId   - [int] process instance id
+	 *   activityId   - [string] id of the flow node
+	 *   activityType - [string] type of the flow node
+	 *   offset       - [int] (default: 0) offset into the index
+	 *   limit        - [int] (default: 20) number of results to return
+	 */
+	e.GET("/activities", func(c echo.Context) error {
+		var offset, limit, instanceID int
+		filter := &HistoricActivityFilter{}
+
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.InstanceID = uint(instanceID)
+		if err := resource.Param("activityId").Optional("").String(c, &filter.ActivityID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("activityType").Optional("").String(c, &filter.ActivityType); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		activities, err := GetHistoricActivities(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, activities)
+	})
+
+	/*
+	 * get the changes to variables, oldest first. Only recorded at the full
+	 * history level.
+	 *   instanceId - [int] process instance id
+	 *   name       - [string] name of the variable
+	 *   offset     - [int] (default: 0) offset into the index
+	 *   limit      - [int] (default: 20) number of results to return
+	 */
+	e.GET("/variables", func(c echo.Context) error {
+		var offset, limit, instanceID int
+		filter := &HistoricVariableFilter{}
+
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.InstanceID = uint(instanceID)
+		if err := resource.Param("name").Optional("").String(c, &filter.Name); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		variables, err := GetHistoricVariables(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, variables)
+	})
+
+	/*
+	 * get what happened to user tasks, oldest first
+	 *   instanceId - [int] process instance id
+	 *   taskId     - [int] task id
+	 *   userId     - [int] user acting on the task
+	 *   event      - [string] create, claim, unclaim, delegate, resolve,
+	 *                due-date, complete or cancel
+	 *   offset     - [int] (default: 0) offset into the index
+	 *   limit      - [int] (default: 20) number of results to return
+	 */
+	e.GET("/tasks", func(c echo.Context) error {
+		var offset, limit, instanceID, taskID, userID int
+		filter := &HistoricTaskFilter{}
+
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.InstanceID = uint(instanceID)
+		if err := resource.Param("taskId").Optional("0").Int(c, &taskID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.TaskID = uint(taskID)
+		if err := resource.Param("userId").Optional("0").Int(c, &userID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.UserID = uint(userID)
+		if err := resource.Param("event").Optional("").String(c, &filter.Event); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		tasks, err := GetHistoricTasks(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, tasks)
+	})
+
+	/*
+	 * get incidents, including those resolved or removed, oldest first
+	 *   instanceId - [int] process instance id
+	 *   activityId - [string] activity the incident was raised on
+	 *   type       - [string] type of incident
+	 *   state      - [string] open, resolved or deleted
+	 *   offset     - [int] (default: 0) offset into the index
+	 *   limit      - [int] (default: 20) number of results to return
+	 */
+	e.GET("/incidents", func(c echo.Context) error {
+		var offset, limit, instanceID int
+		filter := &HistoricIncidentFilter{}
+
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.InstanceID = uint(instanceID)
+		if err := resource.Param("activityId").Optional("").String(c, &filter.ActivityID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("type").Optional("").String(c, &filter.Type); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("state").Optional("").String(c, &filter.State); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		incidents, err := GetHistoricIncidents(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, incidents)
+	})
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// createIncident records and logs an incident
+func createIncident(tx *gorm.DB, incident *Incident) error {
+	if err := tx.Create(incident).Error; err != nil {
+		return err
+	}
+	if err := recordIncident(tx, incident); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"incident": incident.ID,
+		"type":     incident.Type,
+		"instance": incident.InstanceID,
+		"token":    incident.TokenID,
+		"activity": incident.ActivityID,
+		"job":      incident.JobID,
+	}).Warnf("Incident raised: %s", incident.Message)
+	return nil
+}
+
+// errorChain describes an error followed by the errors it wraps, one per line
+func errorChain(err error) string {
+	chain := make([]string, 0)
+	for err != nil {
+		chain = append(chain, err.Error())
+		wrapper, isWrapper := err.(interface{ Unwrap() error })
+		if !isWrapper {
+			break
+		}
+		err = wrapper.Unwrap()
+	}
+	return strings.Join(chain, "\n")
+}
+
+// ResolveIncident retries what failed once the given variables are set on the
+// instance. A job or external task that ran out of retries is given the
+// retries, at least one, and is run again by the job executor or a worker.
+// Other incidents move their token on again: a token that failed to leave its
+// activity takes the outgoing flows again and any other token starts its
+// activity over. Incidents of jobs outside of any instance only take the
+// retries.
+func ResolveIncident(id uint, retries int, variables map[string]interface{}) error {
+	if retries < 1 {
+		retries = 1
+	}
+	return inTransaction(func(tx *gorm.DB) error {
+		incident, err := findIncident(tx, id)
+		if err != nil {
+			return err
+		}
+		if incident.InstanceID == 0 {
+			if len(variables) > 0 {
+				return util.NewValidationError("Incident %d does not belong to an instance to set variables on", id)
+			}
+			if err := endIncident(tx, incident); err != nil {
+				return err
+			}
+			return retryJob(tx, incident.JobID, retries)
+		}
+
+		instance, err := findInstance(tx, incident.InstanceID)
+		if err != nil {
+			return err
+		}
+		if instance.State != InstanceActive {
+			return util.NewConflictError("Process instance %d is %s", instance.ID, instance.State)
+		}
+
+		x, err := newExecution(tx, instance)
+		if err != nil {
+			return err
+		}
+		if err := x.setVariables(variables); err != nil {
+			return err
+		}
+		if err := endIncident(tx, incident); err != nil {
+			return err
+		}
+
+		switch {
+		case incident.JobID != 0:
+			return retryJob(tx, incident.JobID, retries)
+		case incident.Type == IncidentFailedExternalTask:
+			if err := tx.Model(&ExternalTask{}).Where("token_id = ?", incident.TokenID).Updates(map[string]interface{}{
+				"retries":      retries,
+				"available_at": gorm.Expr("NULL"),
+			}).Error; err != nil {
+				return err
+			}
+			announceExternalTask()
+			return nil
+		}
+
+		t, err := findToken(tx, incident.TokenID)
+		if err != nil {
+			return err
+		}
+		if err := x.retry(t, incident); err != nil {
+			return err
+		}
+		return x.run()
+	})
+}
+
+// endIncident deletes a resolved incident
+func endIncident(tx *gorm.DB, incident *Incident) error {
+	if err := recordIncidentEnd(tx, IncidentResolved, "incident_id = ?", incident.ID); err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(incident).Error
+}
+
+// retryJob gives a job that ran out of retries the retries and makes it due
+func retryJob(tx *gorm.DB, jobID uint, retries int) error {
+	return tx.Model(&Job{}).Where("id = ?", jobID).Updates(map[string]interface{}{
+		"retries":         retries,
+		"failures":        0,
+		"due_at":          time.Now(),
+		"lock_owner":      "",
+		"lock_expires_at": gorm.Expr("NULL"),
+	}).Error
+}
+
+// retry moves the token of an incident on again. A completing token whose
+// outgoing flows could not be selected selects them again, an active token
+// has whatever its activity was waiting on removed and starts the activity
+// over, and a token that failed to start or complete its activity steps
+// again.
+func (x *execution) retry(t *Token, incident *Incident) error {
+	switch t.State {
+	case TokenCompleted:
+		return nil
+
+	case TokenCompleting:
+		if incident.Type == IncidentNoOutgoingFlow || incident.Type == IncidentCondition {
+			node, err := x.node(t)
+			if err != nil {
+				return err
+			}
+			b, err := behaviorOf(node)
+			if err != nil {
+				return err
+			}
+			return b.leave(x, t, node)
+		}
+
+	case TokenActive:
+		if err := x.closeTasks(t, TaskCancelled); err != nil {
+			return err
+		}
+		if err := x.detach(t); err != nil {
+			return err
+		}
+		t.State = TokenReady
+	}
+	return x.save(t)
+}
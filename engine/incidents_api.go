@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+)
+
+// ResolveIncidentRequest resolves an incident by retrying, optionally with
+// changed variables. Retries are given to the job or external task that ran
+// out of them.
+type ResolveIncidentRequest struct {
+	Retries   int                    `json:"retries"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Validate the ResolveIncidentRequest
+func (req *ResolveIncidentRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.Retries < 0 {
+		response = append(response, "Retries cannot be negative")
+	}
+	return response
+}
+
+// RegisterIncidents registers the incident API, the queue of work that is
+// stuck until it is resolved
+func RegisterIncidents(e *echo.Group, config *Config) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+
+	/*
+	 * get incidents, oldest first
+	 *   instanceId - [int] process instance id
+	 *   activityId - [string] activity the incident was raised on
+	 *   type       - [string] type of incident
+	 *   offset     - [int] (default: 0) offset into the index
+	 *   limit      - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit, instanceID int
+		filter := &IncidentFilter{}
+
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		filter.InstanceID = uint(instanceID)
+		if err := resource.Param("activityId").Optional("").String(c, &filter.ActivityID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("type").Optional("").String(c, &filter.Type); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		incidents, err := GetIncidents(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, incidents)
+	})
+
+	/*
+	 * resolve an incident by retrying what failed
+	 */
+	e.POST("/:id/resolve", func(c echo.Context) error {
+		var id int
+		if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &ResolveIncidentRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := ResolveIncident(uint(id), req.Retries, req.Variables); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	resource.GetMethod(e, GetIncident)
+}
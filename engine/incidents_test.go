@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sterrasi/stepwise/util"
+)
+
+// wrapped an error that wraps another
+type wrapped struct {
+	message string
+	cause   error
+}
+
+func (w *wrapped) Error() string {
+	return w.message + ": " + w.cause.Error()
+}
+
+func (w *wrapped) Unwrap() error {
+	return w.cause
+}
+
+func TestErrorChain(t *testing.T) {
+	cause := fmt.Errorf("connection refused")
+	expected := "GET /orders: dial: connection refused\ndial: connection refused\nconnection refused"
+	if chain := errorChain(&wrapped{"GET /orders", &wrapped{"dial", cause}}); chain != expected {
+		t.Errorf("chain %q", chain)
+	}
+	if chain := errorChain(cause); chain != "connection refused" {
+		t.Errorf("chain %q", chain)
+	}
+}
+
+func TestIncidentStackTrace(t *testing.T) {
+	s := newService(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	defer s.Close()
+	deployProcess(t, fmt.Sprintf(connectorProcess, "incidentStackTrace", `
+      <sw:http url="${baseUrl}/invalid">
+        <sw:status code="400" outcome="incident"/>
+      </sw:http>`))
+	deployProcess(t, `
+<process id="incidentWithoutJob" isExecutable="true">
+  <startEvent id="start"/>
+  <sequenceFlow id="f1" sourceRef="start" targetRef="script"/>
+  <scriptTask id="script" scriptFormat="expression"><script>missing.name</script></scriptTask>
+</process>`)
+
+	// a failed job keeps the errors that failed it rather than the stack of
+	// the executor
+	instance := startProcess(t, "incidentStackTrace", map[string]interface{}{"baseUrl": s.URL})
+	runJobs(t, instance.ID)
+	incidents := instanceIncidents(t, instance.ID)
+	if len(incidents) != 1 {
+		t.Fatalf("incidents %+v", incidents)
+	}
+	if trace := incidents[0].StackTrace; trace != incidents[0].Message || strings.Contains(trace, "goroutine") {
+		t.Errorf("stack trace %q of %q", trace, incidents[0].Message)
+	}
+
+	// other incidents have none
+	instance = startProcess(t, "incidentWithoutJob", nil)
+	incidents = instanceIncidents(t, instance.ID)
+	if len(incidents) != 1 || incidents[0].StackTrace != "" {
+		t.Errorf("incidents %+v", incidents)
+	}
+}
+
+func TestFailedJobWithoutToken(t *testing.T) {
+	job := &Job{Type: "unknown", ActivityID: "unknownStart", DueAt: time.Now(), Retries: 1}
+	if err := db.Create(job).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(job)
+
+	// a job of no instance that runs out of retries raises an incident
+	runJobs(t, 0)
+	incident := &Incident{}
+	if err := db.Where("job_id = ?", job.ID).First(incident).Error; err != nil {
+		t.Fatal(err)
+	}
+	if incident.InstanceID != 0 || incident.TokenID != 0 || incident.ActivityID != "unknownStart" ||
+		incident.Type != IncidentFailedJob || incident.Message != "Unknown job type unknown" {
+		t.Errorf("incident %+v", incident)
+	}
+
+	// which is resolved by retrying the job without setting variables
+	err := ResolveIncident(incident.ID, 2, map[string]interface{}{"retried": true})
+	if !util.IsValidationError(err) {
+		t.Errorf("resolving with variables failed with %v", err)
+	}
+	if err := ResolveIncident(incident.ID, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(job, job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Retries != 2 || job.Failures != 0 || job.LockOwner != "" {
+		t.Errorf("job %+v", job)
+	}
+	if _, err := findIncident(db, incident.ID); err != util.ErrNotFound {
+		t.Errorf("incident left after resolving it: %v", err)
+	}
+}
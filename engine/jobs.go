@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"math"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/sterrasi/stepwise/timer"
+)
+
+const (
+
+	// number of times a job is run before an incident is raised
+	jobRetries = 3
+
+	// delay before a job of a suspended instance is tried again
+	suspendedDelay = time.Minute
+)
+
+// jobHandler runs a job within the transaction of the executor. It returns
+// false when the job has not finished and has been rescheduled by the handler.
+type jobHandler func(tx *gorm.DB, job *Job) (bool, error)
+
+var jobHandlers = map[string]jobHandler{
+	JobTimer: fireTimer,
+}
+
+// jobCall prepares the slow part of a job, such as a request over the
+// network, within the transaction of the executor. The returned work runs
+// outside of any transaction so that other executions are not held up and
+// returns the handler that applies its result. No work is returned when the
+// call has already dealt with the job.
+type jobCall func(tx *gorm.DB, job *Job) (func() jobHandler, error)
+
+var jobCalls = map[string]jobCall{
+	JobHTTP: callHTTP,
+}
+
+// postpone unlocks the job so that it runs again later
+func postpone(tx *gorm.DB, job *Job) error {
+	return tx.Model(job).Updates(map[string]interface{}{
+		"due_at":          time.Now().Add(suspendedDelay),
+		"lock_owner":      "",
+		"lock_expires_at": gorm.Expr("NULL"),
+	}).Error
+}
+
+// finishJob deletes a job that has run unless it is a timer cycle with
+// repetitions left, which is rescheduled instead. Jobs may have been deleted
+// by their own handler such as when an interrupting boundary timer fires.
+func finishJob(tx *gorm.DB, job *Job) error {
+	var count int
+	if err := tx.Model(&Job{}).Where("id = ?", job.ID).Count(&count).Error; err != nil || count == 0 {
+		return err
+	}
+
+	if job.Timer != "" && job.Repetitions != 1 {
+		tm, err := timer.Parse(timer.Cycle, job.Timer)
+		if err == nil {
+			repetitions := job.Repetitions
+			if repetitions != timer.Unbounded {
+				repetitions--
+			}
+			return tx.Model(job).Updates(map[string]interface{}{
+				"due_at":          tm.Next(job.DueAt, time.Now()),
+				"repetitions":     repetitions,
+				"failures":        0,
+				"error":           "",
+				"lock_owner":      "",
+				"lock_expires_at": gorm.Expr("NULL"),
+			}).Error
+		}
+		logrus.Errorf("Dropping repetitions of job %d: %s", job.ID, err)
+	}
+	return tx.Unscoped().Delete(job).Error
+}
+
+// failJob records a failed run of a job and reschedules it with an
+// exponential backoff. An incident is raised once no retries are left.
+func failJob(tx *gorm.DB, job *Job, cause error, backoff time.Duration) error {
+	if job.Backoff > 0 {
+		backoff = job.Backoff
+	}
+	job.Retries--
+	job.Failures++
+	job.Error = cause.Error()
+	job.LockOwner = ""
+	job.LockExpiresAt = nil
+	job.DueAt = time.Now().Add(backoff * time.Duration(math.Pow(2, float64(job.Failures-1))))
+	if err := tx.Save(job).Error; err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"job":      job.ID,
+		"type":     job.Type,
+		"instance": job.InstanceID,
+		"activity": job.ActivityID,
+		"retries":  job.Retries,
+	}).Warnf("Job failed: %s", job.Error)
+
+	if job.Retries > 0 {
+		return nil
+	}
+
+	// jobs without a token, such as those of timer start events, are known
+	// by the job and its activity
+	incident := &Incident{
+		InstanceID: job.InstanceID,
+		ActivityID: job.ActivityID,
+		Type:       IncidentFailedJob,
+		Message:    job.Error,
+		JobID:      job.ID,
+	}
+	if job.TokenID != 0 {
+		t, err := findToken(tx, job.TokenID)
+		if err != nil {
+			return err
+		}
+		incident.TokenID, incident.ActivityID = t.ID, t.ActivityID
+	}
+	// only a panic has a stack worth keeping, the stack here is the executor's
+	if p, isPanic := cause.(*panicError); isPanic {
+		incident.StackTrace = p.stack
+	} else {
+		incident.StackTrace = errorChain(cause)
+	}
+	return createIncident(tx, incident)
+}
+
+// abandonJob records a failure of a job that is not worth retrying, raising
+// an incident straight away
+func abandonJob(tx *gorm.DB, job *Job, cause error) error {
+	job.Retries = 1
+	return failJob(tx, job, cause, 0)
+}
@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// variables local to the token of a multi-instance activity
+const (
+	nrOfInstances          = "nrOfInstances"
+	nrOfActiveInstances    = "nrOfActiveInstances"
+	nrOfCompletedInstances = "nrOfCompletedInstances"
+)
+
+// loopCounter is local to each instance and counts from zero
+const loopCounter = "loopCounter"
+
+// startLoop runs a multi-instance activity. The token of the activity acts as
+// the scope of a token for every instance, which runs the activity itself
+// with the element of the collection and the loop counter as local
+// variables. Instances run one after the other when the loop is sequential
+// and all at once otherwise. Boundary events are attached to the activity as
+// a whole rather than to its instances.
+func (x *execution) startLoop(body *Token, node *bpmn.FlowNode) error {
+	body.State = TokenActive
+	if err := x.tx.Save(body).Error; err != nil {
+		return err
+	}
+	if err := x.attachBoundaries(body, node); err != nil {
+		return err
+	}
+
+	items, count, err := x.loopItems(body, node)
+	if err != nil {
+		return x.raiseIncident(body, IncidentExpression, err.Error())
+	}
+	counters := map[string]interface{}{
+		nrOfInstances:          count,
+		nrOfActiveInstances:    0,
+		nrOfCompletedInstances: 0,
+	}
+	for name, value := range counters {
+		if err := x.vars.set(x.tx, x.instance.ID, body.ID, name, "", value); err != nil {
+			return err
+		}
+	}
+	if count == 0 {
+		return x.complete(body)
+	}
+
+	started := count
+	if node.Loop.Sequential {
+		started = 1
+	}
+	for i := 0; i < started; i++ {
+		if err := x.startLoopInstance(body, node, items, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loopItems evaluates the collection of the loop, or its cardinality when it
+// has none in which case no items are returned, along with the number of
+// instances to run
+func (x *execution) loopItems(body *Token, node *bpmn.FlowNode) ([]interface{}, int, error) {
+	vars, err := x.variables(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	loop := node.Loop
+	if loop.Collection != "" {
+		value, err := expr.Evaluate(loop.Collection, vars)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Collection of %s: %s", node.ID, err)
+		}
+		if value == nil {
+			return nil, 0, nil
+		}
+		items, isList := value.([]interface{})
+		if !isList {
+			return nil, 0, fmt.Errorf("Collection of %s is a %T rather than a list", node.ID, value)
+		}
+		return items, len(items), nil
+	}
+
+	value, err := expr.Evaluate(loop.Cardinality, vars)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Loop cardinality of %s: %s", node.ID, err)
+	}
+	var count int
+	switch v := value.(type) {
+	case float64:
+		count = int(v)
+	case int64:
+		count = int(v)
+	default:
+		return nil, 0, fmt.Errorf("Loop cardinality of %s is a %T rather than a number", node.ID, value)
+	}
+	if count < 0 {
+		return nil, 0, fmt.Errorf("Loop cardinality of %s is negative", node.ID)
+	}
+	return nil, count, nil
+}
+
+// startLoopInstance enters a token for the instance at the zero-based index
+func (x *execution) startLoopInstance(body *Token, node *bpmn.FlowNode, items []interface{}, index int) error {
+	t := &Token{ParentID: body.ID, Loop: index + 1}
+	if err := x.enter(t, node, nil); err != nil {
+		return err
+	}
+
+	locals := map[string]interface{}{loopCounter: index}
+	if node.Loop.ElementVariable != "" && index < len(items) {
+		locals[node.Loop.ElementVariable] = items[index]
+	}
+	for name, value := range locals {
+		if err := x.vars.set(x.tx, x.instance.ID, t.ID, name, "", value); err != nil {
+			return err
+		}
+	}
+	return x.addToCounter(body, nrOfActiveInstances, 1)
+}
+
+// completeLoopInstance finishes an instance of a multi-instance activity,
+// mapping its outputs to the scope enclosing the activity where it is also
+// recorded for compensation. Once every
+// instance has completed, or the completion condition holds in which case
+// the instances still running are interrupted, the activity completes.
+// Otherwise a sequential loop starts its next instance.
+func (x *execution) completeLoopInstance(t *Token, node *bpmn.FlowNode) error {
+	body, err := findToken(x.tx, t.ParentID)
+	if err != nil {
+		return err
+	}
+	if err := x.applyMappings(t, node.Outputs, body.ParentID); err != nil {
+		return x.raiseIncident(t, IncidentExpression, fmt.Sprintf("Output mapping of %s: %s", node.ID, err))
+	}
+	counters, err := x.loopCounters(body)
+	if err != nil {
+		return err
+	}
+	counters[nrOfActiveInstances]--
+	counters[nrOfCompletedInstances]++
+
+	completed := counters[nrOfCompletedInstances]
+	done := completed >= counters[nrOfInstances]
+	if !done && node.Loop.CompletionCondition != "" {
+		vars, err := x.variables(t)
+		if err != nil {
+			return err
+		}
+		for name, value := range counters {
+			vars[name] = value
+		}
+		if done, err = expr.EvaluateBool(node.Loop.CompletionCondition, vars); err != nil {
+			return x.raiseIncident(t, IncidentExpression, fmt.Sprintf("Completion condition of %s: %s", node.ID, err))
+		}
+	}
+	var items []interface{}
+	if !done && node.Loop.Sequential {
+		if items, _, err = x.loopItems(body, node); err != nil {
+			return x.raiseIncident(t, IncidentExpression, err.Error())
+		}
+	}
+	for name, value := range counters {
+		if err := x.vars.set(x.tx, x.instance.ID, body.ID, name, "", value); err != nil {
+			return err
+		}
+	}
+	if err := x.recordCompensation(t, node, body.ParentID); err != nil {
+		return err
+	}
+
+	if err := x.vars.clear(x.tx, t.ID); err != nil {
+		return err
+	}
+	if err := x.detach(t); err != nil {
+		return err
+	}
+
+	switch {
+	case done:
+		if err := x.interruptScope(body.ID, t.ID); err != nil {
+			return err
+		}
+	case node.Loop.Sequential:
+		// the next instance enters first so that the activity does not
+		// complete in between
+		if err := x.startLoopInstance(body, node, items, completed); err != nil {
+			return err
+		}
+	}
+	return x.end(t)
+}
+
+// loopCounters returns the counters of the multi-instance activity
+func (x *execution) loopCounters(body *Token) (map[string]int, error) {
+	values, err := x.vars.scope(body.ID)
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]int)
+	for _, name := range []string{nrOfInstances, nrOfActiveInstances, nrOfCompletedInstances} {
+		value, _ := values[name].(int64)
+		counters[name] = int(value)
+	}
+	return counters, nil
+}
+
+// addToCounter adds the delta to a counter of the multi-instance activity
+func (x *execution) addToCounter(body *Token, name string, delta int) error {
+	counters, err := x.loopCounters(body)
+	if err != nil {
+		return err
+	}
+	return x.vars.set(x.tx, x.instance.ID, body.ID, name, "", counters[name]+delta)
+}
@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// Correlation addresses a message to the single instance waiting for it, or
+// to the start event that receives it when no instance is waiting
+type Correlation struct {
+	MessageName string `json:"messageName"`
+
+	// business key of the instance, or of the instance to start
+	BusinessKey string `json:"businessKey"`
+
+	// tenant of the instance, or of the instance to start
+	TenantID string `json:"tenantId"`
+
+	// values the instance variables must equal
+	CorrelationKeys map[string]interface{} `json:"correlationKeys"`
+
+	// variables set on the instance that receives the message
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Validate the Correlation
+func (c *Correlation) Validate() []string {
+	response := make([]string, 0)
+
+	if c.MessageName == "" {
+		response = append(response, "Message Name is required")
+	}
+	return response
+}
+
+// CorrelationResult identifies the instance that received a message
+type CorrelationResult struct {
+	InstanceID uint `json:"instanceId"`
+
+	// the message started the instance
+	Started bool `json:"started"`
+}
+
+// messageThrowBehavior correlates its message to another instance. The
+// variables of the message are the local variables created by the input
+// mappings of the element and the businessKey attribute, which may be an
+// expression, selects the receiving instance.
+type messageThrowBehavior struct {
+	takeOutgoing
+
+	// ends the path of the token once the message was sent
+	end bool
+}
+
+func (b messageThrowBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	vars, err := x.variables(t)
+	if err != nil {
+		return err
+	}
+	businessKey, err := attributeValue(node, "businessKey", vars)
+	if err != nil {
+		return x.raiseIncident(t, IncidentExpression, err.Error())
+	}
+	payload, err := x.vars.scope(t.ID)
+	if err != nil {
+		return err
+	}
+
+	c := &Correlation{MessageName: node.Event.Name, TenantID: x.instance.TenantID, Variables: payload}
+	if businessKey != nil {
+		c.BusinessKey = fmt.Sprint(businessKey)
+	}
+	if _, err := correlate(x.tx, c, x.instance.ID); err != nil {
+		if err != util.ErrNotFound && !util.IsConflictError(err) {
+			return err
+		}
+		if err == util.ErrNotFound {
+			err = fmt.Errorf("No receiver found for message %s", c.MessageName)
+		}
+		return x.raiseIncident(t, IncidentCorrelation, err.Error())
+	}
+
+	if b.end {
+		return x.end(t)
+	}
+	return x.complete(t)
+}
+
+// Correlate delivers a message to the single active instance waiting for it
+// that has the business key and correlation keys of the message. A message
+// start event receives the message when no instance is waiting and no
+// correlation keys are given. A message that matches nothing is not found
+// while one that matches several receivers is a conflict.
+func Correlate(c *Correlation) (*CorrelationResult, error) {
+	var result *CorrelationResult
+	err := inTransaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = correlate(tx, c, 0)
+		return err
+	})
+	return result, err
+}
+
+// correlate delivers the message, ignoring the instance that excluded
+func correlate(tx *gorm.DB, c *Correlation, excluded uint) (*CorrelationResult, error) {
+	subscriptions := make([]*EventSubscription, 0)
+	if err := tx.Where("type = ? AND name = ? AND instance_id <> 0 AND instance_id <> ?",
+		bpmn.MessageEvent, c.MessageName, excluded).Order("id").Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+
+	matches := make([]*EventSubscription, 0)
+	for _, subscription := range subscriptions {
+		instance, err := findInstance(tx, subscription.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		matched, err := c.matches(tx, instance)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, subscription)
+		}
+	}
+
+	switch {
+	case len(matches) > 1:
+		return nil, util.NewConflictError("Message %s matches %d waiting receivers", c.MessageName, len(matches))
+	case len(matches) == 1:
+		return deliver(tx, c, matches[0])
+	case len(c.CorrelationKeys) > 0:
+		return nil, util.ErrNotFound
+	}
+	return startByMessage(tx, c)
+}
+
+// matches tells whether the instance is active and has the business key,
+// tenant and correlation keys of the message
+func (c *Correlation) matches(tx *gorm.DB, instance *ProcessInstance) (bool, error) {
+	if instance.State != InstanceActive {
+		return false, nil
+	}
+	if c.BusinessKey != "" && instance.BusinessKey != c.BusinessKey {
+		return false, nil
+	}
+	if c.TenantID != "" && instance.TenantID != c.TenantID {
+		return false, nil
+	}
+	if len(c.CorrelationKeys) == 0 {
+		return true, nil
+	}
+
+	vars, err := loadVariables(tx, instance.ID)
+	if err != nil {
+		return false, err
+	}
+	values, err := vars.scope(0)
+	if err != nil {
+		return false, err
+	}
+	for name, value := range c.CorrelationKeys {
+		if _, exists := values[name]; !exists || !expr.Equal(values[name], value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deliver sets the variables of the message and moves the token of the
+// subscription on
+func deliver(tx *gorm.DB, c *Correlation, subscription *EventSubscription) (*CorrelationResult, error) {
+	instance, err := findInstance(tx, subscription.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	x, err := newExecution(tx, instance)
+	if err != nil {
+		return nil, err
+	}
+	if err := x.setVariables(c.Variables); err != nil {
+		return nil, err
+	}
+	if err := x.receive(subscription); err != nil {
+		return nil, err
+	}
+	if err := x.run(); err != nil {
+		return nil, err
+	}
+	return &CorrelationResult{InstanceID: instance.ID}, nil
+}
+
+// startByMessage starts an instance of the single process definition with a
+// message start event for the message
+func startByMessage(tx *gorm.DB, c *Correlation) (*CorrelationResult, error) {
+	subscriptions := make([]*EventSubscription, 0)
+	if err := tx.Where("type = ? AND name = ? AND instance_id = 0", bpmn.MessageEvent, c.MessageName).
+		Order("id").Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+
+	switch len(subscriptions) {
+	case 0:
+		return nil, util.ErrNotFound
+	case 1:
+	default:
+		return nil, util.NewConflictError("Message %s starts %d process definitions", c.MessageName, len(subscriptions))
+	}
+
+	instance, err := startSubscription(tx, subscriptions[0], c.TenantID, c.BusinessKey, c.Variables)
+	if err != nil {
+		return nil, err
+	}
+	if instance == nil {
+		return nil, util.ErrNotFound
+	}
+	return &CorrelationResult{InstanceID: instance.ID, Started: true}, nil
+}
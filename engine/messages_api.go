@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// RegisterMessages registers the message correlation API
+func RegisterMessages(e *echo.Group) {
+
+	/*
+	 * correlate a message to the instance waiting for it or start an instance
+	 */
+	e.POST("", func(c echo.Context) error {
+		correlation := &Correlation{}
+		if err := c.Bind(correlation); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := correlation.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		result, err := Correlate(correlation)
+		if err == util.ErrNotFound {
+			return resource.NotFound(fmt.Errorf("No process instance or start event is waiting for message %s",
+				correlation.MessageName))
+		}
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
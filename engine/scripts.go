@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+)
+
+// scriptTaskBehavior evaluates its script in the expression language and
+// stores the result in the variable named by the resultVariable attribute.
+// Scripts raise BPMN errors by calling throwError(code, message).
+type scriptTaskBehavior struct {
+	takeOutgoing
+}
+
+func (scriptTaskBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	vars, err := x.variables(t)
+	if err != nil {
+		return err
+	}
+	result, err := expr.Evaluate(node.Script, vars)
+	if raised, isRaised := err.(*expr.Raised); isRaised {
+		return &BPMNError{Code: raised.Code, Message: raised.Message}
+	}
+	if err != nil {
+		return x.raiseIncident(t, IncidentExpression, fmt.Sprintf("Script of %s: %s", node.ID, err))
+	}
+
+	if name := node.Attribute("resultVariable"); name != "" {
+		if err := x.vars.set(x.tx, x.instance.ID, 0, name, "", result); err != nil {
+			return err
+		}
+	}
+	return x.complete(t)
+}
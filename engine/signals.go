@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// Signal is broadcast to every token waiting for it and starts an instance of
+// every process definition with a start event for it
+type Signal struct {
+	Name string `json:"name"`
+
+	// only instances of the tenant receive the signal when it is given, and
+	// the instances it starts belong to the tenant
+	TenantID string `json:"tenantId"`
+
+	// variables set on every instance that receives the signal
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Validate the Signal
+func (s *Signal) Validate() []string {
+	response := make([]string, 0)
+
+	if s.Name == "" {
+		response = append(response, "Name is required")
+	}
+	return response
+}
+
+// SignalResult lists the instances that received a signal
+type SignalResult struct {
+	Received []uint `json:"received"`
+	Started  []uint `json:"started"`
+}
+
+// signalThrowBehavior broadcasts its signal within the tenant of its instance.
+// The variables of the signal are the local variables created by the input
+// mappings of the element.
+type signalThrowBehavior struct {
+	takeOutgoing
+
+	// ends the path of the token once the signal was broadcast
+	end bool
+}
+
+func (b signalThrowBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	payload, err := x.vars.scope(t.ID)
+	if err != nil {
+		return err
+	}
+	s := &Signal{Name: node.Event.Name, TenantID: x.instance.TenantID, Variables: payload}
+	if _, err := broadcast(x.tx, s, x); err != nil {
+		return err
+	}
+
+	if b.end {
+		return x.end(t)
+	}
+	return x.complete(t)
+}
+
+// Broadcast delivers a signal to every active instance waiting for it and
+// starts the process definitions with a start event for it
+func Broadcast(s *Signal) (*SignalResult, error) {
+	var result *SignalResult
+	err := inTransaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = broadcast(tx, s, nil)
+		return err
+	})
+	return result, err
+}
+
+// broadcast delivers the signal. The subscriptions of the instance of the
+// current execution, if any, are delivered within that execution which runs
+// them once the throwing token has moved on.
+func broadcast(tx *gorm.DB, s *Signal, current *execution) (*SignalResult, error) {
+	result := &SignalResult{Received: make([]uint, 0), Started: make([]uint, 0)}
+
+	subscriptions := make([]*EventSubscription, 0)
+	if err := tx.Where("type = ? AND name = ?", bpmn.SignalEvent, s.Name).
+		Order("instance_id, id").Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+
+	// subscriptions are ordered by instance so each instance runs once
+	var x *execution
+	for i, subscription := range subscriptions {
+		if subscription.InstanceID == 0 {
+			instance, err := startSubscription(tx, subscription, s.TenantID, "", s.Variables)
+			if err != nil {
+				return nil, err
+			}
+			if instance != nil {
+				result.Started = append(result.Started, instance.ID)
+			}
+			continue
+		}
+
+		if x == nil || x.instance.ID != subscription.InstanceID {
+			var err error
+			if x, err = signalExecution(tx, s, subscription, current); err != nil {
+				return nil, err
+			}
+			if x == nil {
+				continue
+			}
+			if err := x.setVariables(s.Variables); err != nil {
+				return nil, err
+			}
+			result.Received = append(result.Received, x.instance.ID)
+		}
+
+		if err := x.receive(subscription); err != nil {
+			return nil, err
+		}
+		last := i == len(subscriptions)-1 || subscriptions[i+1].InstanceID != x.instance.ID
+		if last && x != current {
+			if err := x.run(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// signalExecution returns the execution that delivers the signal to the
+// instance of the subscription or nil when the instance does not receive it
+func signalExecution(tx *gorm.DB, s *Signal, subscription *EventSubscription, current *execution) (*execution, error) {
+	if current != nil && current.instance.ID == subscription.InstanceID {
+		return current, nil
+	}
+	instance, err := findInstance(tx, subscription.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if instance.State != InstanceActive || (s.TenantID != "" && instance.TenantID != s.TenantID) {
+		return nil, nil
+	}
+	return newExecution(tx, instance)
+}
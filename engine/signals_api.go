@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+)
+
+// RegisterSignals registers the signal broadcast API
+func RegisterSignals(e *echo.Group) {
+
+	/*
+	 * broadcast a signal to every instance waiting for it, optionally only
+	 * within a tenant
+	 */
+	e.POST("", func(c echo.Context) error {
+		signal := &Signal{}
+		if err := c.Bind(signal); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := signal.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+
+		result, err := Broadcast(signal)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// subProcessBehavior runs the flow nodes of a subprocess as a scope within
+// its token, starting at its start event and completing once every token
+// within it has completed. Event subprocesses run the same way once the
+// event of their start event occurs.
+type subProcessBehavior struct {
+	takeOutgoing
+}
+
+func (subProcessBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	if err := x.openScope(t); err != nil {
+		return err
+	}
+	return x.enter(&Token{ParentID: t.ID}, node.StartEvent(), nil)
+}
+
+// openScope schedules the timers and subscribes to the messages and signals
+// of the event subprocesses within the subprocess of the scope token, or at
+// process level when it is nil. They listen for as long as the scope is
+// active.
+func (x *execution) openScope(scope *Token) error {
+	var subprocess *bpmn.FlowNode
+
+	// the process level has no token of its own to listen with
+	listener := &Token{InstanceID: x.instance.ID, ActivityID: x.process.ID}
+	if scope != nil {
+		node, err := x.node(scope)
+		if err != nil {
+			return err
+		}
+		subprocess, listener = node, scope
+	}
+
+	for _, sub := range x.process.EventSubprocesses(subprocess) {
+		start := sub.StartEvent()
+		switch {
+		case start.Event.Type == bpmn.TimerEvent:
+			if err := x.scheduleTimer(listener, start, !start.CancelActivity); err != nil {
+				return err
+			}
+		case startSubscriptions[start.Event.Type]:
+			if err := x.subscribe(listener, start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeEventSubprocesses removes the timers and subscriptions of the event
+// subprocesses within the scope, whose id is zero at process level
+func (x *execution) closeEventSubprocesses(scopeID uint, subprocess *bpmn.FlowNode) error {
+	starts := make([]string, 0)
+	for _, sub := range x.process.EventSubprocesses(subprocess) {
+		starts = append(starts, sub.StartEvent().ID)
+	}
+	if len(starts) == 0 {
+		return nil
+	}
+
+	query := x.tx.Unscoped().Where("instance_id = ? AND token_id = ? AND activity_id IN (?)",
+		x.instance.ID, scopeID, starts)
+	if err := query.Delete(&Job{}).Error; err != nil {
+		return err
+	}
+	return query.Delete(&EventSubscription{}).Error
+}
+
+// scopeActive tells whether the scope with the id, which is zero at process
+// level, has not ended
+func (x *execution) scopeActive(scopeID uint) (bool, error) {
+	if scopeID == 0 {
+		return x.instance.State == InstanceActive, nil
+	}
+	scope, err := findToken(x.tx, scopeID)
+	if err != nil {
+		return false, err
+	}
+	return scope.State == TokenActive, nil
+}
+
+// startEventSubprocess runs the event subprocess of the start event within
+// the scope once its event has occurred. An interrupting start event first
+// ends everything else within the scope, including the other event
+// subprocesses that were listening.
+func (x *execution) startEventSubprocess(scopeID uint, start *bpmn.FlowNode) error {
+	t := &Token{ParentID: scopeID}
+	if err := x.enter(t, start.Parent, nil); err != nil {
+		return err
+	}
+	if !start.CancelActivity {
+		return nil
+	}
+	if err := x.closeEventSubprocesses(scopeID, start.Parent.Parent); err != nil {
+		return err
+	}
+	return x.interruptScope(scopeID, t.ID)
+}
+
+// completeScope completes the subprocess of the scope token once no token
+// remains within it
+func (x *execution) completeScope(scopeID uint) error {
+	var remaining int
+	if err := x.tx.Model(&Token{}).Where("instance_id = ? AND parent_id = ? AND state <> ?",
+		x.instance.ID, scopeID, TokenCompleted).Count(&remaining).Error; err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+
+	scope, err := findToken(x.tx, scopeID)
+	if err != nil {
+		return err
+	}
+	if scope.State != TokenActive {
+		return nil
+	}
+	return x.complete(scope)
+}
+
+// interruptScope interrupts the tokens within the scope, whose id is zero at
+// process level, other than the excepted token
+func (x *execution) interruptScope(scopeID uint, except uint) error {
+	tokens := make([]*Token, 0)
+	if err := x.tx.Where("instance_id = ? AND parent_id = ? AND state <> ? AND id <> ?",
+		x.instance.ID, scopeID, TokenCompleted, except).Order("id").Find(&tokens).Error; err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := x.interrupt(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
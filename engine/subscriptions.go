@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// subscribed event types that start process instances
+var startSubscriptions = map[bpmn.EventType]bool{
+	bpmn.MessageEvent: true,
+	bpmn.SignalEvent:  true,
+}
+
+// subscriptionCatchBehavior waits until the message or signal it subscribes
+// to is delivered to the token
+type subscriptionCatchBehavior struct {
+	takeOutgoing
+}
+
+func (subscriptionCatchBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.subscribe(t, node)
+}
+
+// subscriptionBoundaryBehavior fires when the message or signal it subscribes
+// to is delivered to the token of its activity. A non interrupting event may
+// fire repeatedly.
+type subscriptionBoundaryBehavior struct {
+	passThroughBehavior
+}
+
+func (subscriptionBoundaryBehavior) attach(x *execution, t *Token, boundary *bpmn.FlowNode) error {
+	return x.subscribe(t, boundary)
+}
+
+// subscribe records that the token waits for the message or signal of the event
+func (x *execution) subscribe(t *Token, event *bpmn.FlowNode) error {
+	return x.tx.Create(&EventSubscription{
+		Type:       string(event.Event.Type),
+		Name:       event.Event.Name,
+		InstanceID: x.instance.ID,
+		TokenID:    t.ID,
+		ActivityID: event.ID,
+	}).Error
+}
+
+// receive moves the token of a subscription on, either past the event it is
+// waiting at or onto the boundary event of its activity, or runs the event
+// subprocess of the subscribed start event within its scope. Tokens and
+// scopes that have already moved on are left alone.
+func (x *execution) receive(subscription *EventSubscription) error {
+	event := x.process.Node(subscription.ActivityID)
+	if event == nil {
+		return fmt.Errorf("Activity %s not found in process %s", subscription.ActivityID, x.process.ID)
+	}
+	if event.Type == bpmn.StartEvent {
+		active, err := x.scopeActive(subscription.TokenID)
+		if err != nil && err != util.ErrNotFound {
+			return err
+		}
+		if err != nil || !active {
+			return nil
+		}
+		return x.startEventSubprocess(subscription.TokenID, event)
+	}
+
+	t, err := findToken(x.tx, subscription.TokenID)
+	if err != nil && err != util.ErrNotFound {
+		return err
+	}
+	if err != nil || t.State != TokenActive {
+		return nil
+	}
+	if event.ID == t.ActivityID {
+		return x.complete(t)
+	}
+	return x.fireBoundary(t, event)
+}
+
+// subscribeStartEvents replaces the message and signal start event
+// subscriptions of the previous versions of a deployed process definition
+func subscribeStartEvents(tx *gorm.DB, def *bpmn.ProcessDefinition, process *bpmn.Process) error {
+	if err := tx.Unscoped().Where("instance_id = 0 AND definition_id IN (?)", sameKey(tx, def.Key)).
+		Delete(&EventSubscription{}).Error; err != nil {
+		return err
+	}
+
+	for _, start := range process.StartEvents() {
+		if start.Event == nil || !startSubscriptions[start.Event.Type] {
+			continue
+		}
+		if err := tx.Create(&EventSubscription{
+			Type:         string(start.Event.Type),
+			Name:         start.Event.Name,
+			DefinitionID: def.ID,
+			ActivityID:   start.ID,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSubscription starts an instance at the start event of a subscription,
+// returning nil when its definition has since been deleted
+func startSubscription(tx *gorm.DB, subscription *EventSubscription, tenantID string, businessKey string,
+	variables map[string]interface{}) (*ProcessInstance, error) {
+
+	def := &bpmn.ProcessDefinition{}
+	if err := tx.First(def, subscription.DefinitionID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	process, err := bpmn.LoadProcess(def)
+	if err != nil {
+		return nil, err
+	}
+	start := process.Node(subscription.ActivityID)
+	if start == nil {
+		return nil, nil
+	}
+
+	instance := newInstance(def, tenantID, businessKey)
+	if err := startAt(tx, instance, start, variables, nil); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
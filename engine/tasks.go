@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/users"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// tasks without candidates may be claimed by any user, otherwise they can
+// only be assigned when they are created
+var openTasks = false
+
+// ClaimTask assigns an unassigned task to a user that may claim it
+func ClaimTask(taskID uint, userID uint) error {
+	return withTask(taskID, userID, func(tx *gorm.DB, task *Task, user *users.User) error {
+		if task.AssigneeID != nil {
+			if *task.AssigneeID == user.ID {
+				return nil
+			}
+			return util.NewConflictError("Task %d is already assigned", task.ID)
+		}
+		if !task.isCandidate(user) {
+			return util.NewConflictError("User %s is not a candidate for task %d", user.UserName, task.ID)
+		}
+		task.AssigneeID = &user.ID
+		if err := tx.Save(task).Error; err != nil {
+			return err
+		}
+		return recordTaskEvent(tx, task, TaskClaimed, &user.ID)
+	})
+}
+
+// UnclaimTask returns a task assigned to the user to its candidates
+func UnclaimTask(taskID uint, userID uint) error {
+	return withTask(taskID, userID, func(tx *gorm.DB, task *Task, user *users.User) error {
+		if err := task.requireAssignee(user); err != nil {
+			return err
+		}
+		if task.DelegationState == DelegationPending {
+			return util.NewConflictError("Task %d is delegated and must be resolved", task.ID)
+		}
+		if err := tx.Model(task).Update("assignee_id", gorm.Expr("NULL")).Error; err != nil {
+			return err
+		}
+		task.AssigneeID = nil
+		return recordTaskEvent(tx, task, TaskUnclaimed, &user.ID)
+	})
+}
+
+// DelegateTask hands a task assigned to the user over to another user, who
+// resolves it by completing it and so returns it to the user
+func DelegateTask(taskID uint, userID uint, delegateID uint) error {
+	return withTask(taskID, userID, func(tx *gorm.DB, task *Task, user *users.User) error {
+		if err := task.requireAssignee(user); err != nil {
+			return err
+		}
+		delegate, err := findUser(tx, delegateID)
+		if err != nil {
+			return err
+		}
+
+		if task.DelegationState != DelegationPending {
+			task.OwnerID = &user.ID
+		}
+		task.AssigneeID = &delegate.ID
+		task.DelegationState = DelegationPending
+		if err := tx.Save(task).Error; err != nil {
+			return err
+		}
+		return recordTaskEvent(tx, task, TaskDelegated, &user.ID)
+	})
+}
+
+// CompleteTask completes a task assigned to the user, setting the given
+// variables on the instance. A delegated task is resolved and handed back to
+// its owner instead.
+func CompleteTask(taskID uint, userID uint, variables map[string]interface{}) error {
+	return withTask(taskID, userID, func(tx *gorm.DB, task *Task, user *users.User) error {
+		if err := task.requireAssignee(user); err != nil {
+			return err
+		}
+
+		t, err := findToken(tx, task.TokenID)
+		if err != nil {
+			return err
+		}
+		if task.DelegationState != DelegationPending {
+			return trigger(tx, t, variables)
+		}
+
+		instance, err := findInstance(tx, task.InstanceID)
+		if err != nil {
+			return err
+		}
+		x, err := newExecution(tx, instance)
+		if err != nil {
+			return err
+		}
+		if err := x.setVariables(variables); err != nil {
+			return err
+		}
+		task.AssigneeID = task.OwnerID
+		task.DelegationState = DelegationResolved
+		if err := tx.Save(task).Error; err != nil {
+			return err
+		}
+		return recordTaskEvent(tx, task, TaskResolved, &user.ID)
+	})
+}
+
+// SetTaskDueDate sets or, when due is nil, clears the due date of a task
+// the user is assigned to or may claim
+func SetTaskDueDate(taskID uint, userID uint, due *time.Time) error {
+	return withTask(taskID, userID, func(tx *gorm.DB, task *Task, user *users.User) error {
+		if !task.isAssignee(user) && (task.AssigneeID != nil || !task.isCandidate(user)) {
+			return util.NewConflictError("Task %d is not available to user %s", task.ID, user.UserName)
+		}
+		var err error
+		if due == nil {
+			err = tx.Model(task).Update("due_date", gorm.Expr("NULL")).Error
+		} else {
+			err = tx.Model(task).Update("due_date", *due).Error
+		}
+		if err != nil {
+			return err
+		}
+		return recordTaskEvent(tx, task, TaskDueDateSet, &user.ID)
+	})
+}
+
+// withTask runs fn with an open task and the user acting on it
+func withTask(taskID uint, userID uint, fn func(tx *gorm.DB, task *Task, user *users.User) error) error {
+	return inTransaction(func(tx *gorm.DB) error {
+		task, err := findTask(tx, taskID)
+		if err != nil {
+			return err
+		}
+		if task.State != TaskOpen {
+			return util.NewConflictError("Task %d is %s", task.ID, task.State)
+		}
+		user, err := findUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		return fn(tx, task, user)
+	})
+}
+
+func (task *Task) isAssignee(user *users.User) bool {
+	return task.AssigneeID != nil && *task.AssigneeID == user.ID
+}
+
+func (task *Task) requireAssignee(user *users.User) error {
+	if !task.isAssignee(user) {
+		return util.NewConflictError("Task %d is not assigned to user %s", task.ID, user.UserName)
+	}
+	return nil
+}
+
+// isCandidate tells whether the user may claim the task. Tasks without
+// candidates can only be claimed when tasks are open to all.
+func (task *Task) isCandidate(user *users.User) bool {
+	if len(task.Candidates) == 0 {
+		return openTasks
+	}
+	for _, candidate := range task.Candidates {
+		if candidate.UserID != nil && *candidate.UserID == user.ID {
+			return true
+		}
+		if candidate.GroupName != "" && candidate.GroupName == user.Organization {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+)
+
+// DelegateRequest names the user a task is delegated to
+type DelegateRequest struct {
+	UserID uint `json:"userId"`
+}
+
+// Validate the DelegateRequest
+func (req *DelegateRequest) Validate() []string {
+	response := make([]string, 0)
+
+	if req.UserID == 0 {
+		response = append(response, "User ID is required")
+	}
+	return response
+}
+
+// CompleteRequest completes a task
+type CompleteRequest struct {
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// DueDateRequest sets the due date of a task, a null due date clears it
+type DueDateRequest struct {
+	DueDate *time.Time `json:"dueDate"`
+}
+
+// RegisterTasks registers the task API. There is no authentication yet so
+// every endpoint takes the id of the user acting on the task as the user
+// query parameter.
+func RegisterTasks(e *echo.Group, config *Config) {
+	resultsPerPage := strconv.Itoa(config.ResultsPerPage)
+	openTasks = config.OpenTasks
+
+	/*
+	 * get the open tasks of a user, ordered by due date
+	 *   user       - [int] id of the user
+	 *   filter     - [string] (default: all) assigned, claimable or all
+	 *   instanceId - [int] process instance id
+	 *   offset     - [int] (default: 0) offset into the index
+	 *   limit      - [int] (default: 20) number of results to return
+	 */
+	e.GET("", func(c echo.Context) error {
+		var offset, limit, userID, instanceID int
+		var kind string
+
+		if err := resource.Param("user").Int(c, &userID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("filter").Optional("all").String(c, &kind); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("instanceId").Optional("0").Int(c, &instanceID); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("offset").Optional("0").Int(c, &offset); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := resource.Param("limit").Optional(resultsPerPage).Int(c, &limit); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		filter := &TaskFilter{UserID: uint(userID), InstanceID: uint(instanceID)}
+		switch kind {
+		case "assigned":
+			filter.Assigned = true
+		case "claimable":
+			filter.Claimable = true
+		case "all":
+		default:
+			return resource.BadRequest([]string{"Filter must be one of assigned, claimable or all"})
+		}
+
+		tasks, err := GetTasks(filter, offset, limit)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, tasks)
+	})
+
+	/*
+	 * claim an unassigned task
+	 */
+	e.POST("/:id/claim", func(c echo.Context) error {
+		id, userID, err := taskUser(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := ClaimTask(id, userID); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * give up a claimed task
+	 */
+	e.POST("/:id/unclaim", func(c echo.Context) error {
+		id, userID, err := taskUser(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := UnclaimTask(id, userID); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * delegate a task to another user
+	 */
+	e.POST("/:id/delegate", func(c echo.Context) error {
+		id, userID, err := taskUser(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &DelegateRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if issues := req.Validate(); len(issues) > 0 {
+			return resource.BadRequest(issues)
+		}
+		if err := DelegateTask(id, userID, req.UserID); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * complete a task, or resolve it when it was delegated
+	 */
+	e.POST("/:id/complete", func(c echo.Context) error {
+		id, userID, err := taskUser(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &CompleteRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := CompleteTask(id, userID, req.Variables); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * set or clear the due date of a task
+	 */
+	e.PUT("/:id/due-date", func(c echo.Context) error {
+		id, userID, err := taskUser(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		req := &DueDateRequest{}
+		if err := c.Bind(req); err != nil {
+			return resource.BadRequest(err)
+		}
+		if err := SetTaskDueDate(id, userID, req.DueDate); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	resource.GetMethod(e, GetTask)
+}
+
+// taskUser reads the task id and the user acting on it
+func taskUser(c echo.Context) (uint, uint, error) {
+	var id, userID int
+
+	if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+		return 0, 0, err
+	}
+	if err := resource.Param("user").Int(c, &userID); err != nil {
+		return 0, 0, err
+	}
+	return uint(id), uint(userID), nil
+}
@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+	"github.com/sterrasi/stepwise/timer"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// timerCatchBehavior waits until its timer fires
+type timerCatchBehavior struct {
+	takeOutgoing
+}
+
+func (timerCatchBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	return x.scheduleTimer(t, node, false)
+}
+
+// timerBoundaryBehavior fires while its activity is active. Cycles repeat
+// for as long as the activity is active unless the event interrupts it.
+type timerBoundaryBehavior struct {
+	passThroughBehavior
+}
+
+func (timerBoundaryBehavior) attach(x *execution, t *Token, boundary *bpmn.FlowNode) error {
+	return x.scheduleTimer(t, boundary, !boundary.CancelActivity)
+}
+
+// scheduleTimer creates the job that fires the timer of the event for the
+// token, where only a repeating timer fires more than once
+func (x *execution) scheduleTimer(t *Token, event *bpmn.FlowNode, repeat bool) error {
+	vars, err := x.variables(t)
+	if err != nil {
+		return err
+	}
+	tm, err := resolveTimer(event, vars)
+	if err != nil {
+		return x.raiseIncident(t, IncidentExpression, err.Error())
+	}
+
+	job := timerJob(tm, event, repeat)
+	job.InstanceID = x.instance.ID
+	job.TokenID = t.ID
+	return x.tx.Create(job).Error
+}
+
+// scheduleStartTimers replaces the timer start event jobs of the previous
+// versions of a deployed process definition, along with their incidents
+func scheduleStartTimers(tx *gorm.DB, def *bpmn.ProcessDefinition, process *bpmn.Process) error {
+	previous := tx.Unscoped().Model(&Job{}).Select("id").Where("type = ? AND instance_id = 0 AND definition_id IN (?)",
+		JobTimer, sameKey(tx, def.Key)).QueryExpr()
+	if err := recordIncidentEnd(tx, IncidentDeleted, "job_id IN (?)", previous); err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("job_id IN (?)", previous).Delete(&Incident{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("type = ? AND instance_id = 0 AND definition_id IN (?)", JobTimer,
+		sameKey(tx, def.Key)).Delete(&Job{}).Error; err != nil {
+		return err
+	}
+
+	for _, start := range process.StartEvents() {
+		if start.Event == nil || start.Event.Type != bpmn.TimerEvent {
+			continue
+		}
+		tm, err := resolveTimer(start, nil)
+		if err != nil {
+			return err
+		}
+		job := timerJob(tm, start, true)
+		job.DefinitionID = def.ID
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func timerJob(tm *timer.Timer, event *bpmn.FlowNode, repeat bool) *Job {
+	job := &Job{
+		Type:        JobTimer,
+		ActivityID:  event.ID,
+		DueAt:       tm.First(time.Now()),
+		Repetitions: 1,
+		Retries:     jobRetries,
+	}
+	if repeat && tm.Kind == timer.Cycle {
+		job.Timer = tm.String()
+		job.Repetitions = tm.Repetitions
+	}
+	return job
+}
+
+// resolveTimer parses the timer of an event, evaluating it first when it is
+// an expression
+func resolveTimer(event *bpmn.FlowNode, vars map[string]interface{}) (*timer.Timer, error) {
+	kind := timer.Kind(event.Event.TimerKind)
+	source := event.Event.Timer
+
+	if unwrapped := expr.Unwrap(source); unwrapped != source {
+		value, err := expr.Evaluate(unwrapped, vars)
+		if err != nil {
+			return nil, fmt.Errorf("Timer of %s: %s", event.ID, err)
+		}
+		switch v := value.(type) {
+		case time.Time:
+			if kind == timer.Date {
+				return &timer.Timer{Kind: kind, At: &v, Repetitions: 1}, nil
+			}
+		case string:
+			source = v
+		default:
+			return nil, fmt.Errorf("Timer of %s evaluated to %v rather than a %s", event.ID, value, kind)
+		}
+	}
+
+	tm, err := timer.Parse(kind, source)
+	if err != nil {
+		return nil, fmt.Errorf("Timer of %s: %s", event.ID, err)
+	}
+	return tm, nil
+}
+
+// fireTimer handles timer jobs. A timer start event starts an instance of
+// its definition or, within an event subprocess, runs the subprocess in the
+// scope it was scheduled for while other timers move the token they were
+// scheduled for. Timers with nothing left to fire, such as those of deleted
+// definitions or of tokens that have since moved on, are dropped rather than
+// rescheduled.
+func fireTimer(tx *gorm.DB, job *Job) (bool, error) {
+	if job.InstanceID == 0 {
+		def := &bpmn.ProcessDefinition{}
+		if err := tx.First(def, job.DefinitionID).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return dropTimer(tx, job)
+			}
+			return false, err
+		}
+		process, err := bpmn.LoadProcess(def)
+		if err != nil {
+			return false, err
+		}
+		start := process.Node(job.ActivityID)
+		if start == nil {
+			return dropTimer(tx, job)
+		}
+		return true, startAt(tx, newInstance(def, "", ""), start, nil, nil)
+	}
+
+	instance, err := findInstance(tx, job.InstanceID)
+	if err != nil {
+		return false, err
+	}
+	switch instance.State {
+	case InstanceSuspended:
+		return false, postpone(tx, job)
+	case InstanceActive:
+	default:
+		return dropTimer(tx, job)
+	}
+
+	x, err := newExecution(tx, instance)
+	if err != nil {
+		return false, err
+	}
+	event := x.process.Node(job.ActivityID)
+	if event == nil {
+		return dropTimer(tx, job)
+	}
+	if event.Type == bpmn.StartEvent {
+		active, err := x.scopeActive(job.TokenID)
+		if err != nil && err != util.ErrNotFound {
+			return false, err
+		}
+		if err != nil || !active {
+			return dropTimer(tx, job)
+		}
+		if err := x.startEventSubprocess(job.TokenID, event); err != nil {
+			return false, err
+		}
+		return true, x.run()
+	}
+
+	t, err := findToken(tx, job.TokenID)
+	if err != nil && err != util.ErrNotFound {
+		return false, err
+	}
+	if err != nil || t.State != TokenActive {
+		return dropTimer(tx, job)
+	}
+	switch {
+	case event.ID == t.ActivityID:
+		if err := x.complete(t); err != nil {
+			return false, err
+		}
+	case event.AttachedTo != nil && event.AttachedTo.ID == t.ActivityID:
+		if err := x.fireBoundary(t, event); err != nil {
+			return false, err
+		}
+	default:
+		return dropTimer(tx, job)
+	}
+	return true, x.run()
+}
+
+// dropTimer deletes a timer job so that a cycle is not rescheduled
+func dropTimer(tx *gorm.DB, job *Job) (bool, error) {
+	return true, tx.Unscoped().Delete(job).Error
+}
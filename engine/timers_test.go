@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sterrasi/stepwise/bpmn"
+)
+
+// startedInstances returns how many instances of the definition were started
+func startedInstances(t *testing.T, definitionID uint) int {
+	var count int
+	if err := db.Model(&ProcessInstance{}).Where("definition_id = ?", definitionID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestStartTimerCycle(t *testing.T) {
+	def := deployProcess(t, `
+<process id="startTimerCycle" isExecutable="true">
+  <startEvent id="hourly">
+    <timerEventDefinition><timeCycle>R/PT1H</timeCycle></timerEventDefinition>
+  </startEvent>
+  <sequenceFlow id="f1" sourceRef="hourly" targetRef="review"/>
+  <userTask id="review"/>
+</process>`)
+
+	// the cycle starts an instance and is rescheduled
+	if ran := runJobs(t, 0); ran != 1 {
+		t.Fatalf("ran %d jobs", ran)
+	}
+	if started := startedInstances(t, def.ID); started != 1 {
+		t.Errorf("started %d instances", started)
+	}
+	job := &Job{}
+	if err := db.Where("definition_id = ? AND instance_id = 0", def.ID).First(job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !job.DueAt.After(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("rescheduled for %s", job.DueAt)
+	}
+
+	// and dropped once its definition is deleted
+	if err := bpmn.DeleteProcessDefinition(int(def.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if ran := runJobs(t, 0); ran != 1 {
+		t.Fatalf("ran %d jobs", ran)
+	}
+	var jobs int
+	if err := db.Model(&Job{}).Where("definition_id = ?", def.ID).Count(&jobs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if jobs != 0 || startedInstances(t, def.ID) != 1 {
+		t.Errorf("%d jobs left after starting %d instances", jobs, startedInstances(t, def.ID))
+	}
+}
@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sterrasi/stepwise/bpmn"
+	"github.com/sterrasi/stepwise/expr"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// date layouts accepted for the dueDate attribute of a user task
+var dueDateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// userTaskBehavior creates a task for the token and waits until it is completed.
+// The assignee, candidateUsers, candidateGroups and dueDate attributes are either
+// literals or ${...} expressions, where candidates may be given as a comma
+// separated string or as a list. Users are referenced by user name.
+type userTaskBehavior struct {
+	takeOutgoing
+}
+
+func (userTaskBehavior) execute(x *execution, t *Token, node *bpmn.FlowNode) error {
+	task := &Task{
+		InstanceID: x.instance.ID,
+		TokenID:    t.ID,
+		ActivityID: node.ID,
+		Name:       node.Name,
+		State:      TaskOpen,
+		Candidates: make([]*TaskCandidate, 0),
+	}
+	if task.Name == "" {
+		task.Name = node.ID
+	}
+
+	if err := x.assignTask(t, node, task); err != nil {
+		return x.raiseIncident(t, IncidentAssignment, fmt.Sprintf("User task %s: %s", node.ID, err))
+	}
+	if err := x.tx.Create(task).Error; err != nil {
+		return err
+	}
+	return recordTaskEvent(x.tx, task, TaskCreated, nil)
+}
+
+func (userTaskBehavior) trigger(x *execution, t *Token, node *bpmn.FlowNode, variables map[string]interface{}) error {
+	if err := x.setVariables(variables); err != nil {
+		return err
+	}
+	if err := x.closeTasks(t, TaskCompleted); err != nil {
+		return err
+	}
+	return x.complete(t)
+}
+
+// assignTask resolves the assignment attributes of the node onto the task
+func (x *execution) assignTask(t *Token, node *bpmn.FlowNode, task *Task) error {
+	vars, err := x.variables(t)
+	if err != nil {
+		return err
+	}
+
+	assignee, err := attributeValues(node, "assignee", vars)
+	if err != nil {
+		return err
+	}
+	switch len(assignee) {
+	case 0:
+	case 1:
+		user, err := findUserByName(x.tx, assignee[0])
+		if err != nil {
+			return userError(assignee[0], err)
+		}
+		task.AssigneeID = &user.ID
+	default:
+		return fmt.Errorf("a task has a single assignee but %d were given", len(assignee))
+	}
+
+	candidateUsers, err := attributeValues(node, "candidateUsers", vars)
+	if err != nil {
+		return err
+	}
+	for _, name := range candidateUsers {
+		user, err := findUserByName(x.tx, name)
+		if err != nil {
+			return userError(name, err)
+		}
+		task.Candidates = append(task.Candidates, &TaskCandidate{UserID: &user.ID})
+	}
+
+	candidateGroups, err := attributeValues(node, "candidateGroups", vars)
+	if err != nil {
+		return err
+	}
+	for _, group := range candidateGroups {
+		task.Candidates = append(task.Candidates, &TaskCandidate{GroupName: group})
+	}
+
+	dueDate, err := attributeValue(node, "dueDate", vars)
+	if err != nil {
+		return err
+	}
+	switch v := dueDate.(type) {
+	case nil:
+	case time.Time:
+		task.DueDate = &v
+	case string:
+		due, err := parseDueDate(v)
+		if err != nil {
+			return err
+		}
+		task.DueDate = due
+	default:
+		return fmt.Errorf("dueDate must be a date but was %v", v)
+	}
+	return nil
+}
+
+// closeTasks ends the open tasks of the token. A completed task is recorded
+// as completed by its assignee.
+func (x *execution) closeTasks(t *Token, state string) error {
+	tasks := make([]*Task, 0)
+	if err := x.tx.Where("token_id = ? AND state = ?", t.ID, TaskOpen).Find(&tasks).Error; err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"state": state}
+	if state == TaskCompleted {
+		updates["completed_at"] = time.Now()
+	}
+	for _, task := range tasks {
+		if err := x.tx.Model(task).Updates(updates).Error; err != nil {
+			return err
+		}
+		event, userID := TaskCancelledEvent, (*uint)(nil)
+		if state == TaskCompleted {
+			event, userID = TaskCompletedEvent, task.AssigneeID
+		}
+		if err := recordTaskEvent(x.tx, task, event, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributeValue returns the attribute of the node, evaluating it when it is
+// wrapped in ${...} or #{...}
+func attributeValue(node *bpmn.FlowNode, name string, vars map[string]interface{}) (interface{}, error) {
+	source := strings.TrimSpace(node.Attribute(name))
+	if source == "" {
+		return nil, nil
+	}
+	if unwrapped := expr.Unwrap(source); unwrapped != source {
+		value, err := expr.Evaluate(unwrapped, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		return value, nil
+	}
+	return source, nil
+}
+
+// attributeValues returns the attribute of the node as a list of names
+func attributeValues(node *bpmn.FlowNode, name string, vars map[string]interface{}) ([]string, error) {
+	value, err := attributeValue(node, name, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]interface{}, 0)
+	switch v := value.(type) {
+	case nil:
+	case string:
+		for _, item := range strings.Split(v, ",") {
+			items = append(items, item)
+		}
+	case []interface{}:
+		items = v
+	default:
+		return nil, fmt.Errorf("%s must be a string or a list but was %v", name, v)
+	}
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		s, isString := item.(string)
+		if !isString {
+			return nil, fmt.Errorf("%s must only contain strings but contained %v", name, item)
+		}
+		if s = strings.TrimSpace(s); s != "" {
+			names = append(names, s)
+		}
+	}
+	return names, nil
+}
+
+func parseDueDate(value string) (*time.Time, error) {
+	for _, layout := range dueDateLayouts {
+		if due, err := time.Parse(layout, value); err == nil {
+			return &due, nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot convert %q to a due date", value)
+}
+
+func userError(name string, err error) error {
+	if err == util.ErrNotFound {
+		return fmt.Errorf("unknown user %s", name)
+	}
+	return err
+}
@@ -0,0 +1,501 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sterrasi/stepwise/util"
+)
+
+// TypedValue a variable value along with its type
+type TypedValue struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// inferType returns the variable type for a value
+func inferType(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return NullType, nil
+	case string:
+		return StringType, nil
+	case bool:
+		return BooleanType, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32:
+		return LongType, nil
+	case float32:
+		return DoubleType, nil
+	case float64:
+		// JSON numbers are decoded as float64, whole numbers are taken as longs
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return LongType, nil
+		}
+		return DoubleType, nil
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return LongType, nil
+		}
+		return DoubleType, nil
+	case time.Time, *time.Time:
+		return DateType, nil
+	case []byte:
+		return BinaryType, nil
+	case map[string]interface{}, []interface{}:
+		return JSONType, nil
+	}
+	return "", fmt.Errorf("Unsupported variable value of type %T", value)
+}
+
+// convert the value into the Go representation of the type:
+// string, int64, float64, bool, time.Time, []byte or a decoded JSON value
+func convert(variableType string, value interface{}) (interface{}, error) {
+	invalid := fmt.Errorf("Value %v is not a valid %s", value, variableType)
+	if value == nil {
+		return nil, nil
+	}
+
+	switch variableType {
+	case NullType:
+		return nil, invalid
+
+	case StringType:
+		if s, isString := value.(string); isString {
+			return s, nil
+		}
+
+	case BooleanType:
+		if b, isBool := value.(bool); isBool {
+			return b, nil
+		}
+
+	case LongType:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int8:
+			return int64(v), nil
+		case int16:
+			return int64(v), nil
+		case int32:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case uint:
+			return int64(v), nil
+		case uint8:
+			return int64(v), nil
+		case uint16:
+			return int64(v), nil
+		case uint32:
+			return int64(v), nil
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return int64(v), nil
+			}
+		case json.Number:
+			return v.Int64()
+		}
+
+	case DoubleType:
+		switch v := value.(type) {
+		case float32:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case json.Number:
+			return v.Float64()
+		}
+
+	case DateType:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case *time.Time:
+			return *v, nil
+		case string:
+			return time.Parse(time.RFC3339Nano, v)
+		}
+
+	case BinaryType:
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return base64.StdEncoding.DecodeString(v)
+		}
+
+	case JSONType:
+		// round trip to normalize the value to decoded JSON
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, invalid
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return nil, invalid
+		}
+		return decoded, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown variable type %s", variableType)
+	}
+	return nil, invalid
+}
+
+// encode stores the value in the column for its type
+func (v *Variable) encode(variableType string, value interface{}) error {
+	converted, err := convert(variableType, value)
+	if err != nil {
+		return err
+	}
+	if converted == nil {
+		variableType = NullType
+	}
+
+	v.Type = variableType
+	v.TextValue, v.LongValue, v.DoubleValue, v.BinaryValue = "", nil, nil, nil
+
+	switch c := converted.(type) {
+	case string:
+		v.TextValue = c
+	case int64:
+		v.LongValue = &c
+	case float64:
+		v.DoubleValue = &c
+	case bool:
+		var l int64
+		if c {
+			l = 1
+		}
+		v.LongValue = &l
+	case time.Time:
+		v.TextValue = c.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		v.BinaryValue = c
+	}
+
+	if variableType == JSONType {
+		data, err := json.Marshal(converted)
+		if err != nil {
+			return err
+		}
+		v.TextValue = string(data)
+	}
+	return nil
+}
+
+// decode reads the value from the column for its type
+func (v *Variable) decode() (interface{}, error) {
+	switch v.Type {
+	case NullType:
+		return nil, nil
+	case StringType:
+		return v.TextValue, nil
+	case LongType:
+		if v.LongValue == nil {
+			return nil, nil
+		}
+		return *v.LongValue, nil
+	case DoubleType:
+		if v.DoubleValue == nil {
+			return nil, nil
+		}
+		return *v.DoubleValue, nil
+	case BooleanType:
+		return v.LongValue != nil && *v.LongValue != 0, nil
+	case DateType:
+		return time.Parse(time.RFC3339Nano, v.TextValue)
+	case BinaryType:
+		return v.BinaryValue, nil
+	case JSONType:
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(v.TextValue), &decoded); err != nil {
+			return nil, fmt.Errorf("Variable %s holds malformed JSON: %s", v.Name, err)
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("Variable %s has unknown type %s", v.Name, v.Type)
+}
+
+// typedValue returns the value of the variable along with its type
+func (v *Variable) typedValue() (*TypedValue, error) {
+	value, err := v.decode()
+	if err != nil {
+		return nil, err
+	}
+	return &TypedValue{Type: v.Type, Value: value}, nil
+}
+
+// variables holds the variables of an instance by scope and name
+type variables map[uint]map[string]*Variable
+
+// loadVariables reads every variable of the instance
+func loadVariables(tx *gorm.DB, instanceID uint) (variables, error) {
+	rows := make([]*Variable, 0)
+	if err := tx.Where("instance_id = ?", instanceID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	vars := variables{0: make(map[string]*Variable)}
+	for _, row := range rows {
+		if vars[row.ScopeID] == nil {
+			vars[row.ScopeID] = make(map[string]*Variable)
+		}
+		vars[row.ScopeID][row.Name] = row
+	}
+	return vars, nil
+}
+
+// visible returns the values of the variables visible from the scopes, given
+// from the outermost to the innermost, where the variables of a scope hide
+// those of the same name of the instance and of the scopes enclosing it
+func (vars variables) visible(scopeIDs ...uint) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, scope := range append([]uint{0}, scopeIDs...) {
+		for name, row := range vars[scope] {
+			value, err := row.decode()
+			if err != nil {
+				return nil, err
+			}
+			values[name] = value
+		}
+	}
+	return values, nil
+}
+
+// set creates or updates a variable, inferring its type when none is given
+func (vars variables) set(tx *gorm.DB, instanceID uint, scopeID uint, name string, variableType string, value interface{}) error {
+	if name == "" {
+		return util.NewValidationError("Variable name is required")
+	}
+	if variableType == "" {
+		inferred, err := inferType(value)
+		if err != nil {
+			return util.NewValidationError("Variable %s: %s", name, err)
+		}
+		variableType = inferred
+	}
+
+	if vars[scopeID] == nil {
+		vars[scopeID] = make(map[string]*Variable)
+	}
+	var before *Variable
+	row := vars[scopeID][name]
+	if row == nil {
+		row = &Variable{InstanceID: instanceID, ScopeID: scopeID, Name: name}
+	} else {
+		previous := *row
+		before = &previous
+	}
+	if err := row.encode(variableType, value); err != nil {
+		return util.NewValidationError("Variable %s: %s", name, err)
+	}
+	if err := tx.Save(row).Error; err != nil {
+		return err
+	}
+	vars[scopeID][name] = row
+	return recordVariable(tx, before, row)
+}
+
+// remove deletes a variable, returning util.ErrNotFound when it does not exist
+func (vars variables) remove(tx *gorm.DB, scopeID uint, name string) error {
+	row := vars[scopeID][name]
+	if row == nil {
+		return util.ErrNotFound
+	}
+	if err := tx.Unscoped().Delete(row).Error; err != nil {
+		return err
+	}
+	delete(vars[scopeID], name)
+	return recordVariable(tx, row, nil)
+}
+
+// clear deletes every variable of the scope as the scope ends, which is not
+// recorded in the history as the variables are not removed by anyone
+func (vars variables) clear(tx *gorm.DB, scopeID uint) error {
+	for _, row := range vars[scopeID] {
+		if err := tx.Unscoped().Delete(row).Error; err != nil {
+			return err
+		}
+	}
+	delete(vars, scopeID)
+	return nil
+}
+
+// scope returns the values of the variables of a single scope
+func (vars variables) scope(scopeID uint) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for name, row := range vars[scopeID] {
+		value, err := row.decode()
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// typedVisible returns the typed variables visible from the scopes, given
+// from the outermost to the innermost
+func (vars variables) typedVisible(scopeIDs ...uint) (map[string]*TypedValue, error) {
+	values := make(map[string]*TypedValue)
+	for _, scope := range append([]uint{0}, scopeIDs...) {
+		for name, row := range vars[scope] {
+			value, err := row.typedValue()
+			if err != nil {
+				return nil, err
+			}
+			values[name] = value
+		}
+	}
+	return values, nil
+}
+
+// VariablesUpdate sets and deletes several variables at once
+type VariablesUpdate struct {
+	Modifications map[string]*TypedValue `json:"modifications"`
+	Deletions     []string               `json:"deletions"`
+}
+
+// withVariables runs fn with the variables of an instance after checking that
+// the scope is either zero or a token of the instance that has not completed.
+// Changes are only permitted while the instance has not ended.
+func withVariables(instanceID uint, scopeID uint, change bool, fn func(tx *gorm.DB, vars variables) error) error {
+	return inTransaction(func(tx *gorm.DB) error {
+		instance, err := findInstance(tx, instanceID)
+		if err != nil {
+			return err
+		}
+		if change && instance.State != InstanceActive && instance.State != InstanceSuspended {
+			return util.NewConflictError("Process instance %d is %s", instance.ID, instance.State)
+		}
+		if scopeID != 0 {
+			t, err := findToken(tx, scopeID)
+			if err != nil || t.InstanceID != instanceID || t.State == TokenCompleted {
+				return util.ErrNotFound
+			}
+		}
+
+		vars, err := loadVariables(tx, instance.ID)
+		if err != nil {
+			return err
+		}
+		return fn(tx, vars)
+	})
+}
+
+// GetVariables returns the variables visible from a scope of an instance,
+// where scope zero is the instance itself, including those of the
+// subprocesses the scope is within
+func GetVariables(instanceID uint, scopeID uint) (map[string]*TypedValue, error) {
+	var values map[string]*TypedValue
+	err := withVariables(instanceID, scopeID, false, func(tx *gorm.DB, vars variables) error {
+		scopes := []uint{scopeID}
+		if scopeID != 0 {
+			t, err := findToken(tx, scopeID)
+			if err != nil {
+				return err
+			}
+			if scopes, err = scopeChain(tx, t); err != nil {
+				return err
+			}
+		}
+		var err error
+		values, err = vars.typedVisible(scopes...)
+		return err
+	})
+	return values, err
+}
+
+// GetVariable returns a variable visible from a scope of an instance
+func GetVariable(instanceID uint, scopeID uint, name string) (*TypedValue, error) {
+	values, err := GetVariables(instanceID, scopeID)
+	if err != nil {
+		return nil, err
+	}
+	value, exists := values[name]
+	if !exists {
+		return nil, util.ErrNotFound
+	}
+	return value, nil
+}
+
+// UpdateVariables sets and deletes variables of a scope of an instance. The
+// type of a value is inferred when it is not given.
+func UpdateVariables(instanceID uint, scopeID uint, update *VariablesUpdate) error {
+	return withVariables(instanceID, scopeID, true, func(tx *gorm.DB, vars variables) error {
+		for name, value := range update.Modifications {
+			if value == nil {
+				value = &TypedValue{}
+			}
+			if err := vars.set(tx, instanceID, scopeID, name, value.Type, value.Value); err != nil {
+				return err
+			}
+		}
+		for _, name := range update.Deletions {
+			if err := vars.remove(tx, scopeID, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetVariable creates or replaces a variable of a scope of an instance
+func SetVariable(instanceID uint, scopeID uint, name string, value *TypedValue) error {
+	return UpdateVariables(instanceID, scopeID, &VariablesUpdate{
+		Modifications: map[string]*TypedValue{name: value},
+	})
+}
+
+// DeleteVariable deletes a variable of a scope of an instance
+func DeleteVariable(instanceID uint, scopeID uint, name string) error {
+	return UpdateVariables(instanceID, scopeID, &VariablesUpdate{Deletions: []string{name}})
+}
+
+// PatchVariable applies a JSON merge patch (RFC 7386) to a json variable of a
+// scope of an instance
+func PatchVariable(instanceID uint, scopeID uint, name string, patch interface{}) error {
+	return withVariables(instanceID, scopeID, true, func(tx *gorm.DB, vars variables) error {
+		row := vars[scopeID][name]
+		if row == nil {
+			return util.ErrNotFound
+		}
+		if row.Type != JSONType {
+			return util.NewConflictError("Variable %s is a %s, only json variables can be patched", name, row.Type)
+		}
+		value, err := row.decode()
+		if err != nil {
+			return err
+		}
+		return vars.set(tx, instanceID, scopeID, name, JSONType, mergePatch(value, patch))
+	})
+}
+
+// mergePatch applies a JSON merge patch to a decoded JSON value
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, isObject := patch.(map[string]interface{})
+	if !isObject {
+		return patch
+	}
+	t, isObject := target.(map[string]interface{})
+	if !isObject {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], value)
+	}
+	return t
+}
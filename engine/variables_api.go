@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/sterrasi/stepwise/resource"
+)
+
+// registerVariables adds the variable endpoints of the process instance API.
+// Every endpoint accepts an optional scope query parameter holding the id of
+// the token whose local variables should be addressed.
+func registerVariables(e *echo.Group) {
+
+	/*
+	 * get the variables of an instance
+	 *   scope - [int] (default: 0) token id of a local scope
+	 */
+	e.GET("/:id/variables", func(c echo.Context) error {
+		id, scope, err := variableScope(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		values, err := GetVariables(id, scope)
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, values)
+	})
+
+	/*
+	 * set and delete several variables of an instance
+	 */
+	e.PATCH("/:id/variables", func(c echo.Context) error {
+		id, scope, err := variableScope(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		update := &VariablesUpdate{}
+		if err := c.Bind(update); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		if err := UpdateVariables(id, scope, update); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * get a variable of an instance
+	 */
+	e.GET("/:id/variables/:name", func(c echo.Context) error {
+		id, scope, err := variableScope(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		value, err := GetVariable(id, scope, c.Param("name"))
+		if err != nil {
+			return failure(err)
+		}
+		return c.JSON(http.StatusOK, value)
+	})
+
+	/*
+	 * set a variable of an instance, inferring its type when none is given
+	 */
+	e.PUT("/:id/variables/:name", func(c echo.Context) error {
+		id, scope, err := variableScope(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		value := &TypedValue{}
+		if err := c.Bind(value); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		if err := SetVariable(id, scope, c.Param("name"), value); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * apply a JSON merge patch to a json variable of an instance
+	 */
+	e.PATCH("/:id/variables/:name", func(c echo.Context) error {
+		id, scope, err := variableScope(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+		var patch interface{}
+		if err := c.Bind(&patch); err != nil {
+			return resource.BadRequest(err)
+		}
+
+		if err := PatchVariable(id, scope, c.Param("name"), patch); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	/*
+	 * delete a variable of an instance
+	 */
+	e.DELETE("/:id/variables/:name", func(c echo.Context) error {
+		id, scope, err := variableScope(c)
+		if err != nil {
+			return resource.BadRequest(err)
+		}
+
+		if err := DeleteVariable(id, scope, c.Param("name")); err != nil {
+			return failure(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// variableScope reads the instance id and the optional scope of a variable request
+func variableScope(c echo.Context) (uint, uint, error) {
+	var id, scope int
+
+	if err := resource.Param("id").InPath().Int(c, &id); err != nil {
+		return 0, 0, err
+	}
+	if err := resource.Param("scope").Optional("0").Int(c, &scope); err != nil {
+		return 0, 0, err
+	}
+	return uint(id), uint(scope), nil
+}
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/sterrasi/stepwise/util"
+)
+
+func TestUpdateVariables(t *testing.T) {
+	deployProcess(t, `
+<process id="updateVariables" isExecutable="true">
+  <startEvent id="start"/>
+  <sequenceFlow id="f1" sourceRef="start" targetRef="review"/>
+  <userTask id="review"/>
+</process>`)
+	instance := startProcess(t, "updateVariables", map[string]interface{}{"amount": 10})
+
+	err := UpdateVariables(instance.ID, 0, &VariablesUpdate{
+		Modifications: map[string]*TypedValue{"amount": {Type: LongType, Value: 20}},
+		Deletions:     []string{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount := instanceVariable(t, instance.ID, "amount"); amount != int64(20) {
+		t.Errorf("amount %v", amount)
+	}
+
+	// values that are not valid are rejected as they are given
+	for value, expected := range map[*TypedValue]string{
+		{Type: LongType, Value: "50%d"}:   "Variable amount: Value 50%d is not a valid long",
+		{Value: struct{ Percent int }{5}}: "Variable amount: Unsupported variable value of type struct { Percent int }",
+	} {
+		err := UpdateVariables(instance.ID, 0, &VariablesUpdate{
+			Modifications: map[string]*TypedValue{"amount": value},
+		})
+		if !util.IsValidationError(err) || err.Error() != expected {
+			t.Errorf("updating to %v failed with %v", value.Value, err)
+		}
+	}
+	if amount := instanceVariable(t, instance.ID, "amount"); amount != int64(20) {
+		t.Errorf("amount %v", amount)
+	}
+
+	// so are names
+	err = SetVariable(instance.ID, 0, "", &TypedValue{Value: "x"})
+	if !util.IsValidationError(err) {
+		t.Errorf("setting a variable without a name failed with %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// normalize converts values into the types understood by the evaluator:
+// nil, bool, float64, string, time.Time, []interface{} and map[string]interface{}
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		if n, err := v.Float64(); err == nil {
+			return n
+		}
+		return v.String()
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return *v
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for key, s := range v {
+			m[key] = s
+		}
+		return m
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	}
+	return value
+}
+
+// describe a value for use in error messages
+func describe(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprintf("boolean %t", v)
+	case float64:
+		return fmt.Sprintf("number %s", format(v))
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case time.Time:
+		return fmt.Sprintf("date %s", v.Format(time.RFC3339))
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// format a value for string concatenation
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+func (n *literalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *variableNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return normalize(vars[n.name]), nil
+}
+
+func (n *memberNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case nil:
+		if n.nullSafe {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cannot read field %s of null, use ?. to navigate null values", n.name)
+	case map[string]interface{}:
+		return normalize(t[n.name]), nil
+	}
+	return nil, fmt.Errorf("Cannot read field %s of %s", n.name, describe(target))
+}
+
+func (n *indexNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		i, isNumber := index.(float64)
+		if !isNumber || i != math.Trunc(i) {
+			return nil, fmt.Errorf("List index must be a whole number but was %s", describe(index))
+		}
+		if i < 0 || int(i) >= len(t) {
+			return nil, nil
+		}
+		return normalize(t[int(i)]), nil
+	case map[string]interface{}:
+		key, isString := index.(string)
+		if !isString {
+			return nil, fmt.Errorf("Object key must be a string but was %s", describe(index))
+		}
+		return normalize(t[key]), nil
+	}
+	return nil, fmt.Errorf("Cannot index %s", describe(target))
+}
+
+func (n *callNode) eval(vars map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	result, err := n.fn.call(args)
+	if _, isRaised := err.(*Raised); isRaised {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.name, err)
+	}
+	return normalize(result), nil
+}
+
+func (n *unaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	operand, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, err := truth(operand)
+		return !b, err
+	}
+	switch v := operand.(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		return -v, nil
+	}
+	return nil, fmt.Errorf("Cannot negate %s", describe(operand))
+}
+
+// truth of a value in a logical operation where null is false
+func truth(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("Expected a boolean but found %s", describe(value))
+}
+
+func (n *binaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// logical operators short circuit
+	if n.op == "&&" || n.op == "||" {
+		l, err := truth(left)
+		if err != nil || l == (n.op == "||") {
+			return l, err
+		}
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		return truth(right)
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return order(n.op, left, right)
+	case "+":
+		if _, isString := left.(string); isString {
+			return left.(string) + format(right), nil
+		}
+		if s, isString := right.(string); isString {
+			return format(left) + s, nil
+		}
+	}
+	return arithmetic(n.op, left, right)
+}
+
+func equal(left, right interface{}) bool {
+	if l, isTime := left.(time.Time); isTime {
+		r, isTime := right.(time.Time)
+		return isTime && l.Equal(r)
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// order compares numbers, strings and dates, comparisons with null are false
+func order(op string, left, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, isNumber := right.(float64)
+		if !isNumber {
+			return nil, fmt.Errorf("Cannot compare %s with %s", describe(left), describe(right))
+		}
+		cmp = compareFloats(l, r)
+	case string:
+		r, isString := right.(string)
+		if !isString {
+			return nil, fmt.Errorf("Cannot compare %s with %s", describe(left), describe(right))
+		}
+		cmp = strings.Compare(l, r)
+	case time.Time:
+		r, isTime := right.(time.Time)
+		if !isTime {
+			return nil, fmt.Errorf("Cannot compare %s with %s", describe(left), describe(right))
+		}
+		cmp = compareFloats(float64(l.UnixNano()), float64(r.UnixNano()))
+	default:
+		return nil, fmt.Errorf("Cannot compare %s with %s", describe(left), describe(right))
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// arithmetic on numbers, where null in produces null out
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	l, isNumber := left.(float64)
+	r, isOtherNumber := right.(float64)
+	if !isNumber || !isOtherNumber {
+		return nil, fmt.Errorf("Cannot apply %s to %s and %s", op, describe(left), describe(right))
+	}
+
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	}
+	if r == 0 {
+		return nil, fmt.Errorf("Division by zero")
+	}
+	if op == "/" {
+		return l / r, nil
+	}
+	return math.Mod(l, r), nil
+}
+
+func (n *conditionalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	condition, err := n.condition.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	c, err := truth(condition)
+	if err != nil {
+		return nil, err
+	}
+	if c {
+		return n.then.eval(vars)
+	}
+	return n.otherwise.eval(vars)
+}
@@ -0,0 +1,134 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxLength is the longest expression that will be compiled
+const MaxLength = 4096
+
+// Error lists the issues found with an expression
+type Error struct {
+	Issues []string
+}
+
+func (e *Error) Error() string {
+	return strings.Join(e.Issues, "; ")
+}
+
+// Raised is returned by an evaluation that called throwError to raise a BPMN
+// error with a code that the process can catch
+type Raised struct {
+	Code    string
+	Message string
+}
+
+func (e *Raised) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("BPMN error %s", e.Code)
+	}
+	return fmt.Sprintf("BPMN error %s: %s", e.Code, e.Message)
+}
+
+// Expression a compiled expression. Expressions only read the variables they
+// are evaluated with and can only call the built in functions.
+type Expression struct {
+	source string
+	root   node
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Compile parses an expression, which may be wrapped in ${...}
+func Compile(source string) (*Expression, error) {
+	body := Unwrap(source)
+	if body == "" {
+		return nil, &Error{[]string{"Expression is empty"}}
+	}
+	if len(body) > MaxLength {
+		return nil, &Error{[]string{fmt.Sprintf("Expression is longer than %d characters", MaxLength)}}
+	}
+
+	tokens, err := lex(body)
+	if err != nil {
+		return nil, &Error{[]string{err.Error()}}
+	}
+	p := &parser{tokens: tokens, issues: make([]string, 0)}
+	root, err := p.parseExpression()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("Unexpected %s", p.peek())
+	}
+	if err != nil {
+		p.issues = append(p.issues, err.Error())
+	}
+	if len(p.issues) > 0 {
+		return nil, &Error{p.issues}
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// Validate returns the issues with an expression, which is empty when the
+// expression is valid
+func Validate(source string) []string {
+	if _, err := Compile(source); err != nil {
+		return err.(*Error).Issues
+	}
+	return make([]string, 0)
+}
+
+// Unwrap removes a ${...} or #{...} wrapper from an expression
+func Unwrap(source string) string {
+	source = strings.TrimSpace(source)
+	if (strings.HasPrefix(source, "${") || strings.HasPrefix(source, "#{")) && strings.HasSuffix(source, "}") {
+		return strings.TrimSpace(source[2 : len(source)-1])
+	}
+	return source
+}
+
+// Evaluate the expression against the given variables
+func (e *Expression) Evaluate(vars map[string]interface{}) (interface{}, error) {
+	if vars == nil {
+		vars = make(map[string]interface{})
+	}
+	return e.root.eval(vars)
+}
+
+// EvaluateBool evaluates an expression that must produce a boolean
+func (e *Expression) EvaluateBool(vars map[string]interface{}) (bool, error) {
+	value, err := e.Evaluate(vars)
+	if err != nil {
+		return false, err
+	}
+	b, isBool := value.(bool)
+	if !isBool {
+		return false, fmt.Errorf("Expression %s evaluated to %s rather than a boolean", e.source, describe(value))
+	}
+	return b, nil
+}
+
+// Evaluate compiles and evaluates an expression
+func Evaluate(source string, vars map[string]interface{}) (interface{}, error) {
+	e, err := Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	return e.Evaluate(vars)
+}
+
+// EvaluateBool compiles and evaluates an expression that must produce a boolean
+func EvaluateBool(source string, vars map[string]interface{}) (bool, error) {
+	e, err := Compile(source)
+	if err != nil {
+		return false, err
+	}
+	return e.EvaluateBool(vars)
+}
+
+// Equal tells whether two values are equal the way the == operator compares them
+func Equal(left, right interface{}) bool {
+	return equal(normalize(left), normalize(right))
+}
@@ -0,0 +1,219 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func variables() map[string]interface{} {
+	return map[string]interface{}{
+		"amount": 1500,
+		"region": "EU",
+		"flag":   true,
+		"due":    time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC),
+		"customer": map[string]interface{}{
+			"name":    "bob",
+			"address": nil,
+			"tags":    []interface{}{"a", "b"},
+		},
+	}
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		{`amount > 1000 && region == "EU"`, true},
+		{`${amount > 1000 and region = 'US'}`, false},
+		{`#{amount >= 1500}`, true},
+		{`not (amount >= 1500)`, false},
+		{`!flag || amount < 0`, false},
+		{`flag or missing`, true},
+		{`amount != 1500`, false},
+		{`amount * 2 + 1`, float64(3001)},
+		{`-amount % 7`, float64(-2)},
+		{`10 / 4`, 2.5},
+		{`customer.name + "!"`, "bob!"},
+		{`customer.tags[1]`, "b"},
+		{`customer["name"]`, "bob"},
+		{`amount > 10 ? "big" : "small"`, "big"},
+		{`missing == null`, true},
+		{`due < date("2024-02-01")`, true},
+		{`"a" < "b"`, true},
+	}
+	for _, test := range tests {
+		got, err := Evaluate(test.source, variables())
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestNullSafeNavigation(t *testing.T) {
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		{`customer?.address?.city`, nil},
+		{`customer?.address?.city == "Berlin"`, false},
+		{`nothing?.deep.deeper == null`, true},
+		{`customer?.name`, "bob"},
+	}
+	for _, test := range tests {
+		got, err := Evaluate(test.source, variables())
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %v, want %v", test.source, got, test.want)
+		}
+	}
+
+	if _, err := Evaluate(`customer.address.city`, variables()); err == nil {
+		t.Error("customer.address.city: expected an error navigating null without ?.")
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		// strings
+		{`upper(customer.name)`, "BOB"},
+		{`lower("ABC")`, "abc"},
+		{`trim("  x ")`, "x"},
+		{`startsWith(region, "E")`, true},
+		{`endsWith(region, "E")`, false},
+		{`contains("hello", "ell")`, true},
+		{`contains(customer.tags, "a")`, true},
+		{`length("héllo")`, float64(5)},
+		{`length(customer.tags)`, float64(2)},
+		{`substring("hello", 1, 3)`, "ell"},
+		{`substring("hello", 2)`, "llo"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`string(42)`, "42"},
+		{`urlEncode("a b&c")`, "a+b%26c"},
+		{`upper(nothing)`, nil},
+
+		// numbers
+		{`number("42") + 1`, float64(43)},
+		{`abs(-2)`, float64(2)},
+		{`floor(2.7)`, float64(2)},
+		{`ceil(2.1)`, float64(3)},
+		{`round(10 / 3, 2)`, 3.33},
+		{`round(2.5)`, float64(3)},
+		{`max(1, 5, 3)`, float64(5)},
+		{`min(customer.tags)`, "a"},
+
+		// dates
+		{`year(addDays(due, 30))`, float64(2024)},
+		{`month(addDays(due, 30))`, float64(2)},
+		{`day(due)`, float64(10)},
+		{`daysBetween(date("2024-01-01"), due)`, float64(9)},
+		{`date("2024-01-10T00:00:00Z") == due`, true},
+
+		// nulls
+		{`coalesce(nothing, customer.address, "x")`, "x"},
+	}
+	for _, test := range tests {
+		got, err := Evaluate(test.source, variables())
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %v (%T), want %v (%T)", test.source, got, got, test.want, test.want)
+		}
+	}
+}
+
+func TestEvaluationErrors(t *testing.T) {
+	for _, source := range []string{
+		`amount + true`,
+		`1 / 0`,
+		`customer.name > 3`,
+		`substring("abc", 2, 5)`,
+		`number("abc")`,
+		`date("yesterday")`,
+		`replace("abc", "", "x")`,
+		`amount ? 1 : 2`,
+	} {
+		if _, err := Evaluate(source, variables()); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestThrowError(t *testing.T) {
+	_, err := Evaluate(`amount > 1000 ? throwError("TOO_MUCH", "over the limit") : amount`, variables())
+	raised, isRaised := err.(*Raised)
+	if !isRaised {
+		t.Fatalf("expected a raised BPMN error but got %v", err)
+	}
+	if raised.Code != "TOO_MUCH" || raised.Message != "over the limit" {
+		t.Errorf("raised %+v", raised)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		source string
+		issues []string
+	}{
+		{`amount > 1`, []string{}},
+		{``, []string{"Expression is empty"}},
+		{`"abc`, []string{"Unterminated string starting at position 1"}},
+		{`a # b`, []string{"Unexpected character '#' at position 3"}},
+		{`foo(1) && bar()`, []string{"Unknown function foo at position 1", "Unknown function bar at position 11"}},
+		{`upper()`, []string{"Function upper called with 0 arguments at position 1"}},
+	}
+	for _, test := range tests {
+		issues := Validate(test.source)
+		if !reflect.DeepEqual(issues, test.issues) {
+			t.Errorf("Validate(%q) = %q, want %q", test.source, issues, test.issues)
+		}
+	}
+
+	for _, source := range []string{`a >`, `(a`, `a b`, `customer.`} {
+		if len(Validate(source)) == 0 {
+			t.Errorf("Validate(%q): expected issues", source)
+		}
+	}
+
+	_, err := Compile(`foo(1)`)
+	if e, isError := err.(*Error); !isError || len(e.Issues) != 1 {
+		t.Errorf("Compile returned %v rather than an *Error with one issue", err)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	template, err := CompileTemplate(`/customers/${urlEncode(customer.name)}/orders?amount=${amount}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := template.Render(variables())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/customers/bob/orders?amount=1500"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := CompileTemplate(`/customers/${customer.name`); err == nil {
+		t.Error("expected an unclosed placeholder to be rejected")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !Equal(1500, float64(1500)) || Equal("1", 1) {
+		t.Error("Equal should compare numbers of any type and not coerce strings")
+	}
+}
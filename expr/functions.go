@@ -0,0 +1,368 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// function built into the expression language. A maxArgs of -1 allows any
+// number of arguments.
+type function struct {
+	minArgs int
+	maxArgs int
+	call    func(args []interface{}) (interface{}, error)
+}
+
+// date layouts accepted by date()
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+var functions = map[string]*function{
+
+	/* STRINGS */
+
+	"upper":      stringFunction(strings.ToUpper),
+	"lower":      stringFunction(strings.ToLower),
+	"trim":       stringFunction(strings.TrimSpace),
+	"startsWith": stringPredicate(strings.HasPrefix),
+	"endsWith":   stringPredicate(strings.HasSuffix),
+	"urlEncode":  stringFunction(url.QueryEscape),
+
+	"contains": {2, 2, func(args []interface{}) (interface{}, error) {
+		if list, isList := args[0].([]interface{}); isList {
+			for _, item := range list {
+				if equal(normalize(item), args[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return stringPredicate(strings.Contains).call(args)
+	}},
+
+	"length": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("Expected a string, list or object but found %s", describe(args[0]))
+	}},
+
+	// substring(s, start[, length]) with a zero based start
+	"substring": {2, 3, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, err := stringArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		runes := []rune(s)
+		start, err := intArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		end := len(runes)
+		if len(args) == 3 {
+			length, err := intArg(args, 2)
+			if err != nil {
+				return nil, err
+			}
+			end = start + length
+		}
+		if start < 0 || start > len(runes) || end < start || end > len(runes) {
+			return nil, fmt.Errorf("Range out of bounds for a string of length %d", len(runes))
+		}
+		return string(runes[start:end]), nil
+	}},
+
+	"replace": {3, 3, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, err := stringArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		old, err := stringArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		if old == "" {
+			return nil, fmt.Errorf("Argument 2 must not be an empty string")
+		}
+		replacement, err := stringArg(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Replace(s, old, replacement, -1), nil
+	}},
+
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return format(args[0]), nil
+	}},
+
+	/* NUMBERS */
+
+	"number": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case nil, float64:
+			return v, nil
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot convert %q to a number", v)
+			}
+			return n, nil
+		}
+		return nil, fmt.Errorf("Cannot convert %s to a number", describe(args[0]))
+	}},
+
+	"abs":   numberFunction(math.Abs),
+	"floor": numberFunction(math.Floor),
+	"ceil":  numberFunction(math.Ceil),
+
+	// round(n[, scale]) rounds half away from zero
+	"round": {1, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		n, err := numberArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		scale := 0
+		if len(args) == 2 {
+			if scale, err = intArg(args, 1); err != nil {
+				return nil, err
+			}
+		}
+		factor := math.Pow(10, float64(scale))
+		return math.Round(n*factor) / factor, nil
+	}},
+
+	"min": {1, -1, func(args []interface{}) (interface{}, error) {
+		return extreme(args, -1)
+	}},
+
+	"max": {1, -1, func(args []interface{}) (interface{}, error) {
+		return extreme(args, 1)
+	}},
+
+	/* DATES */
+
+	"now": {0, 0, func(args []interface{}) (interface{}, error) {
+		return time.Now(), nil
+	}},
+
+	// date parses RFC 3339 date times and yyyy-mm-dd dates
+	"date": {1, 1, func(args []interface{}) (interface{}, error) {
+		return dateArg(args, 0)
+	}},
+
+	"year": dateFunction(func(t time.Time) interface{} {
+		return float64(t.Year())
+	}),
+
+	"month": dateFunction(func(t time.Time) interface{} {
+		return float64(t.Month())
+	}),
+
+	"day": dateFunction(func(t time.Time) interface{} {
+		return float64(t.Day())
+	}),
+
+	"addDays": {2, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		t, err := dateArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		days, err := intArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return t.(time.Time).AddDate(0, 0, days), nil
+	}},
+
+	// daysBetween(from, to) counts whole days
+	"daysBetween": {2, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+		from, err := dateArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		to, err := dateArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return math.Trunc(to.(time.Time).Sub(from.(time.Time)).Hours() / 24), nil
+	}},
+
+	/* ERRORS */
+
+	// throwError(code[, message]) raises a BPMN error
+	"throwError": {1, 2, func(args []interface{}) (interface{}, error) {
+		code, err := stringArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		raised := &Raised{Code: code}
+		if len(args) == 2 && args[1] != nil {
+			raised.Message = format(args[1])
+		}
+		return nil, raised
+	}},
+
+	/* NULLS */
+
+	// coalesce returns the first argument that is not null
+	"coalesce": {1, -1, func(args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+}
+
+func stringArg(args []interface{}, i int) (string, error) {
+	s, isString := args[i].(string)
+	if !isString {
+		return "", fmt.Errorf("Argument %d must be a string but was %s", i+1, describe(args[i]))
+	}
+	return s, nil
+}
+
+func numberArg(args []interface{}, i int) (float64, error) {
+	n, isNumber := args[i].(float64)
+	if !isNumber {
+		return 0, fmt.Errorf("Argument %d must be a number but was %s", i+1, describe(args[i]))
+	}
+	return n, nil
+}
+
+func intArg(args []interface{}, i int) (int, error) {
+	n, err := numberArg(args, i)
+	if err != nil {
+		return 0, err
+	}
+	if n != math.Trunc(n) {
+		return 0, fmt.Errorf("Argument %d must be a whole number but was %s", i+1, format(n))
+	}
+	return int(n), nil
+}
+
+func dateArg(args []interface{}, i int) (interface{}, error) {
+	switch v := args[i].(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("Cannot convert %q to a date", v)
+	}
+	return nil, fmt.Errorf("Argument %d must be a date but was %s", i+1, describe(args[i]))
+}
+
+func stringFunction(fn func(string) string) *function {
+	return &function{1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, err := stringArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}}
+}
+
+func stringPredicate(fn func(string, string) bool) *function {
+	return &function{2, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil || args[1] == nil {
+			return false, nil
+		}
+		s, err := stringArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		other, err := stringArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s, other), nil
+	}}
+}
+
+func numberFunction(fn func(float64) float64) *function {
+	return &function{1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		n, err := numberArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return fn(n), nil
+	}}
+}
+
+func dateFunction(fn func(time.Time) interface{}) *function {
+	return &function{1, 1, func(args []interface{}) (interface{}, error) {
+		t, err := dateArg(args, 0)
+		if err != nil || t == nil {
+			return nil, err
+		}
+		return fn(t.(time.Time)), nil
+	}}
+}
+
+// extreme returns the smallest (sign -1) or largest (sign 1) of the arguments,
+// which may also be given as a single list
+func extreme(args []interface{}, sign int) (interface{}, error) {
+	if list, isList := args[0].([]interface{}); isList && len(args) == 1 {
+		args = list
+	}
+	var result interface{}
+	for _, arg := range args {
+		arg = normalize(arg)
+		if arg == nil {
+			continue
+		}
+		if result == nil {
+			result = arg
+			continue
+		}
+		greater, err := order(">", arg, result)
+		if err != nil {
+			return nil, err
+		}
+		if greater.(bool) == (sign > 0) && !equal(arg, result) {
+			result = arg
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s' at position %d", t.text, t.pos+1)
+}
+
+// operators ordered so that longer operators are matched first
+var operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=", "?.",
+	"(", ")", "[", "]", ",", ".", "!", "<", ">", "=", "+", "-", "*", "/", "%", "?", ":",
+}
+
+// lex splits the source into tokens
+func lex(source string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			text := string(runes[start:i])
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: text, pos: start})
+
+		case r == '"' || r == '\'':
+			start := i
+			var value strings.Builder
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						value.WriteRune('\n')
+					case 't':
+						value.WriteRune('\t')
+					default:
+						value.WriteRune(runes[i])
+					}
+					continue
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("Unterminated string starting at position %d", start+1)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenString, text: string(runes[start:i]), value: value.String(), pos: start})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			text := string(runes[start:i])
+			tokens = append(tokens, token{kind: tokenIdent, text: text, value: text, pos: start})
+
+		default:
+			matched := ""
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				return nil, fmt.Errorf("Unexpected character '%c' at position %d", r, i+1)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: matched, value: matched, pos: i})
+			i += len([]rune(matched))
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
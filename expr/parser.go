@@ -0,0 +1,277 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// node of the expression syntax tree
+type node interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+type variableNode struct {
+	name string
+}
+
+type memberNode struct {
+	target   node
+	name     string
+	nullSafe bool
+}
+
+type indexNode struct {
+	target node
+	index  node
+}
+
+type callNode struct {
+	name string
+	fn   *function
+	args []node
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+type conditionalNode struct {
+	condition, then, otherwise node
+}
+
+// keyword aliases for operators
+var keywordOperators = map[string]string{
+	"and": "&&",
+	"or":  "||",
+	"not": "!",
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	issues []string
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// match consumes the next token when it is one of the given operators
+func (p *parser) match(ops ...string) (string, bool) {
+	t := p.peek()
+	op := t.value
+	if t.kind == tokenIdent {
+		if alias, isKeyword := keywordOperators[t.value]; isKeyword {
+			op = alias
+		}
+	} else if t.kind != tokenOperator {
+		return "", false
+	}
+	if op == "=" {
+		op = "=="
+	}
+	for _, candidate := range ops {
+		if op == candidate {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, matched := p.match(op); !matched {
+		return fmt.Errorf("Expected '%s' but found %s", op, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) parseExpression() (node, error) {
+	condition, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, matched := p.match("?"); !matched {
+		return condition, nil
+	}
+	then, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &conditionalNode{condition, then, otherwise}, nil
+}
+
+// binary operators by increasing precedence
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, matched := p.match(precedence[level]...)
+		if !matched {
+			return left, nil
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if op, matched := p.match("!", "-"); matched {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op, operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	target, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	// once ?. is used the rest of the chain is null safe as well
+	nullSafe := false
+	for {
+		op, matched := p.match(".", "?.", "[")
+		if !matched {
+			return target, nil
+		}
+		if op == "[" {
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			target = &indexNode{target, index}
+			continue
+		}
+		name := p.next()
+		if name.kind != tokenIdent {
+			return nil, fmt.Errorf("Expected a field name but found %s", name)
+		}
+		nullSafe = nullSafe || op == "?."
+		target = &memberNode{target, name.value, nullSafe}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed number %s", t)
+		}
+		return &literalNode{n}, nil
+
+	case tokenString:
+		return &literalNode{t.value}, nil
+
+	case tokenIdent:
+		switch t.value {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null", "nil":
+			return &literalNode{nil}, nil
+		}
+		if _, matched := p.match("("); matched {
+			return p.parseCall(t)
+		}
+		return &variableNode{t.value}, nil
+
+	case tokenOperator:
+		if t.value == "(" {
+			inner, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("Unexpected %s", t)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	call := &callNode{name: name.value, args: make([]node, 0)}
+	if _, matched := p.match(")"); !matched {
+		for {
+			arg, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, matched := p.match(","); matched {
+				continue
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	// unknown functions and wrong argument counts are reported without
+	// stopping the parse so that every such issue is found
+	fn, exists := functions[call.name]
+	switch {
+	case !exists:
+		p.issues = append(p.issues, fmt.Sprintf("Unknown function %s at position %d", call.name, name.pos+1))
+	case len(call.args) < fn.minArgs || (fn.maxArgs >= 0 && len(call.args) > fn.maxArgs):
+		p.issues = append(p.issues, fmt.Sprintf("Function %s called with %d arguments at position %d",
+			call.name, len(call.args), name.pos+1))
+	}
+	call.fn = fn
+	return call, nil
+}
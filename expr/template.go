@@ -0,0 +1,122 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template text with ${...} placeholders holding expressions, such as
+// "/orders/${orderId}/items"
+type Template struct {
+	source string
+
+	// literal text and the expressions between them, where literals has one
+	// more entry than expressions
+	literals    []string
+	expressions []*Expression
+}
+
+// String returns the source of the template
+func (t *Template) String() string {
+	return t.source
+}
+
+// CompileTemplate parses the placeholders of a template
+func CompileTemplate(source string) (*Template, error) {
+	t := &Template{source: source, literals: make([]string, 0), expressions: make([]*Expression, 0)}
+	issues := make([]string, 0)
+
+	rest := source
+	for {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			t.literals = append(t.literals, rest)
+			break
+		}
+		end := placeholderEnd(rest, start+2)
+		if end < 0 {
+			issues = append(issues, fmt.Sprintf("Placeholder at %q is not closed", rest[start:]))
+			break
+		}
+
+		e, err := Compile(rest[start+2 : end])
+		if err != nil {
+			issues = append(issues, err.(*Error).Issues...)
+		}
+		t.literals = append(t.literals, rest[:start])
+		t.expressions = append(t.expressions, e)
+		rest = rest[end+1:]
+	}
+
+	if len(issues) > 0 {
+		return nil, &Error{issues}
+	}
+	return t, nil
+}
+
+// placeholderEnd returns the index of the brace closing a placeholder, which
+// is the first one outside of a string literal, or -1 when there is none
+func placeholderEnd(s string, from int) int {
+	var quote rune
+	escaped := false
+	for i, r := range s[from:] {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '}':
+			return from + i
+		}
+	}
+	return -1
+}
+
+// ValidateTemplate returns the issues with a template, which is empty when
+// the template is valid
+func ValidateTemplate(source string) []string {
+	if _, err := CompileTemplate(source); err != nil {
+		return err.(*Error).Issues
+	}
+	return make([]string, 0)
+}
+
+// Render replaces the placeholders of the template with the values of their
+// expressions
+func (t *Template) Render(vars map[string]interface{}) (string, error) {
+	var b strings.Builder
+	for i, e := range t.expressions {
+		b.WriteString(t.literals[i])
+		value, err := e.Evaluate(vars)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(format(value))
+	}
+	b.WriteString(t.literals[len(t.literals)-1])
+	return b.String(), nil
+}
+
+// Evaluate returns the value of the expression of a template consisting of a
+// single placeholder as is, and otherwise renders the template
+func (t *Template) Evaluate(vars map[string]interface{}) (interface{}, error) {
+	if len(t.expressions) == 1 && t.literals[0] == "" && t.literals[1] == "" {
+		return t.expressions[0].Evaluate(vars)
+	}
+	return t.Render(vars)
+}
+
+// RenderTemplate compiles and renders a template
+func RenderTemplate(source string, vars map[string]interface{}) (string, error) {
+	t, err := CompileTemplate(source)
+	if err != nil {
+		return "", err
+	}
+	return t.Render(vars)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo"
 )
@@ -92,6 +93,28 @@ func (p *HTTPParam) String(c echo.Context, value *string) error {
 	return nil
 }
 
+// Time sets the param's type to an RFC 3339 time, which is left nil when the
+// param is empty
+func (p *HTTPParam) Time(c echo.Context, value **time.Time) error {
+	stringValue, err := p.getValue(c)
+	if err != nil {
+		return err
+	}
+	if stringValue == "" {
+		*value = nil
+		return nil
+	}
+
+	timeValue, err := time.Parse(time.RFC3339, stringValue)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Cannot convert %s parameter value (%s) to an RFC 3339 time",
+				p.name, stringValue))
+	}
+	*value = &timeValue
+	return nil
+}
+
 // InPath identifies the parameter in the request path
 func (p *HTTPParam) InPath() *HTTPParam {
 	p.location = Path
@@ -90,7 +90,12 @@ func GetMethod(e *echo.Group, fn getByIDFn) {
 
 		resource, err := fn(id)
 		if err != nil {
-			return InternalServerError(err)
+			switch err {
+			case util.ErrNotFound:
+				return NotFound(err)
+			default:
+				return InternalServerError(err)
+			}
 		}
 
 		return c.JSON(http.StatusOK, resource)
@@ -17,6 +17,11 @@ func NotFound(payload interface{}) error {
 	return echo.NewHTTPError(http.StatusNotFound, processPayload(payload))
 }
 
+// Conflict http 409 error
+func Conflict(payload interface{}) error {
+	return echo.NewHTTPError(http.StatusConflict, processPayload(payload))
+}
+
 // InternalServerError http 500 error
 func InternalServerError(payload interface{}) error {
 	return echo.NewHTTPError(http.StatusInternalServerError, processPayload(payload))
@@ -36,7 +41,7 @@ func Created(c echo.Context, id uint) error {
 
 func processPayload(payload interface{}) interface{} {
 	if err, isError := payload.(error); isError {
-		return err.Error
+		return err.Error()
 	}
 	return payload
 }
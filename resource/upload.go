@@ -0,0 +1,44 @@
+package resource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// ReadUpload reads an uploaded XML document and its resource name from the
+// request, either as the "file" part of a multipart form or as the raw XML
+// request body named by the name query parameter
+func ReadUpload(c echo.Context, defaultName string) (string, []byte, error) {
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+
+	if strings.HasPrefix(contentType, echo.MIMEMultipartForm) {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return "", nil, fmt.Errorf("Multipart upload requires a file part: %s", err)
+		}
+		file, err := header.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		return header.Filename, data, err
+	}
+
+	if !strings.HasPrefix(contentType, echo.MIMEApplicationXML) &&
+		!strings.HasPrefix(contentType, echo.MIMETextXML) {
+		return "", nil, fmt.Errorf("Unsupported content type %s, expected %s or %s",
+			contentType, echo.MIMEApplicationXML, echo.MIMEMultipartForm)
+	}
+
+	var name string
+	if err := Param("name").Optional(defaultName).String(c, &name); err != nil {
+		return "", nil, err
+	}
+	data, err := ioutil.ReadAll(c.Request().Body)
+	return name, data, err
+}
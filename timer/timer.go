@@ -0,0 +1,259 @@
+package timer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Kind of a timer definition, named after the BPMN timer event elements
+type Kind string
+
+const (
+
+	// Date fires once at a point in time, e.g. 2019-10-01T12:00:00Z
+	Date Kind = "timeDate"
+
+	// Duration fires once after a period, e.g. P1DT12H
+	Duration Kind = "timeDuration"
+
+	// Cycle fires repeatedly, e.g. R3/PT10M or R/2019-10-01T12:00:00Z/P1D
+	Cycle Kind = "timeCycle"
+)
+
+// Unbounded number of repetitions of a cycle
+const Unbounded = -1
+
+// date layouts accepted for points in time, those without a zone are UTC
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// Period is an ISO-8601 duration. Years, months and days follow the calendar
+// while the time components are exact.
+type Period struct {
+	Years, Months, Days int
+	Time                time.Duration
+}
+
+// AddTo returns the point in time the period after t
+func (p Period) AddTo(t time.Time) time.Time {
+	return t.AddDate(p.Years, p.Months, p.Days).Add(p.Time)
+}
+
+// IsZero tells whether the period is empty
+func (p Period) IsZero() bool {
+	return p.Years == 0 && p.Months == 0 && p.Days == 0 && p.Time == 0
+}
+
+// String formats the period in ISO-8601
+func (p Period) String() string {
+	var b strings.Builder
+	b.WriteString("P")
+	for _, part := range []struct {
+		value int
+		unit  string
+	}{{p.Years, "Y"}, {p.Months, "M"}, {p.Days, "D"}} {
+		if part.value != 0 {
+			b.WriteString(strconv.Itoa(part.value) + part.unit)
+		}
+	}
+	if p.Time != 0 || b.Len() == 1 {
+		b.WriteString("T" + strconv.FormatFloat(p.Time.Seconds(), 'f', -1, 64) + "S")
+	}
+	return b.String()
+}
+
+// Timer is a parsed timer definition
+type Timer struct {
+	Kind Kind
+
+	// point in time of a date timer and optional start of a cycle
+	At *time.Time
+
+	// period of a duration timer and interval of a cycle
+	Period Period
+
+	// number of times a cycle fires or Unbounded
+	Repetitions int
+}
+
+// Parse reads a timer definition of the given kind
+func Parse(kind Kind, value string) (*Timer, error) {
+	value = strings.TrimSpace(value)
+	t := &Timer{Kind: kind, Repetitions: 1}
+
+	switch kind {
+	case Date:
+		at, err := ParseDate(value)
+		if err != nil {
+			return nil, err
+		}
+		t.At = &at
+
+	case Duration:
+		period, err := ParsePeriod(value)
+		if err != nil {
+			return nil, err
+		}
+		t.Period = period
+
+	case Cycle:
+		parts := strings.Split(value, "/")
+		if len(parts) < 2 || len(parts) > 3 || !strings.HasPrefix(parts[0], "R") {
+			return nil, fmt.Errorf("Malformed cycle %q, expected R[n]/[start/]duration", value)
+		}
+		t.Repetitions = Unbounded
+		if count := parts[0][1:]; count != "" {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Malformed repetition count in cycle %q", value)
+			}
+			t.Repetitions = n
+		}
+		if len(parts) == 3 {
+			at, err := ParseDate(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			t.At = &at
+		}
+		period, err := ParsePeriod(parts[len(parts)-1])
+		if err != nil {
+			return nil, err
+		}
+		t.Period = period
+
+	default:
+		return nil, fmt.Errorf("Unknown timer kind %s", kind)
+	}
+
+	if kind != Date && t.Period.IsZero() {
+		return nil, fmt.Errorf("Timer %q has an empty duration", value)
+	}
+	return t, nil
+}
+
+// First returns when the timer first fires given that it starts at now
+func (t *Timer) First(now time.Time) time.Time {
+	switch {
+	case t.Kind == Date:
+		return *t.At
+	case t.At != nil:
+		return *t.At
+	}
+	return t.Period.AddTo(now)
+}
+
+// Next returns when a cycle fires after it fired at previous, skipping the
+// occurrences that are already in the past at now
+func (t *Timer) Next(previous time.Time, now time.Time) time.Time {
+	next := t.Period.AddTo(previous)
+	for !next.After(now) {
+		next = t.Period.AddTo(next)
+	}
+	return next
+}
+
+// String formats the timer definition
+func (t *Timer) String() string {
+	switch t.Kind {
+	case Date:
+		return t.At.Format(time.RFC3339)
+	case Duration:
+		return t.Period.String()
+	}
+	cycle := "R"
+	if t.Repetitions != Unbounded {
+		cycle += strconv.Itoa(t.Repetitions)
+	}
+	if t.At != nil {
+		cycle += "/" + t.At.Format(time.RFC3339)
+	}
+	return cycle + "/" + t.Period.String()
+}
+
+// ParseDate reads an ISO-8601 date or date time
+func ParseDate(value string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Malformed date %q", value)
+}
+
+// ParsePeriod reads an ISO-8601 duration such as P1Y2M3DT4H5M6.5S or P2W,
+// whose units must be given at most once and from the largest to the smallest
+func ParsePeriod(value string) (Period, error) {
+	p := Period{}
+	malformed := fmt.Errorf("Malformed duration %q", value)
+	if !strings.HasPrefix(value, "P") || len(value) < 3 {
+		return p, malformed
+	}
+
+	inTime := false
+	number := ""
+	last := -1
+	for _, r := range value[1:] {
+		switch {
+		case r == 'T':
+			if inTime || number != "" {
+				return p, malformed
+			}
+			inTime = true
+			continue
+		case (r >= '0' && r <= '9') || r == '.' || r == ',':
+			if r == ',' {
+				r = '.'
+			}
+			number += string(r)
+			continue
+		}
+
+		// the units in the order they must appear, those of the date part
+		// followed by those of the time part, which are kept in lower case
+		unit, rank := r, strings.IndexRune("YMWD", r)
+		if inTime {
+			unit = unicode.ToLower(r)
+			if rank = strings.IndexRune("hms", unit); rank >= 0 {
+				rank += 4
+			}
+		}
+		if rank < 0 || rank <= last {
+			return p, malformed
+		}
+		last = rank
+
+		n, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return p, malformed
+		}
+		number = ""
+		whole := int(n)
+		if !inTime && float64(whole) != n {
+			return p, fmt.Errorf("Fractional %c is not supported in duration %q", r, value)
+		}
+
+		switch unit {
+		case 'Y':
+			p.Years += whole
+		case 'M':
+			p.Months += whole
+		case 'W':
+			p.Days += whole * 7
+		case 'D':
+			p.Days += whole
+		case 'h':
+			p.Time += time.Duration(n * float64(time.Hour))
+		case 'm':
+			p.Time += time.Duration(n * float64(time.Minute))
+		case 's':
+			p.Time += time.Duration(n * float64(time.Second))
+		}
+	}
+	if number != "" || strings.HasSuffix(value, "T") {
+		return p, malformed
+	}
+	return p, nil
+}
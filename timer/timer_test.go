@@ -0,0 +1,209 @@
+package timer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Period
+	}{
+		{"P1Y2M3DT4H5M6.5S", Period{1, 2, 3, 4*time.Hour + 5*time.Minute + 6500*time.Millisecond}},
+		{"P1Y", Period{Years: 1}},
+		{"P18M", Period{Months: 18}},
+		{"P2W", Period{Days: 14}},
+		{"P1W2D", Period{Days: 9}},
+		{"PT36H", Period{Time: 36 * time.Hour}},
+		{"PT1H30M", Period{Time: 90 * time.Minute}},
+		{"PT0,5S", Period{Time: 500 * time.Millisecond}},
+		{"PT1.5M", Period{Time: 90 * time.Second}},
+		{"P1DT12H", Period{Days: 1, Time: 12 * time.Hour}},
+	}
+	for _, test := range tests {
+		got, err := ParsePeriod(test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s = %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParsePeriodMalformed(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"P",
+		"PT",
+		"1D",
+		"P1",
+		"P1H",
+		"P5m",
+		"P1h",
+		"P2s",
+		"P1Y2m",
+		"PT1D",
+		"P1DT",
+		"P1.5D",
+		"PT1M1H",
+		"PT1S1M",
+		"P1D1Y",
+		"P1D1M",
+		"P1D1D",
+		"PT1H1H",
+		"PT1HT1M",
+		"P1X",
+		"PD",
+	} {
+		if p, err := ParsePeriod(value); err == nil {
+			t.Errorf("%q parsed to %+v", value, p)
+		}
+	}
+}
+
+func TestPeriodString(t *testing.T) {
+	tests := []struct {
+		period Period
+		want   string
+	}{
+		{Period{1, 2, 3, 0}, "P1Y2M3D"},
+		{Period{Time: 90 * time.Minute}, "PT5400S"},
+		{Period{Days: 1, Time: 500 * time.Millisecond}, "P1DT0.5S"},
+		{Period{}, "PT0S"},
+	}
+	for _, test := range tests {
+		if got := test.period.String(); got != test.want {
+			t.Errorf("%+v = %s, want %s", test.period, got, test.want)
+		}
+		if !test.period.IsZero() {
+			if parsed, err := ParsePeriod(test.want); err != nil || parsed.AddTo(time.Time{}) != test.period.AddTo(time.Time{}) {
+				t.Errorf("%s does not parse back to %+v: %v", test.want, test.period, err)
+			}
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2019-10-01T12:00:00Z", time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2019-10-01T12:00:00+02:00", time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC)},
+		{"2019-10-01T12:00:00.250Z", time.Date(2019, 10, 1, 12, 0, 0, 250000000, time.UTC)},
+		{"2019-10-01T12:00:00", time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2019-10-01T12:00", time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2019-10-01", time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		timer, err := Parse(Date, test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if !timer.At.Equal(test.want) {
+			t.Errorf("%s = %s, want %s", test.value, timer.At, test.want)
+		}
+		if first := timer.First(time.Now()); !first.Equal(test.want) {
+			t.Errorf("%s first fires at %s", test.value, first)
+		}
+	}
+
+	for _, value := range []string{"", "yesterday", "2019-13-01", "01/10/2019", "2019-10-01 12:00"} {
+		if _, err := Parse(Date, value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	now := time.Date(2020, 1, 31, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		first time.Time
+	}{
+		{"PT10M", time.Date(2020, 1, 31, 8, 10, 0, 0, time.UTC)},
+		{" P1DT12H ", time.Date(2020, 2, 1, 20, 0, 0, 0, time.UTC)},
+		{"P1M", time.Date(2020, 3, 2, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		timer, err := Parse(Duration, test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if first := timer.First(now); !first.Equal(test.first) {
+			t.Errorf("%s first fires at %s, want %s", test.value, first, test.first)
+		}
+	}
+
+	for _, value := range []string{"PT0S", "P0D", "PT1M1H", "10 minutes"} {
+		if _, err := Parse(Duration, value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestParseCycle(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value       string
+		repetitions int
+		at          *time.Time
+		period      Period
+		formatted   string
+	}{
+		{"R3/PT10M", 3, nil, Period{Time: 10 * time.Minute}, "R3/PT600S"},
+		{"R/P1D", Unbounded, nil, Period{Days: 1}, "R/P1D"},
+		{"R3/2020-01-01T00:00:00Z/PT1H", 3, &start, Period{Time: time.Hour}, "R3/2020-01-01T00:00:00Z/PT3600S"},
+		{"R/2020-01-01/P1W", Unbounded, &start, Period{Days: 7}, "R/2020-01-01T00:00:00Z/P7D"},
+	}
+	for _, test := range tests {
+		timer, err := Parse(Cycle, test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if timer.Repetitions != test.repetitions || timer.Period != test.period ||
+			(timer.At == nil) != (test.at == nil) || (timer.At != nil && !timer.At.Equal(*test.at)) {
+			t.Errorf("%s = %+v", test.value, timer)
+		}
+		if got := timer.String(); got != test.formatted {
+			t.Errorf("%s formatted as %s, want %s", test.value, got, test.formatted)
+		}
+	}
+
+	for _, value := range []string{"PT1H", "R0/PT1H", "R-1/PT1H", "Rx/PT1H", "R3", "R3/PT0S", "R3/a/b/PT1H",
+		"R3/yesterday/PT1H", "R3/PT1M1H"} {
+		if _, err := Parse(Cycle, value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestCycleNext(t *testing.T) {
+	timer, err := Parse(Cycle, "R/2020-01-01T00:00:00Z/PT1H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 5, 30, 0, 0, time.UTC)
+	if first := timer.First(now); !first.Equal(*timer.At) {
+		t.Errorf("first fires at %s", first)
+	}
+
+	// occurrences already in the past are skipped
+	if next := timer.Next(*timer.At, now); !next.Equal(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("next fires at %s", next)
+	}
+
+	daily, err := Parse(Cycle, "R/P1D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := daily.First(now); !first.Equal(now.AddDate(0, 0, 1)) {
+		t.Errorf("first fires at %s", first)
+	}
+}
@@ -1,6 +1,9 @@
 package util
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrNotFound to indicate that a required subject was not found
@@ -16,6 +19,37 @@ func (e *baseError) Error() string {
 	return e.s
 }
 
+// validationError indicates that the request holds values that are not valid
 type validationError struct {
 	baseError
 }
+
+// conflictError indicates that the subject is not in a state that permits the operation
+type conflictError struct {
+	baseError
+}
+
+// NewConflictError creates an error for an operation that conflicts with the
+// current state of its subject
+func NewConflictError(format string, a ...interface{}) error {
+	return &conflictError{baseError{fmt.Sprintf(format, a...)}}
+}
+
+// IsConflictError returns true when the error was created with NewConflictError
+func IsConflictError(err error) bool {
+	_, isConflict := err.(*conflictError)
+	return isConflict
+}
+
+// NewValidationError creates an error for a value given to an operation that
+// is not valid
+func NewValidationError(format string, a ...interface{}) error {
+	return &validationError{baseError{fmt.Sprintf(format, a...)}}
+}
+
+// IsValidationError returns true when the error was created with
+// NewValidationError
+func IsValidationError(err error) bool {
+	_, isInvalid := err.(*validationError)
+	return isInvalid
+}
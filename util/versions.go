@@ -0,0 +1,43 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Versioned a definition deployed in versions numbered per key, each of which
+// keeps the hash of the content it was deployed from
+type Versioned interface {
+
+	// VersionOf returns the version, the content hash and whether the
+	// definition is deleted
+	VersionOf() (version int, hash string, deleted bool)
+}
+
+// ContentHash returns the hex encoded SHA-256 of the content
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// NextVersion loads the latest version of the definition with the key into
+// latest and returns the version a new one is deployed as. Versions keep
+// increasing across deleted definitions. Zero is returned when the latest
+// version is not deleted and was deployed from content with the hash, so that
+// deploying the same content again leaves it as is.
+func NextVersion(tx *gorm.DB, latest Versioned, key string, hash string) (int, error) {
+	err := tx.Unscoped().Where("key = ?", key).Order("version desc").First(latest).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, latestHash, deleted := latest.VersionOf()
+	if !deleted && latestHash == hash {
+		return 0, nil
+	}
+	return version + 1, nil
+}
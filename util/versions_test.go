@@ -0,0 +1,76 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+type definition struct {
+	EntityImpl
+	Key     string
+	Version int
+	Hash    string
+}
+
+func (def *definition) VersionOf() (int, string, bool) {
+	return def.Version, def.Hash, def.DeletedAt != nil
+}
+
+func TestNextVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stepwise-util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "util.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.AutoMigrate(&definition{})
+
+	deploy := func(key string, content string) (int, *definition) {
+		t.Helper()
+		latest := &definition{}
+		hash := ContentHash([]byte(content))
+		version, err := NextVersion(db, latest, key, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version == 0 {
+			return 0, latest
+		}
+		def := &definition{Key: key, Version: version, Hash: hash}
+		if err := db.Create(def).Error; err != nil {
+			t.Fatal(err)
+		}
+		return version, def
+	}
+
+	if version, _ := deploy("a", "one"); version != 1 {
+		t.Errorf("first version %d", version)
+	}
+	if version, latest := deploy("a", "one"); version != 0 || latest.Version != 1 {
+		t.Errorf("unchanged content deployed as %d over %d", version, latest.Version)
+	}
+	_, second := deploy("a", "two")
+	if second.Version != 2 {
+		t.Errorf("changed content deployed as %d", second.Version)
+	}
+	if version, _ := deploy("b", "two"); version != 1 {
+		t.Errorf("other key deployed as %d", version)
+	}
+
+	// versions keep increasing once the latest is deleted, even for the same content
+	if err := db.Delete(second).Error; err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := deploy("a", "two"); version != 3 {
+		t.Errorf("content of a deleted version deployed as %d", version)
+	}
+}